@@ -0,0 +1,179 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// processAffinity returns the CPUs the process may currently run on
+func processAffinity() ([]int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for cpu := 0; len(cpus) < set.Count(); cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// pinProcess restricts every thread of the process to cpus, like running it
+// under taskset. Affinity is per thread on Linux, so each one in
+// /proc/self/task is pinned; threads started later inherit it.
+func pinProcess(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		// Threads can exit between listing and pinning
+		if err := unix.SchedSetaffinity(tid, &set); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("thread %d: %w", tid, err)
+		}
+	}
+	return nil
+}
+
+// cpuTopology returns the package and core of every CPU in cpus, read from
+// sysfs
+func cpuTopology(cpus []int) ([]logicalCPU, error) {
+	topology := make([]logicalCPU, len(cpus))
+	for i, cpu := range cpus {
+		dir := filepath.Join("/sys/devices/system/cpu", fmt.Sprintf("cpu%d", cpu), "topology")
+		topology[i].ID = cpu
+		for name, value := range map[string]*int{"physical_package_id": &topology[i].Package, "core_id": &topology[i].Core} {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			if *value, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+				return nil, fmt.Errorf("cpu%d %s: %w", cpu, name, err)
+			}
+		}
+	}
+	return topology, nil
+}
+
+// numaNodes returns the CPUs of every NUMA node that the process may run
+// on, read from sysfs. Machines without NUMA report a single node.
+func numaNodes() ([][]int, error) {
+	allowed, err := processAffinity()
+	if err != nil {
+		return nil, err
+	}
+	usable := make(map[int]bool, len(allowed))
+	for _, cpu := range allowed {
+		usable[cpu] = true
+	}
+	dirs, err := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		return [][]int{allowed}, nil
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		a, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dirs[i]), "node"))
+		b, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(dirs[j]), "node"))
+		return a < b
+	})
+	var nodes [][]int
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		cpus, err := parseCPUList(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", dir, err)
+		}
+		var node []int
+		for _, cpu := range cpus {
+			if usable[cpu] {
+				node = append(node, cpu)
+			}
+		}
+		// Memory-only nodes and nodes outside the affinity mask get no workers
+		if len(node) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no NUMA node has any of the CPUs %s", formatCPUs(allowed))
+	}
+	return nodes, nil
+}
+
+// parseCPUList parses a kernel CPU list such as "0-3,8-11"
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	if list == "" {
+		return nil, nil
+	}
+	for _, field := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(field, "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU list %q", list)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(last); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// pinThread restricts the calling OS thread to cpus. The goroutine must be
+// locked to its thread with runtime.LockOSThread first.
+func pinThread(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
+
+// mapUntouched returns size bytes of anonymous memory that no thread has
+// written yet, so Linux's first-touch policy places every page on the node
+// of the thread that first writes it. Memory from make may be spans the Go
+// allocator already zeroed on whatever thread allocated them. The memory
+// must be released with unmap.
+func mapUntouched(size int) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+}
+
+// unmap releases memory returned by mapUntouched
+func unmap(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return unix.Munmap(b)
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errPinning = errors.New("CPU pinning is only supported on Linux")
+
+func processAffinity() ([]int, error) {
+	return nil, errPinning
+}
+
+func pinProcess(cpus []int) error {
+	return errPinning
+}
+
+func cpuTopology(cpus []int) ([]logicalCPU, error) {
+	return nil, errPinning
+}
+
+func numaNodes() ([][]int, error) {
+	return nil, errPinning
+}
+
+func pinThread(cpus []int) error {
+	return errPinning
+}
+
+func mapUntouched(size int) ([]byte, error) {
+	return nil, errPinning
+}
+
+func unmap(b []byte) error {
+	return errPinning
+}
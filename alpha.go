@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// splitAlpha converts img to grayscale like toBlackAndWhite and returns its
+// alpha channel as a second gray image. The gray levels are taken from the
+// un-premultiplied colors, so transparent pixels keep their shade instead
+// of fading to black. alpha is nil when img is fully opaque.
+func splitAlpha(img image.Image) (gray, alpha *image.Gray) {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return toBlackAndWhite(img), nil
+	}
+	bounds := img.Bounds()
+	gray = image.NewGray(bounds)
+	alpha = image.NewGray(bounds)
+	if src, ok := img.(*image.NRGBA); ok {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(bounds.Min.X, y):][:4*bounds.Dx()]
+			g := gray.Pix[(y-bounds.Min.Y)*gray.Stride:]
+			a := alpha.Pix[(y-bounds.Min.Y)*alpha.Stride:]
+			for x := range g[:bounds.Dx()] {
+				p := row[4*x : 4*x+4]
+				g[x] = uint8((int(p[0]) + int(p[1]) + int(p[2])) / 3)
+				a[x] = p[3]
+			}
+		}
+		return gray, alpha
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			gray.Pix[gray.PixOffset(x, y)] = uint8((int(c.R) + int(c.G) + int(c.B)) / 3)
+			alpha.Pix[alpha.PixOffset(x, y)] = c.A
+		}
+	}
+	return gray, alpha
+}
+
+// mergeAlpha puts the alpha channel back on a filtered grayscale image
+func mergeAlpha(gray, alpha *image.Gray) *image.NRGBA {
+	bounds := gray.Bounds()
+	output := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := output.Pix[output.PixOffset(bounds.Min.X, y):][:4*bounds.Dx()]
+		g := gray.Pix[gray.PixOffset(bounds.Min.X, y):]
+		a := alpha.Pix[alpha.PixOffset(bounds.Min.X, y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = g[x], g[x], g[x], a[x]
+		}
+	}
+	return output
+}
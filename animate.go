@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// grayPalette maps palette index i to gray level i, so a gray image becomes
+// a GIF frame by copying its pixels
+var grayPalette = func() color.Palette {
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.Gray{Y: uint8(i)}
+	}
+	return p
+}()
+
+// grayFrame converts img to a GIF frame without dithering or quantization
+func grayFrame(img *image.Gray) *image.Paletted {
+	bounds := img.Bounds()
+	frame := image.NewPaletted(bounds, grayPalette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		copy(frame.Pix[frame.PixOffset(bounds.Min.X, y):frame.PixOffset(bounds.Max.X, y)],
+			img.Pix[img.PixOffset(bounds.Min.X, y):img.PixOffset(bounds.Max.X, y)])
+	}
+	return frame
+}
+
+// alternateAnimation shows the noisy input and the filtered result in turn
+func alternateAnimation(noisy, filtered *image.Gray, delay int) *gif.GIF {
+	return &gif.GIF{
+		Image: []*image.Paletted{grayFrame(noisy), grayFrame(filtered)},
+		Delay: []int{delay, delay},
+	}
+}
+
+// wipeFrame draws the columns of rect with the filtered result left of
+// split, a white divider at split and the noisy input right of it
+func wipeFrame(noisy, filtered *image.Gray, rect image.Rectangle, split int) *image.Paletted {
+	bounds := noisy.Bounds()
+	frame := image.NewPaletted(rect, grayPalette)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			switch {
+			case x < split:
+				frame.Pix[frame.PixOffset(x, y)] = filtered.Pix[filtered.PixOffset(x, y)]
+			case x == split && split > bounds.Min.X:
+				frame.Pix[frame.PixOffset(x, y)] = 255
+			default:
+				frame.Pix[frame.PixOffset(x, y)] = noisy.Pix[noisy.PixOffset(x, y)]
+			}
+		}
+	}
+	return frame
+}
+
+// wipeAnimation sweeps a white divider across the image in steps frames, with
+// the filtered result on its left and the noisy input on its right, then
+// sweeps back. Both ends are held for delay. Only the first frame covers the
+// whole image; every other frame redraws just the strip the divider crossed.
+func wipeAnimation(noisy, filtered *image.Gray, steps, delay int) *gif.GIF {
+	bounds := noisy.Bounds()
+	splits := make([]int, steps+1)
+	for i := range splits {
+		splits[i] = bounds.Min.X + bounds.Dx()*i/steps
+	}
+	strip := func(from, to int) image.Rectangle {
+		return image.Rect(from, bounds.Min.Y, min(to+1, bounds.Max.X), bounds.Max.Y)
+	}
+
+	anim := &gif.GIF{
+		Image:    []*image.Paletted{grayFrame(noisy)},
+		Delay:    []int{delay},
+		Disposal: []byte{gif.DisposalNone},
+	}
+	add := func(frame *image.Paletted, delay int) {
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, delay)
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+	for i := 1; i <= steps; i++ {
+		add(wipeFrame(noisy, filtered, strip(splits[i-1], splits[i]), splits[i]), 4)
+	}
+	anim.Delay[steps] = delay
+	// Sweep back; looping to the first frame completes the return
+	for i := steps - 1; i > 0; i-- {
+		add(wipeFrame(noisy, filtered, strip(splits[i], splits[i+1]), splits[i]), 4)
+	}
+	return anim
+}
+
+// kernelAnimation shows the noisy input followed by the result of every
+// kernel size in turn
+func kernelAnimation(noisy *image.Gray, mode string, chunkSize int, kernels []int, delay int) (*gif.GIF, error) {
+	anim := &gif.GIF{Image: []*image.Paletted{grayFrame(noisy)}, Delay: []int{delay}}
+	for _, kernel := range kernels {
+		output, err := applyFilter(mode, noisy, chunkSize, kernel)
+		if err != nil {
+			return nil, err
+		}
+		anim.Image = append(anim.Image, grayFrame(output))
+		anim.Delay = append(anim.Delay, delay)
+	}
+	return anim, nil
+}
+
+// parseKernelSizes parses a comma separated list of odd kernel sizes
+func parseKernelSizes(list string) ([]int, error) {
+	var kernels []int
+	for _, field := range strings.Split(list, ",") {
+		k, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || k < 1 || k%2 == 0 {
+			return nil, fmt.Errorf("invalid kernel size %q, must be a positive odd number", field)
+		}
+		kernels = append(kernels, k)
+	}
+	return kernels, nil
+}
+
+// runAnimate writes an animated GIF per input image comparing the noisy
+// input with the filtered result, for slides and demos
+func runAnimate(args []string) {
+	fs := flag.NewFlagSet("animate", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip or .tar(.gz) archive, or s3:// or gs:// prefix with the input images")
+	output := fs.String("output", filepath.Join("dataset-output", "animations"), "folder the GIFs are written to")
+	style := fs.String("style", "wipe", "animation: alternate (input and result in turn), wipe (a divider sweeping between them) or kernels (increasing kernel sizes)")
+	kernel := fs.Int("kernel", 3, "median window size for the alternate and wipe styles, must be odd")
+	kernelList := fs.String("kernels", "3,5,7,9", "comma separated kernel sizes shown by the kernels style")
+	mode := fs.String("mode", "parallel", "filter variant: sequential, parallel, halo (parallel with private tile copies), numa (parallel with per-node bands) or simd")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	delay := fs.Int("delay", 100, "time every still frame is shown, in hundredths of a second")
+	steps := fs.Int("steps", 24, "frames in one sweep of the wipe style")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if *delay < 1 {
+		fatal("delay must be positive", "delay", *delay)
+	}
+	if *steps < 2 {
+		fatal("steps must be at least 2", "steps", *steps)
+	}
+	kernels, err := parseKernelSizes(*kernelList)
+	if err != nil {
+		fatal("invalid kernel sizes", "err", err)
+	}
+	var render func(noisy *image.Gray) (*gif.GIF, error)
+	switch *style {
+	case "alternate", "wipe":
+		render = func(noisy *image.Gray) (*gif.GIF, error) {
+			filtered, err := applyFilter(*mode, noisy, *chunkSize, *kernel)
+			if err != nil {
+				return nil, err
+			}
+			if *style == "alternate" {
+				return alternateAnimation(noisy, filtered, *delay), nil
+			}
+			return wipeAnimation(noisy, filtered, *steps, *delay), nil
+		}
+	case "kernels":
+		render = func(noisy *image.Gray) (*gif.GIF, error) {
+			return kernelAnimation(noisy, *mode, *chunkSize, kernels, *delay)
+		}
+	default:
+		fatal("unknown style, use alternate, wipe or kernels", "style", *style)
+	}
+	if _, err := applyFilter(*mode, image.NewGray(image.Rect(0, 0, 1, 1)), *chunkSize, *kernel); err != nil {
+		fatal("invalid filter settings", "err", err)
+	}
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "path", *input, "err", err)
+	}
+	defer in.Close()
+	if err := os.MkdirAll(*output, os.ModePerm); err != nil {
+		fatal("failed to create output folder", "path", *output, "err", err)
+	}
+
+	images := 0
+	err = in.Walk(func(filename string, img image.Image) error {
+		anim, err := render(toBlackAndWhite(img))
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		name := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".gif"
+		f, err := os.Create(filepath.Join(*output, name))
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		err = gif.EncodeAll(w, anim)
+		if err == nil {
+			err = w.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		images++
+		slog.Info("saved animation", "image", filename, "path", filepath.Join(*output, name), "frames", len(anim.Image))
+		return nil
+	})
+	if err != nil {
+		fatal("failed to animate images", "input", *input, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+}
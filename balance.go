@@ -0,0 +1,262 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"runtime"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// tileSpan is when one tile of the parallel filter ran, relative to the
+// start of the filter, and on which worker
+type tileSpan struct {
+	Tile   image.Rectangle
+	Start  time.Duration
+	End    time.Duration
+	Worker int
+}
+
+func (s tileSpan) Duration() time.Duration { return s.End - s.Start }
+
+// traceTiles runs fn for every tile with the named scheduling policy and
+// records when each one started and finished and on which worker. The tiles
+// policy has no fixed workers and goroutines are not pinned to threads, so
+// there every tile holds one of GOMAXPROCS worker tokens while it runs; this
+// keeps the runtime from interleaving more tiles than there are workers and
+// names the worker.
+func traceTiles(bounds image.Rectangle, chunkSize int, schedule string, fn func(tile image.Rectangle)) []tileSpan {
+	tiles := tileRects(bounds, chunkSize)
+	spans := make([]tileSpan, len(tiles))
+	index := make(map[image.Rectangle]int, len(tiles))
+	for i, tile := range tiles {
+		spans[i].Tile = tile
+		index[tile] = i
+	}
+	workers := make(chan int, runtime.GOMAXPROCS(0))
+	for w := 0; w < cap(workers); w++ {
+		workers <- w
+	}
+
+	// Every tile is run once, so each span is only written by one goroutine
+	// and no lock is needed
+	start := time.Now()
+	tileSchedulers[schedule](tiles, func(worker int, tile image.Rectangle) {
+		span := &spans[index[tile]]
+		if worker < 0 {
+			worker = <-workers
+			defer func() { workers <- worker }()
+		}
+		span.Worker = worker
+		span.Start = time.Since(start)
+		fn(tile)
+		span.End = time.Since(start)
+	})
+	return spans
+}
+
+// workerLoad is the work one worker did during a traced run
+type workerLoad struct {
+	Worker int
+	Tiles  int
+	Pixels int
+	Busy   time.Duration
+}
+
+// workerLoads sums the spans of every worker
+func workerLoads(spans []tileSpan) []workerLoad {
+	var loads []workerLoad
+	for _, span := range spans {
+		for len(loads) <= span.Worker {
+			loads = append(loads, workerLoad{Worker: len(loads)})
+		}
+		load := &loads[span.Worker]
+		load.Tiles++
+		load.Pixels += span.Tile.Dx() * span.Tile.Dy()
+		load.Busy += span.Duration()
+	}
+	return loads
+}
+
+// imbalanceFactor is max/mean of values: 1 is a perfect balance, 2 means the
+// busiest share took twice the average and everyone else waited on it
+func imbalanceFactor(values []float64) float64 {
+	var total, largest float64
+	for _, v := range values {
+		total += v
+		largest = max(largest, v)
+	}
+	if total == 0 {
+		return 1
+	}
+	return largest * float64(len(values)) / total
+}
+
+// PrintLoadBalanceReport prints the work and busy time of every worker and
+// how unevenly the tiles and the workers were loaded
+func PrintLoadBalanceReport(spans []tileSpan, wall time.Duration, chunkSize int) {
+	loads := workerLoads(spans)
+	fmt.Println("Worker\tTiles\tPixels\t\tBusy (s)\tIdle (s)\tUtilization")
+	fmt.Println("------------------------------------------------------------------")
+	busy := make([]float64, len(loads))
+	var totalBusy time.Duration
+	for i, load := range loads {
+		busy[i] = load.Busy.Seconds()
+		totalBusy += load.Busy
+		fmt.Printf("%d\t%d\t%d\t\t%.6f\t%.6f\t%.1f%%\n", load.Worker, load.Tiles, load.Pixels,
+			load.Busy.Seconds(), (wall - load.Busy).Seconds(), 100*load.Busy.Seconds()/wall.Seconds())
+	}
+
+	tileTimes := make([]float64, len(spans))
+	tilePixels := make([]float64, len(spans))
+	full, shortest, longest := 0, spans[0].Duration(), spans[0].Duration()
+	for i, span := range spans {
+		tileTimes[i] = span.Duration().Seconds()
+		tilePixels[i] = float64(span.Tile.Dx() * span.Tile.Dy())
+		if span.Tile.Dx() == chunkSize && span.Tile.Dy() == chunkSize {
+			full++
+		}
+		shortest, longest = min(shortest, span.Duration()), max(longest, span.Duration())
+	}
+	fmt.Printf("Wall clock time:        %.6f s\n", wall.Seconds())
+	fmt.Printf("Tiles:                  %d (%d full %dx%d, %d partial at the edges)\n", len(spans), full, chunkSize, chunkSize, len(spans)-full)
+	fmt.Printf("Tile time:              %.6f s min, %.6f s mean, %.6f s max\n",
+		shortest.Seconds(), totalBusy.Seconds()/float64(len(spans)), longest.Seconds())
+	fmt.Printf("Tile work imbalance:    %.2f (max/mean pixels)\n", imbalanceFactor(tilePixels))
+	fmt.Printf("Tile time imbalance:    %.2f (max/mean time)\n", imbalanceFactor(tileTimes))
+	fmt.Printf("Worker load imbalance:  %.2f (max/mean busy time over %d workers)\n", imbalanceFactor(busy), len(loads))
+	fmt.Printf("Parallel efficiency:    %.1f%% (busy time / (workers x wall time))\n",
+		100*totalBusy.Seconds()/(float64(len(loads))*wall.Seconds()))
+}
+
+// ganttBars draws every tile as a bar on its worker's row, full tiles and
+// partial edge tiles in different colors
+type ganttBars struct {
+	spans     []tileSpan
+	chunkSize int
+}
+
+var (
+	fullTileColor = color.RGBA{R: 0, G: 0, B: 255, A: 255}   // Blue for full tiles
+	edgeTileColor = color.RGBA{R: 255, G: 140, B: 0, A: 255} // Orange for edge tiles
+)
+
+func (g ganttBars) Plot(c draw.Canvas, plt *plot.Plot) {
+	trX, trY := plt.Transforms(&c)
+	for _, span := range g.spans {
+		fill := fullTileColor
+		if span.Tile.Dx() != g.chunkSize || span.Tile.Dy() != g.chunkSize {
+			fill = edgeTileColor
+		}
+		x0, x1 := trX(span.Start.Seconds()*1000), trX(span.End.Seconds()*1000)
+		y0, y1 := trY(float64(span.Worker)-0.4), trY(float64(span.Worker)+0.4)
+		bar := c.ClipPolygonXY([]vg.Point{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}})
+		c.FillPolygon(fill, bar)
+		c.StrokeLines(draw.LineStyle{Color: color.White, Width: vg.Points(0.25)}, bar)
+	}
+}
+
+func (g ganttBars) DataRange() (xmin, xmax, ymin, ymax float64) {
+	for _, span := range g.spans {
+		xmax = max(xmax, span.End.Seconds()*1000)
+		ymax = max(ymax, float64(span.Worker))
+	}
+	return 0, xmax, -0.5, ymax + 0.5
+}
+
+// plotGantt saves when every tile ran on every worker
+func plotGantt(spans []tileSpan, chunkSize int, schedule string, opts *plotOptions) error {
+	p := plot.New()
+	p.Title.Text = fmt.Sprintf("Parallel Median Filter Tiles (chunk size %d, %s schedule)", chunkSize, schedule)
+	p.X.Label.Text = "Time (ms)"
+	p.Y.Label.Text = "Worker"
+	p.Y.Tick.Marker = plot.TickerFunc(func(min, max float64) []plot.Tick {
+		var ticks []plot.Tick
+		for w := 0; float64(w) <= max; w++ {
+			ticks = append(ticks, plot.Tick{Value: float64(w), Label: fmt.Sprint(w)})
+		}
+		return ticks
+	})
+	p.Add(ganttBars{spans: spans, chunkSize: chunkSize})
+	p.Legend.Add("Full tile", swatch{fullTileColor})
+	p.Legend.Add("Edge tile", swatch{edgeTileColor})
+
+	// The bars fill the chart; passing their corners makes the legend
+	// placement move it above them
+	var corners plotter.XYs
+	for _, span := range spans {
+		for _, y := range []float64{float64(span.Worker) - 0.4, float64(span.Worker) + 0.4} {
+			corners = append(corners, plotter.XY{X: span.Start.Seconds() * 1000, Y: y}, plotter.XY{X: span.End.Seconds() * 1000, Y: y})
+		}
+	}
+	opts.apply(p, corners)
+	return opts.save(p)
+}
+
+// runBalance traces one run of the parallel median filter and reports how
+// evenly its tiles and workers were loaded
+func runBalance(args []string) {
+	fs := flag.NewFlagSet("balance", flag.ExitOnError)
+	input := fs.String("image", "", "image to filter (default: a synthetic -pattern image of -width x -height)")
+	width := fs.Int("width", 768, "synthetic image width")
+	height := fs.Int("height", 512, "synthetic image height")
+	pattern := fs.String("pattern", "impulse", "synthetic pattern to filter: "+strings.Join(synthPatterns, ", "))
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	schedule := fs.String("schedule", defaultSchedule, "tile scheduling policy: tiles, static or stealing")
+	runs := fs.Int("runs", 3, "traced runs, the fastest one is reported")
+	plotOpts := addPlotFlags(fs, "load_balance.png")
+	addDecodeFlags(fs, false)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+	if _, err := applyScheduledFilter("parallel", *schedule, image.NewGray(image.Rect(0, 0, 1, 1)), *chunkSize, *kernel); err != nil {
+		fatal("invalid filter settings", "err", err)
+	}
+
+	var img *image.Gray
+	if *input != "" {
+		img = toBlackAndWhite(loadImage(".", *input))
+	} else {
+		var err error
+		if img, err = generateImage(*pattern, *width, *height, 1); err != nil {
+			fatal("failed to generate image", "err", err)
+		}
+	}
+
+	slog.Info("tracing parallel median filter", "width", img.Rect.Dx(), "height", img.Rect.Dy(), "chunk", *chunkSize, "schedule", *schedule, "runs", *runs)
+	var best []tileSpan
+	var bestWall time.Duration
+	for i := 0; i < *runs; i++ {
+		output := image.NewGray(img.Bounds())
+		start := time.Now()
+		spans := traceTiles(img.Bounds(), *chunkSize, *schedule, func(tile image.Rectangle) {
+			medianRect(output, img, tile, *kernel/2)
+		})
+		wall := time.Since(start)
+		slog.Debug("filtered image", "stage", "balance", "run", i+1, "duration", wall, "tiles", len(spans))
+		if best == nil || wall < bestWall {
+			best, bestWall = spans, wall
+		}
+	}
+
+	if err := plotGantt(best, *chunkSize, *schedule, plotOpts); err != nil {
+		fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+	}
+	PrintLoadBalanceReport(best, bestWall, *chunkSize)
+}
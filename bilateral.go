@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// bilateralKernel holds the precomputed weights of a bilateral filter: a
+// spatial Gaussian over the window and a range Gaussian over gray level
+// differences
+type bilateralKernel struct {
+	radius  int
+	spatial []float64 // (2*radius+1)^2 weights, row major
+	rng     [256]float64
+}
+
+func newBilateralKernel(sigmaSpatial, sigmaRange float64) *bilateralKernel {
+	k := &bilateralKernel{radius: max(1, int(math.Ceil(2*sigmaSpatial)))}
+	for dy := -k.radius; dy <= k.radius; dy++ {
+		for dx := -k.radius; dx <= k.radius; dx++ {
+			k.spatial = append(k.spatial, math.Exp(-float64(dx*dx+dy*dy)/(2*sigmaSpatial*sigmaSpatial)))
+		}
+	}
+	for diff := range k.rng {
+		k.rng[diff] = math.Exp(-float64(diff*diff) / (2 * sigmaRange * sigmaRange))
+	}
+	return k
+}
+
+// bilateralRect filters the pixels of rect. Every neighbor is weighted by
+// its distance and by how close its gray level is to the center pixel, so
+// edges are kept while flat areas are smoothed.
+func bilateralRect(output, img *image.Gray, rect image.Rectangle, k *bilateralKernel) {
+	bounds := img.Bounds()
+	size := 2*k.radius + 1
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			center := int(img.Pix[img.PixOffset(x, y)])
+			var sum, weights float64
+			for dy := -k.radius; dy <= k.radius; dy++ {
+				ny := y + dy
+				if ny < bounds.Min.Y || ny >= bounds.Max.Y {
+					continue
+				}
+				for dx := -k.radius; dx <= k.radius; dx++ {
+					nx := x + dx
+					if nx < bounds.Min.X || nx >= bounds.Max.X {
+						continue
+					}
+					v := int(img.Pix[img.PixOffset(nx, ny)])
+					diff := v - center
+					if diff < 0 {
+						diff = -diff
+					}
+					w := k.spatial[(dy+k.radius)*size+dx+k.radius] * k.rng[diff]
+					sum += w * float64(v)
+					weights += w
+				}
+			}
+			output.Pix[output.PixOffset(x, y)] = uint8(math.Round(sum / weights))
+		}
+	}
+}
+
+// Bilateral Filter (Sequential)
+func bilateralSequential(img *image.Gray, sigmaSpatial, sigmaRange float64) *image.Gray {
+	output := GetGray(img.Bounds())
+	bilateralRect(output, img, img.Bounds(), newBilateralKernel(sigmaSpatial, sigmaRange))
+	return output
+}
+
+// Bilateral Filter (Parallel)
+func bilateralParallel(img *image.Gray, chunkSize int, sigmaSpatial, sigmaRange float64) *image.Gray {
+	output := GetGray(img.Bounds())
+	k := newBilateralKernel(sigmaSpatial, sigmaRange)
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		bilateralRect(output, img, tile, k)
+	})
+	return output
+}
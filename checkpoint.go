@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// coordinatorCheckpoint is what a coordinator needs to pick up a run where
+// it stopped: the settings it was started with, the images already saved
+// to the output together with their timings, and the wall clock time spent
+// so far
+type coordinatorCheckpoint struct {
+	Parameters checkpointParameters `json:"parameters"`
+	Elapsed    time.Duration        `json:"elapsed_ns"`
+	Updated    time.Time            `json:"updated"`
+	Completed  []distributedResult  `json:"completed"`
+}
+
+// checkpointParameters are the coordinator settings that must not change
+// between a run and its resumption, or the output would mix two runs
+type checkpointParameters struct {
+	Input     string `json:"input"`
+	Output    string `json:"output"`
+	Mode      string `json:"mode"`
+	ChunkSize int    `json:"chunk_size"`
+	Kernel    int    `json:"kernel"`
+	Format    string `json:"format,omitempty"`
+}
+
+func loadCheckpoint(path string) (*coordinatorCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c coordinatorCheckpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes c to path atomically, so a coordinator killed while saving
+// still finds the previous checkpoint
+func (c *coordinatorCheckpoint) Save(path string) error {
+	c.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// completed returns the names of the images already done
+func (c *coordinatorCheckpoint) completed() map[string]bool {
+	done := make(map[string]bool, len(c.Completed))
+	for _, r := range c.Completed {
+		done[r.Name] = true
+	}
+	return done
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+)
+
+// logicalCPU is one hardware thread and the physical core it belongs to
+type logicalCPU struct {
+	ID      int
+	Package int
+	Core    int
+}
+
+// pinPolicies are the ways the cpus sweep can place its workers:
+//   - none leaves the placement to the operating system
+//   - compact fills every hardware thread of a core before the next core,
+//     so 2 workers share one core when it has two hyperthreads
+//   - spread takes one thread of every physical core before any sibling,
+//     so hyperthreads only come into play once every core is busy
+var pinPolicies = []string{"none", "compact", "spread"}
+
+// orderCPUs lists the CPUs in the order the policy hands them to workers
+func orderCPUs(topology []logicalCPU, policy string) []int {
+	cpus := append([]logicalCPU(nil), topology...)
+	sort.Slice(cpus, func(i, j int) bool {
+		a, b := cpus[i], cpus[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.Core != b.Core {
+			return a.Core < b.Core
+		}
+		return a.ID < b.ID
+	})
+	if policy == "spread" {
+		// Number the threads of every core, then take all first threads,
+		// all second threads and so on
+		thread := make(map[logicalCPU]int, len(cpus))
+		for i, cpu := range cpus {
+			if i > 0 && cpu.Package == cpus[i-1].Package && cpu.Core == cpus[i-1].Core {
+				thread[cpu] = thread[cpus[i-1]] + 1
+			}
+		}
+		sort.SliceStable(cpus, func(i, j int) bool { return thread[cpus[i]] < thread[cpus[j]] })
+	}
+	ids := make([]int, len(cpus))
+	for i, cpu := range cpus {
+		ids[i] = cpu.ID
+	}
+	return ids
+}
+
+// cpuSweep filters every image with the parallel filter once per worker
+// count, with GOMAXPROCS set to the count and, unless policy is none, the
+// process pinned to that many CPUs of order. The time of a count is the
+// sum over the images of the fastest of runs runs.
+func cpuSweep(images []*image.Gray, counts []int, policy string, order []int, schedule string, chunkSize, kernel, runs int) ([]ScalingPoint, error) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	if policy != "none" {
+		defer pinProcess(order)
+	}
+
+	var points []ScalingPoint
+	for _, workers := range counts {
+		point := ScalingPoint{Workers: workers, Schedule: schedule, Pin: policy}
+		if policy != "none" {
+			if workers > len(order) {
+				return nil, fmt.Errorf("cannot pin %d workers to %d CPUs", workers, len(order))
+			}
+			point.CPUs = order[:workers]
+			if err := pinProcess(point.CPUs); err != nil {
+				return nil, fmt.Errorf("failed to pin to CPUs %v: %w", point.CPUs, err)
+			}
+		}
+		runtime.GOMAXPROCS(workers)
+		filterMetrics.SetWorkers(workers)
+
+		for _, img := range images {
+			var best time.Duration
+			for i := 0; i < runs; i++ {
+				start := time.Now()
+				output, err := applyScheduledFilter("parallel", schedule, img, chunkSize, kernel)
+				if err != nil {
+					return nil, err
+				}
+				elapsed := time.Since(start)
+				PutGray(output)
+				filterMetrics.Observe("parallel", len(img.Pix), elapsed)
+				if i == 0 || elapsed < best {
+					best = elapsed
+				}
+			}
+			point.Time += best
+		}
+		slog.Debug("filtered images", "stage", "cpus", "worker", workers, "pin", policy, "cpus", point.CPUs, "duration", point.Time)
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// formatCPUs lists the CPUs of a pinned point, or "any" when it was not pinned
+func formatCPUs(cpus []int) string {
+	if cpus == nil {
+		return "any"
+	}
+	return strings.Trim(strings.Join(strings.Fields(fmt.Sprint(cpus)), ","), "[]")
+}
+
+// PrintCPUSweepTable prints the time, speedup and efficiency of every
+// worker count of one pinning policy next to the fitted Amdahl's law
+func PrintCPUSweepTable(points []ScalingPoint, images int) {
+	serial := fitAmdahl(points)
+	fmt.Printf("%d images, %s schedule, pinning %s\n", images, points[0].Schedule, points[0].Pin)
+	fmt.Println("Workers\tCPUs\t\tTime (s)\tSpeedup\tAmdahl\tEfficiency")
+	fmt.Println("------------------------------------------------------------------")
+	for _, p := range points {
+		speedup := points[0].Time.Seconds() / p.Time.Seconds()
+		fmt.Printf("%d\t%-12s\t%.6f\t%.2fx\t%.2fx\t%.1f%%\n", p.Workers, formatCPUs(p.CPUs), p.Time.Seconds(), speedup,
+			amdahlSpeedup(serial, p.Workers), 100*speedup/float64(p.Workers))
+	}
+	fmt.Printf("Parallel fraction: %.1f%% (Amdahl)\n", 100*(1-serial))
+}
+
+// plotCPUSweep saves the speedup of every pinning policy against the worker
+// count next to the ideal linear speedup
+func plotCPUSweep(series [][]ScalingPoint, opts *plotOptions) error {
+	p := plot.New()
+	p.Title.Text = "Speedup by GOMAXPROCS"
+	p.X.Label.Text = "Workers (GOMAXPROCS)"
+	p.Y.Label.Text = "Speedup"
+	if !opts.logY {
+		p.Y.Min = 0
+	}
+
+	var drawn []plotter.XYs
+	last := 1
+	for i, points := range series {
+		measured := make(plotter.XYs, len(points))
+		for j, point := range points {
+			measured[j] = plotter.XY{X: float64(point.Workers), Y: points[0].Time.Seconds() / point.Time.Seconds()}
+			last = max(last, point.Workers)
+		}
+		line, pts, err := plotter.NewLinePoints(measured)
+		if err != nil {
+			return err
+		}
+		line.Color = plotutil.Color(i)
+		pts.Color = plotutil.Color(i)
+		p.Add(line, pts)
+		p.Legend.Add("Pinning "+points[0].Pin, line, pts)
+		drawn = append(drawn, measured)
+	}
+
+	ideal, err := plotter.NewLine(plotter.XYs{{X: 1, Y: 1}, {X: float64(last), Y: float64(last)}})
+	if err != nil {
+		return err
+	}
+	ideal.Dashes = []vg.Length{vg.Points(4), vg.Points(4)}
+	p.Add(ideal)
+	p.Legend.Add("Ideal", ideal)
+	drawn = append(drawn, ideal.XYs)
+
+	opts.apply(p, drawn...)
+	return opts.save(p)
+}
+
+// runCPUs reruns the parallel filter on the dataset under several
+// GOMAXPROCS values and CPU pinning policies and plots the scaling curves
+func runCPUs(args []string) {
+	fs := flag.NewFlagSet("cpus", flag.ExitOnError)
+	workers := fs.String("workers", "", "comma separated GOMAXPROCS values starting with 1 (default 1, 2, 4, ... up to the number of CPUs)")
+	pinList := fs.String("pin", "none", "comma separated CPU pinning policies to compare: none, compact (fill hyperthreads first) or spread (one thread per core first); pinning needs Linux")
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	schedule := fs.String("schedule", defaultSchedule, "tile scheduling policy: tiles, static or stealing")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	runs := fs.Int("runs", 3, "runs per image and worker count, the fastest one is counted")
+	plotOpts := addPlotFlags(fs, "cpu_scaling.png")
+	metricsAddr := fs.String("metrics", "", "address to expose Prometheus /metrics on while the sweep runs (disabled when empty)")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+	serveMetrics(*metricsAddr)
+
+	counts := defaultWorkerCounts()
+	if *workers != "" {
+		var err error
+		if counts, err = parseWorkerCounts(*workers); err != nil {
+			fatal("failed to parse worker counts", "err", err)
+		}
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+	if _, err := applyScheduledFilter("parallel", *schedule, image.NewGray(image.Rect(0, 0, 1, 1)), *chunkSize, *kernel); err != nil {
+		fatal("invalid filter settings", "err", err)
+	}
+
+	policies := strings.Split(*pinList, ",")
+	var topology []logicalCPU
+	for _, policy := range policies {
+		switch policy {
+		case "none":
+		case "compact", "spread":
+			if topology != nil {
+				continue
+			}
+			cpus, err := processAffinity()
+			if err == nil {
+				topology, err = cpuTopology(cpus)
+			}
+			if err != nil {
+				fatal("failed to read CPU topology", "err", err)
+			}
+		default:
+			fatal("unknown pinning policy", "pin", policy, "known", pinPolicies)
+		}
+	}
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	var images []*image.Gray
+	err = in.Walk(func(filename string, img image.Image) error {
+		images = append(images, toBlackAndWhite(img))
+		return nil
+	})
+	in.Close()
+	if err != nil {
+		fatal("failed to read input", "input", *input, "err", err)
+	}
+	if len(images) == 0 {
+		fatal("no images found", "input", *input)
+	}
+
+	slog.Info("running GOMAXPROCS sweep, please wait", "workers", counts, "pin", *pinList, "images", len(images))
+	var series [][]ScalingPoint
+	for _, policy := range policies {
+		points, err := cpuSweep(images, counts, policy, orderCPUs(topology, policy), *schedule, *chunkSize, *kernel, *runs)
+		if err != nil {
+			fatal("GOMAXPROCS sweep failed", "pin", policy, "err", err)
+		}
+		series = append(series, points)
+	}
+	if err := plotCPUSweep(series, plotOpts); err != nil {
+		fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+	}
+	for i, points := range series {
+		if i > 0 {
+			fmt.Println()
+		}
+		PrintCPUSweepTable(points, len(images))
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// activeDashboard is the dashboard of the running benchmark, nil unless
+// -dashboard was given. Every dashboard method does nothing on nil, so the
+// benchmark reports its progress whether or not one is shown.
+var activeDashboard *dashboard
+
+// dashboard redraws a live view of the benchmark batch on the terminal
+// every refresh: a progress bar per image, the speedup of every finished
+// one, how busy the CPUs are and sparklines of the times so far. Logs are
+// shown in the last few lines of the view instead of scrolling it away.
+type dashboard struct {
+	mu      sync.Mutex
+	out     *os.File
+	width   int
+	height  int
+	start   time.Time
+	names   []string
+	stages  int // timed stages per image
+	runs    int
+	drawn   int // lines of the last frame, moved back over by the next one
+	stopped chan struct{}
+	wg      sync.WaitGroup
+
+	finished map[string]ManifestImage
+	filtered []time.Duration // wall time of every image that was not reused
+	current  int             // index in names of the image being filtered
+	begun    time.Time
+	variant  string
+	stage    int // stages of the current image already timed
+	run      int // runs of the current stage already timed
+	last     time.Duration
+
+	cpu     time.Duration
+	sampled time.Time
+	busy    float64 // share of the CPUs used since the previous frame, -1 when unknown
+
+	logs []string
+}
+
+const (
+	dashboardRefresh = 250 * time.Millisecond
+	dashboardLogs    = 4
+	dashboardBar     = 24
+)
+
+// newDashboard starts drawing the dashboard of a batch over names on
+// stderr, or returns nil when stderr is not a terminal
+func newDashboard(names []string, variants, runs int) *dashboard {
+	width, height, ok := terminalSize(os.Stderr)
+	if !ok {
+		return nil
+	}
+	d := &dashboard{
+		out:      os.Stderr,
+		width:    width,
+		height:   height,
+		start:    time.Now(),
+		names:    names,
+		stages:   variants,
+		runs:     runs,
+		stopped:  make(chan struct{}),
+		finished: map[string]ManifestImage{},
+		current:  -1,
+		busy:     -1,
+	}
+	d.cpu, _ = processCPUTime()
+	d.sampled = d.start
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(dashboardRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.mu.Lock()
+				d.sample()
+				d.draw()
+				d.mu.Unlock()
+			case <-d.stopped:
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// Close stops the refresh and leaves the last frame on the terminal, so the
+// tables printed afterwards appear below it
+func (d *dashboard) Close() {
+	if d == nil {
+		return
+	}
+	close(d.stopped)
+	d.wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.current = -1
+	d.sample()
+	d.draw()
+}
+
+// Write takes the log output while the dashboard is shown. Every record is
+// drawn at once, so a fatal error is on the screen before the process exits.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.logs = append(d.logs, line)
+	}
+	if len(d.logs) > dashboardLogs {
+		d.logs = d.logs[len(d.logs)-dashboardLogs:]
+	}
+	d.draw()
+	return len(p), nil
+}
+
+// beginImage marks name as the image being filtered
+func (d *dashboard) beginImage(name string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, n := range d.names {
+		if n == name {
+			d.current = i
+		}
+	}
+	d.begun = time.Now()
+	d.variant = ""
+	d.stage, d.run = 0, 0
+}
+
+// beginStage marks variant as the stage being timed on the current image
+func (d *dashboard) beginStage(variant string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.variant != "" {
+		d.stage++
+	}
+	d.variant = variant
+	d.run = 0
+}
+
+// ranOnce records one timed run of the current stage
+func (d *dashboard) ranOnce(elapsed time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.run++
+	d.last = elapsed
+}
+
+// finishImage records the results of an image, which reused tells were
+// taken from the previous manifest instead of being measured
+func (d *dashboard) finishImage(entry ManifestImage, reused bool) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.finished[entry.Name] = entry
+	if !reused {
+		d.filtered = append(d.filtered, time.Since(d.begun))
+	}
+	d.draw()
+}
+
+// sample updates the CPU utilization from the CPU time used since the last
+// sample
+func (d *dashboard) sample() {
+	now := time.Now()
+	cpu, ok := processCPUTime()
+	wall := now.Sub(d.sampled)
+	if !ok || wall <= 0 {
+		return
+	}
+	d.busy = min(1, float64(cpu-d.cpu)/float64(wall)/float64(runtime.GOMAXPROCS(0)))
+	d.cpu, d.sampled = cpu, now
+}
+
+// progress returns how much of the image at index i is done, from 0 to 1
+func (d *dashboard) progress(i int) float64 {
+	switch {
+	case d.finished[d.names[i]].Name != "":
+		return 1
+	case i != d.current || d.variant == "":
+		return 0
+	}
+	return min(1, (float64(d.stage)+float64(d.run)/float64(d.runs))/float64(d.stages))
+}
+
+// draw writes the frame over the previous one. The caller holds mu.
+func (d *dashboard) draw() {
+	var lines []string
+	done := len(d.finished)
+	overall := float64(done)
+	if d.current >= 0 && d.finished[d.names[d.current]].Name == "" {
+		overall += d.progress(d.current)
+	}
+	header := fmt.Sprintf("%d/%d images  elapsed %s", done, len(d.names), time.Since(d.start).Round(time.Second))
+	if remaining := len(d.names) - done; remaining > 0 && len(d.filtered) > 0 {
+		var total time.Duration
+		for _, elapsed := range d.filtered {
+			total += elapsed
+		}
+		eta := total / time.Duration(len(d.filtered)) * time.Duration(remaining)
+		header += fmt.Sprintf("  eta %s", eta.Round(time.Second))
+	}
+	lines = append(lines, header, fmt.Sprintf("%-10s %s %3.0f%%", "overall", progressBar(overall/float64(len(d.names)), dashboardBar), 100*overall/float64(len(d.names))))
+
+	// The images around the current one, as many as the terminal has room for
+	rows := min(len(d.names), max(3, d.height-10-dashboardLogs))
+	first := 0
+	if d.current >= 0 {
+		first = min(max(0, d.current-rows+3), len(d.names)-rows)
+	} else if done == len(d.names) {
+		first = len(d.names) - rows
+	}
+	for i := first; i < first+rows; i++ {
+		name := d.names[i]
+		line := fmt.Sprintf("%-10s %s  ", strings.TrimSuffix(name, ".png"), progressBar(d.progress(i), dashboardBar))
+		entry, ok := d.finished[name]
+		switch {
+		case ok && entry.TimedOut:
+			line += "timed out"
+		case ok:
+			line += fmt.Sprintf("seq %s  par %s  %.2fx", entry.Duration("sequential").Round(time.Microsecond), entry.Duration("parallel").Round(time.Microsecond), speedup(entry))
+		case i == d.current && d.variant != "":
+			line += fmt.Sprintf("%s run %d/%d", d.variant, min(d.run+1, d.runs), d.runs)
+			if d.run > 0 {
+				line += fmt.Sprintf("  last %s", d.last.Round(time.Microsecond))
+			}
+		case i == d.current:
+			line += "loading"
+		}
+		lines = append(lines, line)
+	}
+
+	if d.busy >= 0 {
+		lines = append(lines, fmt.Sprintf("%-10s %s %3.0f%% of %d CPUs", "cpu", progressBar(d.busy, dashboardBar), 100*d.busy, runtime.GOMAXPROCS(0)))
+	}
+	var sequential, parallel, speedups []float64
+	for _, name := range d.names {
+		entry, ok := d.finished[name]
+		if !ok || entry.TimedOut || entry.Seconds["parallel"] == 0 {
+			continue
+		}
+		sequential = append(sequential, entry.Seconds["sequential"])
+		parallel = append(parallel, entry.Seconds["parallel"])
+		speedups = append(speedups, speedup(entry))
+	}
+	if len(speedups) > 0 {
+		var sum, best float64
+		for _, s := range speedups {
+			sum += s
+			best = max(best, s)
+		}
+		lines = append(lines, fmt.Sprintf("%-10s last %.2fx  mean %.2fx  best %.2fx", "speedup", speedups[len(speedups)-1], sum/float64(len(speedups)), best))
+	}
+	lines = append(lines,
+		fmt.Sprintf("%-10s %s", "sequential", sparkline(sequential)),
+		fmt.Sprintf("%-10s %s", "parallel", sparkline(parallel)))
+	lines = append(lines, d.logs...)
+
+	var buf bytes.Buffer
+	if d.drawn > 0 {
+		// Back to the start of the previous frame and clear it
+		fmt.Fprintf(&buf, "\x1b[%dF\x1b[J", d.drawn)
+	}
+	for _, line := range lines {
+		buf.WriteString(truncateLine(line, d.width-1))
+		buf.WriteByte('\n')
+	}
+	d.out.Write(buf.Bytes())
+	d.drawn = len(lines)
+}
+
+// speedup returns how many times faster the parallel filter was than the
+// sequential one on entry
+func speedup(entry ManifestImage) float64 {
+	if entry.Seconds["parallel"] == 0 {
+		return 0
+	}
+	return entry.Seconds["sequential"] / entry.Seconds["parallel"]
+}
+
+// progressBar draws a bar width cells wide, filled to fraction
+func progressBar(fraction float64, width int) string {
+	filled := int(min(1, max(0, fraction)) * float64(width))
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", width-filled) + "]"
+}
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws values as a row of blocks, the highest value as a full one
+func sparkline(values []float64) string {
+	var highest float64
+	for _, v := range values {
+		highest = max(highest, v)
+	}
+	var b strings.Builder
+	for _, v := range values {
+		level := 0
+		if highest > 0 {
+			level = min(len(sparkBlocks)-1, int(v/highest*float64(len(sparkBlocks)-1)+0.5))
+		}
+		b.WriteRune(sparkBlocks[level])
+	}
+	return b.String()
+}
+
+// truncateLine cuts line to at most width characters, so no line of the
+// frame wraps and throws off the cursor movement of the next one
+func truncateLine(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:max(0, width)])
+}
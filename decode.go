@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"image"
+	"io"
+	"log/slog"
+
+	"hpc_final/filter"
+)
+
+// decodeOptions are the checks every input image goes through before a
+// decoder is allowed to allocate its pixels. A zero limit is disabled.
+type decodeOptions struct {
+	filter.Limits
+	// untrusted makes batches skip the images that fail the checks or do
+	// not decode, instead of stopping at the first one
+	untrusted bool
+}
+
+// decodeLimits is set by the flags of addDecodeFlags. The defaults are the
+// filter package's.
+var decodeLimits = decodeOptions{Limits: filter.DefaultLimits}
+
+// addDecodeFlags registers the decode limits on fs, and for commands that
+// read a whole input folder or archive, the -untrusted flag
+func addDecodeFlags(fs *flag.FlagSet, batch bool) {
+	fs.Int64Var(&decodeLimits.MaxBytes, "max-file-size", decodeLimits.MaxBytes, "reject input files larger than this many bytes (0 for no limit)")
+	fs.Int64Var(&decodeLimits.MaxPixels, "max-pixels", decodeLimits.MaxPixels, "reject images with more pixels than this, checked before decoding (0 for no limit)")
+	fs.IntVar(&decodeLimits.MaxDim, "max-input-dim", decodeLimits.MaxDim, "reject images wider or taller than this, checked before decoding (0 for no limit)")
+	if batch {
+		fs.BoolVar(&decodeLimits.untrusted, "untrusted", false, "skip and log the inputs that are corrupt or exceed the limits instead of stopping")
+	}
+}
+
+// DecodeError is an input that decodeImage refused or failed to decode
+type DecodeError = filter.DecodeError
+
+// readInput reads an encoded image, giving up as soon as it passes the file
+// size limit
+func readInput(name string, r io.Reader) ([]byte, error) {
+	return decodeLimits.Read(name, r)
+}
+
+// decodeImage is image.Decode behind the decode limits. Read errors are
+// returned as they are, everything wrong with the image itself as a
+// *DecodeError.
+func decodeImage(name string, r io.Reader) (image.Image, string, error) {
+	data, err := readInput(name, r)
+	if err != nil {
+		return nil, "", err
+	}
+	return decodeBytes(name, data)
+}
+
+// decodeBytes decodes an image held in memory behind the decode limits,
+// checking its header before its pixels are allocated
+func decodeBytes(name string, data []byte) (image.Image, string, error) {
+	return decodeLimits.Decode(name, data)
+}
+
+// skipRejected reports whether a batch should skip the input that failed
+// with err and go on with the next one, which -untrusted allows for the
+// images decodeImage rejects. Skipped inputs are logged with the reason.
+func skipRejected(err error) bool {
+	var rejected *DecodeError
+	if err == nil || !decodeLimits.untrusted || !errors.As(err, &rejected) {
+		return false
+	}
+	slog.Warn("skipping rejected image", "image", rejected.Name, "reason", rejected.Reason, "width", rejected.Width, "height", rejected.Height, "err", rejected.Err)
+	return true
+}
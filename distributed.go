@@ -0,0 +1,338 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FilterArgs is a single image shipped from the coordinator to a worker
+type FilterArgs struct {
+	Name      string
+	Width     int
+	Height    int
+	Pix       []uint8
+	Mode      string
+	ChunkSize int
+	Kernel    int
+}
+
+// FilterReply carries the filtered pixels and the time the worker spent filtering
+type FilterReply struct {
+	Pix     []uint8
+	Elapsed time.Duration
+	Worker  string
+}
+
+// Worker is the RPC service exposed by `worker` processes
+type Worker struct {
+	name string
+}
+
+// Filter applies the requested median filter to one image
+func (w *Worker) Filter(args *FilterArgs, reply *FilterReply) error {
+	if len(args.Pix) != args.Width*args.Height {
+		return fmt.Errorf("%s: got %d pixels for a %dx%d image", args.Name, len(args.Pix), args.Width, args.Height)
+	}
+	img := &image.Gray{Pix: args.Pix, Stride: args.Width, Rect: image.Rect(0, 0, args.Width, args.Height)}
+
+	idle := filterMetrics.WorkerBusy()
+	start := time.Now()
+	output, err := applyFilter(args.Mode, img, args.ChunkSize, args.Kernel)
+	reply.Elapsed = time.Since(start)
+	idle()
+	if err != nil {
+		return err
+	}
+	filterMetrics.Observe(args.Mode, len(args.Pix), reply.Elapsed)
+	reply.Pix = output.Pix
+	reply.Worker = w.name
+	slog.Debug("filtered image", "image", args.Name, "stage", args.Mode, "duration", reply.Elapsed, "worker", w.name)
+	return nil
+}
+
+// runWorker serves the Worker RPC service until the process is killed
+func runWorker(args []string) {
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	listen := fs.String("listen", ":7070", "address to accept coordinator connections on")
+	metricsAddr := fs.String("metrics", "", "address to expose Prometheus /metrics on (disabled when empty)")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	filterMetrics.SetWorkers(1)
+	serveMetrics(*metricsAddr)
+
+	hostname, _ := os.Hostname()
+	if err := rpc.Register(&Worker{name: hostname + *listen}); err != nil {
+		fatal("failed to register worker", "err", err)
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal("failed to listen", "addr", *listen, "err", err)
+	}
+	slog.Info("worker listening", "addr", ln.Addr().String(), "worker", hostname+*listen)
+	rpc.Accept(ln)
+}
+
+// distributedResult is the outcome of one image processed on a remote worker
+type distributedResult struct {
+	Name      string        `json:"name"`
+	Worker    string        `json:"worker"`
+	Compute   time.Duration `json:"compute_ns"`
+	RoundTrip time.Duration `json:"round_trip_ns"`
+}
+
+// runCoordinator shards the images in the input folder across the workers,
+// saves the filtered outputs and prints a scaling report
+func runCoordinator(args []string) {
+	fs := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	workers := fs.String("workers", "localhost:7070", "comma separated list of worker addresses")
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	output := fs.String("output", "dataset-output", "folder, new .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix to write the filtered images to")
+	mode := fs.String("mode", "parallel", "filter to run on the workers: sequential, parallel, halo, numa or simd")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	format := fs.String("format", "", "format of the saved outputs: png, pgm or ppm (default: the input's own format)")
+	checkpointPath := fs.String("checkpoint", "", "file to record finished images in, so an interrupted run can be resumed (disabled when empty)")
+	interval := fs.Duration("checkpoint-interval", 30*time.Second, "how often the checkpoint is written while images finish")
+	resume := fs.Bool("resume", false, "skip the images recorded in the checkpoint and add their timings to the report")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if !validOutputFormat(*format) {
+		fatal("unknown output format, use png, pgm or ppm", "format", *format)
+	}
+	if *resume && *checkpointPath == "" {
+		fatal("-resume needs a -checkpoint file")
+	}
+	if *checkpointPath != "" && (isZip(*output) || isTar(*output)) {
+		// Archives are written from scratch, which would lose the images
+		// finished before the restart
+		fatal("checkpoints need a folder or remote output", "output", *output)
+	}
+	checkpoint := &coordinatorCheckpoint{Parameters: checkpointParameters{
+		Input:     *input,
+		Output:    *output,
+		Mode:      *mode,
+		ChunkSize: *chunkSize,
+		Kernel:    *kernel,
+		Format:    *format,
+	}}
+	if *resume {
+		previous, err := loadCheckpoint(*checkpointPath)
+		if os.IsNotExist(err) {
+			slog.Info("no checkpoint to resume from, processing every image", "path", *checkpointPath)
+		} else if err != nil {
+			fatal("failed to load checkpoint", "path", *checkpointPath, "err", err)
+		} else if previous.Parameters != checkpoint.Parameters {
+			fatal("checkpoint was written with different settings", "path", *checkpointPath, "checkpoint", fmt.Sprintf("%+v", previous.Parameters))
+		} else {
+			checkpoint = previous
+			slog.Info("resuming from checkpoint", "path", *checkpointPath, "images", len(checkpoint.Completed), "elapsed", checkpoint.Elapsed)
+		}
+	}
+	done := checkpoint.completed()
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+
+	addrs := strings.Split(*workers, ",")
+	var clients []*rpc.Client
+	for i, addr := range addrs {
+		addrs[i] = strings.TrimSpace(addr)
+		client, err := rpc.Dial("tcp", addrs[i])
+		if err != nil {
+			fatal("failed to connect to worker", "worker", addr, "err", err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	out, err := createImageOutput(*output)
+	if err != nil {
+		fatal("failed to create output", "output", *output, "err", err)
+	}
+	if remote, ok := out.(*remoteOutput); ok && *checkpointPath != "" {
+		// An image is only recorded in the checkpoint once it is stored,
+		// so a background upload still running or failing when the
+		// coordinator stops cannot be skipped by -resume
+		remote.synchronous = true
+	}
+
+	slog.Info("distributing images, please wait", "input", *input, "workers", len(clients))
+
+	// Every worker pulls the next image as soon as it is done with the
+	// previous one, so faster machines end up with larger shards.
+	type job struct {
+		name string
+		img  *image.Gray
+		meta imageMetadata
+	}
+	jobs := make(chan job)
+	results := make(chan distributedResult)
+	var wg sync.WaitGroup
+	// The time spent before the restart counts towards the wall clock
+	start := time.Now().Add(-checkpoint.Elapsed)
+
+	for i, client := range clients {
+		wg.Add(1)
+		go func(client *rpc.Client, addr string) {
+			defer wg.Done()
+			for j := range jobs {
+				filename, bwImage := j.name, j.img
+				bounds := bwImage.Bounds()
+
+				var reply FilterReply
+				sent := time.Now()
+				err := client.Call("Worker.Filter", &FilterArgs{
+					Name:      filename,
+					Width:     bounds.Dx(),
+					Height:    bounds.Dy(),
+					Pix:       bwImage.Pix,
+					Mode:      *mode,
+					ChunkSize: *chunkSize,
+					Kernel:    *kernel,
+				}, &reply)
+				if err != nil {
+					fatal("worker failed", "image", filename, "worker", addr, "err", err)
+				}
+				roundTrip := time.Since(sent)
+				slog.Debug("received image", "image", filename, "stage", *mode, "duration", roundTrip, "worker", addr)
+
+				filtered := &image.Gray{Pix: reply.Pix, Stride: bounds.Dx(), Rect: bounds}
+				name := withFormat(fmt.Sprintf("distributed-%s", filename), *format)
+				if _, err := out.Save(name, filtered, j.meta); err != nil {
+					fatal("failed to save image", "image", name, "output", *output, "err", err)
+				}
+
+				results <- distributedResult{
+					Name:      filename,
+					Worker:    reply.Worker,
+					Compute:   reply.Elapsed,
+					RoundTrip: roundTrip,
+				}
+			}
+		}(client, addrs[i])
+	}
+
+	// Images are decoded one at a time as workers free up, so archives are
+	// streamed instead of being unpacked first
+	go func() {
+		err := in.WalkHashed(func(name, _ string, img image.Image, meta imageMetadata) error {
+			if done[name] {
+				slog.Debug("skipping image finished before the restart", "image", name)
+				return nil
+			}
+			jobs <- job{name: name, img: toBlackAndWhite(img), meta: meta}
+			return nil
+		})
+		if err != nil {
+			fatal("failed to read input", "input", *input, "err", err)
+		}
+		close(jobs)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// A killed coordinator or a preempted worker, which fails the run, only
+	// loses the images finished since the last checkpoint. SIGINT and
+	// SIGTERM, which cloud providers send before preempting a machine, save
+	// one last checkpoint before exiting.
+	stop := make(chan os.Signal, 1)
+	if *checkpointPath != "" {
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(stop)
+	}
+	save := func() {
+		checkpoint.Elapsed = time.Since(start)
+		if err := checkpoint.Save(*checkpointPath); err != nil {
+			fatal("failed to save checkpoint", "path", *checkpointPath, "err", err)
+		}
+	}
+	saved := time.Now()
+collect:
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				break collect
+			}
+			checkpoint.Completed = append(checkpoint.Completed, result)
+			if *checkpointPath != "" && time.Since(saved) >= *interval {
+				save()
+				saved = time.Now()
+				slog.Debug("saved checkpoint", "path", *checkpointPath, "images", len(checkpoint.Completed))
+			}
+		case sig := <-stop:
+			save()
+			fatal("interrupted, rerun with -resume to continue", "signal", sig.String(), "checkpoint", *checkpointPath, "images", len(checkpoint.Completed))
+		}
+	}
+	if err := out.Close(); err != nil {
+		fatal("failed to finish output", "output", *output, "err", err)
+	}
+	if *checkpointPath != "" {
+		save()
+	}
+	collected := checkpoint.Completed
+	if len(collected) == 0 {
+		fatal("no images found", "input", *input)
+	}
+	PrintScalingReport(collected, time.Since(start))
+}
+
+// PrintScalingReport prints per-image timings, per-worker load and overall speedup
+func PrintScalingReport(results []distributedResult, wall time.Duration) {
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	fmt.Println("Image\t\tWorker\t\t\tCompute (s)\tRound Trip (s)")
+	fmt.Println("------------------------------------------------------------------")
+	busy := map[string]time.Duration{}
+	count := map[string]int{}
+	var totalCompute time.Duration
+	for _, r := range results {
+		fmt.Printf("%s\t%s\t\t%.6f\t%.6f\n", r.Name, r.Worker, r.Compute.Seconds(), r.RoundTrip.Seconds())
+		busy[r.Worker] += r.Compute
+		count[r.Worker]++
+		totalCompute += r.Compute
+	}
+
+	var names []string
+	for name := range busy {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println()
+	fmt.Println("Worker\t\t\tImages\tBusy (s)\tUtilization")
+	fmt.Println("------------------------------------------------------------------")
+	for _, name := range names {
+		fmt.Printf("%s\t\t%d\t%.6f\t%.1f%%\n", name, count[name], busy[name].Seconds(), 100*busy[name].Seconds()/wall.Seconds())
+	}
+
+	speedup := totalCompute.Seconds() / wall.Seconds()
+	fmt.Println()
+	fmt.Printf("Wall clock time:   %.6f s\n", wall.Seconds())
+	fmt.Printf("Total compute:     %.6f s\n", totalCompute.Seconds())
+	fmt.Printf("Speedup:           %.2fx over %d workers\n", speedup, len(names))
+	if len(names) > 0 {
+		fmt.Printf("Efficiency:        %.1f%%\n", 100*speedup/float64(len(names)))
+	}
+}
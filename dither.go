@@ -0,0 +1,158 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// floydSteinberg dithers img to black and white, diffusing the error of
+// every pixel to its unvisited neighbors with the weights
+//
+//	.  *  7
+//	3  5  1   (/16)
+//
+// Each row depends on the row above it, so the rows cannot be split into
+// independent tiles. They can still overlap as a wavefront: row y may
+// dither pixel x once row y-1 is past x+1, since after that nothing above
+// changes its error. The rows are dealt out to workers in turn and each one
+// waits for the row above in blocks of block pixels. One worker gives the
+// plain sequential algorithm, and every worker count gives the same pixels.
+func floydSteinberg(img *image.Gray, workers, block int) *image.Gray {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	output := GetGray(bounds)
+	if width == 0 || height == 0 {
+		return output
+	}
+
+	// errs[y] holds the error diffused into row y from row y-1 in 1/16 gray
+	// levels, with a column of padding on both sides for the edge pixels.
+	// Only the row above writes it, so the error carried along a row stays
+	// in a local variable.
+	stride := width + 2
+	errs := make([]int32, (height+1)*stride)
+	progress := make([]atomic.Int64, height) // pixels dithered per row
+
+	dither := func(y int) {
+		src := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:width]
+		dst := output.Pix[output.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:width]
+		cur := errs[y*stride:][:stride]
+		next := errs[(y+1)*stride:][:stride]
+		var right int32
+		for x0 := 0; x0 < width; x0 += block {
+			x1 := min(x0+block, width)
+			if y > 0 {
+				for progress[y-1].Load() < int64(min(x1+1, width)) {
+					runtime.Gosched()
+				}
+			}
+			for x := x0; x < x1; x++ {
+				v := 16*int32(src[x]) + cur[x+1] + right
+				var out int32
+				if v >= 16*128 {
+					out = 255
+				}
+				dst[x] = uint8(out)
+				e := v - 16*out
+				right = e * 7 / 16
+				next[x] += e * 3 / 16
+				next[x+1] += e * 5 / 16
+				next[x+2] += e / 16
+			}
+			progress[y].Store(int64(x1))
+		}
+	}
+
+	workers = max(1, min(workers, height))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for y := w; y < height; y += workers {
+				dither(y)
+			}
+		}(w)
+	}
+	wg.Wait()
+	return output
+}
+
+func floydSteinbergSequential(img *image.Gray) *image.Gray {
+	return floydSteinberg(img, 1, img.Bounds().Dx())
+}
+
+// floydSteinbergParallel runs the wavefront with GOMAXPROCS workers, waiting
+// for the row above every chunkSize pixels
+func floydSteinbergParallel(img *image.Gray, chunkSize int) *image.Gray {
+	return floydSteinberg(img, runtime.GOMAXPROCS(0), chunkSize)
+}
+
+// bayer8 is the 8x8 Bayer threshold matrix, ranks 0 to 63
+var bayer8 = [8][8]uint8{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// orderedRect dithers the pixels of rect by comparing each one with the
+// Bayer threshold of its position, which needs no other pixel
+func orderedRect(output, img *image.Gray, rect image.Rectangle) {
+	bounds := img.Bounds()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(rect.Min.X, y):][:rect.Dx()]
+		dst := output.Pix[output.PixOffset(rect.Min.X, y):][:rect.Dx()]
+		thresholds := &bayer8[(y-bounds.Min.Y)&7]
+		for i, v := range src {
+			// Rank m covers levels from 4m to 4m+3, so threshold in its middle
+			if int(v) >= 4*int(thresholds[(rect.Min.X-bounds.Min.X+i)&7])+2 {
+				dst[i] = 255
+			} else {
+				dst[i] = 0
+			}
+		}
+	}
+}
+
+func orderedDitherSequential(img *image.Gray) *image.Gray {
+	output := GetGray(img.Bounds())
+	orderedRect(output, img, img.Bounds())
+	return output
+}
+
+func orderedDitherParallel(img *image.Gray, chunkSize int) *image.Gray {
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		orderedRect(output, img, tile)
+	})
+	return output
+}
+
+// ditherers are the dithering stages selectable with -dither
+var ditherers = map[string]func(img *image.Gray, chunkSize int) *image.Gray{
+	"floyd":   floydSteinbergParallel,
+	"ordered": orderedDitherParallel,
+}
+
+// oneBit repacks a black and white image as a two color palette, which the
+// PNG encoder writes with one bit per pixel
+func oneBit(img *image.Gray) *image.Paletted {
+	bounds := img.Bounds()
+	output := image.NewPaletted(bounds, color.Palette{color.Gray{Y: 0}, color.Gray{Y: 255}})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		dst := output.Pix[output.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		for i, v := range src {
+			dst[i] = v >> 7
+		}
+	}
+	return output
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sync/atomic"
+)
+
+// gradient holds the Sobel magnitude of every pixel and its direction
+// rounded to one of four sectors: 0 horizontal, 1 at 45 degrees, 2 vertical
+// and 3 at 135 degrees
+type gradient struct {
+	bounds    image.Rectangle
+	magnitude []float32
+	sector    []uint8
+}
+
+func newGradient(bounds image.Rectangle) *gradient {
+	n := bounds.Dx() * bounds.Dy()
+	return &gradient{bounds: bounds, magnitude: make([]float32, n), sector: make([]uint8, n)}
+}
+
+func (g *gradient) index(x, y int) int {
+	return (y-g.bounds.Min.Y)*g.bounds.Dx() + (x - g.bounds.Min.X)
+}
+
+// clampedAt reads a pixel, replicating the border for offsets outside the image
+func clampedAt(img *image.Gray, x, y int) int {
+	b := img.Bounds()
+	x = min(max(x, b.Min.X), b.Max.X-1)
+	y = min(max(y, b.Min.Y), b.Max.Y-1)
+	return int(img.Pix[img.PixOffset(x, y)])
+}
+
+// smoothRect applies the 3x3 binomial kernel [1 2 1]^T [1 2 1] / 16 to rect,
+// which keeps Canny from tracing single noisy pixels
+func smoothRect(output, img *image.Gray, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			sum := 0
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					weight := (2 - dx*dx) * (2 - dy*dy)
+					sum += weight * clampedAt(img, x+dx, y+dy)
+				}
+			}
+			output.Pix[output.PixOffset(x, y)] = uint8((sum + 8) / 16)
+		}
+	}
+}
+
+// sobelRect fills the gradient of every pixel in rect
+func sobelRect(g *gradient, img *image.Gray, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			gx := clampedAt(img, x+1, y-1) + 2*clampedAt(img, x+1, y) + clampedAt(img, x+1, y+1) -
+				clampedAt(img, x-1, y-1) - 2*clampedAt(img, x-1, y) - clampedAt(img, x-1, y+1)
+			gy := clampedAt(img, x-1, y+1) + 2*clampedAt(img, x, y+1) + clampedAt(img, x+1, y+1) -
+				clampedAt(img, x-1, y-1) - 2*clampedAt(img, x, y-1) - clampedAt(img, x+1, y-1)
+
+			i := g.index(x, y)
+			g.magnitude[i] = float32(math.Sqrt(float64(gx*gx + gy*gy)))
+
+			angle := math.Atan2(float64(gy), float64(gx)) * 180 / math.Pi
+			if angle < 0 {
+				angle += 180
+			}
+			g.sector[i] = uint8(int(math.Round(angle/45)) % 4)
+		}
+	}
+}
+
+// magnitudeRect writes the gradient magnitude of rect, clamped to 255
+func magnitudeRect(output *image.Gray, g *gradient, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			output.Pix[output.PixOffset(x, y)] = uint8(min(255, math.Round(float64(g.magnitude[g.index(x, y)]))))
+		}
+	}
+}
+
+// sectorOffsets are the neighbor offsets along the gradient of every sector
+var sectorOffsets = [4]image.Point{{X: 1, Y: 0}, {X: 1, Y: 1}, {X: 0, Y: 1}, {X: -1, Y: 1}}
+
+// Edge states used by the Canny thresholding and hysteresis passes
+const (
+	edgeNone uint8 = iota
+	edgeWeak
+	edgeStrong
+)
+
+// suppressRect keeps the pixels of rect that are a local maximum along their
+// gradient and classifies them against the two thresholds
+func suppressRect(edges []uint8, g *gradient, rect image.Rectangle, low, high float32) {
+	at := func(x, y int) float32 {
+		if !(image.Point{X: x, Y: y}).In(g.bounds) {
+			return 0
+		}
+		return g.magnitude[g.index(x, y)]
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			i := g.index(x, y)
+			m := g.magnitude[i]
+			d := sectorOffsets[g.sector[i]]
+			state := edgeNone
+			if m >= at(x+d.X, y+d.Y) && m >= at(x-d.X, y-d.Y) {
+				switch {
+				case m >= high:
+					state = edgeStrong
+				case m >= low:
+					state = edgeWeak
+				}
+			}
+			edges[i] = state
+		}
+	}
+}
+
+// traceRect promotes every weak pixel of rect connected to a strong one.
+// Pixels outside rect are only read, from seen, so tiles can be traced
+// concurrently. It reports whether any pixel was promoted.
+func traceRect(edges, seen []uint8, g *gradient, rect image.Rectangle) bool {
+	var stack []image.Point
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			i := g.index(x, y)
+			switch edges[i] {
+			case edgeStrong:
+				stack = append(stack, image.Point{X: x, Y: y})
+			case edgeWeak:
+				// Seed weak pixels touching strong pixels of other tiles
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						p := image.Point{X: x + dx, Y: y + dy}
+						if p.In(g.bounds) && !p.In(rect) && seen[g.index(p.X, p.Y)] == edgeStrong {
+							edges[i] = edgeStrong
+						}
+					}
+				}
+				if edges[i] == edgeStrong {
+					stack = append(stack, image.Point{X: x, Y: y})
+				}
+			}
+		}
+	}
+
+	promoted := false
+	for _, p := range stack {
+		if seen != nil && seen[g.index(p.X, p.Y)] != edgeStrong {
+			promoted = true
+		}
+	}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				q := image.Point{X: p.X + dx, Y: p.Y + dy}
+				if q.In(rect) && edges[g.index(q.X, q.Y)] == edgeWeak {
+					edges[g.index(q.X, q.Y)] = edgeStrong
+					promoted = true
+					stack = append(stack, q)
+				}
+			}
+		}
+	}
+	return promoted
+}
+
+// edgeImage draws strong edges white on black
+func edgeImage(edges []uint8, bounds image.Rectangle) *image.Gray {
+	output := image.NewGray(bounds)
+	for i, state := range edges {
+		if state == edgeStrong {
+			output.Pix[i] = 255
+		}
+	}
+	return output
+}
+
+// Sobel Gradient Magnitude (Sequential)
+func sobelSequential(img *image.Gray) *image.Gray {
+	g := newGradient(img.Bounds())
+	sobelRect(g, img, img.Bounds())
+	output := GetGray(img.Bounds())
+	magnitudeRect(output, g, img.Bounds())
+	return output
+}
+
+// Sobel Gradient Magnitude (Parallel)
+func sobelParallel(img *image.Gray, chunkSize int) *image.Gray {
+	g := newGradient(img.Bounds())
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		sobelRect(g, img, tile)
+		magnitudeRect(output, g, tile)
+	})
+	return output
+}
+
+// Canny Edge Detection (Sequential)
+// Smoothing, Sobel gradients, non-maximum suppression with double
+// thresholding, and hysteresis as a single flood fill from the strong pixels
+func cannySequential(img *image.Gray, low, high float32) *image.Gray {
+	bounds := img.Bounds()
+	smoothed := image.NewGray(bounds)
+	smoothRect(smoothed, img, bounds)
+	g := newGradient(bounds)
+	sobelRect(g, smoothed, bounds)
+	edges := make([]uint8, len(g.magnitude))
+	suppressRect(edges, g, bounds, low, high)
+	traceRect(edges, nil, g, bounds)
+	return edgeImage(edges, bounds)
+}
+
+// Canny Edge Detection (Parallel)
+// Every pass runs over the tiles and waits for all of them, since each one
+// reads the neighbors of the previous pass. Hysteresis floods inside every
+// tile and repeats, reading the other tiles from a snapshot of the previous
+// round, until no tile promotes a pixel.
+func cannyParallel(img *image.Gray, chunkSize int, low, high float32) *image.Gray {
+	bounds := img.Bounds()
+	smoothed := image.NewGray(bounds)
+	forEachTile(bounds, chunkSize, func(tile image.Rectangle) {
+		smoothRect(smoothed, img, tile)
+	})
+	g := newGradient(bounds)
+	forEachTile(bounds, chunkSize, func(tile image.Rectangle) {
+		sobelRect(g, smoothed, tile)
+	})
+	edges := make([]uint8, len(g.magnitude))
+	forEachTile(bounds, chunkSize, func(tile image.Rectangle) {
+		suppressRect(edges, g, tile, low, high)
+	})
+
+	seen := make([]uint8, len(edges))
+	for {
+		copy(seen, edges)
+		var promoted atomic.Bool
+		forEachTile(bounds, chunkSize, func(tile image.Rectangle) {
+			if traceRect(edges, seen, g, tile) {
+				promoted.Store(true)
+			}
+		})
+		if !promoted.Load() {
+			break
+		}
+	}
+	return edgeImage(edges, bounds)
+}
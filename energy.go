@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// EnergyUsage is the energy one filter run took according to the RAPL
+// counters: Joules per run and the average power over the timed runs.
+// RAPL counts the whole CPU package, so anything else running on the
+// machine is counted too.
+type EnergyUsage struct {
+	Joules float64 `json:"joules"`
+	Watts  float64 `json:"watts"`
+}
+
+// energyNotice logs once why energy is not measured
+var energyNotice sync.Once
+
+// measureRunsEnergy is measureRuns that also reads the RAPL counters
+// around the runs. The energy is nil when the counters cannot be read.
+func measureRunsEnergy(runs int, function func() *image.Gray) ([]time.Duration, *EnergyUsage) {
+	before, err := energySnapshot()
+	if err != nil {
+		energyNotice.Do(func() { slog.Info("energy is not measured", "err", err) })
+		return measureRuns(runs, function), nil
+	}
+	times := measureRuns(runs, function)
+	after, err := energySnapshot()
+	if err != nil {
+		energyNotice.Do(func() { slog.Info("energy is not measured", "err", err) })
+		return times, nil
+	}
+	var total time.Duration
+	for _, elapsed := range times {
+		total += elapsed
+	}
+	joules := energyBetween(before, after)
+	usage := &EnergyUsage{Joules: joules / float64(runs)}
+	if total > 0 {
+		usage.Watts = joules / total.Seconds()
+	}
+	return times, usage
+}
+
+// joules formats an energy in joules, or "-" when it was not measured
+func joules(usage EnergyUsage, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f", usage.Joules)
+}
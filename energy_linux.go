@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// raplZone is one top-level RAPL zone, the package of one socket. Its
+// subzones (cores, uncore) are already part of it and are not read.
+type raplZone struct {
+	energy   string // path of energy_uj
+	maxRange uint64 // value energy_uj wraps at, in microjoules
+}
+
+var (
+	raplOnce  sync.Once
+	raplZones []raplZone
+	raplErr   error
+)
+
+// findRAPLZones lists the package zones under /sys/class/powercap
+func findRAPLZones() ([]raplZone, error) {
+	raplOnce.Do(func() {
+		dirs, _ := filepath.Glob("/sys/class/powercap/intel-rapl:*")
+		for _, dir := range dirs {
+			if strings.Count(filepath.Base(dir), ":") != 1 {
+				continue
+			}
+			maxRange, err := readUint(filepath.Join(dir, "max_energy_range_uj"))
+			if err != nil {
+				raplErr = err
+				return
+			}
+			raplZones = append(raplZones, raplZone{energy: filepath.Join(dir, "energy_uj"), maxRange: maxRange})
+		}
+		if len(raplZones) == 0 {
+			raplErr = errors.New("no RAPL zones in /sys/class/powercap")
+		}
+	})
+	return raplZones, raplErr
+}
+
+func readUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// energySnapshot reads the energy counter of every package in microjoules.
+// Recent kernels only let root read them.
+func energySnapshot() ([]uint64, error) {
+	zones, err := findRAPLZones()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make([]uint64, len(zones))
+	for i, zone := range zones {
+		if snapshot[i], err = readUint(zone.energy); err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// energyBetween returns the joules used between two snapshots, allowing
+// every counter to wrap around once
+func energyBetween(before, after []uint64) float64 {
+	var total uint64
+	for i, zone := range raplZones {
+		if after[i] >= before[i] {
+			total += after[i] - before[i]
+		} else {
+			total += zone.maxRange - before[i] + after[i]
+		}
+	}
+	return float64(total) / 1e6
+}
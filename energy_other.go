@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errRAPL = errors.New("RAPL energy counters are only supported on Linux")
+
+func energySnapshot() ([]uint64, error) {
+	return nil, errRAPL
+}
+
+func energyBetween(before, after []uint64) float64 {
+	return 0
+}
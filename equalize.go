@@ -0,0 +1,230 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// CLAHE splits the image into claheGrid x claheGrid tiles and limits every
+// histogram bin to claheClip times the mean bin height
+const (
+	claheGrid = 8
+	claheClip = 2.0
+)
+
+// equalizeLUT maps every gray level through the normalized cumulative
+// histogram so the output levels are spread over the full 0-255 range
+func equalizeLUT(histogram *[256]int) [256]uint8 {
+	var lut [256]uint8
+	total, cdfMin := 0, 0
+	for _, count := range histogram {
+		if cdfMin == 0 {
+			cdfMin = count
+		}
+		total += count
+	}
+	if total == cdfMin {
+		// A single gray level, nothing to spread
+		for level := range lut {
+			lut[level] = uint8(level)
+		}
+		return lut
+	}
+
+	cdf := 0
+	for level, count := range histogram {
+		cdf += count
+		if cdf < cdfMin {
+			continue
+		}
+		lut[level] = uint8(math.Round(float64(cdf-cdfMin) * 255 / float64(total-cdfMin)))
+	}
+	return lut
+}
+
+// addHistogram counts the gray levels of rect into histogram
+func addHistogram(histogram *[256]int, img *image.Gray, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for _, v := range img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)] {
+			histogram[v]++
+		}
+	}
+}
+
+// applyLUT writes lut[img] into output for every pixel of rect
+func applyLUT(output, img *image.Gray, rect image.Rectangle, lut *[256]uint8) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		in := img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)]
+		out := output.Pix[output.PixOffset(rect.Min.X, y):output.PixOffset(rect.Max.X, y)]
+		for i, v := range in {
+			out[i] = lut[v]
+		}
+	}
+}
+
+// Histogram Equalization (Sequential)
+func equalizeSequential(img *image.Gray) *image.Gray {
+	var histogram [256]int
+	addHistogram(&histogram, img, img.Bounds())
+	lut := equalizeLUT(&histogram)
+
+	output := GetGray(img.Bounds())
+	applyLUT(output, img, img.Bounds(), &lut)
+	return output
+}
+
+// Histogram Equalization (Parallel)
+// Every tile builds a partial histogram, the partials are merged into the
+// lookup table and the tiles then apply it concurrently
+func equalizeParallel(img *image.Gray, chunkSize int) *image.Gray {
+	var histogram [256]int
+	var mu sync.Mutex
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		var partial [256]int
+		addHistogram(&partial, img, tile)
+		mu.Lock()
+		for level, count := range partial {
+			histogram[level] += count
+		}
+		mu.Unlock()
+	})
+	lut := equalizeLUT(&histogram)
+
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		applyLUT(output, img, tile, &lut)
+	})
+	return output
+}
+
+// claheTiling describes the grid of contextual regions CLAHE equalizes independently
+type claheTiling struct {
+	bounds       image.Rectangle
+	cols, rows   int
+	tileW, tileH float64
+}
+
+func newClaheTiling(bounds image.Rectangle) claheTiling {
+	t := claheTiling{
+		bounds: bounds,
+		cols:   max(1, min(claheGrid, bounds.Dx())),
+		rows:   max(1, min(claheGrid, bounds.Dy())),
+	}
+	t.tileW = float64(bounds.Dx()) / float64(t.cols)
+	t.tileH = float64(bounds.Dy()) / float64(t.rows)
+	return t
+}
+
+// tile returns the pixels of the region in column col and row row
+func (t claheTiling) tile(col, row int) image.Rectangle {
+	return image.Rect(
+		t.bounds.Min.X+col*t.bounds.Dx()/t.cols, t.bounds.Min.Y+row*t.bounds.Dy()/t.rows,
+		t.bounds.Min.X+(col+1)*t.bounds.Dx()/t.cols, t.bounds.Min.Y+(row+1)*t.bounds.Dy()/t.rows,
+	)
+}
+
+// claheLUT equalizes one region with its histogram clipped at claheClip times
+// the mean bin height. The clipped counts are spread evenly over every bin.
+func claheLUT(img *image.Gray, rect image.Rectangle) [256]uint8 {
+	var histogram [256]int
+	addHistogram(&histogram, img, rect)
+	area := rect.Dx() * rect.Dy()
+
+	limit := max(1, int(claheClip*float64(area)/256))
+	excess := 0
+	for level, count := range histogram {
+		if count > limit {
+			excess += count - limit
+			histogram[level] = limit
+		}
+	}
+	for level := range histogram {
+		histogram[level] += excess / 256
+		if level < excess%256 {
+			histogram[level]++
+		}
+	}
+
+	var lut [256]uint8
+	cdf := 0
+	for level, count := range histogram {
+		cdf += count
+		lut[level] = uint8(cdf * 255 / area)
+	}
+	return lut
+}
+
+// claheNeighbors returns the two region indices around position pos (in pixels
+// from the start of the axis) and the weight of the second one
+func claheNeighbors(pos int, size float64, count int) (int, int, float64) {
+	g := (float64(pos)+0.5)/size - 0.5
+	lo := int(math.Floor(g))
+	weight := g - float64(lo)
+	if lo < 0 {
+		return 0, 0, 0
+	}
+	if lo >= count-1 {
+		return count - 1, count - 1, 0
+	}
+	return lo, lo + 1, weight
+}
+
+// claheInterpolate maps every pixel of rect through the lookup tables of the
+// four nearest regions, weighted bilinearly by distance to their centers
+func claheInterpolate(output, img *image.Gray, rect image.Rectangle, t claheTiling, luts [][256]uint8) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		r0, r1, wy := claheNeighbors(y-t.bounds.Min.Y, t.tileH, t.rows)
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c0, c1, wx := claheNeighbors(x-t.bounds.Min.X, t.tileW, t.cols)
+			v := img.Pix[img.PixOffset(x, y)]
+			top := (1-wx)*float64(luts[r0*t.cols+c0][v]) + wx*float64(luts[r0*t.cols+c1][v])
+			bottom := (1-wx)*float64(luts[r1*t.cols+c0][v]) + wx*float64(luts[r1*t.cols+c1][v])
+			output.Pix[output.PixOffset(x, y)] = uint8(math.Round((1-wy)*top + wy*bottom))
+		}
+	}
+}
+
+// Contrast-Limited Adaptive Histogram Equalization (Sequential)
+func claheSequential(img *image.Gray) *image.Gray {
+	t := newClaheTiling(img.Bounds())
+	buf := lutPool.get(t.rows * t.cols)
+	defer lutPool.put(t.rows*t.cols, buf)
+	luts := *buf
+	for row := 0; row < t.rows; row++ {
+		for col := 0; col < t.cols; col++ {
+			luts[row*t.cols+col] = claheLUT(img, t.tile(col, row))
+		}
+	}
+
+	output := GetGray(img.Bounds())
+	claheInterpolate(output, img, img.Bounds(), t, luts)
+	return output
+}
+
+// Contrast-Limited Adaptive Histogram Equalization (Parallel)
+// Each CLAHE region builds its lookup table in its own goroutine, then the
+// interpolation runs over the usual chunkSize tiles
+func claheParallel(img *image.Gray, chunkSize int) *image.Gray {
+	t := newClaheTiling(img.Bounds())
+	buf := lutPool.get(t.rows * t.cols)
+	defer lutPool.put(t.rows*t.cols, buf)
+	luts := *buf
+	var wg sync.WaitGroup
+	for row := 0; row < t.rows; row++ {
+		for col := 0; col < t.cols; col++ {
+			wg.Add(1)
+			go func(col, row int) {
+				defer wg.Done()
+				luts[row*t.cols+col] = claheLUT(img, t.tile(col, row))
+			}(col, row)
+		}
+	}
+	wg.Wait()
+
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		claheInterpolate(output, img, tile, t, luts)
+	})
+	return output
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kodakBaseURL is where the benchmark's copy of the Kodak Lossless True
+// Color Image Suite is hosted: the noisy re-encodings in this repository's
+// dataset folder, not the clean originals, which have other hashes
+const kodakBaseURL = "https://raw.githubusercontent.com/Diego-Paris/hpc_final/main/dataset/"
+
+// kodakChecksums are the SHA-256 hashes of the images in dataset/, the ones
+// the benchmark was developed against
+var kodakChecksums = map[string]string{
+	"kodim01.png": "cdd1ee470df13388267e9ea0e1b116b20f8a70f4192415c7124901bf4a8e6f61",
+	"kodim02.png": "d3c763d0c00fb2692b2ff2daf2c3bb07a5697ea0eaab8461571826a91e85a6b6",
+	"kodim03.png": "987b3d0db94d5f3a9125f9e0f130bf543974d1d6548f2a1e6685d97292a4d613",
+	"kodim04.png": "c2d66d30f9c9f4c2ee6abc58a4dd19fa8824d55174a64b2f27bf9eb94a09e787",
+	"kodim05.png": "10d8faed4a306a3f1289c5ec323fefcafb764ae52b19be92ea380570824535b2",
+	"kodim06.png": "67dabc082705b34a34c74babf04fcbde2de0b3c0c3ce6cc97f645ee876a15576",
+	"kodim07.png": "ff5601acc2b6f51214e134fd7690cb875e18b6f173f07f9fda53fcab07006743",
+	"kodim08.png": "7973b59056cc354ff11479dbad6e63daefe9f53acff9d26401ed6da157f9e235",
+	"kodim09.png": "a6d377b230a945ea77c6164943685cb4cbe0c6da12ebba25f06d74fbf4d717d5",
+	"kodim10.png": "7094d2b6883f73b19d880847fa4ab43ef97e180e1548b28ba8f8618554727c28",
+	"kodim11.png": "f50ef86757f779088f21bdaa9638bf9bcd2cf555fc15f7fe011a99991c31f8fd",
+	"kodim12.png": "ed83f9ea03ea02fb7f162c0e10846194cbc6b149a91129377486ce52c8a339d7",
+	"kodim13.png": "3b8e7060aa727f62bb700789de19620c712da1439f546c1d6a5ad732403bd2f6",
+	"kodim14.png": "05579db314d975ce28c5d0f6563a2b7ad2853f26dcc6d7c54473e6294e6b9f28",
+	"kodim15.png": "6c38b09efbe94c26dda84411eaec305f97f5867013191814a924448f71ee0db2",
+	"kodim16.png": "d152058a76b56474d693fe69968a6822c4da2e48bdea7a11ecf70b68bd75325d",
+	"kodim17.png": "b4fa0a577cce41a142b689f2ca44b5a7cd84899d7258cd31377a493690063bce",
+	"kodim18.png": "8b76f53e32256dafca41fc7a1800d2ffd54c04f5df83478bc17b3c902ca2ffc8",
+	"kodim19.png": "ed6e178a3cbfc0920f751e020a400e976d66bc75604432a1e1194febf8118bbb",
+	"kodim20.png": "31dfb1e1926183634946d6ace34087d75124c19433900645fa35276a74e15092",
+	"kodim21.png": "907e5033d11be04fde00df22a4d68128270c6fe32c70643ee19fa1c74a8125ac",
+	"kodim22.png": "1899856d6f5499c3d505ad341ffdc71fbe2f0401893f41dc6ec4b662723ef7aa",
+	"kodim23.png": "8499a488c1f4e36ff5cbeb354ebda5643fab189ec50cc7ca0c53a2c5eb2f3baa",
+	"kodim24.png": "35f172663dcb78093efa069c65a54e387065870216c9498a981d3c6cfe7aabdc",
+}
+
+// downloadItem is one file to fetch. SHA256 may be empty for URL lists
+// without checksums, in which case the file is downloaded but not verified.
+type downloadItem struct {
+	URL    string
+	Name   string
+	SHA256 string
+}
+
+// kodakItems returns the 24 Kodak images hosted under base
+func kodakItems(base string) []downloadItem {
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	var items []downloadItem
+	for name, sum := range kodakChecksums {
+		items = append(items, downloadItem{URL: base + name, Name: name, SHA256: sum})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items
+}
+
+// readURLList parses a file with one "URL [sha256]" entry per line. Blank
+// lines and lines starting with # are ignored.
+func readURLList(filename string) ([]downloadItem, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []downloadItem
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"URL [sha256]\"", filename, line)
+		}
+		item := downloadItem{URL: fields[0], Name: path.Base(fields[0])}
+		if len(fields) == 2 {
+			item.SHA256 = strings.ToLower(fields[1])
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// fetcher downloads files into dir, keeping verified copies in cacheDir so
+// other clones and later runs do not hit the network again
+type fetcher struct {
+	dir      string
+	cacheDir string
+	client   *http.Client
+}
+
+// fetch makes sure item is present and valid in f.dir. It returns where the
+// file came from: "present", "cache" or "download".
+func (f *fetcher) fetch(item downloadItem) (string, error) {
+	dest := filepath.Join(f.dir, item.Name)
+	if item.SHA256 != "" {
+		if sum, err := hashFile(dest); err == nil && sum == item.SHA256 {
+			return "present", nil
+		}
+		if f.cacheDir != "" {
+			cached := filepath.Join(f.cacheDir, item.SHA256)
+			if sum, err := hashFile(cached); err == nil && sum == item.SHA256 {
+				return "cache", copyFile(cached, dest)
+			}
+		}
+	} else if _, err := os.Stat(dest); err == nil {
+		return "present", nil
+	}
+
+	if err := f.download(item, dest); err != nil {
+		return "", err
+	}
+	if item.SHA256 != "" && f.cacheDir != "" {
+		if err := copyFile(dest, filepath.Join(f.cacheDir, item.SHA256)); err != nil {
+			slog.Warn("failed to cache download", "image", item.Name, "err", err)
+		}
+	}
+	return "download", nil
+}
+
+// download writes item.URL to dest, verifying the checksum before the file is
+// moved into place so a failed or corrupt download never looks complete
+func (f *fetcher) download(item downloadItem, dest string) error {
+	resp, err := f.client.Get(item.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", item.URL, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(f.dir, item.Name+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("GET %s: %w", item.URL, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); item.SHA256 != "" && sum != item.SHA256 {
+		return fmt.Errorf("%s: checksum mismatch, got %s, want %s", item.Name, sum, item.SHA256)
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0o644)
+}
+
+// runFetchDataset downloads the Kodak suite, or the files of a URL list, into the dataset folder
+func runFetchDataset(args []string) {
+	fs := flag.NewFlagSet("fetch-dataset", flag.ExitOnError)
+	dir := fs.String("dir", "dataset", "folder to download the images into")
+	base := fs.String("base-url", kodakBaseURL, "where the Kodak images are hosted")
+	list := fs.String("list", "", "file with one \"URL [sha256]\" per line to download instead of the Kodak suite")
+	cacheDir := fs.String("cache", defaultCacheDir(), "folder for verified downloads shared between runs (disabled when empty)")
+	parallel := fs.Int("parallel", 4, "number of concurrent downloads")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	items := kodakItems(*base)
+	if *list != "" {
+		var err error
+		if items, err = readURLList(*list); err != nil {
+			fatal("failed to read URL list", "path", *list, "err", err)
+		}
+	}
+	if *parallel < 1 {
+		fatal("parallel must be positive", "parallel", *parallel)
+	}
+
+	for _, folder := range []string{*dir, *cacheDir} {
+		if folder == "" {
+			continue
+		}
+		if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+			fatal("failed to create folder", "path", folder, "err", err)
+		}
+	}
+
+	f := &fetcher{dir: *dir, cacheDir: *cacheDir, client: &http.Client{Timeout: 5 * time.Minute}}
+	sem := make(chan struct{}, *parallel)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+
+	for _, item := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(item downloadItem) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			source, err := f.fetch(item)
+			if err != nil {
+				slog.Error("failed to fetch image", "image", item.Name, "url", item.URL, "err", err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			slog.Info("fetched image", "image", item.Name, "source", source, "duration", time.Since(start))
+		}(item)
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		fatal("some images could not be fetched", "failed", failed, "total", len(items))
+	}
+	slog.Info("dataset is ready", "path", *dir, "images", len(items))
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hpc_final")
+}
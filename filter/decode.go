@@ -0,0 +1,120 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Limits are the checks an input image goes through before a decoder is
+// allowed to allocate its pixels. A zero limit is disabled.
+type Limits struct {
+	MaxBytes  int64 // size of the encoded image
+	MaxPixels int64
+	MaxDim    int // largest width or height
+}
+
+// DefaultLimits only stop inputs no real photo or scan reaches. They are
+// the defaults of Process and of the hpc_final command.
+var DefaultLimits = Limits{
+	MaxBytes:  512 << 20,
+	MaxPixels: 1 << 28,
+	MaxDim:    1 << 16,
+}
+
+// Reasons a DecodeError gives for rejecting an image
+const (
+	RejectFileSize   = "file too large"
+	RejectDimensions = "dimensions too large"
+	RejectPixels     = "too many pixels"
+	RejectEmpty      = "empty image"
+	RejectFormat     = "unknown format"
+	RejectCorrupt    = "corrupt data"
+	RejectPanic      = "decoder panic"
+)
+
+// DecodeError is an input that Limits.Read or Limits.Decode refused or
+// failed to decode. Width and Height are the size from the image header,
+// when it was read.
+type DecodeError struct {
+	Name   string
+	Reason string
+	Width  int
+	Height int
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Width > 0 || e.Height > 0 {
+		return fmt.Sprintf("%s: %s (%dx%d): %v", e.Name, e.Reason, e.Width, e.Height, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Name, e.Reason, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// TooLarge reports whether the image was rejected by a size limit rather
+// than for its contents
+func (e *DecodeError) TooLarge() bool {
+	return e.Reason == RejectFileSize || e.Reason == RejectDimensions || e.Reason == RejectPixels
+}
+
+// Read reads the encoded image name from r, giving up as soon as it passes
+// MaxBytes. Read errors are returned as they are.
+func (l Limits) Read(name string, r io.Reader) ([]byte, error) {
+	if l.MaxBytes <= 0 {
+		return io.ReadAll(r)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, l.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > l.MaxBytes {
+		return nil, &DecodeError{Name: name, Reason: RejectFileSize, Err: fmt.Errorf("more than %d bytes", l.MaxBytes)}
+	}
+	return data, nil
+}
+
+// Decode decodes an image held in memory, returning everything wrong with
+// it as a *DecodeError. The header is read first and checked against the
+// limits, so a small file claiming a huge size, like a PNG decompression
+// bomb, is rejected before its pixels are allocated. Decoders that panic
+// on malformed data are recovered from.
+func (l Limits) Decode(name string, data []byte) (img image.Image, format string, err error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		reason := RejectCorrupt
+		if errors.Is(err, image.ErrFormat) {
+			reason = RejectFormat
+		}
+		return nil, "", &DecodeError{Name: name, Reason: reason, Err: err}
+	}
+	reject := func(reason string, err error) (image.Image, string, error) {
+		return nil, "", &DecodeError{Name: name, Reason: reason, Width: config.Width, Height: config.Height, Err: err}
+	}
+	w, h := config.Width, config.Height
+	switch {
+	case w <= 0 || h <= 0:
+		return reject(RejectEmpty, errors.New("no pixels"))
+	case l.MaxDim > 0 && max(w, h) > l.MaxDim:
+		return reject(RejectDimensions, fmt.Errorf("limit is %d pixels per side", l.MaxDim))
+	case l.MaxPixels > 0 && int64(w)*int64(h) > l.MaxPixels:
+		return reject(RejectPixels, fmt.Errorf("limit is %d pixels", l.MaxPixels))
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			img, format, err = reject(RejectPanic, fmt.Errorf("%v", p))
+		}
+	}()
+	img, format, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return reject(RejectCorrupt, err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(w, h) {
+		return reject(RejectCorrupt, fmt.Errorf("decoded %dx%d pixels", size.X, size.Y))
+	}
+	return img, format, nil
+}
@@ -0,0 +1,25 @@
+package filter
+
+import "image"
+
+// Gray converts img to grayscale with the average of R, G and B, the same
+// conversion the hpc_final command applies before filtering. Grayscale
+// images are copied as they are.
+func Gray(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	if src, ok := img.(*image.Gray); ok {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			copy(gray.Pix[gray.PixOffset(bounds.Min.X, y):][:bounds.Dx()], src.Pix[src.PixOffset(bounds.Min.X, y):])
+		}
+		return gray
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := gray.Pix[gray.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		for x := range row {
+			r, g, b, _ := img.At(bounds.Min.X+x, y).RGBA()
+			row[x] = uint8((r + g + b) / 3 >> 8)
+		}
+	}
+	return gray
+}
@@ -0,0 +1,156 @@
+// Package filter is the median filter of hpc_final as a library. Settings
+// are passed as options and invalid ones are returned as errors:
+//
+//	output, err := filter.Median(img, filter.Kernel(5), filter.Workers(8), filter.Border(filter.Reflect))
+//
+// With the default Crop border and the median percentile the output is
+// pixel for pixel the same as the sequential and parallel median filters of
+// the hpc_final command.
+//
+// Other filters register themselves by name with Register and are run with
+// Run, taking the same options. The median filter is registered as
+// "median".
+package filter
+
+import (
+	"image"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Median filters img with a median filter configured by opts and returns
+// a new image with the same bounds
+func Median(img *image.Gray, opts ...Option) (*image.Gray, error) {
+	return Run("median", img, opts...)
+}
+
+func init() {
+	Register("median", median)
+}
+
+func median(img *image.Gray, c Config) (*image.Gray, error) {
+	output := image.NewGray(img.Bounds())
+	tiles := tileRects(img.Bounds(), c.ChunkSize)
+	run(tiles, c.Workers, c.Schedule, func(tile image.Rectangle) {
+		rankRect(output, img, tile, c)
+	})
+	return output, nil
+}
+
+// tileRects splits bounds into chunkSize x chunkSize tiles, row by row
+func tileRects(bounds image.Rectangle, chunkSize int) []image.Rectangle {
+	var tiles []image.Rectangle
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += chunkSize {
+		for x := bounds.Min.X; x < bounds.Max.X; x += chunkSize {
+			tiles = append(tiles, image.Rect(x, y, x+chunkSize, y+chunkSize).Intersect(bounds))
+		}
+	}
+	return tiles
+}
+
+// run calls fn for every tile on workers goroutines and waits for them
+func run(tiles []image.Rectangle, workers int, schedule ScheduleMode, fn func(tile image.Rectangle)) {
+	workers = min(workers, len(tiles))
+	if workers <= 1 {
+		for _, tile := range tiles {
+			fn(tile)
+		}
+		return
+	}
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			if schedule == Static {
+				for _, tile := range tiles[len(tiles)*w/workers : len(tiles)*(w+1)/workers] {
+					fn(tile)
+				}
+				return
+			}
+			for i := next.Add(1) - 1; i < int64(len(tiles)); i = next.Add(1) - 1 {
+				fn(tiles[i])
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// Sources of a window position that is not a pixel of the image
+const (
+	skip  = -1 // left out of the window (Crop)
+	black = -2 // read as 0 (Zero)
+)
+
+// borderIndex maps position i of an axis of length n, which may lie outside
+// [0, n), to the position read for it, or to skip or black
+func borderIndex(i, n int, border BorderMode) int {
+	if i >= 0 && i < n {
+		return i
+	}
+	switch border {
+	case Replicate:
+		return min(max(i, 0), n-1)
+	case Reflect:
+		if n == 1 {
+			return 0
+		}
+		// Mirror with period 2(n-1), so -1 reads 1 and n reads n-2
+		period := 2 * (n - 1)
+		i = ((i % period) + period) % period
+		if i >= n {
+			i = period - i
+		}
+		return i
+	case Zero:
+		return black
+	}
+	return skip
+}
+
+// rankRect writes the configured percentile of the window of every pixel of
+// rect to output
+func rankRect(output, img *image.Gray, rect image.Rectangle, c Config) {
+	bounds := img.Bounds()
+	radius := c.Kernel / 2
+
+	// Where every column and row the windows of rect touch is read from,
+	// relative to the image
+	cols := make([]int, rect.Dx()+2*radius)
+	for i := range cols {
+		cols[i] = borderIndex(rect.Min.X-radius+i-bounds.Min.X, bounds.Dx(), c.Border)
+	}
+	rows := make([]int, rect.Dy()+2*radius)
+	for i := range rows {
+		rows[i] = borderIndex(rect.Min.Y-radius+i-bounds.Min.Y, bounds.Dy(), c.Border)
+	}
+
+	window := make([]uint8, 0, c.Kernel*c.Kernel)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		dst := output.Pix[output.PixOffset(rect.Min.X, y):][:rect.Dx()]
+		windowRows := rows[y-rect.Min.Y:][:c.Kernel]
+		for x := range dst {
+			window = window[:0]
+			for _, row := range windowRows {
+				if row == skip {
+					continue
+				}
+				for _, col := range cols[x:][:c.Kernel] {
+					switch {
+					case col == skip:
+					case row == black || col == black:
+						window = append(window, 0)
+					default:
+						window = append(window, img.Pix[row*img.Stride+col])
+					}
+				}
+			}
+			slices.Sort(window)
+			dst[x] = window[int(math.Round(c.Percentile/100*float64(len(window)-1)))]
+		}
+	}
+}
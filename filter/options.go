@@ -0,0 +1,193 @@
+package filter
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// BorderMode is how windows reaching past the edge of the image are filled
+type BorderMode int
+
+const (
+	// Crop clips windows to the image, so border pixels take the median of
+	// fewer values. This is what the hpc_final command line filters do.
+	Crop BorderMode = iota
+	// Replicate repeats the nearest edge pixel
+	Replicate
+	// Reflect mirrors the image about its edge pixels, so the pixel one
+	// past the edge reads the pixel one inside it
+	Reflect
+	// Zero reads black outside the image
+	Zero
+)
+
+var borderNames = map[BorderMode]string{Crop: "crop", Replicate: "replicate", Reflect: "reflect", Zero: "zero"}
+
+func (b BorderMode) String() string {
+	if name, ok := borderNames[b]; ok {
+		return name
+	}
+	return fmt.Sprintf("BorderMode(%d)", int(b))
+}
+
+// ParseBorder returns the border mode named crop, replicate, reflect or zero
+func ParseBorder(name string) (BorderMode, error) {
+	for b, n := range borderNames {
+		if n == name {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("filter: unknown border %q, use crop, replicate, reflect or zero", name)
+}
+
+// ScheduleMode is how the tiles of the image are handed out to the workers
+type ScheduleMode int
+
+const (
+	// Dynamic lets every worker take the next unfiltered tile when it is
+	// done with the previous one
+	Dynamic ScheduleMode = iota
+	// Static gives each worker an equal contiguous run of tiles up front
+	Static
+)
+
+// Config holds the settings the options change. Filters registered with
+// Register receive it with every option already applied.
+type Config struct {
+	Kernel     int
+	Workers    int
+	ChunkSize  int
+	Border     BorderMode
+	Schedule   ScheduleMode
+	Percentile float64
+	// Filter is the registered filter Process runs. Run and Median ignore
+	// it since they are given the filter to run.
+	Filter string
+	// Limits are the checks Process runs on its input before decoding it.
+	// Run and Median ignore them since they are given a decoded image.
+	Limits Limits
+}
+
+// NewConfig applies opts on top of the defaults and returns the first
+// invalid one as an error
+func NewConfig(opts ...Option) (Config, error) {
+	c := Config{
+		Kernel:     3,
+		Workers:    runtime.GOMAXPROCS(0),
+		ChunkSize:  45,
+		Border:     Crop,
+		Schedule:   Dynamic,
+		Percentile: 50,
+		Filter:     "median",
+		Limits:     DefaultLimits,
+	}
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return Config{}, err
+		}
+	}
+	return c, nil
+}
+
+// Option changes one setting of a filter. Invalid values are reported as an
+// error by the filter they are passed to.
+type Option func(*Config) error
+
+// Kernel sets the width and height of the window, a positive odd number.
+// The default is 3.
+func Kernel(size int) Option {
+	return func(c *Config) error {
+		if size < 1 || size%2 == 0 {
+			return fmt.Errorf("filter: kernel size must be a positive odd number, got %d", size)
+		}
+		c.Kernel = size
+		return nil
+	}
+}
+
+// Workers sets how many goroutines filter the image. 1 filters it on the
+// calling goroutine. The default is GOMAXPROCS.
+func Workers(n int) Option {
+	return func(c *Config) error {
+		if n < 1 {
+			return fmt.Errorf("filter: workers must be positive, got %d", n)
+		}
+		c.Workers = n
+		return nil
+	}
+}
+
+// ChunkSize sets the side of the square tiles the workers filter. The
+// default is 45.
+func ChunkSize(n int) Option {
+	return func(c *Config) error {
+		if n < 1 {
+			return fmt.Errorf("filter: chunk size must be positive, got %d", n)
+		}
+		c.ChunkSize = n
+		return nil
+	}
+}
+
+// Border sets how windows are filled past the edge of the image. The
+// default is Crop.
+func Border(b BorderMode) Option {
+	return func(c *Config) error {
+		if _, ok := borderNames[b]; !ok {
+			return fmt.Errorf("filter: unknown border %v", b)
+		}
+		c.Border = b
+		return nil
+	}
+}
+
+// Schedule sets how tiles are handed out to the workers. The default is
+// Dynamic.
+func Schedule(s ScheduleMode) Option {
+	return func(c *Config) error {
+		if s != Dynamic && s != Static {
+			return fmt.Errorf("filter: unknown schedule %d", int(s))
+		}
+		c.Schedule = s
+		return nil
+	}
+}
+
+// Percentile makes the filter keep the given percentile of every window
+// instead of the median: 0 is a minimum filter, 100 a maximum filter. The
+// value kept is the one at index round(p/100*(n-1)) of the n sorted values.
+// The default is 50.
+func Percentile(p float64) Option {
+	return func(c *Config) error {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("filter: percentile must be between 0 and 100, got %g", p)
+		}
+		c.Percentile = p
+		return nil
+	}
+}
+
+// Use sets the registered filter Process and ProcessBytes run. The default is
+// "median".
+func Use(name string) Option {
+	return func(c *Config) error {
+		if !Registered(name) {
+			return fmt.Errorf("filter: unknown filter %q, registered: %v", name, Names())
+		}
+		c.Filter = name
+		return nil
+	}
+}
+
+// DecodeLimits sets the checks Process and ProcessBytes run on the encoded
+// image before its pixels are allocated. The default is DefaultLimits, and
+// Limits{} turns every check off.
+func DecodeLimits(l Limits) Option {
+	return func(c *Config) error {
+		if l.MaxBytes < 0 || l.MaxPixels < 0 || l.MaxDim < 0 {
+			return fmt.Errorf("filter: decode limits must not be negative, got %+v", l)
+		}
+		c.Limits = l
+		return nil
+	}
+}
@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Process reads a PNG or JPEG image from r, filters its grayscale version
+// with the filter picked by Use, median by default, and writes the result
+// to w as a PNG. Nothing touches the file system, so it can run inside a
+// server handler or a test on in-memory data:
+//
+//	err := filter.Process(req.Body, w, filter.Kernel(5))
+//
+// Other formats can be read once their decoder is registered with
+// image.RegisterFormat. The input goes through the checks set by
+// DecodeLimits first, so an untrusted upload such as a PNG decompression
+// bomb is returned as a *DecodeError before its pixels are allocated.
+func Process(r io.Reader, w io.Writer, opts ...Option) error {
+	c, err := NewConfig(opts...)
+	if err != nil {
+		return err
+	}
+	data, err := c.Limits.Read("image", r)
+	if err != nil {
+		return fmt.Errorf("filter: failed to read image: %w", err)
+	}
+	img, _, err := c.Limits.Decode("image", data)
+	if err != nil {
+		return fmt.Errorf("filter: failed to decode image: %w", err)
+	}
+	output, err := runConfig(c.Filter, Gray(img), c)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(w, output); err != nil {
+		return fmt.Errorf("filter: failed to encode image: %w", err)
+	}
+	return nil
+}
+
+// ProcessBytes is Process for an image already in memory, returning the
+// encoded PNG
+func ProcessBytes(data []byte, opts ...Option) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Process(bytes.NewReader(data), &buf, opts...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FilterBytes is Run for an image that is neither decoded nor encoded: pix
+// holds width x height gray levels row by row, and the filtered levels are
+// returned the same way
+func FilterBytes(pix []byte, width, height int, name string, opts ...Option) ([]byte, error) {
+	if width < 0 || height < 0 || len(pix) != width*height {
+		return nil, fmt.Errorf("filter: %d bytes is not a %dx%d image", len(pix), width, height)
+	}
+	img := &image.Gray{Pix: pix, Stride: width, Rect: image.Rect(0, 0, width, height)}
+	output, err := Run(name, img, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return output.Pix, nil
+}
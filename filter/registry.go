@@ -0,0 +1,82 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+)
+
+// Func is a filter that can be registered. It gets the options of the call
+// already applied on top of the defaults, and must return a new image
+// instead of changing img.
+type Func func(img *image.Gray, c Config) (*image.Gray, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Func{}
+)
+
+// Register makes fn available under name to Run and to everything that
+// lists the filters with Names, such as the -filter flag of the hpc_final
+// command. It is meant to be called from an init function, like
+//
+//	func init() {
+//		filter.Register("blur", blur)
+//	}
+//
+// and panics when name is empty, fn is nil or name is already taken.
+func Register(name string, fn Func) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" || fn == nil {
+		panic("filter: Register needs a name and a function")
+	}
+	if _, ok := registry[name]; ok {
+		panic("filter: Register called twice for " + name)
+	}
+	registry[name] = fn
+}
+
+// Names returns the names of every registered filter, sorted
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Registered reports whether a filter is registered under name
+func Registered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	_, ok := registry[name]
+	return ok
+}
+
+// Run filters img with the filter registered under name, configured by opts
+func Run(name string, img *image.Gray, opts ...Option) (*image.Gray, error) {
+	c, err := NewConfig(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return runConfig(name, img, c)
+}
+
+func runConfig(name string, img *image.Gray, c Config) (*image.Gray, error) {
+	registryMu.RLock()
+	fn, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("filter: unknown filter %q, registered: %v", name, Names())
+	}
+	if img == nil {
+		return nil, errors.New("filter: nil image")
+	}
+	return fn(img, c)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"hpc_final/filter"
+)
+
+// openInput opens path for reading, or stdin when path is "-"
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// createOutput creates path for writing, or returns stdout when path is "-"
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// outputFormat picks the format to write: the -format flag, then the
+// extension of the output path, then the format the input was decoded from.
+// JPEG inputs are written as PNG since there is no lossless JPEG.
+func outputFormat(flagValue, path, inputFormat string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if path != "-" {
+		if ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."); validOutputFormat(ext) && ext != "" {
+			return ext
+		}
+	}
+	if validOutputFormat(inputFormat) {
+		return inputFormat
+	}
+	return "png"
+}
+
+// runFilter filters a single image, reading it from a file or stdin and
+// writing the result to a file or stdout, so it can sit in a shell pipeline:
+//
+//	curl -s https://example.com/scan.png | hpc_final filter -kernel 5 - - | display
+func runFilter(args []string) {
+	fs := flag.NewFlagSet("filter", flag.ExitOnError)
+	kernelFlag := fs.String("kernel", "3", "median window size, must be odd, or auto to pick it from the estimated noise of the image")
+	name := fs.String("filter", "median", "registered filter to run: "+strings.Join(filter.Names(), ", "))
+	mode := fs.String("mode", "parallel", "filter variant: sequential, parallel, halo (parallel with private tile copies), numa (parallel with per-node bands) or simd (median filter only)")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	format := fs.String("format", "", "output format: png, pgm or ppm (default: from the output extension, else the input's format)")
+	roiSpec := fs.String("roi", "", "only filter this region, given as x,y,width,height")
+	borderName := fs.String("border", "crop", "how windows past the edge are filled: crop, replicate, reflect or zero")
+	percentile := fs.Float64("percentile", 50, "percentile of every window the median and rank filters keep: 0 is a minimum filter, 100 a maximum filter")
+	dither := fs.String("dither", "", "dither the filtered image to 1-bit black and white: floyd (Floyd-Steinberg error diffusion) or ordered (8x8 Bayer matrix)")
+	metadata := fs.String("metadata", "keep", "what to do with the EXIF, ICC profile and text chunks of the input: keep (in PNG output) or strip")
+	resize := addResizeFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hpc_final filter [flags] <input|-> <output|->")
+		fs.PrintDefaults()
+	}
+	addDecodeFlags(fs, false)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	inputPath, outputPath := fs.Arg(0), fs.Arg(1)
+	if !validOutputFormat(*format) {
+		fatal("unknown output format, use png, pgm or ppm", "format", *format)
+	}
+	border, err := filter.ParseBorder(*borderName)
+	if err != nil {
+		fatal("invalid border", "err", err)
+	}
+	if *metadata != "keep" && *metadata != "strip" {
+		fatal("unknown metadata handling, use keep or strip", "metadata", *metadata)
+	}
+	if err := resize.validate(); err != nil {
+		fatal("invalid resize options", "err", err)
+	}
+	if _, ok := ditherers[*dither]; *dither != "" && !ok {
+		fatal("unknown dithering, use floyd or ordered", "dither", *dither)
+	}
+	if !filter.Registered(*name) {
+		fatal("unknown filter", "filter", *name, "known", filter.Names())
+	}
+	if *percentile < 0 || *percentile > 100 {
+		fatal("percentile must be between 0 and 100", "percentile", *percentile)
+	}
+	kernel, err := parseKernel(*kernelFlag)
+	if err != nil {
+		fatal("invalid kernel", "err", err)
+	}
+	job := filterJob{mode: *mode, filter: *name, chunkSize: *chunkSize, border: border, percentile: *percentile}
+	if *roiSpec != "" {
+		if job.roi, err = parseROI(*roiSpec); err != nil {
+			fatal("invalid region", "err", err)
+		}
+	}
+
+	in, err := openInput(inputPath)
+	if err != nil {
+		fatal("failed to open input", "path", inputPath, "err", err)
+	}
+	// The whole file is kept for its metadata. image.Decode sniffs the magic
+	// bytes, so the format does not depend on the file name and stdin works
+	// the same as a file.
+	data, err := readInput(inputPath, in)
+	in.Close()
+	if err != nil {
+		fatal("failed to read input", "path", inputPath, "err", err)
+	}
+	img, inputFormat, err := decodeBytes(inputPath, data)
+	if err != nil {
+		fatal("failed to decode input", "path", inputPath, "err", err)
+	}
+	meta := readMetadata(data)
+
+	gray, alpha := splitAlpha(img)
+	gray = orient(gray, meta.Orientation)
+	if alpha != nil {
+		alpha = orient(alpha, meta.Orientation)
+	}
+	if resize.enabled() {
+		gray = resize.apply(gray, *chunkSize)
+		if alpha != nil {
+			alpha = resize.apply(alpha, *chunkSize)
+		}
+	}
+	job.kernel = autoKernel(gray, kernel, inputPath)
+	start := time.Now()
+	output, err := job.run(gray)
+	if err != nil {
+		fatal("failed to filter image", "err", err)
+	}
+	elapsed := time.Since(start)
+	slog.Debug("filtered image", "image", inputPath, "stage", *mode, "duration", elapsed)
+
+	var result image.Image = output
+	if *dither != "" {
+		start := time.Now()
+		output = ditherers[*dither](output, *chunkSize)
+		slog.Debug("dithered image", "image", inputPath, "stage", *dither, "duration", time.Since(start))
+		result = oneBit(output)
+	}
+	if alpha != nil {
+		result = mergeAlpha(output, alpha)
+	}
+	outFormat := outputFormat(*format, outputPath, inputFormat)
+	out, err := createOutput(outputPath)
+	if err != nil {
+		fatal("failed to create output", "path", outputPath, "err", err)
+	}
+	w := bufio.NewWriter(out)
+	if *metadata == "strip" {
+		meta = imageMetadata{}
+	}
+	if err := encodeWithMetadata(w, result, outFormat, meta); err != nil {
+		fatal("failed to encode output", "path", outputPath, "err", err)
+	}
+	if err := w.Flush(); err != nil {
+		fatal("failed to write output", "path", outputPath, "err", err)
+	}
+	if err := out.Close(); err != nil {
+		fatal("failed to write output", "path", outputPath, "err", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"hpc_final/filter"
+)
+
+// The ops operations are registered as filters too, so the filter
+// subcommand and the benchmark can run them by name. The kernel size sets
+// the structuring element of the morphology operations, the window of the
+// rank filter and the largest window of the adaptive median, the
+// percentile sets the rank it keeps, and everything else uses the ops
+// defaults. One worker runs the sequential variant, more the parallel one.
+func init() {
+	for _, name := range operationNames() {
+		if filter.Registered(name) {
+			continue
+		}
+		name := name
+		filter.Register(name, func(img *image.Gray, c filter.Config) (*image.Gray, error) {
+			op, err := registeredOperation(name, c)
+			if err != nil {
+				return nil, err
+			}
+			if c.Workers == 1 {
+				return op.sequential(img), nil
+			}
+			return op.parallel(img, c.ChunkSize), nil
+		})
+	}
+}
+
+// registeredOperation configures the ops operation name from the options of
+// a filter call
+func registeredOperation(name string, c filter.Config) (operation, error) {
+	if c.Border != filter.Crop {
+		return operation{}, fmt.Errorf("%s only supports the crop border", name)
+	}
+	cfg := opsConfig{
+		cannyLow:         50,
+		cannyHigh:        150,
+		bilateralSpatial: 3,
+		bilateralRange:   30,
+		gaussianSigma:    2,
+		rankRadius:       c.Kernel / 2,
+		rankPercentile:   c.Percentile,
+		adaptiveMax:      c.Kernel,
+		pyramidLevels:    4,
+		pyramidThreshold: 10,
+	}
+	var err error
+	if cfg.element, err = newStructuringElement("square", c.Kernel); err != nil {
+		return operation{}, err
+	}
+	if cfg.weights, err = parseWeightMask("1,1,1,1,3,1,1,1,1"); err != nil {
+		return operation{}, err
+	}
+	op, _ := findOperation(cfg, name)
+	return op, nil
+}
@@ -0,0 +1,304 @@
+//go:build grpc
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// tileCodec encodes the tile messages with their hand written protobuf
+// encoding. It is named "proto" so clients generated from tiles.proto, in
+// any language, talk to the server as they would to a generated one.
+type tileCodec struct{}
+
+func (tileCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(tileMessage)
+	if !ok {
+		return nil, fmt.Errorf("tile codec cannot encode %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (tileCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(tileMessage)
+	if !ok {
+		return fmt.Errorf("tile codec cannot decode %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (tileCodec) Name() string { return "proto" }
+
+// tileFilterServer is the TileFilter service of tiles.proto
+type tileFilterServer interface {
+	Filter(stream grpc.ServerStream) error
+}
+
+var tileFilterService = grpc.ServiceDesc{
+	ServiceName: "hpc_final.TileFilter",
+	HandlerType: (*tileFilterServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Filter",
+		Handler:       func(srv any, stream grpc.ServerStream) error { return srv.(tileFilterServer).Filter(stream) },
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+	Metadata: "tiles.proto",
+}
+
+const tileFilterMethod = "/hpc_final.TileFilter/Filter"
+
+// tileServer filters the tiles of every stream on up to workers goroutines
+// at a time
+type tileServer struct {
+	workers int
+}
+
+// Filter receives tiles until the client closes its side of the stream and
+// sends every tile back as soon as it is filtered. A tile that cannot be
+// filtered ends the stream with InvalidArgument.
+func (s *tileServer) Filter(stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	replies := make(chan *TileReply)
+	failed := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(replies)
+		}()
+		sem := make(chan struct{}, s.workers)
+		for {
+			req := new(TileRequest)
+			if err := stream.RecvMsg(req); err == io.EOF {
+				return
+			} else if err != nil {
+				fail(err)
+				return
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				idle := filterMetrics.WorkerBusy()
+				reply, err := filterTile(req)
+				idle()
+				if err != nil {
+					fail(status.Error(codes.InvalidArgument, err.Error()))
+					return
+				}
+				filterMetrics.Observe("tile", len(reply.Pix), reply.Elapsed)
+				select {
+				case replies <- reply:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}()
+
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				select {
+				case err := <-failed:
+					return err
+				default:
+					return nil
+				}
+			}
+			if err := stream.SendMsg(reply); err != nil {
+				return err
+			}
+		case err := <-failed:
+			return err
+		}
+	}
+}
+
+// runTileServer serves the TileFilter gRPC service until the process is
+// killed
+func runTileServer(args []string) {
+	fs := flag.NewFlagSet("tile-server", flag.ExitOnError)
+	addr := fs.String("addr", ":9090", "address to accept gRPC connections on")
+	workers := fs.Int("workers", runtime.GOMAXPROCS(0), "tiles filtered at the same time per stream")
+	metricsAddr := fs.String("metrics", "", "address to expose Prometheus /metrics on (disabled when empty)")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if *workers < 1 {
+		fatal("workers must be positive", "workers", *workers)
+	}
+	filterMetrics.SetWorkers(*workers)
+	serveMetrics(*metricsAddr)
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fatal("failed to listen", "addr", *addr, "err", err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(tileCodec{}))
+	server.RegisterService(&tileFilterService, &tileServer{workers: *workers})
+	slog.Info("tile server listening", "addr", ln.Addr().String(), "workers", *workers)
+	if err := server.Serve(ln); err != nil {
+		fatal("tile server stopped", "err", err)
+	}
+}
+
+// filterRemote streams the tiles of img to a tile server and assembles the
+// filtered image from the replies. The tiles are sent while the replies
+// come in, so the server never waits for the client to finish uploading.
+func filterRemote(ctx context.Context, conn *grpc.ClientConn, img *image.Gray, tileSize, kernel int) (*image.Gray, time.Duration, error) {
+	stream, err := conn.NewStream(ctx, &tileFilterService.Streams[0], tileFilterMethod)
+	if err != nil {
+		return nil, 0, err
+	}
+	requests := tileRequests(img, tileSize, kernel)
+	sent := make(chan error, 1)
+	go func() {
+		for _, req := range requests {
+			if err := stream.SendMsg(req); err != nil {
+				// The reason comes back from RecvMsg
+				sent <- nil
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+
+	bounds := img.Bounds()
+	output := GetGray(bounds)
+	var compute time.Duration
+	for received := 0; received < len(requests); received++ {
+		reply := new(TileReply)
+		if err := stream.RecvMsg(reply); err != nil {
+			PutGray(output)
+			if err == io.EOF {
+				err = fmt.Errorf("server closed the stream after %d of %d tiles", received, len(requests))
+			}
+			return nil, 0, err
+		}
+		tile := reply.Tile.Add(bounds.Min)
+		if !tile.In(bounds) || len(reply.Pix) != tile.Dx()*tile.Dy() {
+			PutGray(output)
+			return nil, 0, fmt.Errorf("tile %d: got %d pixels for tile %v", reply.ID, len(reply.Pix), reply.Tile)
+		}
+		copyRect(output, &image.Gray{Pix: reply.Pix, Stride: tile.Dx(), Rect: tile}, tile)
+		compute += reply.Elapsed
+	}
+	if err := <-sent; err != nil {
+		PutGray(output)
+		return nil, 0, err
+	}
+	return output, compute, nil
+}
+
+// runTileClient filters one image on a tile server, shipping it tile by
+// tile instead of as a whole
+func runTileClient(args []string) {
+	fs := flag.NewFlagSet("tile-client", flag.ExitOnError)
+	server := fs.String("server", "localhost:9090", "address of the tile server")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	tileSize := fs.Int("tile", 256, "width and height of the tiles sent to the server")
+	format := fs.String("format", "", "output format: png, pgm or ppm (default: from the output extension, else the input's format)")
+	verify := fs.Bool("verify", false, "also filter the image locally and fail if the results differ")
+	addDecodeFlags(fs, false)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hpc_final tile-client [flags] <input|-> <output|->")
+		fs.PrintDefaults()
+	}
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	inputPath, outputPath := fs.Arg(0), fs.Arg(1)
+	if *kernel < 1 || *kernel%2 == 0 {
+		fatal("kernel size must be a positive odd number", "kernel", *kernel)
+	}
+	if *tileSize < 1 {
+		fatal("tile size must be positive", "tile", *tileSize)
+	}
+	if !validOutputFormat(*format) {
+		fatal("unknown output format, use png, pgm or ppm", "format", *format)
+	}
+
+	in, err := openInput(inputPath)
+	if err != nil {
+		fatal("failed to open input", "path", inputPath, "err", err)
+	}
+	img, inputFormat, err := decodeImage(inputPath, in)
+	in.Close()
+	if err != nil {
+		fatal("failed to decode input", "path", inputPath, "err", err)
+	}
+	gray := toBlackAndWhite(img)
+
+	conn, err := grpc.NewClient(*server,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(tileCodec{})))
+	if err != nil {
+		fatal("failed to connect to tile server", "server", *server, "err", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	output, compute, err := filterRemote(context.Background(), conn, gray, *tileSize, *kernel)
+	if err != nil {
+		fatal("remote filtering failed", "server", *server, "err", err)
+	}
+	slog.Info("filtered image remotely", "image", inputPath, "server", *server, "duration", time.Since(start), "compute", compute)
+
+	if *verify {
+		local := medianFilterParallel(gray, *tileSize, *kernel/2)
+		equal := bytes.Equal(local.Pix, output.Pix)
+		PutGray(local)
+		if !equal {
+			fatal("remote output differs from the local filter", "image", inputPath)
+		}
+		slog.Info("remote output matches the local filter", "image", inputPath)
+	}
+
+	out, err := createOutput(outputPath)
+	if err != nil {
+		fatal("failed to create output", "path", outputPath, "err", err)
+	}
+	w := bufio.NewWriter(out)
+	if err := encodeImage(w, output, outputFormat(*format, outputPath, inputFormat)); err != nil {
+		fatal("failed to encode output", "path", outputPath, "err", err)
+	}
+	if err := w.Flush(); err != nil {
+		fatal("failed to write output", "path", outputPath, "err", err)
+	}
+	if err := out.Close(); err != nil {
+		fatal("failed to write output", "path", outputPath, "err", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !grpc
+
+package main
+
+// The tile server and client need google.golang.org/grpc, which is only
+// linked into builds with -tags grpc, see the README
+
+func runTileServer(args []string) {
+	fatal("the tile server needs a build with -tags grpc")
+}
+
+func runTileClient(args []string) {
+	fatal("the tile client needs a build with -tags grpc")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+)
+
+// privateGray returns a pooled image with bounds rect whose pixels belong to
+// the caller alone. The buffer is pooled by size, not by position, so tiles
+// of the same size share buffers. Release it with PutGray(buf).
+func privateGray(rect image.Rectangle) (img, buf *image.Gray) {
+	buf = GetGray(image.Rectangle{Max: rect.Size()})
+	return &image.Gray{Pix: buf.Pix, Stride: buf.Stride, Rect: rect}, buf
+}
+
+// copyRect copies the pixels of rect from src to dst
+func copyRect(dst, src *image.Gray, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		copy(dst.Pix[dst.PixOffset(rect.Min.X, y):][:rect.Dx()], src.Pix[src.PixOffset(rect.Min.X, y):])
+	}
+}
+
+// medianFilterHalo is the parallel median filter with ghost cells. Every
+// tile first copies its pixels plus a filterSize wide halo of its
+// neighbors' pixels into a private buffer, filters that into a second
+// private buffer and finally copies its own pixels into the output. While
+// filtering a worker neither reads the shared input nor writes next to
+// another worker's pixels. The halo is clipped to the image like the
+// windows are, so the output is identical to medianFilterScheduled.
+func medianFilterHalo(img *image.Gray, chunkSize, filterSize int, schedule string) *image.Gray {
+	bounds := img.Bounds()
+	output := GetGray(bounds)
+	tileSchedulers[schedule](tileRects(bounds, chunkSize), func(_ int, tile image.Rectangle) {
+		halo := tile.Inset(-filterSize).Intersect(bounds)
+		local, localBuf := privateGray(halo)
+		copyRect(local, img, halo)
+		result, resultBuf := privateGray(tile)
+		medianRect(result, local, tile, filterSize)
+		copyRect(output, result, tile)
+		PutGray(localBuf)
+		PutGray(resultBuf)
+	})
+	return output
+}
+
+// haloTiming is the mean time per image of the shared-read and halo-copy
+// parallel filters at one chunk size
+type haloTiming struct {
+	ChunkSize int
+	Shared    time.Duration
+	Halo      time.Duration
+}
+
+// PrintHaloTable prints the time of both filters per chunk size and how
+// much faster the halo copy is
+func PrintHaloTable(timings []haloTiming, schedule string) {
+	fmt.Printf("%s schedule\n", schedule)
+	fmt.Println("Chunk\tShared (s)\tHalo (s)\tHalo speedup")
+	fmt.Println("------------------------------------------------------------------")
+	for _, t := range timings {
+		fmt.Printf("%d\t%.6f\t%.6f\t%.2fx\n", t.ChunkSize, t.Shared.Seconds(), t.Halo.Seconds(), t.Shared.Seconds()/t.Halo.Seconds())
+	}
+}
+
+// plotHaloTimings saves the time of both filters against the chunk size
+func plotHaloTimings(timings []haloTiming, opts *plotOptions) error {
+	p := plot.New()
+	p.Title.Text = "Shared Read vs Halo Copy"
+	p.X.Label.Text = "Chunk size (pixels)"
+	p.Y.Label.Text = "Time per image (s)"
+
+	shared := make(plotter.XYs, len(timings))
+	halo := make(plotter.XYs, len(timings))
+	for i, t := range timings {
+		shared[i] = plotter.XY{X: float64(t.ChunkSize), Y: t.Shared.Seconds()}
+		halo[i] = plotter.XY{X: float64(t.ChunkSize), Y: t.Halo.Seconds()}
+	}
+	for i, series := range []struct {
+		label  string
+		points plotter.XYs
+	}{{"Shared read", shared}, {"Halo copy", halo}} {
+		line, pts, err := plotter.NewLinePoints(series.points)
+		if err != nil {
+			return err
+		}
+		line.Color = plotutil.Color(i)
+		pts.Color = plotutil.Color(i)
+		p.Add(line, pts)
+		p.Legend.Add(series.label, line, pts)
+	}
+	opts.apply(p, shared, halo)
+	return opts.save(p)
+}
+
+// parseChunkSizes parses a comma separated list of positive chunk sizes
+func parseChunkSizes(list string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(list, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("invalid chunk size %q", field)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// runHalo times the shared-read and halo-copy parallel filters on the
+// dataset for several chunk sizes, checking that they produce the same
+// pixels
+func runHalo(args []string) {
+	fs := flag.NewFlagSet("halo", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	chunks := fs.String("chunks", "8,16,32,45,64,128", "comma separated chunk sizes to compare")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	schedule := fs.String("schedule", defaultSchedule, "tile scheduling policy: tiles, static or stealing")
+	runs := fs.Int("runs", 3, "times every filter is run per image and chunk size, the mean is reported")
+	plotOpts := addPlotFlags(fs, "halo_comparison.png")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	sizes, err := parseChunkSizes(*chunks)
+	if err != nil {
+		fatal("failed to parse chunk sizes", "err", err)
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+	if _, err := applyScheduledFilter("halo", *schedule, image.NewGray(image.Rect(0, 0, 1, 1)), sizes[0], *kernel); err != nil {
+		fatal("invalid filter settings", "err", err)
+	}
+	filterSize := *kernel / 2
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+
+	slog.Info("comparing shared read and halo copy, please wait", "input", *input, "chunks", sizes, "kernel", *kernel)
+	timings := make([]haloTiming, len(sizes))
+	images := 0
+	err = in.Walk(func(filename string, img image.Image) error {
+		images++
+		bwImage := toBlackAndWhite(img)
+		for i, size := range sizes {
+			timings[i].ChunkSize = size
+			shared := func() *image.Gray { return medianFilterScheduled(bwImage, size, filterSize, *schedule) }
+			halo := func() *image.Gray { return medianFilterHalo(bwImage, size, filterSize, *schedule) }
+
+			want, got := shared(), halo()
+			equal := bytes.Equal(want.Pix, got.Pix)
+			PutGray(want)
+			PutGray(got)
+			if !equal {
+				return fmt.Errorf("%s: halo output differs from the shared read output at chunk size %d", filename, size)
+			}
+			for _, elapsed := range measureRuns(*runs, shared) {
+				timings[i].Shared += elapsed
+			}
+			for _, elapsed := range measureRuns(*runs, halo) {
+				timings[i].Halo += elapsed
+			}
+		}
+		slog.Debug("processed image", "image", filename, "stage", "halo")
+		return nil
+	})
+	if err != nil {
+		fatal("failed to compare halo copy", "input", *input, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+
+	n := time.Duration(images * *runs)
+	for i := range timings {
+		timings[i].Shared /= n
+		timings[i].Halo /= n
+	}
+	if err := plotHaloTimings(timings, plotOpts); err != nil {
+		fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+	}
+	PrintHaloTable(timings, *schedule)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// The functions below are the conversion and median filter as they were
+// before the hot loops were moved onto Pix. They go through the image.Image
+// interface one pixel at a time, allocate a new slice for every window and
+// sort it with sort.Slice. The layout subcommand keeps them only to measure
+// the gain against.
+
+func toBlackAndWhiteAt(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	grayScale := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			originalColor := img.At(x, y)
+			r, g, b, _ := originalColor.RGBA()
+			grayValue := uint8((r + g + b) / 3 >> 8) // Average of RGB
+			grayScale.Set(x, y, color.Gray{Y: grayValue})
+		}
+	}
+	return grayScale
+}
+
+func getNeighborhood(img *image.Gray, x, y, size int) []uint8 {
+	var values []uint8
+	for dy := -size; dy <= size; dy++ {
+		for dx := -size; dx <= size; dx++ {
+			nx, ny := x+dx, y+dy
+			if nx >= 0 && ny >= 0 && nx < img.Rect.Max.X && ny < img.Rect.Max.Y {
+				values = append(values, img.GrayAt(nx, ny).Y)
+			}
+		}
+	}
+	return values
+}
+
+func medianRectAt(output, img *image.Gray, rect image.Rectangle, filterSize int) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			neighborhood := getNeighborhood(img, x, y, filterSize)
+			sort.Slice(neighborhood, func(i, j int) bool { return neighborhood[i] < neighborhood[j] })
+			median := neighborhood[len(neighborhood)/2]
+			output.SetGray(x, y, color.Gray{Y: median})
+		}
+	}
+}
+
+func medianFilterSequentialAt(img *image.Gray, filterSize int) *image.Gray {
+	output := image.NewGray(img.Bounds())
+	medianRectAt(output, img, img.Bounds(), filterSize)
+	return output
+}
+
+func medianFilterParallelAt(img *image.Gray, chunkSize, filterSize int) *image.Gray {
+	output := image.NewGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		medianRectAt(output, img, tile, filterSize)
+	})
+	return output
+}
+
+// layoutTiming is the mean time of one stage with the interface based
+// implementation (Before) and the Pix based one (After)
+type layoutTiming struct {
+	Stage  string
+	Before time.Duration
+	After  time.Duration
+}
+
+// PrintLayoutTable prints the before and after time of every stage and the
+// speedup of the Pix based implementation
+func PrintLayoutTable(timings []layoutTiming) {
+	fmt.Println("Stage\t\tBefore (s)\tAfter (s)\tSpeedup")
+	fmt.Println("------------------------------------------------------------------")
+	for _, t := range timings {
+		fmt.Printf("%-10s\t%.6f\t%.6f\t%.2fx\n", t.Stage, t.Before.Seconds(), t.After.Seconds(), t.Before.Seconds()/t.After.Seconds())
+	}
+}
+
+// runLayout times the grayscale conversion and the sequential and parallel
+// median filters before and after the memory layout pass on the dataset,
+// checking that both produce the same pixels
+func runLayout(args []string) {
+	fs := flag.NewFlagSet("layout", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	runs := fs.Int("runs", 1, "times every stage is run per image, the mean is reported")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if _, err := applyFilter("parallel", image.NewGray(image.Rect(0, 0, 1, 1)), *chunkSize, *kernel); err != nil {
+		fatal("invalid filter settings", "err", err)
+	}
+	filterSize := *kernel / 2
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+
+	slog.Info("timing memory layout, please wait", "input", *input, "kernel", *kernel)
+	timings := []layoutTiming{{Stage: "grayscale"}, {Stage: "sequential"}, {Stage: "parallel"}}
+	images := 0
+	err = in.Walk(func(filename string, img image.Image) error {
+		images++
+		bwImage := toBlackAndWhite(img)
+		stages := []struct {
+			before, after func() *image.Gray
+		}{
+			{func() *image.Gray { return toBlackAndWhiteAt(img) }, func() *image.Gray { return toBlackAndWhite(img) }},
+			{func() *image.Gray { return medianFilterSequentialAt(bwImage, filterSize) },
+				func() *image.Gray { return medianFilterSequential(bwImage, filterSize) }},
+			{func() *image.Gray { return medianFilterParallelAt(bwImage, *chunkSize, filterSize) },
+				func() *image.Gray { return medianFilterParallel(bwImage, *chunkSize, filterSize) }},
+		}
+		for i, stage := range stages {
+			if !bytes.Equal(stage.before().Pix, stage.after().Pix) {
+				return fmt.Errorf("%s: %s output differs from the interface based version", filename, timings[i].Stage)
+			}
+			for _, elapsed := range measureRuns(*runs, stage.before) {
+				timings[i].Before += elapsed
+			}
+			for _, elapsed := range measureRuns(*runs, stage.after) {
+				timings[i].After += elapsed
+			}
+		}
+		slog.Debug("processed image", "image", filename, "stage", "layout")
+		return nil
+	})
+	if err != nil {
+		fatal("failed to time memory layout", "input", *input, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+
+	n := time.Duration(images * *runs)
+	for i := range timings {
+		timings[i].Before /= n
+		timings[i].After /= n
+	}
+	PrintLayoutTable(timings)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// logOptions holds the logging flags shared by every subcommand
+type logOptions struct {
+	verbose bool
+	format  string
+}
+
+func addLogFlags(fs *flag.FlagSet) *logOptions {
+	opts := &logOptions{}
+	fs.BoolVar(&opts.verbose, "v", false, "log every image and stage at debug level")
+	fs.StringVar(&opts.format, "log-format", "text", "log output format: text or json")
+	return opts
+}
+
+// setup installs the default slog logger described by the flags. Logs go to
+// stderr so they never mix with the tables printed on stdout.
+func (o *logOptions) setup() {
+	o.setupOutput(os.Stderr)
+}
+
+// setupOutput is setup with the logs going to w
+func (o *logOptions) setupOutput(w io.Writer) {
+	level := slog.LevelInfo
+	if o.verbose {
+		level = slog.LevelDebug
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch o.format {
+	case "text":
+		handler = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown log format %q, use text or json\n", o.format)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs msg with its fields at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,224 +1,831 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"sort"
-	"sync"
+	"runtime"
+	"slices"
+	"strings"
 	"time"
 
-	"gonum.org/v1/plot"
-	"gonum.org/v1/plot/plotter"
-	"gonum.org/v1/plot/vg"
+	"hpc_final/filter"
 )
 
 type PerformanceData struct {
-	ImageNumber    int
-	SequentialTime time.Duration
-	ParallelTime   time.Duration
+	ImageNumber int
+	Times       map[string]time.Duration // mean time by variant
+	Pixels      int
+	Memory      map[string]MemoryUsage // by variant, nil when not measured
+	Energy      map[string]EnergyUsage // by variant, nil when not measured
+	TimedOut    bool
 }
 
-// PrintExecutionTimesTable prints a table of execution times
-func PrintExecutionTimesTable(performanceData []PerformanceData) {
-	fmt.Println("Image\tSequential Time (s)\tParallel Time (s)")
-	fmt.Println("--------------------------------------------------")
+// seconds formats the mean time of one variant, or "-" when it was not timed
+func (data PerformanceData) seconds(variant string) string {
+	elapsed, ok := data.Times[variant]
+	if !ok {
+		return "-"
+	}
+	return fmt.Sprintf("%.6f", elapsed.Seconds())
+}
+
+// peakHeap formats the peak heap of one variant in KiB
+func (data PerformanceData) peakHeap(variant string) string {
+	usage, ok := data.Memory[variant]
+	return kibibytes(usage.PeakHeap, ok)
+}
+
+// energy formats the joules per run of one variant
+func (data PerformanceData) energy(variant string) string {
+	usage, ok := data.Energy[variant]
+	return joules(usage, ok)
+}
+
+// PrintExecutionTimesTable prints a table of execution times and of the
+// peak heap and energy of every variant
+func PrintExecutionTimesTable(performanceData []PerformanceData, variants []timingVariant) {
+	times := make([]string, len(variants))
+	short := make([]string, len(variants))
+	for i, v := range variants {
+		times[i] = v.label + " Time (s)"
+		short[i] = v.short
+	}
+	fmt.Printf("Image\t%s\tPeak Heap %s (KiB)\tEnergy %s (J)\n", strings.Join(times, "\t"), strings.Join(short, "/"), strings.Join(short, "/"))
+	fmt.Println("------------------------------------------------------------------------------------------------------------------")
 
 	for _, data := range performanceData {
-		fmt.Printf("%d\t%.6f\t\t%.6f\n", data.ImageNumber, data.SequentialTime.Seconds(), data.ParallelTime.Seconds())
+		if data.TimedOut {
+			fmt.Printf("%d\ttimeout\n", data.ImageNumber)
+			continue
+		}
+		heaps := make([]string, len(variants))
+		energies := make([]string, len(variants))
+		for i, v := range variants {
+			times[i] = data.seconds(v.name)
+			heaps[i] = data.peakHeap(v.name)
+			energies[i] = data.energy(v.name)
+		}
+		fmt.Printf("%d\t%s\t%s\t\t%s\n", data.ImageNumber, strings.Join(times, "\t\t"), strings.Join(heaps, " / "), strings.Join(energies, " / "))
 	}
 }
 
+// cacheLine is the width in pixels of the column strips the median filter
+// walks, one cache line of a gray row
+const cacheLine = 64
+
+// grayLevel is the gray value toBlackAndWhite gives 16-bit color channels
+func grayLevel(r, g, b uint32) uint8 {
+	return uint8((r + g + b) / 3 >> 8) // Average of RGB
+}
+
 // Convert to Black and White
+// The decoders' own image types are read straight from Pix; any other
+// image goes through At.
 func toBlackAndWhite(img image.Image) *image.Gray {
 	bounds := img.Bounds()
 	grayScale := image.NewGray(bounds)
+	width := bounds.Dx()
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			originalColor := img.At(x, y)
-			r, g, b, _ := originalColor.RGBA()
-			grayValue := uint8((r + g + b) / 3 >> 8) // Average of RGB
-			grayScale.Set(x, y, color.Gray{Y: grayValue})
-		}
-	}
-	return grayScale
-}
-
-// Get neighborhood pixel values
-func getNeighborhood(img *image.Gray, x, y, size int) []uint8 {
-	var values []uint8
-	for dy := -size; dy <= size; dy++ {
-		for dx := -size; dx <= size; dx++ {
-			nx, ny := x+dx, y+dy
-			if nx >= 0 && ny >= 0 && nx < img.Rect.Max.X && ny < img.Rect.Max.Y {
-				values = append(values, img.GrayAt(nx, ny).Y)
+		dst := grayScale.Pix[(y-bounds.Min.Y)*grayScale.Stride:][:width]
+		switch src := img.(type) {
+		case *image.Gray:
+			copy(dst, src.Pix[src.PixOffset(bounds.Min.X, y):])
+		case *image.RGBA:
+			row := src.Pix[src.PixOffset(bounds.Min.X, y):][:4*width]
+			for x := range dst {
+				p := row[4*x : 4*x+3]
+				dst[x] = grayLevel(uint32(p[0])*0x101, uint32(p[1])*0x101, uint32(p[2])*0x101)
+			}
+		case *image.NRGBA:
+			row := src.Pix[src.PixOffset(bounds.Min.X, y):][:4*width]
+			for x := range dst {
+				p := row[4*x : 4*x+4]
+				r, g, b, _ := color.NRGBA{R: p[0], G: p[1], B: p[2], A: p[3]}.RGBA()
+				dst[x] = grayLevel(r, g, b)
+			}
+		case *image.YCbCr:
+			yRow := src.Y[src.YOffset(bounds.Min.X, y):][:width]
+			for x := range dst {
+				c := src.COffset(bounds.Min.X+x, y)
+				r, g, b, _ := color.YCbCr{Y: yRow[x], Cb: src.Cb[c], Cr: src.Cr[c]}.RGBA()
+				dst[x] = grayLevel(r, g, b)
+			}
+		default:
+			for x := range dst {
+				r, g, b, _ := img.At(bounds.Min.X+x, y).RGBA()
+				dst[x] = grayLevel(r, g, b)
 			}
 		}
 	}
-	return values
+	return grayScale
 }
 
 // Median Filter (Sequential)
-func medianFilterSequential(img *image.Gray) *image.Gray {
-	bounds := img.Bounds()
-	output := image.NewGray(bounds)
-	filterSize := 1 // You can adjust this size
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			neighborhood := getNeighborhood(img, x, y, filterSize)
-			sort.Slice(neighborhood, func(i, j int) bool { return neighborhood[i] < neighborhood[j] })
-			median := neighborhood[len(neighborhood)/2]
-			output.SetGray(x, y, color.Gray{Y: median})
-		}
-	}
+// filterSize is the radius of the window, 1 gives a 3x3 kernel
+func medianFilterSequential(img *image.Gray, filterSize int) *image.Gray {
+	output := GetGray(img.Bounds())
+	medianRect(output, img, img.Bounds(), filterSize)
 	return output
 }
 
 // Median Filter (Parallel)
-func medianFilterParallel(img *image.Gray, chunkSize int) *image.Gray {
+func medianFilterParallel(img *image.Gray, chunkSize, filterSize int) *image.Gray {
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		medianRect(output, img, tile, filterSize)
+	})
+	return output
+}
+
+// medianRect writes the median of every pixel of rect to output. Windows
+// are clipped to the image and read row by row from Pix with stride
+// arithmetic into one reused buffer. rect is walked in strips one cache
+// line wide, so the 2*filterSize+1 input rows of a strip stay in cache on
+// the way down even when a wide kernel spans more rows than fit at full
+// image width.
+func medianRect(output, img *image.Gray, rect image.Rectangle, filterSize int) {
 	bounds := img.Bounds()
-	output := image.NewGray(bounds)
-	filterSize := 1 // You can adjust this size
-	var wg sync.WaitGroup
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y += chunkSize {
-		for x := bounds.Min.X; x < bounds.Max.X; x += chunkSize {
-			wg.Add(1)
-			go func(x, y int) {
-				defer wg.Done()
-				for cy := y; cy < y+chunkSize && cy < bounds.Max.Y; cy++ {
-					for cx := x; cx < x+chunkSize && cx < bounds.Max.X; cx++ {
-						neighborhood := getNeighborhood(img, cx, cy, filterSize)
-						sort.Slice(neighborhood, func(i, j int) bool { return neighborhood[i] < neighborhood[j] })
-						median := neighborhood[len(neighborhood)/2]
-						output.SetGray(cx, cy, color.Gray{Y: median})
-					}
+	window := make([]uint8, 0, (2*filterSize+1)*(2*filterSize+1))
+	for x0 := rect.Min.X; x0 < rect.Max.X; x0 += cacheLine {
+		x1 := min(x0+cacheLine, rect.Max.X)
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			if filterAbort.Load() {
+				return
+			}
+			top := (max(y-filterSize, bounds.Min.Y) - bounds.Min.Y) * img.Stride
+			bottom := (min(y+filterSize+1, bounds.Max.Y) - bounds.Min.Y) * img.Stride
+			dst := output.Pix[output.PixOffset(x0, y):][:x1-x0]
+			for x := x0; x < x1; x++ {
+				left := max(x-filterSize, bounds.Min.X) - bounds.Min.X
+				right := min(x+filterSize+1, bounds.Max.X) - bounds.Min.X
+				window = window[:0]
+				for row := top; row < bottom; row += img.Stride {
+					window = append(window, img.Pix[row+left:row+right]...)
 				}
-			}(x, y)
+				slices.Sort(window)
+				dst[x-x0] = window[len(window)/2]
+			}
 		}
 	}
-	wg.Wait()
+}
 
-	return output
+// applyFilter runs the median filter variant selected by mode with a
+// kernel x kernel window
+func applyFilter(mode string, img *image.Gray, chunkSize, kernel int) (*image.Gray, error) {
+	if kernel < 1 || kernel%2 == 0 {
+		return nil, fmt.Errorf("kernel size must be a positive odd number, got %d", kernel)
+	}
+	if chunkSize < 1 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+	}
+	filterSize := kernel / 2
+
+	switch mode {
+	case "sequential":
+		return medianFilterSequential(img, filterSize), nil
+	case "parallel":
+		return medianFilterParallel(img, chunkSize, filterSize), nil
+	case "halo":
+		return medianFilterHalo(img, chunkSize, filterSize, defaultSchedule), nil
+	case "numa":
+		return medianFilterNUMA(img, chunkSize, filterSize)
+	case "simd":
+		if kernel != 3 {
+			return nil, fmt.Errorf("simd mode only supports a 3x3 kernel, got %d", kernel)
+		}
+		return medianFilterSIMD(img), nil
+	}
+	return nil, fmt.Errorf("unknown filter mode %q", mode)
+}
+
+// registeredFilter runs the filter registered as name in the filter
+// package, which is also how the median filter handles the replicate,
+// reflect and zero borders. The sequential mode uses a single worker, the
+// parallel mode one per CPU.
+func registeredFilter(name, mode string, img *image.Gray, chunkSize, kernel int, border filter.BorderMode, percentile float64) (*image.Gray, error) {
+	workers := runtime.GOMAXPROCS(0)
+	switch mode {
+	case "sequential":
+		workers = 1
+	case "parallel":
+	default:
+		return nil, fmt.Errorf("%s mode only supports the median filter with the crop border", mode)
+	}
+	return filter.Run(name, img, filter.Kernel(kernel), filter.ChunkSize(chunkSize), filter.Workers(workers), filter.Border(border), filter.Percentile(percentile))
 }
 
 // Measure the execution time
+// The result goes back to the gray pool, so function must return an image
+// nothing else holds on to.
 func measureTime(function func() *image.Gray) time.Duration {
 	start := time.Now()
-	function()
-	return time.Since(start)
+	output := function()
+	elapsed := time.Since(start)
+	PutGray(output)
+	return elapsed
+}
+
+// measureRuns measures the execution time of runs calls to function
+func measureRuns(runs int, function func() *image.Gray) []time.Duration {
+	times := make([]time.Duration, runs)
+	for i := range times {
+		times[i] = measureTime(function)
+		activeDashboard.ranOnce(times[i])
+	}
+	return times
+}
+
+func loadImage(folder, filename string) image.Image {
+	inFile, err := os.Open(filepath.Join(folder, filename))
+	if err != nil {
+		fatal("failed to open image", "image", filename, "err", err)
+	}
+	defer inFile.Close()
+
+	img, _, err := decodeImage(filename, inFile)
+	if err != nil {
+		fatal("failed to decode image", "image", filename, "err", err)
+	}
+	return img
+}
+
+// encodeImageBytes encodes img the way saveImage writes it to filename, as
+// a PNG, or as a PGM or PPM when filename ends in .pgm or .ppm, and returns
+// the encoded image with its SHA-256
+func encodeImageBytes(img image.Image, filename string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), hex.EncodeToString(sum[:]), nil
 }
 
-func saveImage(img image.Image, folder, filename string) {
+// saveImage writes img as a PNG, or as a PGM or PPM when filename ends in
+// .pgm or .ppm, and returns the SHA-256 of the written file
+func saveImage(img image.Image, folder, filename string) string {
 	// Check if the directory exists, if not create it
 	if _, err := os.Stat(folder); os.IsNotExist(err) {
 		os.Mkdir(folder, os.ModePerm)
 	}
 
 	// Save the image
-	outFile, err := os.Create(filepath.Join(folder, filename))
+	data, hash, err := encodeImageBytes(img, filename)
 	if err != nil {
-		log.Fatalf("failed to create file: %v", err)
+		fatal("failed to encode image", "image", filename, "err", err)
 	}
-	defer outFile.Close()
-
-	if err := png.Encode(outFile, img); err != nil {
-		log.Fatalf("failed to encode image: %v", err)
+	if err := os.WriteFile(filepath.Join(folder, filename), data, 0o644); err != nil {
+		fatal("failed to create file", "image", filename, "err", err)
 	}
+	return hash
 }
 
 func main() {
-	fmt.Println("Running Median Filter, please wait...")
-	p := plot.New()
-	p.Title.Text = "Performance Comparison"
-	p.X.Label.Text = "Image Number"
-	p.Y.Label.Text = "Time (s)"
-	var performanceData []PerformanceData
-
-	sequentialPoints := make(plotter.XYs, 24)
-	parallelPoints := make(plotter.XYs, 24)
-
-	for i := 1; i <= 24; i++ {
-		filename := fmt.Sprintf("kodim%02d.png", i)
-		inFile, err := os.Open(filepath.Join("dataset", filename))
-		if err != nil {
-			log.Fatalf("failed to open %s: %v", filename, err)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "worker":
+			runWorker(os.Args[2:])
+			return
+		case "coordinator":
+			runCoordinator(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "fetch-dataset":
+			runFetchDataset(os.Args[2:])
+			return
+		case "generate":
+			runGenerate(os.Args[2:])
+			return
+		case "weak-scaling":
+			runWeakScaling(os.Args[2:])
+			return
+		case "strong-scaling":
+			runStrongScaling(os.Args[2:])
+			return
+		case "compare":
+			runCompare(os.Args[2:])
+			return
+		case "ops":
+			runOps(os.Args[2:])
+			return
+		case "filter":
+			runFilter(os.Args[2:])
+			return
+		case "video":
+			runVideo(os.Args[2:])
+			return
+		case "animate":
+			runAnimate(os.Args[2:])
+			return
+		case "balance":
+			runBalance(os.Args[2:])
+			return
+		case "layout":
+			runLayout(os.Args[2:])
+			return
+		case "cpus":
+			runCPUs(os.Args[2:])
+			return
+		case "halo":
+			runHalo(os.Args[2:])
+			return
+		case "numa":
+			runNUMA(os.Args[2:])
+			return
+		case "tile-server":
+			runTileServer(os.Args[2:])
+			return
+		case "tile-client":
+			runTileClient(os.Args[2:])
+			return
+		case "temporal":
+			runTemporal(os.Args[2:])
+			return
+		case "noise":
+			runNoise(os.Args[2:])
+			return
+		case "report":
+			runReport(os.Args[2:])
+			return
+		case "resolution":
+			runResolution(os.Args[2:])
+			return
+		case "kernels":
+			runKernels(os.Args[2:])
+			return
+		case "density":
+			runDensity(os.Args[2:])
+			return
+		case "selftest":
+			runSelftest(os.Args[2:])
+			return
 		}
+	}
+	runBenchmark(os.Args[1:])
+}
 
-		img, _, err := image.Decode(inFile)
-		inFile.Close()
+// benchmarkImage times every filter variant runs times on img, then runs it
+// once more to measure its memory usage and saves that output to out,
+// binarized with Otsu's method when binarize is set. The black and white
+// input is saved to noisy unless it is nil. Every saved image carries meta,
+// the metadata of the input. The parallel variant hands its tiles out with
+// schedule. Every registered
+// filter in filters is timed as one more variant named after it. The input
+// is resized first as resize says. The returned entry has everything but
+// the input hash filled in. An image still
+// running after timeout (when positive) is cancelled and returned with only
+// TimedOut set, and none of its outputs are saved.
+func benchmarkImage(filename string, img image.Image, meta imageMetadata, out, noisy imageOutput, filterSize, chunkSize, runs int, binarize bool, schedule string, filters []string, resize *resizeOptions, timeout time.Duration) ManifestImage {
+	var entry ManifestImage
+	err := withTimeout(timeout, func() error {
+		var err error
+		entry, err = timeImage(filename, img, meta, out, noisy, filterSize, chunkSize, runs, binarize, schedule, filters, resize)
+		return err
+	})
+	if err != nil {
+		slog.Warn("image timed out, moving on to the next one", "image", filename, "timeout", timeout)
+		return ManifestImage{Name: filename, TimedOut: true}
+	}
+	return entry
+}
+
+// timeImage does the work of benchmarkImage, returning errImageTimeout as
+// soon as a variant finishes after the watchdog raised filterAbort
+func timeImage(filename string, img image.Image, meta imageMetadata, out, noisy imageOutput, filterSize, chunkSize, runs int, binarize bool, schedule string, filters []string, resize *resizeOptions) (ManifestImage, error) {
+	bwImage := resize.apply(toBlackAndWhite(img), chunkSize)
+	save := func(to imageOutput, img image.Image, name string) string {
+		hash, err := to.Save(name, img, meta)
 		if err != nil {
-			log.Fatalf("failed to decode %s: %v", filename, err)
+			fatal("failed to save image", "image", name, "err", err)
 		}
+		return hash
+	}
 
-		bwImage := toBlackAndWhite(img)
+	// Save black and white image with noise
+	if noisy != nil {
+		save(noisy, bwImage, filename)
+	}
 
-		// Save black and white image with noise
-		saveImage(bwImage, "dataset-w-noise", filename)
+	// Optional post-filter stage, applied to every output but not timed
+	finish := func(img *image.Gray) *image.Gray {
+		if !binarize {
+			return img
+		}
+		output, threshold := BinarizeOtsu(img)
+		slog.Debug("binarized image", "image", filename, "threshold", threshold)
+		return output
+	}
 
-		// Measure sequential processing time
-		seqTime := measureTime(func() *image.Gray {
-			return medianFilterSequential(bwImage)
-		})
+	// Energy of every variant whose RAPL counters could be read
+	energy := map[string]EnergyUsage{}
+	recordEnergy := func(variant string, usage *EnergyUsage) {
+		if usage != nil {
+			energy[variant] = *usage
+		}
+	}
 
-		sequentialOutput := medianFilterSequential(bwImage)
-		saveImage(sequentialOutput, "dataset-output", fmt.Sprintf("sequential-%s", filename))
+	// Measure sequential processing time
+	activeDashboard.beginStage("sequential")
+	seqTimes, seqEnergy := measureRunsEnergy(runs, func() *image.Gray {
+		return medianFilterSequential(bwImage, filterSize)
+	})
+	recordEnergy("sequential", seqEnergy)
+	sequentialOutput, sequentialMemory := measureMemory(func() *image.Gray {
+		return medianFilterSequential(bwImage, filterSize)
+	})
+	if filterAbort.Load() {
+		PutGray(sequentialOutput)
+		return ManifestImage{}, errImageTimeout
+	}
+	sequentialHash := save(out, finish(sequentialOutput), fmt.Sprintf("sequential-%s", filename))
+	PutGray(sequentialOutput)
+
+	// Measure parallel processing time
+	activeDashboard.beginStage("parallel")
+	parallelTimes, parallelEnergy := measureRunsEnergy(runs, func() *image.Gray {
+		return medianFilterScheduled(bwImage, chunkSize, filterSize, schedule)
+	})
+	recordEnergy("parallel", parallelEnergy)
+	parallelOutput, parallelMemory := measureMemory(func() *image.Gray {
+		return medianFilterScheduled(bwImage, chunkSize, filterSize, schedule)
+	})
+	if filterAbort.Load() {
+		PutGray(parallelOutput)
+		return ManifestImage{}, errImageTimeout
+	}
+	parallelHash := save(out, finish(parallelOutput), fmt.Sprintf("parallel-%s", filename))
+	PutGray(parallelOutput)
+
+	// Measure single core SIMD processing time
+	activeDashboard.beginStage("simd")
+	simdTimes, simdEnergy := measureRunsEnergy(runs, func() *image.Gray {
+		return medianFilterSIMD(bwImage)
+	})
+	recordEnergy("simd", simdEnergy)
+	simdOutput, simdMemory := measureMemory(func() *image.Gray {
+		return medianFilterSIMD(bwImage)
+	})
+	if filterAbort.Load() {
+		PutGray(simdOutput)
+		return ManifestImage{}, errImageTimeout
+	}
+	simdHash := save(out, finish(simdOutput), fmt.Sprintf("simd-%s", filename))
+	PutGray(simdOutput)
+
+	entry := ManifestImage{
+		Name:    filename,
+		Pixels:  len(bwImage.Pix),
+		Outputs: map[string]string{"sequential": sequentialHash, "parallel": parallelHash, "simd": simdHash},
+		Seconds: map[string]float64{},
+		Runs:    map[string][]float64{},
+		Memory:  map[string]MemoryUsage{"sequential": sequentialMemory, "parallel": parallelMemory, "simd": simdMemory},
+		Energy:  energy,
+	}
+	variantTimes := map[string][]time.Duration{"sequential": seqTimes, "parallel": parallelTimes, "simd": simdTimes}
 
-		// Measure parallel processing time
-		parallelTime := measureTime(func() *image.Gray {
-			return medianFilterParallel(bwImage, 45) // Adjust the chunkSize value as needed
-		})
-		parallelOutput := medianFilterParallel(bwImage, 45) // Adjust the chunkSize
-		saveImage(parallelOutput, "dataset-output", fmt.Sprintf("parallel-%s", filename))
+	for _, name := range filters {
+		run := func() *image.Gray {
+			output, err := filter.Run(name, bwImage, filter.Kernel(2*filterSize+1), filter.ChunkSize(chunkSize))
+			if err != nil {
+				fatal("failed to filter image", "image", filename, "filter", name, "err", err)
+			}
+			return output
+		}
+		var usage *EnergyUsage
+		activeDashboard.beginStage(name)
+		variantTimes[name], usage = measureRunsEnergy(runs, run)
+		recordEnergy(name, usage)
+		output, memory := measureMemory(run)
+		if filterAbort.Load() {
+			PutGray(output)
+			return ManifestImage{}, errImageTimeout
+		}
+		entry.Outputs[name] = save(out, finish(output), fmt.Sprintf("%s-%s", name, filename))
+		entry.Memory[name] = memory
+		PutGray(output)
+	}
 
-		data := PerformanceData{
-			ImageNumber:    i,
-			SequentialTime: seqTime,
-			ParallelTime:   parallelTime,
+	for variant, times := range variantTimes {
+		var total float64
+		for _, elapsed := range times {
+			filterMetrics.Observe(variant, len(bwImage.Pix), elapsed)
+			entry.Runs[variant] = append(entry.Runs[variant], elapsed.Seconds())
+			total += elapsed.Seconds()
 		}
-		performanceData = append(performanceData, data)
+		entry.Seconds[variant] = total / float64(len(times))
+		memory := entry.Memory[variant]
+		slog.Debug("filtered image", "image", filename, "stage", variant, "duration", entry.Duration(variant), "runs", len(times),
+			"peak_heap", memory.PeakHeap, "allocated", memory.Allocated, "gc_pause", memory.GCPause, "joules", energy[variant].Joules)
+	}
+	if len(energy) == 0 {
+		entry.Energy = nil
+	}
+	return entry, nil
+}
 
-		//fmt.Printf("Image %d - Sequential Time: %v seconds\n", i, seqTime.Seconds())
-		//fmt.Printf("Image %d - Parallel Time: %v seconds\n", i, parallelTime.Seconds())
-		sequentialPoints[i-1] = plotter.XY{X: float64(i), Y: seqTime.Seconds()}
-		parallelPoints[i-1] = plotter.XY{X: float64(i), Y: parallelTime.Seconds()}
+// runBenchmark filters the dataset sequentially, in parallel and with SIMD and plots the timings
+func runBenchmark(args []string) {
+	fs := flag.NewFlagSet("hpc_final", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	output := fs.String("output", "dataset-output", "folder, new .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix to write the filtered images and a copy of the manifest to")
+	noisyOutput := fs.String("noisy-output", "dataset-w-noise", "folder, new .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix to write the black and white inputs to (disabled when empty)")
+	metricsAddr := fs.String("metrics", "", "address to expose Prometheus /metrics on while the batch runs (disabled when empty)")
+	manifestPath := fs.String("manifest", filepath.Join("dataset-output", "manifest.json"), "where to write the results manifest")
+	check := fs.Bool("check", false, "verify the outputs against the existing manifest instead of overwriting it")
+	verify := fs.Bool("verify", false, "cross-check the median filters against OpenCV on every image, exiting with status 1 on any difference (needs a build with -tags opencv)")
+	resume := fs.Bool("resume", false, "skip images whose outputs already exist and match the manifest")
+	binarize := fs.Bool("binarize", false, "binarize the filtered outputs with Otsu's method before saving them")
+	runs := fs.Int("runs", 1, "times every filter is run per image, the mean is reported")
+	dbPath := fs.String("db", filepath.Join("dataset-output", "results.db"), "SQLite database every run's timings are added to (disabled when empty)")
+	table := fs.String("table", "text", "format of the timing table printed to stdout: text, markdown or latex")
+	schedule := fs.String("schedule", defaultSchedule, "how the parallel filter hands out its tiles: tiles (a goroutine each), static or stealing")
+	watch := fs.Bool("watch", false, "instead of the batch, filter every new image that appears in the -input folder until interrupted, adding its timings to the manifest and -db")
+	filters := fs.String("filters", "", "comma separated registered filters to time next to the median variants: "+strings.Join(filter.Names(), ", "))
+	timeout := fs.Duration("timeout", 0, "cancel an image still being filtered after this long, record it as timed out and go on with the next one (0 waits forever)")
+	showDashboard := fs.Bool("dashboard", false, "show live progress, speedups, CPU utilization and timing sparklines on the terminal while the batch runs")
+	charts := fs.String("charts", "line", "comma separated charts to draw: line, box (timing distribution per image), bar (mean time per image) and memory (peak heap per image)")
+	resize := addResizeFlags(fs)
+	plotOpts := addPlotFlags(fs, "performance_comparison.png")
+	addDecodeFlags(fs, false)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+	serveMetrics(*metricsAddr)
+
+	if err := resize.validate(); err != nil {
+		fatal("invalid resize options", "err", err)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
 	}
 
-	seqLine, seqPoints, err := plotter.NewLinePoints(sequentialPoints)
+	if *check && *resume {
+		fatal("-check and -resume cannot be combined")
+	}
+	if *resume && (isZip(*output) || isTar(*output) || isRemote(*output)) {
+		fatal("-resume needs a folder -output, an archive is written anew every run and a bucket cannot be checked", "output", *output)
+	}
+	if *watch && (isZip(*input) || isTar(*input) || isRemote(*input)) {
+		fatal("-watch needs a folder -input", "input", *input)
+	}
+	if *watch && (*check || *resume || *verify || *showDashboard) {
+		fatal("-watch cannot be combined with -check, -resume, -verify or -dashboard")
+	}
+	if *verify && !filter.Registered("opencv") {
+		fatal("-verify needs OpenCV, rebuild with -tags opencv")
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if *timeout < 0 {
+		fatal("timeout must not be negative", "timeout", *timeout)
+	}
+	if err := validSchedule(*schedule); err != nil {
+		fatal("invalid schedule", "err", err)
+	}
+	if err := validTable(*table); err != nil {
+		fatal("invalid table format", "err", err)
+	}
+	var extraFilters []string
+	if *filters != "" {
+		extraFilters = strings.Split(*filters, ",")
+	}
+	for _, name := range extraFilters {
+		switch {
+		case name == "sequential" || name == "parallel" || name == "simd":
+			fatal("filter name is taken by a median variant", "filter", name)
+		case !filter.Registered(name):
+			fatal("unknown filter", "filter", name, "known", filter.Names())
+		}
+	}
+	drawCharts, err := parseCharts(*charts)
 	if err != nil {
-		log.Fatalf("failed to create line points for sequential: %v", err)
+		fatal("invalid charts", "err", err)
+	}
+
+	var reference, previous *Manifest
+	if *check {
+		var err error
+		if reference, err = loadManifest(*manifestPath); err != nil {
+			fatal("failed to load manifest", "path", *manifestPath, "err", err)
+		}
+	}
+	if *resume {
+		var err error
+		previous, err = loadManifest(*manifestPath)
+		if os.IsNotExist(err) {
+			slog.Info("no manifest to resume from, processing every image", "path", *manifestPath)
+		} else if err != nil {
+			fatal("failed to load manifest", "path", *manifestPath, "err", err)
+		}
+	}
+
+	filterSize := 1 // You can adjust this size
+	chunkSize := 45 // Adjust the chunkSize value as needed
+	for _, name := range extraFilters {
+		// Check the settings once instead of failing halfway through
+		if _, err := filter.Run(name, image.NewGray(image.Rect(0, 0, 1, 1)), filter.Kernel(2*filterSize+1), filter.ChunkSize(chunkSize)); err != nil {
+			fatal("invalid filter settings", "filter", name, "err", err)
+		}
+	}
+	manifest := newManifest(ManifestParameters{
+		InputFolder:  *input,
+		OutputFolder: *output,
+		FilterSize:   filterSize,
+		ChunkSize:    chunkSize,
+		Binarize:     *binarize,
+		Filters:      *filters,
+	})
+	if *schedule != defaultSchedule {
+		manifest.Parameters.Schedule = *schedule
+	}
+	if resize.enabled() {
+		manifest.Parameters.Scale = resize.scale
+		manifest.Parameters.MaxDim = resize.maxDim
+		manifest.Parameters.ResizeFilter = resize.filter
 	}
-	seqLine.Color = color.RGBA{R: 255, G: 0, B: 0, A: 255} // Red line for sequential
 
-	parLine, parPoints, err := plotter.NewLinePoints(parallelPoints)
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+	out, err := createImageOutput(*output)
 	if err != nil {
-		log.Fatalf("failed to create line points for parallel: %v", err)
+		fatal("failed to create output", "output", *output, "err", err)
+	}
+	var noisy imageOutput
+	if *noisyOutput != "" {
+		if noisy, err = createImageOutput(*noisyOutput); err != nil {
+			fatal("failed to create output", "output", *noisyOutput, "err", err)
+		}
+	}
+	// Archives are only complete once closed, so every output is closed
+	// before the results are reported
+	closeOutputs := func() {
+		if err := out.Close(); err != nil {
+			fatal("failed to finish output", "output", *output, "err", err)
+		}
+		if noisy != nil {
+			if err := noisy.Close(); err != nil {
+				fatal("failed to finish output", "output", *noisyOutput, "err", err)
+			}
+		}
 	}
-	parLine.Color = color.RGBA{R: 0, G: 0, B: 255, A: 255} // Blue line for parallel
 
-	// Adjust the legend position
-	p.Legend.Top = false
-	p.Legend.Left = false
-	p.Legend.XOffs = vg.Points(-500) // You can adjust this for fine positioning
-	p.Legend.YOffs = vg.Points(-30)  // You can adjust this for fine positioning
+	if *watch {
+		opts := watchOptions{
+			folder:       *input,
+			out:          out,
+			noisy:        noisy,
+			filterSize:   filterSize,
+			chunkSize:    chunkSize,
+			runs:         *runs,
+			binarize:     *binarize,
+			schedule:     *schedule,
+			filters:      extraFilters,
+			resize:       resize,
+			timeout:      *timeout,
+			manifestPath: *manifestPath,
+		}
+		if *dbPath != "" {
+			db, err := openStore(*dbPath)
+			if err != nil {
+				fatal("failed to open results database", "path", *dbPath, "err", err)
+			}
+			defer db.Close()
+			opts.db = db
+		}
+		watchImages(manifest, opts)
+		closeOutputs()
+		return
+	}
 
-	// Add the lines and points to the plot
-	p.Add(seqLine, seqPoints)
-	p.Add(parLine, parPoints)
+	// The run is stored up front and every image is added as soon as it is
+	// done, so a crash keeps what was already measured
+	var db *sql.DB
+	var runID int64
+	if *dbPath != "" && !*check {
+		var err error
+		if db, err = openStore(*dbPath); err != nil {
+			fatal("failed to open results database", "path", *dbPath, "err", err)
+		}
+		defer db.Close()
+		if runID, err = storeRun(db, manifest); err != nil {
+			fatal("failed to store run", "path", *dbPath, "err", err)
+		}
+	}
 
-	// Add legend entries
-	p.Legend.Add("Sequential", seqLine, seqPoints)
-	p.Legend.Add("Parallel", parLine, parPoints)
+	slog.Info("running median filter, please wait")
+	start := time.Now()
+	var mismatches []string
 
-	// Save the plot
-	if err := p.Save(8*vg.Inch, 4*vg.Inch, "performance_comparison.png"); err != nil {
-		log.Fatalf("failed to save plot: %v", err)
+	if *showDashboard {
+		filenames, err := in.Names()
+		if err != nil {
+			fatal("failed to list input", "input", *input, "err", err)
+		}
+		activeDashboard = newDashboard(filenames, 3+len(extraFilters), *runs)
+		if activeDashboard == nil {
+			slog.Warn("stderr is not a terminal, -dashboard is ignored")
+		} else {
+			logOpts.setupOutput(activeDashboard)
+		}
 	}
 
-	PrintExecutionTimesTable(performanceData)
+	err = in.WalkHashed(func(filename, inputHash string, img image.Image, meta imageMetadata) error {
+		var entry ManifestImage
+		reused := false
+		if previous != nil {
+			entry, reused = previous.Reusable(filename, inputHash, manifest.Parameters)
+		}
+		activeDashboard.beginImage(filename)
+		if reused {
+			slog.Info("skipping image, outputs are up to date", "image", filename)
+		} else {
+			entry = benchmarkImage(filename, img, meta, out, noisy, filterSize, chunkSize, *runs, *binarize, *schedule, extraFilters, resize, *timeout)
+			entry.InputSHA256 = inputHash
+		}
+		activeDashboard.finishImage(entry, reused)
+		manifest.Images = append(manifest.Images, entry)
+		if *verify {
+			// Filtered again from the input, since the saved outputs may be
+			// binarized
+			bwImage := resize.apply(toBlackAndWhite(img), chunkSize)
+			problems, err := verifyOpenCV(filename, bwImage, chunkSize, 2*filterSize+1)
+			PutGray(bwImage)
+			if err != nil {
+				fatal("failed to run OpenCV", "image", filename, "err", err)
+			}
+			mismatches = append(mismatches, problems...)
+		}
+
+		// Keep the manifest current so an interrupted run can be resumed
+		if !*check {
+			if err := manifest.Save(*manifestPath); err != nil {
+				fatal("failed to save manifest", "path", *manifestPath, "err", err)
+			}
+		}
+		if db != nil {
+			if err := appendTimings(db, runID, entry); err != nil {
+				fatal("failed to store timings", "path", *dbPath, "image", filename, "run", runID, "err", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fatal("failed to read input", "input", *input, "err", err)
+	}
+	closeOutputs()
+	if len(manifest.Images) == 0 {
+		fatal("no images found", "input", *input)
+	}
+	// A batch node may not outlive the run, so the results go to the
+	// bucket next to the outputs
+	if remote, ok := out.(*remoteOutput); ok && !*check {
+		if err := remote.saveManifest(manifest); err != nil {
+			fatal("failed to upload manifest", "output", *output, "err", err)
+		}
+	}
+	if activeDashboard != nil {
+		activeDashboard.Close()
+		activeDashboard = nil
+		logOpts.setup()
+	}
+	if db != nil {
+		slog.Info("stored run", "path", *dbPath, "run", runID)
+	}
+
+	writeReport(manifest.Images, time.Since(start), *table, drawCharts, plotOpts)
+
+	if *verify {
+		for _, problem := range mismatches {
+			slog.Error("verification failed", "problem", problem)
+		}
+		if len(mismatches) > 0 {
+			os.Exit(1)
+		}
+		slog.Info("all median filters match OpenCV")
+	}
+	if *check {
+		problems := manifest.Compare(reference)
+		for _, problem := range problems {
+			slog.Error("check failed", "problem", problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		slog.Info("all outputs match the manifest", "path", *manifestPath)
+	}
 }
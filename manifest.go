@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Manifest records everything needed to reproduce a benchmark run and to
+// verify its outputs bit-for-bit later on
+type Manifest struct {
+	CreatedAt  time.Time          `json:"created_at"`
+	GoVersion  string             `json:"go_version"`
+	GOOS       string             `json:"goos"`
+	GOARCH     string             `json:"goarch"`
+	NumCPU     int                `json:"num_cpu"`
+	CPUModel   string             `json:"cpu_model,omitempty"`
+	Parameters ManifestParameters `json:"parameters"`
+	Images     []ManifestImage    `json:"images"`
+}
+
+// ManifestParameters are the filter settings used for the run
+type ManifestParameters struct {
+	InputFolder  string `json:"input_folder"`
+	OutputFolder string `json:"output_folder"`
+	FilterSize   int    `json:"filter_size"`
+	ChunkSize    int    `json:"chunk_size"`
+	Binarize     bool   `json:"binarize,omitempty"`
+	Schedule     string `json:"schedule,omitempty"` // empty for the default tiles policy
+	Filters      string `json:"filters,omitempty"`  // comma separated registered filters timed next to the median variants
+	// The resizing applied to the inputs, all empty when they are filtered
+	// at their own size
+	Scale        float64 `json:"scale,omitempty"`
+	MaxDim       int     `json:"max_dim,omitempty"`
+	ResizeFilter string  `json:"resize_filter,omitempty"`
+}
+
+// ManifestImage holds the hashes, timings, memory usage and energy of one input
+// image. Outputs, Seconds, Runs, Memory and Energy are keyed by filter variant
+// (sequential, parallel, simd, or the name of a registered filter). Seconds is the mean of the individual runs.
+type ManifestImage struct {
+	Name        string                 `json:"name"`
+	InputSHA256 string                 `json:"input_sha256"`
+	Pixels      int                    `json:"pixels,omitempty"`
+	Outputs     map[string]string      `json:"outputs"`
+	Seconds     map[string]float64     `json:"seconds"`
+	Runs        map[string][]float64   `json:"runs,omitempty"`
+	Memory      map[string]MemoryUsage `json:"memory,omitempty"`
+	Energy      map[string]EnergyUsage `json:"energy,omitempty"`    // only where the RAPL counters are readable
+	TimedOut    bool                   `json:"timed_out,omitempty"` // cancelled by -timeout, so nothing else is recorded
+}
+
+// Duration returns the recorded time of one filter variant
+func (img ManifestImage) Duration(variant string) time.Duration {
+	return time.Duration(img.Seconds[variant] * float64(time.Second))
+}
+
+func newManifest(params ManifestParameters) *Manifest {
+	return &Manifest{
+		CreatedAt:  time.Now().UTC(),
+		GoVersion:  runtime.Version(),
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		NumCPU:     runtime.NumCPU(),
+		CPUModel:   cpuModel(),
+		Parameters: params,
+	}
+}
+
+// cpuModel returns the CPU model name on Linux and "" elsewhere
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && strings.TrimSpace(key) == "model name" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// hashFile returns the hex encoded SHA-256 of a file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func loadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// Save writes m to path atomically, so a crash while saving leaves the
+// previous version intact instead of a truncated file
+func (m *Manifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// writeFileAtomic writes data to a temporary file next to path first and
+// renames that over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Compare checks the hashes of m against a reference manifest and returns one
+// line per difference. Timings and machine details are expected to change and
+// are ignored.
+func (m *Manifest) Compare(reference *Manifest) []string {
+	var problems []string
+	if m.Parameters != reference.Parameters {
+		problems = append(problems, fmt.Sprintf("parameters differ: got %+v, reference has %+v", m.Parameters, reference.Parameters))
+	}
+
+	current := map[string]ManifestImage{}
+	for _, img := range m.Images {
+		current[img.Name] = img
+	}
+	for _, ref := range reference.Images {
+		img, ok := current[ref.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing from this run", ref.Name))
+			continue
+		}
+		if img.InputSHA256 != ref.InputSHA256 {
+			problems = append(problems, fmt.Sprintf("%s: input changed", ref.Name))
+		}
+
+		variants := make([]string, 0, len(ref.Outputs))
+		for variant := range ref.Outputs {
+			variants = append(variants, variant)
+		}
+		sort.Strings(variants)
+		for _, variant := range variants {
+			got, ok := img.Outputs[variant]
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("%s: %s output missing from this run", ref.Name, variant))
+			case got != ref.Outputs[variant]:
+				problems = append(problems, fmt.Sprintf("%s: %s output differs (got %.12s, reference %.12s)", ref.Name, variant, got, ref.Outputs[variant]))
+			}
+		}
+	}
+	return problems
+}
+
+// Reusable returns the entry for name when it was produced from the same
+// input with the same parameters and every output in the output folder still
+// has the recorded hash
+func (m *Manifest) Reusable(name, inputHash string, params ManifestParameters) (ManifestImage, bool) {
+	if m.Parameters != params {
+		return ManifestImage{}, false
+	}
+	for _, img := range m.Images {
+		if img.Name != name {
+			continue
+		}
+		if img.InputSHA256 != inputHash || len(img.Outputs) == 0 {
+			return ManifestImage{}, false
+		}
+		for variant, want := range img.Outputs {
+			got, err := hashFile(filepath.Join(params.OutputFolder, fmt.Sprintf("%s-%s", variant, name)))
+			if err != nil || got != want {
+				return ManifestImage{}, false
+			}
+		}
+		return img, true
+	}
+	return ManifestImage{}, false
+}
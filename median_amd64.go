@@ -0,0 +1,34 @@
+package main
+
+import "golang.org/x/sys/cpu"
+
+// Implemented in median_amd64.s. Each call filters n&^31 (AVX2) or n&^15
+// (SSE2) pixels; r0, r1 and r2 must have n+2 readable bytes.
+
+//go:noescape
+func median3x3AVX2(dst, r0, r1, r2 *uint8, n int)
+
+//go:noescape
+func median3x3SSE2(dst, r0, r1, r2 *uint8, n int)
+
+func median3x3Row(dst, r0, r1, r2 []uint8) {
+	n := len(dst)
+	var done int
+	if cpu.X86.HasAVX2 {
+		median3x3AVX2(&dst[0], &r0[0], &r1[0], &r2[0], n)
+		done = n &^ 31
+	} else {
+		// SSE2 is part of the amd64 baseline.
+		median3x3SSE2(&dst[0], &r0[0], &r1[0], &r2[0], n)
+		done = n &^ 15
+	}
+	median3x3RowGeneric(dst[done:], r0[done:], r1[done:], r2[done:])
+}
+
+// simdKernel names the row kernel median3x3Row runs on this CPU
+func simdKernel() string {
+	if cpu.X86.HasAVX2 {
+		return "avx2"
+	}
+	return "sse2"
+}
@@ -0,0 +1,88 @@
+#include "textflag.h"
+
+// Median of nine network, see median9 in median_simd.go. Each CSWAP leaves
+// min(a, b) in a and max(a, b) in b.
+
+#define CSWAPY(a, b) VPMINUB b, a, Y9; VPMAXUB b, a, b; VMOVDQU Y9, a
+#define CSWAPX(a, b) MOVO a, X9; PMINUB b, a; PMAXUB X9, b
+
+// func median3x3AVX2(dst, r0, r1, r2 *uint8, n int)
+TEXT ·median3x3AVX2(SB), NOSPLIT, $0-40
+	MOVQ dst+0(FP), DI
+	MOVQ r0+8(FP), AX
+	MOVQ r1+16(FP), BX
+	MOVQ r2+24(FP), CX
+	MOVQ n+32(FP), DX
+	SHRQ $5, DX
+	JZ   avx2done
+
+avx2loop:
+	VMOVDQU 0(AX), Y0
+	VMOVDQU 1(AX), Y1
+	VMOVDQU 2(AX), Y2
+	VMOVDQU 0(BX), Y3
+	VMOVDQU 1(BX), Y4
+	VMOVDQU 2(BX), Y5
+	VMOVDQU 0(CX), Y6
+	VMOVDQU 1(CX), Y7
+	VMOVDQU 2(CX), Y8
+
+	CSWAPY(Y1, Y2); CSWAPY(Y4, Y5); CSWAPY(Y7, Y8)
+	CSWAPY(Y0, Y1); CSWAPY(Y3, Y4); CSWAPY(Y6, Y7)
+	CSWAPY(Y1, Y2); CSWAPY(Y4, Y5); CSWAPY(Y7, Y8)
+	CSWAPY(Y0, Y3); CSWAPY(Y5, Y8); CSWAPY(Y4, Y7)
+	CSWAPY(Y3, Y6); CSWAPY(Y1, Y4); CSWAPY(Y2, Y5)
+	CSWAPY(Y4, Y7); CSWAPY(Y4, Y2); CSWAPY(Y6, Y4)
+	CSWAPY(Y4, Y2)
+
+	VMOVDQU Y4, 0(DI)
+	ADDQ    $32, AX
+	ADDQ    $32, BX
+	ADDQ    $32, CX
+	ADDQ    $32, DI
+	DECQ    DX
+	JNZ     avx2loop
+	VZEROUPPER
+
+avx2done:
+	RET
+
+// func median3x3SSE2(dst, r0, r1, r2 *uint8, n int)
+TEXT ·median3x3SSE2(SB), NOSPLIT, $0-40
+	MOVQ dst+0(FP), DI
+	MOVQ r0+8(FP), AX
+	MOVQ r1+16(FP), BX
+	MOVQ r2+24(FP), CX
+	MOVQ n+32(FP), DX
+	SHRQ $4, DX
+	JZ   sse2done
+
+sse2loop:
+	MOVOU 0(AX), X0
+	MOVOU 1(AX), X1
+	MOVOU 2(AX), X2
+	MOVOU 0(BX), X3
+	MOVOU 1(BX), X4
+	MOVOU 2(BX), X5
+	MOVOU 0(CX), X6
+	MOVOU 1(CX), X7
+	MOVOU 2(CX), X8
+
+	CSWAPX(X1, X2); CSWAPX(X4, X5); CSWAPX(X7, X8)
+	CSWAPX(X0, X1); CSWAPX(X3, X4); CSWAPX(X6, X7)
+	CSWAPX(X1, X2); CSWAPX(X4, X5); CSWAPX(X7, X8)
+	CSWAPX(X0, X3); CSWAPX(X5, X8); CSWAPX(X4, X7)
+	CSWAPX(X3, X6); CSWAPX(X1, X4); CSWAPX(X2, X5)
+	CSWAPX(X4, X7); CSWAPX(X4, X2); CSWAPX(X6, X4)
+	CSWAPX(X4, X2)
+
+	MOVOU X4, 0(DI)
+	ADDQ  $16, AX
+	ADDQ  $16, BX
+	ADDQ  $16, CX
+	ADDQ  $16, DI
+	DECQ  DX
+	JNZ   sse2loop
+
+sse2done:
+	RET
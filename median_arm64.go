@@ -0,0 +1,19 @@
+package main
+
+// Implemented in median_arm64.s. Filters n&^15 pixels; r0, r1 and r2 must
+// have n+2 readable bytes.
+
+//go:noescape
+func median3x3NEON(dst, r0, r1, r2 *uint8, n int)
+
+func median3x3Row(dst, r0, r1, r2 []uint8) {
+	n := len(dst)
+	median3x3NEON(&dst[0], &r0[0], &r1[0], &r2[0], n)
+	done := n &^ 15
+	median3x3RowGeneric(dst[done:], r0[done:], r1[done:], r2[done:])
+}
+
+// simdKernel names the row kernel median3x3Row runs on this CPU
+func simdKernel() string {
+	return "neon"
+}
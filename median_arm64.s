@@ -0,0 +1,52 @@
+#include "textflag.h"
+
+// Median of nine network, see median9 in median_simd.go. Each CSWAP leaves
+// min(a, b) in a and max(a, b) in b.
+
+#define CSWAP(a, b) VUMIN b.B16, a.B16, V9.B16; VUMAX b.B16, a.B16, b.B16; VMOV V9.B16, a.B16
+
+// func median3x3NEON(dst, r0, r1, r2 *uint8, n int)
+TEXT ·median3x3NEON(SB), NOSPLIT, $0-40
+	MOVD dst+0(FP), R0
+	MOVD r0+8(FP), R1
+	MOVD r1+16(FP), R2
+	MOVD r2+24(FP), R3
+	MOVD n+32(FP), R4
+	LSR  $4, R4, R4
+	CBZ  R4, done
+
+loop:
+	ADD  $1, R1, R5
+	ADD  $2, R1, R6
+	VLD1 (R1), [V0.B16]
+	VLD1 (R5), [V1.B16]
+	VLD1 (R6), [V2.B16]
+	ADD  $1, R2, R5
+	ADD  $2, R2, R6
+	VLD1 (R2), [V3.B16]
+	VLD1 (R5), [V4.B16]
+	VLD1 (R6), [V5.B16]
+	ADD  $1, R3, R5
+	ADD  $2, R3, R6
+	VLD1 (R3), [V6.B16]
+	VLD1 (R5), [V7.B16]
+	VLD1 (R6), [V8.B16]
+
+	CSWAP(V1, V2); CSWAP(V4, V5); CSWAP(V7, V8)
+	CSWAP(V0, V1); CSWAP(V3, V4); CSWAP(V6, V7)
+	CSWAP(V1, V2); CSWAP(V4, V5); CSWAP(V7, V8)
+	CSWAP(V0, V3); CSWAP(V5, V8); CSWAP(V4, V7)
+	CSWAP(V3, V6); CSWAP(V1, V4); CSWAP(V2, V5)
+	CSWAP(V4, V7); CSWAP(V4, V2); CSWAP(V6, V4)
+	CSWAP(V4, V2)
+
+	VST1 [V4.B16], (R0)
+	ADD  $16, R0
+	ADD  $16, R1
+	ADD  $16, R2
+	ADD  $16, R3
+	SUB  $1, R4
+	CBNZ R4, loop
+
+done:
+	RET
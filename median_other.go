@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+
+package main
+
+func median3x3Row(dst, r0, r1, r2 []uint8) {
+	median3x3RowGeneric(dst, r0, r1, r2)
+}
+
+// simdKernel names the row kernel median3x3Row runs on this CPU
+func simdKernel() string {
+	return "generic"
+}
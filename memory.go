@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"runtime/metrics"
+	"time"
+)
+
+// MemoryUsage is what one filter run cost in memory. PeakHeap is the
+// highest live heap seen during the run above the heap it started with,
+// Allocated and Mallocs count every allocation, including the ones the
+// garbage collector already freed, and GCPause and NumGC are the
+// stop-the-world pauses and collections that happened during the run.
+type MemoryUsage struct {
+	PeakHeap  uint64  `json:"peak_heap_bytes"`
+	Allocated uint64  `json:"allocated_bytes"`
+	Mallocs   uint64  `json:"mallocs"`
+	GCPause   float64 `json:"gc_pause_seconds"`
+	NumGC     uint32  `json:"num_gc"`
+}
+
+// heapObjects is the runtime metric sampled for the peak heap. Reading it
+// does not stop the world, unlike runtime.ReadMemStats.
+const heapObjects = "/memory/classes/heap/objects:bytes"
+
+// memorySampleInterval is how often the live heap is sampled while a
+// filter runs
+const memorySampleInterval = 200 * time.Microsecond
+
+func heapInUse(sample []metrics.Sample) uint64 {
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// measureMemory runs function once and measures its memory usage. It
+// collects garbage first so earlier work is not counted, and samples the
+// live heap in the background, so it is kept apart from the timed runs.
+func measureMemory(function func() *image.Gray) (*image.Gray, MemoryUsage) {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	sample := []metrics.Sample{{Name: heapObjects}}
+	base := heapInUse(sample)
+
+	stop := make(chan struct{})
+	peaks := make(chan uint64)
+	go func() {
+		sample := []metrics.Sample{{Name: heapObjects}}
+		ticker := time.NewTicker(memorySampleInterval)
+		defer ticker.Stop()
+		peak := base
+		for {
+			select {
+			case <-ticker.C:
+				peak = max(peak, heapInUse(sample))
+			case <-stop:
+				peaks <- peak
+				return
+			}
+		}
+	}()
+
+	output := function()
+	close(stop)
+	peak := max(<-peaks, heapInUse(sample))
+	runtime.ReadMemStats(&after)
+
+	return output, MemoryUsage{
+		PeakHeap:  peak - base,
+		Allocated: after.TotalAlloc - before.TotalAlloc,
+		Mallocs:   after.Mallocs - before.Mallocs,
+		GCPause:   time.Duration(after.PauseTotalNs - before.PauseTotalNs).Seconds(),
+		NumGC:     after.NumGC - before.NumGC,
+	}
+}
+
+// kibibytes formats a byte count in KiB, or "-" when usage was not
+// measured (entries resumed from older manifests)
+func kibibytes(bytes uint64, measured bool) string {
+	if !measured {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", float64(bytes)/(1<<10))
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+)
+
+// imageMetadata is the metadata of an input image that is carried over to
+// the filtered output. Reading it is best effort: anything malformed is
+// left out rather than failing the image.
+type imageMetadata struct {
+	// Orientation is the EXIF orientation, 1 to 8, or 0 when there is none
+	Orientation int
+	// EXIF is the TIFF structure of the EXIF block, without the "Exif\0\0"
+	// header JPEG puts in front of it
+	EXIF []byte
+	// orientationOffset is where the orientation value sits in EXIF
+	orientationOffset int
+	// ICC is the uncompressed ICC color profile, named ICCName
+	ICC     []byte
+	ICCName string
+	// Text are the tEXt, zTXt and iTXt chunks of a PNG input, and the
+	// comments of a JPEG input as tEXt chunks
+	Text []pngChunk
+}
+
+// pngChunk is one PNG chunk, without its length and CRC
+type pngChunk struct {
+	Type string
+	Data []byte
+}
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader   = []byte("Exif\x00\x00")
+	iccHeader    = []byte("ICC_PROFILE\x00")
+)
+
+// readMetadata reads the metadata of a PNG or JPEG file. Other formats have
+// none.
+func readMetadata(data []byte) imageMetadata {
+	var meta imageMetadata
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		meta = readPNGMetadata(data)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		meta = readJPEGMetadata(data)
+	}
+	if meta.EXIF != nil {
+		meta.Orientation, meta.orientationOffset = exifOrientation(meta.EXIF)
+	}
+	return meta
+}
+
+// readJPEGMetadata walks the marker segments in front of the image data,
+// collecting the EXIF block of APP1, the ICC profile split over APP2
+// segments and the COM comments
+func readJPEGMetadata(data []byte) imageMetadata {
+	var meta imageMetadata
+	icc := map[byte][]byte{}
+	iccParts := 0
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			// Fill byte
+			i++
+			continue
+		}
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			i += 2
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			// Start of scan or end of image: no metadata after this
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(segment, exifHeader) && meta.EXIF == nil:
+			meta.EXIF = bytes.Clone(segment[len(exifHeader):])
+		case marker == 0xe2 && bytes.HasPrefix(segment, iccHeader) && len(segment) >= len(iccHeader)+2:
+			// One based sequence number and total number of parts
+			seq, total := segment[len(iccHeader)], segment[len(iccHeader)+1]
+			icc[seq] = segment[len(iccHeader)+2:]
+			iccParts = int(total)
+		case marker == 0xfe:
+			meta.Text = append(meta.Text, pngChunk{"tEXt", append([]byte("Comment\x00"), latin1(segment)...)})
+		}
+		i += 2 + length
+	}
+	if iccParts > 0 && len(icc) == iccParts {
+		for seq := 1; seq <= iccParts; seq++ {
+			part, ok := icc[byte(seq)]
+			if !ok {
+				meta.ICC = nil
+				break
+			}
+			meta.ICC = append(meta.ICC, part...)
+		}
+		meta.ICCName = "ICC profile"
+	}
+	return meta
+}
+
+// latin1 replaces the bytes a PNG tEXt chunk cannot hold, which only allows
+// printable Latin-1 and line feeds
+func latin1(s []byte) []byte {
+	out := make([]byte, len(s))
+	for i, c := range s {
+		if c < 0x20 && c != '\n' || c >= 0x7f && c < 0xa0 {
+			c = '?'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// maxICCSize caps the inflated size of an iCCP profile. Real profiles are
+// a few KB to a few hundred, while the compressed chunk can inflate to
+// gigabytes, so a larger profile is dropped rather than read.
+const maxICCSize = 4 << 20
+
+// readPNGMetadata collects the eXIf, iCCP and text chunks of a PNG
+func readPNGMetadata(data []byte) imageMetadata {
+	var meta imageMetadata
+	for i := len(pngSignature); i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || i+12+length > len(data) {
+			break
+		}
+		typ := string(data[i+4 : i+8])
+		chunk := data[i+8 : i+8+length]
+		switch typ {
+		case "eXIf":
+			meta.EXIF = bytes.Clone(chunk)
+		case "iCCP":
+			name, rest, ok := bytes.Cut(chunk, []byte{0})
+			if !ok || len(rest) < 1 || rest[0] != 0 {
+				break
+			}
+			r, err := zlib.NewReader(bytes.NewReader(rest[1:]))
+			if err != nil {
+				break
+			}
+			profile, err := io.ReadAll(io.LimitReader(r, maxICCSize+1))
+			if err == nil && len(profile) <= maxICCSize {
+				meta.ICC, meta.ICCName = profile, string(name)
+			}
+		case "tEXt", "zTXt", "iTXt":
+			meta.Text = append(meta.Text, pngChunk{typ, bytes.Clone(chunk)})
+		case "IEND":
+			return meta
+		}
+		i += 12 + length
+	}
+	return meta
+}
+
+// exifOrientation returns the orientation tag of IFD0 of a TIFF structure
+// and the offset of its value, or 0, 0 when there is none
+func exifOrientation(tiff []byte) (orientation, offset int) {
+	if len(tiff) < 8 {
+		return 0, 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0, 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + 12*e
+		if entry+12 > len(tiff) {
+			break
+		}
+		// Orientation is a single SHORT stored in the value field
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value < 1 || value > 8 {
+				return 0, 0
+			}
+			return value, entry + 8
+		}
+	}
+	return 0, 0
+}
+
+// orientPoint returns where the pixel at x, y of a w x h image goes when
+// the image is turned upright according to an EXIF orientation
+func orientPoint(orientation, x, y, w, h int) (int, int) {
+	switch orientation {
+	case 2: // mirrored
+		return w - 1 - x, y
+	case 3: // rotated 180°
+		return w - 1 - x, h - 1 - y
+	case 4: // mirrored vertically
+		return x, h - 1 - y
+	case 5: // transposed
+		return y, x
+	case 6: // rotated 90° clockwise
+		return h - 1 - y, x
+	case 7: // transversed
+		return h - 1 - y, w - 1 - x
+	case 8: // rotated 90° counterclockwise
+		return y, w - 1 - x
+	}
+	return x, y
+}
+
+// orientedSize returns the upright size of a w x h image. Orientations 5 to
+// 8 swap the width and height.
+func orientedSize(orientation, w, h int) image.Rectangle {
+	if orientation >= 5 {
+		return image.Rect(0, 0, h, w)
+	}
+	return image.Rect(0, 0, w, h)
+}
+
+// orient turns img upright according to an EXIF orientation. img is
+// released to the gray pool when a new image is returned.
+func orient(img *image.Gray, orientation int) *image.Gray {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	output := GetGray(orientedSize(orientation, w, h))
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:w]
+		for x, v := range row {
+			dx, dy := orientPoint(orientation, x, y, w, h)
+			output.Pix[output.PixOffset(dx, dy)] = v
+		}
+	}
+	PutGray(img)
+	return output
+}
+
+// orientImage is orient for an image of any type. Grayscale images stay
+// *image.Gray; the others are turned into an *image.NRGBA, which keeps their
+// color and transparency.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	if gray, ok := img.(*image.Gray); ok {
+		return orient(gray, orientation)
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	output := image.NewNRGBA(orientedSize(orientation, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := orientPoint(orientation, x, y, w, h)
+			output.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return output
+}
+
+// pngChunks returns the metadata as PNG chunks. The pixels were already
+// turned upright by orient, so the orientation in the EXIF copy is reset to
+// 1 for viewers not to rotate them again.
+func (m imageMetadata) pngChunks() ([]pngChunk, error) {
+	var chunks []pngChunk
+	if m.ICC != nil {
+		var buf bytes.Buffer
+		name := m.ICCName
+		if name == "" || len(name) > 79 {
+			name = "ICC profile"
+		}
+		buf.WriteString(name)
+		buf.Write([]byte{0, 0}) // terminator and compression method
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(m.ICC); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, pngChunk{"iCCP", buf.Bytes()})
+	}
+	if m.EXIF != nil {
+		exif := bytes.Clone(m.EXIF)
+		if m.orientationOffset > 0 {
+			order := binary.ByteOrder(binary.LittleEndian)
+			if exif[0] == 'M' {
+				order = binary.BigEndian
+			}
+			order.PutUint16(exif[m.orientationOffset:], 1)
+		}
+		chunks = append(chunks, pngChunk{"eXIf", exif})
+	}
+	return append(chunks, m.Text...), nil
+}
+
+// insertPNGChunks returns the PNG encoding data with chunks added right
+// after its IHDR chunk, where iCCP must go before the image data
+func insertPNGChunks(data []byte, chunks []pngChunk) ([]byte, error) {
+	const ihdrEnd = 8 + 12 + 13 // signature and the 13 byte IHDR chunk
+	if len(data) < ihdrEnd || !bytes.HasPrefix(data, pngSignature) || string(data[12:16]) != "IHDR" {
+		return nil, fmt.Errorf("not a PNG encoding")
+	}
+	var buf bytes.Buffer
+	buf.Write(data[:ihdrEnd])
+	for _, chunk := range chunks {
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(chunk.Data)))
+		copy(header[4:], chunk.Type)
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(chunk.Data)
+		buf.Write(header[:])
+		buf.Write(chunk.Data)
+		binary.Write(&buf, binary.BigEndian, crc.Sum32())
+	}
+	buf.Write(data[ihdrEnd:])
+	return buf.Bytes(), nil
+}
+
+// encodeWithMetadata encodes img like encodeImage and, for PNG output, adds
+// meta. PGM and PPM have nowhere to keep it.
+func encodeWithMetadata(w io.Writer, img image.Image, format string, meta imageMetadata) error {
+	chunks, err := meta.pngChunks()
+	if err != nil {
+		return err
+	}
+	if format == "pgm" || format == "ppm" || len(chunks) == 0 {
+		return encodeImage(w, img, format)
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, format); err != nil {
+		return err
+	}
+	data, err := insertPNGChunks(buf.Bytes(), chunks)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
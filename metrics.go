@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the filter latency histogram
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Metrics collects the counters exported on /metrics in the Prometheus text format
+type Metrics struct {
+	mu           sync.Mutex
+	images       map[string]uint64
+	pixels       map[string]float64
+	seconds      map[string]float64
+	latency      map[string]*histogram
+	busyWorkers  int
+	totalWorkers int
+	busySeconds  float64
+}
+
+// filterMetrics is shared by every mode that filters images
+var filterMetrics = &Metrics{
+	images:  map[string]uint64{},
+	pixels:  map[string]float64{},
+	seconds: map[string]float64{},
+	latency: map[string]*histogram{},
+}
+
+// Observe records one filtered image
+func (m *Metrics) Observe(mode string, pixels int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.latency[mode]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[mode] = h
+	}
+	h.observe(elapsed.Seconds())
+	m.images[mode]++
+	m.pixels[mode] += float64(pixels)
+	m.seconds[mode] += elapsed.Seconds()
+}
+
+// SetWorkers sets the size of the worker pool used for the utilization gauges
+func (m *Metrics) SetWorkers(n int) {
+	m.mu.Lock()
+	m.totalWorkers = n
+	m.mu.Unlock()
+}
+
+// WorkerBusy marks a worker as busy and returns a func that marks it idle again
+func (m *Metrics) WorkerBusy() func() {
+	start := time.Now()
+	m.mu.Lock()
+	m.busyWorkers++
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		m.busyWorkers--
+		m.busySeconds += time.Since(start).Seconds()
+		m.mu.Unlock()
+	}
+}
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	modes := make([]string, 0, len(m.images))
+	for mode := range m.images {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+
+	fmt.Fprintln(w, "# HELP hpc_images_processed_total Images filtered, by filter mode.")
+	fmt.Fprintln(w, "# TYPE hpc_images_processed_total counter")
+	for _, mode := range modes {
+		fmt.Fprintf(w, "hpc_images_processed_total{mode=%q} %d\n", mode, m.images[mode])
+	}
+
+	fmt.Fprintln(w, "# HELP hpc_megapixels_processed_total Megapixels filtered, by filter mode.")
+	fmt.Fprintln(w, "# TYPE hpc_megapixels_processed_total counter")
+	for _, mode := range modes {
+		fmt.Fprintf(w, "hpc_megapixels_processed_total{mode=%q} %g\n", mode, m.pixels[mode]/1e6)
+	}
+
+	fmt.Fprintln(w, "# HELP hpc_megapixels_per_second Average filter throughput, by filter mode.")
+	fmt.Fprintln(w, "# TYPE hpc_megapixels_per_second gauge")
+	for _, mode := range modes {
+		var rate float64
+		if m.seconds[mode] > 0 {
+			rate = m.pixels[mode] / 1e6 / m.seconds[mode]
+		}
+		fmt.Fprintf(w, "hpc_megapixels_per_second{mode=%q} %g\n", mode, rate)
+	}
+
+	fmt.Fprintln(w, "# HELP hpc_filter_duration_seconds Time spent filtering one image, by filter mode.")
+	fmt.Fprintln(w, "# TYPE hpc_filter_duration_seconds histogram")
+	for _, mode := range modes {
+		h := m.latency[mode]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "hpc_filter_duration_seconds_bucket{mode=%q,le=\"%g\"} %d\n", mode, bound, cumulative)
+		}
+		fmt.Fprintf(w, "hpc_filter_duration_seconds_bucket{mode=%q,le=\"+Inf\"} %d\n", mode, h.count)
+		fmt.Fprintf(w, "hpc_filter_duration_seconds_sum{mode=%q} %g\n", mode, h.sum)
+		fmt.Fprintf(w, "hpc_filter_duration_seconds_count{mode=%q} %d\n", mode, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP hpc_workers Size of the filter worker pool.")
+	fmt.Fprintln(w, "# TYPE hpc_workers gauge")
+	fmt.Fprintf(w, "hpc_workers %d\n", m.totalWorkers)
+	fmt.Fprintln(w, "# HELP hpc_workers_busy Workers currently filtering an image.")
+	fmt.Fprintln(w, "# TYPE hpc_workers_busy gauge")
+	fmt.Fprintf(w, "hpc_workers_busy %d\n", m.busyWorkers)
+	fmt.Fprintln(w, "# HELP hpc_worker_busy_seconds_total Time workers spent filtering, divide its rate by hpc_workers for utilization.")
+	fmt.Fprintln(w, "# TYPE hpc_worker_busy_seconds_total counter")
+	fmt.Fprintf(w, "hpc_worker_busy_seconds_total %g\n", m.busySeconds)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintln(w, "# HELP go_goroutines Number of goroutines that currently exist.")
+	fmt.Fprintln(w, "# TYPE go_goroutines gauge")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	fmt.Fprintln(w, "# HELP go_memstats_heap_alloc_bytes Bytes of allocated heap objects.")
+	fmt.Fprintln(w, "# TYPE go_memstats_heap_alloc_bytes gauge")
+	fmt.Fprintf(w, "go_memstats_heap_alloc_bytes %d\n", mem.HeapAlloc)
+	fmt.Fprintln(w, "# HELP go_memstats_alloc_bytes_total Cumulative bytes allocated for heap objects.")
+	fmt.Fprintln(w, "# TYPE go_memstats_alloc_bytes_total counter")
+	fmt.Fprintf(w, "go_memstats_alloc_bytes_total %d\n", mem.TotalAlloc)
+	fmt.Fprintln(w, "# HELP go_gc_cycles_total Completed GC cycles.")
+	fmt.Fprintln(w, "# TYPE go_gc_cycles_total counter")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", mem.NumGC)
+	fmt.Fprintln(w, "# HELP go_gc_pause_seconds_total Total time the world was stopped for GC.")
+	fmt.Fprintln(w, "# TYPE go_gc_pause_seconds_total counter")
+	fmt.Fprintf(w, "go_gc_pause_seconds_total %g\n", float64(mem.PauseTotalNs)/1e9)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	filterMetrics.WritePrometheus(w)
+}
+
+// serveMetrics exposes /metrics on addr in the background, for batch runs
+// that do not already have an HTTP server
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fatal("metrics server stopped", "addr", addr, "err", err)
+		}
+	}()
+}
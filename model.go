@@ -0,0 +1,61 @@
+package main
+
+// Amdahl's law predicts the speedup of a fixed problem on n workers when a
+// fraction s of the work is serial:
+//
+//	S(n) = 1 / (s + (1-s)/n)
+//
+// Gustafson's law predicts the scaled speedup when the problem grows with n:
+//
+//	S(n) = n - s(n-1)
+//
+// Both are linear in s once rearranged, so s is fitted by least squares
+// through the origin and clamped to [0, 1]. Every fit expects points[0] to be
+// the single-worker baseline.
+
+// amdahlSpeedup is the speedup Amdahl's law predicts on n workers
+func amdahlSpeedup(serial float64, n int) float64 {
+	return 1 / (serial + (1-serial)/float64(n))
+}
+
+// gustafsonSpeedup is the scaled speedup Gustafson's law predicts on n workers
+func gustafsonSpeedup(serial float64, n int) float64 {
+	return float64(n) - serial*float64(n-1)
+}
+
+// fitAmdahl estimates the serial fraction from strong-scaling points, using
+// 1/S - 1/n = s(1 - 1/n)
+func fitAmdahl(points []ScalingPoint) float64 {
+	base := points[0].Time.Seconds()
+	var xy, xx float64
+	for _, p := range points {
+		n := float64(p.Workers)
+		speedup := base / p.Time.Seconds()
+		x := 1 - 1/n
+		xy += x * (1/speedup - 1/n)
+		xx += x * x
+	}
+	return clampFraction(xy, xx)
+}
+
+// fitGustafson estimates the serial fraction from weak-scaling points, using
+// n - S = s(n - 1) with the scaled speedup S = n T(1)/T(n)
+func fitGustafson(points []ScalingPoint) float64 {
+	base := points[0].Time.Seconds()
+	var xy, xx float64
+	for _, p := range points {
+		n := float64(p.Workers)
+		speedup := n * base / p.Time.Seconds()
+		x := n - 1
+		xy += x * (n - speedup)
+		xx += x * x
+	}
+	return clampFraction(xy, xx)
+}
+
+func clampFraction(xy, xx float64) float64 {
+	if xx == 0 {
+		return 0
+	}
+	return min(1, max(0, xy/xx))
+}
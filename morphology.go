@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// structuringElement is the set of offsets around a pixel that grayscale
+// morphology takes the minimum or maximum of
+type structuringElement []image.Point
+
+// newStructuringElement builds a square, cross or disk of the given odd size
+func newStructuringElement(shape string, size int) (structuringElement, error) {
+	if size < 1 || size%2 == 0 {
+		return nil, fmt.Errorf("structuring element size must be a positive odd number, got %d", size)
+	}
+	r := size / 2
+	var se structuringElement
+	for dy := -r; dy <= r; dy++ {
+		for dx := -r; dx <= r; dx++ {
+			switch shape {
+			case "square":
+			case "cross":
+				if dx != 0 && dy != 0 {
+					continue
+				}
+			case "disk":
+				if dx*dx+dy*dy > r*r {
+					continue
+				}
+			default:
+				return nil, fmt.Errorf("unknown structuring element %q, use square, cross or disk", shape)
+			}
+			se = append(se, image.Point{X: dx, Y: dy})
+		}
+	}
+	return se, nil
+}
+
+// parseStructuringElement parses "shape:size", e.g. "disk:5"
+func parseStructuringElement(spec string) (structuringElement, error) {
+	shape, sizeText, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid structuring element %q, want shape:size", spec)
+	}
+	size, err := strconv.Atoi(sizeText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid structuring element size %q", sizeText)
+	}
+	return newStructuringElement(shape, size)
+}
+
+// morphRect writes the minimum (erode) or maximum of every pixel's
+// neighborhood under se into output for the pixels of rect. Offsets falling
+// outside the image are ignored, like getNeighborhood does.
+func morphRect(output, img *image.Gray, rect image.Rectangle, se structuringElement, erode bool) {
+	bounds := img.Bounds()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			value := img.Pix[img.PixOffset(x, y)]
+			for _, d := range se {
+				p := image.Point{X: x + d.X, Y: y + d.Y}
+				if !p.In(bounds) {
+					continue
+				}
+				v := img.Pix[img.PixOffset(p.X, p.Y)]
+				if (erode && v < value) || (!erode && v > value) {
+					value = v
+				}
+			}
+			output.Pix[output.PixOffset(x, y)] = value
+		}
+	}
+}
+
+// Erosion and Dilation (Sequential)
+func erodeSequential(img *image.Gray, se structuringElement) *image.Gray {
+	output := GetGray(img.Bounds())
+	morphRect(output, img, img.Bounds(), se, true)
+	return output
+}
+
+func dilateSequential(img *image.Gray, se structuringElement) *image.Gray {
+	output := GetGray(img.Bounds())
+	morphRect(output, img, img.Bounds(), se, false)
+	return output
+}
+
+// Erosion and Dilation (Parallel)
+func erodeParallel(img *image.Gray, se structuringElement, chunkSize int) *image.Gray {
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		morphRect(output, img, tile, se, true)
+	})
+	return output
+}
+
+func dilateParallel(img *image.Gray, se structuringElement, chunkSize int) *image.Gray {
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		morphRect(output, img, tile, se, false)
+	})
+	return output
+}
+
+// Opening removes bright details smaller than se, closing fills dark ones.
+// The parallel variants run both passes tiled, waiting for the first pass to
+// finish before the second one starts. The result of the first pass goes
+// back to the pool once the second one is done.
+func openSequential(img *image.Gray, se structuringElement) *image.Gray {
+	first := erodeSequential(img, se)
+	defer PutGray(first)
+	return dilateSequential(first, se)
+}
+
+func closeSequential(img *image.Gray, se structuringElement) *image.Gray {
+	first := dilateSequential(img, se)
+	defer PutGray(first)
+	return erodeSequential(first, se)
+}
+
+func openParallel(img *image.Gray, se structuringElement, chunkSize int) *image.Gray {
+	first := erodeParallel(img, se, chunkSize)
+	defer PutGray(first)
+	return dilateParallel(first, se, chunkSize)
+}
+
+func closeParallel(img *image.Gray, se structuringElement, chunkSize int) *image.Gray {
+	first := dilateParallel(img, se, chunkSize)
+	defer PutGray(first)
+	return erodeParallel(first, se, chunkSize)
+}
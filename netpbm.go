@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Netpbm support: binary (P5/P6) and plain (P2/P3) PGM and PPM, the formats
+// most C and MPI reference implementations read and write. Decoding is
+// registered with the image package, so loadImage and image.Decode accept
+// them like PNG and JPEG.
+func init() {
+	for _, magic := range []string{"P2", "P5"} {
+		image.RegisterFormat("pgm", magic, decodeNetpbm, decodeNetpbmConfig)
+	}
+	for _, magic := range []string{"P3", "P6"} {
+		image.RegisterFormat("ppm", magic, decodeNetpbm, decodeNetpbmConfig)
+	}
+}
+
+// netpbmHeader is the magic number, size and maximum sample value of a file
+type netpbmHeader struct {
+	magic         string
+	width, height int
+	maxval        int
+}
+
+// readNetpbmToken reads the next whitespace separated header token,
+// skipping # comments
+func readNetpbmToken(r *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(token) > 0 {
+				return string(token), nil
+			}
+			return "", err
+		}
+		switch {
+		case b == '#' && len(token) == 0:
+			if _, err := r.ReadString('\n'); err != nil {
+				return "", err
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, b)
+		}
+	}
+}
+
+func readNetpbmInt(r *bufio.Reader) (int, error) {
+	token, err := readNetpbmToken(r)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(token)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("netpbm: invalid number %q", token)
+	}
+	return n, nil
+}
+
+// readNetpbmHeader reads the header up to and including the single
+// whitespace byte that precedes binary samples
+func readNetpbmHeader(r *bufio.Reader) (netpbmHeader, error) {
+	var h netpbmHeader
+	var err error
+	if h.magic, err = readNetpbmToken(r); err != nil {
+		return h, err
+	}
+	switch h.magic {
+	case "P2", "P3", "P5", "P6":
+	default:
+		return h, fmt.Errorf("netpbm: unsupported magic number %q", h.magic)
+	}
+	if h.width, err = readNetpbmInt(r); err != nil {
+		return h, err
+	}
+	if h.height, err = readNetpbmInt(r); err != nil {
+		return h, err
+	}
+	if h.maxval, err = readNetpbmInt(r); err != nil {
+		return h, err
+	}
+	if h.maxval < 1 || h.maxval > 65535 {
+		return h, fmt.Errorf("netpbm: maximum value %d out of range", h.maxval)
+	}
+	return h, nil
+}
+
+func (h netpbmHeader) gray() bool {
+	return h.magic == "P2" || h.magic == "P5"
+}
+
+func decodeNetpbmConfig(r io.Reader) (image.Config, error) {
+	h, err := readNetpbmHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	model := color.RGBAModel
+	if h.gray() {
+		model = color.GrayModel
+	}
+	return image.Config{ColorModel: model, Width: h.width, Height: h.height}, nil
+}
+
+// decodeNetpbm decodes a PGM into an *image.Gray and a PPM into an
+// *image.RGBA. Samples with a maximum value other than 255 are scaled to
+// 8 bits.
+func decodeNetpbm(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readNetpbmHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := 3
+	if h.gray() {
+		channels = 1
+	}
+	samples := make([]uint8, h.width*h.height*channels)
+	if h.magic == "P5" || h.magic == "P6" {
+		size := 1
+		if h.maxval > 255 {
+			size = 2
+		}
+		raw := make([]byte, len(samples)*size)
+		if _, err := io.ReadFull(br, raw); err != nil {
+			return nil, fmt.Errorf("netpbm: reading samples: %w", err)
+		}
+		for i := range samples {
+			v := int(raw[i*size])
+			if size == 2 {
+				v = v<<8 | int(raw[i*size+1])
+			}
+			samples[i] = uint8(min(v, h.maxval) * 255 / h.maxval)
+		}
+	} else {
+		for i := range samples {
+			v, err := readNetpbmInt(br)
+			if err != nil {
+				return nil, fmt.Errorf("netpbm: reading samples: %w", err)
+			}
+			samples[i] = uint8(min(v, h.maxval) * 255 / h.maxval)
+		}
+	}
+
+	bounds := image.Rect(0, 0, h.width, h.height)
+	if h.gray() {
+		return &image.Gray{Pix: samples, Stride: h.width, Rect: bounds}, nil
+	}
+	img := image.NewRGBA(bounds)
+	for i := 0; i < h.width*h.height; i++ {
+		copy(img.Pix[4*i:], samples[3*i:3*i+3])
+		img.Pix[4*i+3] = 255
+	}
+	return img, nil
+}
+
+// encodePGM writes img as a binary PGM (P5) with a maximum value of 255
+func encodePGM(w io.Writer, img *image.Gray) error {
+	b := img.Bounds()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P5\n%d %d\n255\n", b.Dx(), b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		bw.Write(img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)])
+	}
+	return bw.Flush()
+}
+
+// encodePPM writes img as a binary PPM (P6) with a maximum value of 255,
+// dropping any alpha channel
+func encodePPM(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P6\n%d %d\n255\n", b.Dx(), b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			bw.Write([]byte{c.R, c.G, c.B})
+		}
+	}
+	return bw.Flush()
+}
+
+// encodeImage writes img as a PGM or PPM when format is "pgm" or "ppm" and
+// as a PNG otherwise
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "pgm":
+		gray, ok := img.(*image.Gray)
+		if !ok {
+			gray = toBlackAndWhite(img)
+		}
+		return encodePGM(w, gray)
+	case "ppm":
+		return encodePPM(w, img)
+	}
+	return png.Encode(w, img)
+}
+
+// imageExtensions are the input formats listImages picks up
+var imageExtensions = []string{".png", ".jpg", ".jpeg", ".pgm", ".ppm"}
+
+// listImages returns the sorted paths of every image in folder. Extensions
+// are matched like isImageName does, so KODIM01.PNG straight off a camera
+// is listed too.
+func listImages(folder string) ([]string, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isImageName(entry.Name()) {
+			files = append(files, filepath.Join(folder, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// withFormat replaces the extension of filename with the one of format
+// (png, pgm or ppm), or keeps it when format is empty
+func withFormat(filename, format string) string {
+	if format == "" {
+		return filename
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "." + format
+}
+
+// validOutputFormat reports whether saveImage can write format
+func validOutputFormat(format string) bool {
+	switch format {
+	case "", "png", "pgm", "ppm":
+		return true
+	}
+	return false
+}
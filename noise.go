@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// NoiseEstimate is the noise measured in one image
+type NoiseEstimate struct {
+	// Sigma is the standard deviation of the Gaussian-like noise in gray
+	// levels, from the median absolute deviation of the Laplacian
+	Sigma float64 `json:"sigma"`
+	// Impulse is the fraction of pixels hit by salt and pepper noise
+	Impulse float64 `json:"impulse"`
+}
+
+// impulseContrast is how far a black or white pixel must be from the median
+// of its 8 neighbors to count as an impulse rather than a saturated area
+const impulseContrast = 64
+
+// estimateNoise measures the impulse density and the Gaussian noise sigma
+// of img. A pixel counts as an impulse when it is 0 or 255 and differs from
+// the median of its neighbors by impulseContrast or more. The sigma is
+// 1.4826 times the median absolute deviation of the response to the
+// Laplacian difference mask
+//
+//	 1 -2  1
+//	-2  4 -2
+//	 1 -2  1
+//
+// divided by the mask's norm of 6 (Immerkær, 1996), skipping impulses so
+// they do not inflate it. The mask cancels smooth image content; the
+// median keeps the edges it does not cancel from counting as noise.
+// Images smaller than 3x3 have no interior and report no noise.
+func estimateNoise(img *image.Gray) NoiseEstimate {
+	bounds := img.Bounds()
+	if bounds.Dx() < 3 || bounds.Dy() < 3 {
+		return NoiseEstimate{}
+	}
+
+	// Laplacian responses range from -8*255 to 8*255
+	const offset = 8 * 255
+	histogram := make([]int, 2*offset+1)
+	var impulses, samples int
+	neighbors := make([]uint8, 0, 8)
+	for y := bounds.Min.Y + 1; y < bounds.Max.Y-1; y++ {
+		above := img.Pix[img.PixOffset(bounds.Min.X, y-1):][:bounds.Dx()]
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()]
+		below := img.Pix[img.PixOffset(bounds.Min.X, y+1):][:bounds.Dx()]
+		for x := 1; x < len(row)-1; x++ {
+			p := row[x]
+			if p == 0 || p == 255 {
+				neighbors = append(neighbors[:0], above[x-1], above[x], above[x+1], row[x-1], row[x+1], below[x-1], below[x], below[x+1])
+				slices.Sort(neighbors)
+				if math.Abs(float64(p)-float64(neighbors[4])) >= impulseContrast {
+					impulses++
+					continue
+				}
+			}
+			l := int(above[x-1]) - 2*int(above[x]) + int(above[x+1]) -
+				2*int(row[x-1]) + 4*int(p) - 2*int(row[x+1]) +
+				int(below[x-1]) - 2*int(below[x]) + int(below[x+1])
+			histogram[l+offset]++
+			samples++
+		}
+	}
+
+	estimate := NoiseEstimate{Impulse: float64(impulses) / float64((bounds.Dx()-2)*(bounds.Dy()-2))}
+	if samples == 0 {
+		return estimate
+	}
+	median := histogramMedian(histogram, samples) - offset
+	deviations := make([]int, offset+1)
+	for i, count := range histogram {
+		d := i - offset - median
+		if d < 0 {
+			d = -d
+		}
+		deviations[min(d, offset)] += count
+	}
+	estimate.Sigma = 1.4826 * float64(histogramMedian(deviations, samples)) / 6
+	return estimate
+}
+
+// histogramMedian returns the bin holding the middle of total samples
+func histogramMedian(histogram []int, total int) int {
+	seen := 0
+	for bin, count := range histogram {
+		seen += count
+		if 2*seen > total {
+			return bin
+		}
+	}
+	return len(histogram) - 1
+}
+
+// recommendKernel picks the median window size for the estimated noise:
+// the larger of the size the impulse density needs and the size the
+// Gaussian sigma needs. An impulse density up to 10% is removed by a 3x3
+// median, up to 25% by 5x5 and up to 40% by 7x7; above that 9x9 is used.
+// The median only smooths Gaussian noise, so the sigma thresholds are
+// looser: 3x3 up to sigma 5, 5x5 up to 15 and 7x7 above. An image with
+// almost no noise gets 1, which leaves it as it is.
+func recommendKernel(noise NoiseEstimate) int {
+	if noise.Impulse < 0.001 && noise.Sigma < 2 {
+		return 1
+	}
+	kernel := 3
+	switch {
+	case noise.Impulse > 0.4:
+		kernel = 9
+	case noise.Impulse > 0.25:
+		kernel = 7
+	case noise.Impulse > 0.1:
+		kernel = 5
+	}
+	switch {
+	case noise.Sigma > 15:
+		kernel = max(kernel, 7)
+	case noise.Sigma > 5:
+		kernel = max(kernel, 5)
+	}
+	return kernel
+}
+
+// parseKernel parses a -kernel flag: an odd window size, or auto to pick
+// one per image with recommendKernel, returned as 0
+func parseKernel(value string) (int, error) {
+	if value == "auto" {
+		return 0, nil
+	}
+	kernel, err := strconv.Atoi(value)
+	if err != nil || kernel < 1 || kernel%2 == 0 {
+		return 0, fmt.Errorf("kernel size must be a positive odd number or auto, got %q", value)
+	}
+	return kernel, nil
+}
+
+// autoKernel returns kernel, or the recommended size for img when kernel
+// is 0 (auto), logging the estimate it was picked from
+func autoKernel(img *image.Gray, kernel int, name string) int {
+	if kernel != 0 {
+		return kernel
+	}
+	noise := estimateNoise(img)
+	kernel = recommendKernel(noise)
+	slog.Info("picked kernel size", "image", name, "kernel", kernel, "sigma", noise.Sigma, "impulse", noise.Impulse)
+	return kernel
+}
+
+// runNoise estimates the noise of every input image and prints the kernel
+// size the auto mode would pick for it
+func runNoise(args []string) {
+	fs := flag.NewFlagSet("noise", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	density := fs.Float64("noise", 0, "fraction of pixels replaced by salt and pepper before estimating, to check the estimator against a known density")
+	seed := fs.Int64("seed", 1, "seed of the -noise pixels")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if *density < 0 || *density > 1 {
+		fatal("noise must be between 0 and 1", "noise", *density)
+	}
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+
+	fmt.Println("Image\t\tSigma\tImpulse (%)\tKernel")
+	fmt.Println("------------------------------------------------------------------")
+	images := 0
+	err = in.Walk(func(filename string, img image.Image) error {
+		images++
+		gray := toBlackAndWhite(img)
+		if *density > 0 {
+			noisy := addImpulseNoise(gray, *density, *seed)
+			PutGray(gray)
+			gray = noisy
+		}
+		noise := estimateNoise(gray)
+		PutGray(gray)
+		fmt.Printf("%-16s%.2f\t%.2f\t\t%d\n", filename, noise.Sigma, 100*noise.Impulse, recommendKernel(noise))
+		return nil
+	})
+	if err != nil {
+		fatal("failed to estimate noise", "input", *input, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+}
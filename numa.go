@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// medianFilterNUMA is the parallel median filter laid out for NUMA
+// machines. The image is cut into one horizontal band per node, sized by
+// the node's share of the CPUs, and every band is handled by workers
+// pinned to the CPUs of its node in three steps: copy the band plus a
+// filterSize halo out of the shared input, filter its tiles, and copy the
+// result back into the output. The band buffers are mapped fresh for every
+// run rather than taken from the Go heap, so their pages are still
+// untouched when the pinned workers first write them and Linux's
+// first-touch policy places them on the node that filters them, on the
+// repeated timed runs as on the first. Only the copies in and out cross
+// sockets; every window is read from local memory.
+func medianFilterNUMA(img *image.Gray, chunkSize, filterSize int) (*image.Gray, error) {
+	nodes, err := numaNodes()
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	output := GetGray(bounds)
+	total := 0
+	for _, cpus := range nodes {
+		total += len(cpus)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(nodes))
+	first := 0
+	for i, cpus := range nodes {
+		last := first + len(cpus)
+		band := image.Rect(bounds.Min.X, bounds.Min.Y+bounds.Dy()*first/total, bounds.Max.X, bounds.Min.Y+bounds.Dy()*last/total)
+		first = last
+		if band.Empty() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, cpus []int, band image.Rectangle) {
+			defer wg.Done()
+			errs[i] = filterBand(output, img, band, cpus, chunkSize, filterSize)
+		}(i, cpus, band)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			PutGray(output)
+			return nil, err
+		}
+	}
+	return output, nil
+}
+
+// filterBand filters the rows of band with one worker pinned to the CPUs
+// of its node per CPU. The workers share every step, meeting at a barrier
+// between them.
+func filterBand(output, img *image.Gray, band image.Rectangle, cpus []int, chunkSize, filterSize int) error {
+	halo := band.Inset(-filterSize).Intersect(img.Bounds())
+	localPix, err := mapUntouched(halo.Dx() * halo.Dy())
+	if err != nil {
+		return fmt.Errorf("failed to map the band buffer: %w", err)
+	}
+	defer unmap(localPix)
+	resultPix, err := mapUntouched(band.Dx() * band.Dy())
+	if err != nil {
+		return fmt.Errorf("failed to map the band buffer: %w", err)
+	}
+	defer unmap(resultPix)
+	local := &image.Gray{Pix: localPix, Stride: halo.Dx(), Rect: halo}
+	result := &image.Gray{Pix: resultPix, Stride: band.Dx(), Rect: band}
+	tiles := tileRects(band, chunkSize)
+
+	workers := len(cpus)
+	var copied, filtered, done sync.WaitGroup
+	copied.Add(workers)
+	filtered.Add(workers)
+	done.Add(workers)
+	errs := make([]error, workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer done.Done()
+			// The thread is never unlocked, so it exits with the goroutine
+			// instead of going back to the scheduler still pinned
+			runtime.LockOSThread()
+			errs[w] = pinThread(cpus)
+
+			copyRows(local, img, halo, w, workers)
+			copied.Done()
+			copied.Wait()
+
+			for i := w; i < len(tiles); i += workers {
+				medianRect(result, local, tiles[i], filterSize)
+			}
+			filtered.Done()
+			filtered.Wait()
+
+			copyRows(output, result, band, w, workers)
+		}(w)
+	}
+	done.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to pin a worker to CPUs %s: %w", formatCPUs(cpus), err)
+		}
+	}
+	return nil
+}
+
+// copyRows copies every workers-th row of rect from src to dst, starting
+// with row w
+func copyRows(dst, src *image.Gray, rect image.Rectangle, w, workers int) {
+	for y := rect.Min.Y + w; y < rect.Max.Y; y += workers {
+		copy(dst.Pix[dst.PixOffset(rect.Min.X, y):][:rect.Dx()], src.Pix[src.PixOffset(rect.Min.X, y):])
+	}
+}
+
+// runNUMA times the shared parallel filter against the NUMA-aware one on
+// the dataset, checking that they produce the same pixels
+func runNUMA(args []string) {
+	fs := flag.NewFlagSet("numa", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by both filters")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	runs := fs.Int("runs", 3, "times every filter is run per image, the mean is reported")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if _, err := applyFilter("numa", image.NewGray(image.Rect(0, 0, 1, 1)), *chunkSize, *kernel); err != nil {
+		fatal("invalid filter settings", "err", err)
+	}
+	nodes, _ := numaNodes()
+	for i, cpus := range nodes {
+		slog.Info("found NUMA node", "node", i, "cpus", formatCPUs(cpus))
+	}
+	filterSize := *kernel / 2
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+
+	var shared, local time.Duration
+	images := 0
+	err = in.Walk(func(filename string, img image.Image) error {
+		images++
+		bwImage := toBlackAndWhite(img)
+		defer PutGray(bwImage)
+		parallel := func() *image.Gray { return medianFilterParallel(bwImage, *chunkSize, filterSize) }
+		numa := func() *image.Gray {
+			output, err := medianFilterNUMA(bwImage, *chunkSize, filterSize)
+			if err != nil {
+				fatal("failed to filter image", "image", filename, "err", err)
+			}
+			return output
+		}
+
+		want, got := parallel(), numa()
+		equal := bytes.Equal(want.Pix, got.Pix)
+		PutGray(want)
+		PutGray(got)
+		if !equal {
+			return fmt.Errorf("%s: NUMA output differs from the parallel output", filename)
+		}
+		for _, elapsed := range measureRuns(*runs, parallel) {
+			shared += elapsed
+		}
+		for _, elapsed := range measureRuns(*runs, numa) {
+			local += elapsed
+		}
+		slog.Debug("processed image", "image", filename, "stage", "numa")
+		return nil
+	})
+	if err != nil {
+		fatal("failed to compare NUMA placement", "input", *input, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+
+	n := time.Duration(images * *runs)
+	shared /= n
+	local /= n
+	fmt.Printf("%d NUMA node(s), mean time per image\n", len(nodes))
+	fmt.Println("Placement\tTime (s)\tSpeedup")
+	fmt.Println("------------------------------------------------------------------")
+	fmt.Printf("shared\t\t%.6f\t1.00x\n", shared.Seconds())
+	fmt.Printf("numa\t\t%.6f\t%.2fx\n", local.Seconds(), shared.Seconds()/local.Seconds())
+}
@@ -0,0 +1,51 @@
+//go:build opencv
+
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"gocv.io/x/gocv"
+
+	"hpc_final/filter"
+)
+
+// Building with -tags opencv registers OpenCV's median filter as the
+// "opencv" filter, so the benchmark can time it next to the Go variants
+// with -filters opencv and -verify can check the Go filters against it.
+// It needs OpenCV 4 and gocv.io/x/gocv, see the README.
+func init() {
+	filter.Register("opencv", medianFilterOpenCV)
+}
+
+// medianFilterOpenCV runs cv::medianBlur on img. OpenCV always fills the
+// windows past the edge by replicating it, so with the crop border only the
+// pixels at least kernel/2 from the edge match the Go filters. It picks its
+// own number of threads and ignores the workers and chunk size.
+func medianFilterOpenCV(img *image.Gray, c filter.Config) (*image.Gray, error) {
+	if c.Border != filter.Crop && c.Border != filter.Replicate {
+		return nil, fmt.Errorf("opencv only replicates the edge, got the %s border", c.Border)
+	}
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return GetGray(bounds), nil
+	}
+	// Rows are copied one by one since img may be a sub-image
+	pix := make([]byte, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix = append(pix, img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()]...)
+	}
+	src, err := gocv.NewMatFromBytes(bounds.Dy(), bounds.Dx(), gocv.MatTypeCV8U, pix)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	dst := gocv.NewMat()
+	defer dst.Close()
+	gocv.MedianBlur(src, &dst, c.Kernel)
+
+	output := GetGray(bounds)
+	copy(output.Pix, dst.ToBytes())
+	return output, nil
+}
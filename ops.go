@@ -0,0 +1,376 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// operation is an image operation benchmarked by the ops subcommand. Both
+// variants must produce the same pixels.
+type operation struct {
+	name       string
+	sequential func(img *image.Gray) *image.Gray
+	parallel   func(img *image.Gray, chunkSize int) *image.Gray
+}
+
+// opsConfig holds the settings of the operations that take parameters
+type opsConfig struct {
+	element   structuringElement
+	cannyLow  float32
+	cannyHigh float32
+
+	bilateralSpatial float64
+	bilateralRange   float64
+
+	gaussianSigma float64
+
+	rankRadius     int
+	rankPercentile float64
+
+	weights weightMask
+
+	adaptiveMax int
+
+	pyramidLevels    int
+	pyramidThreshold float32
+}
+
+// operations lists every operation known to the ops subcommand, configured with cfg
+func operations(cfg opsConfig) []operation {
+	return []operation{
+		{"median", func(img *image.Gray) *image.Gray { return medianFilterSequential(img, 1) },
+			func(img *image.Gray, chunkSize int) *image.Gray { return medianFilterParallel(img, chunkSize, 1) }},
+		{"equalize", equalizeSequential, equalizeParallel},
+		{"clahe", claheSequential, claheParallel},
+		{"erode", func(img *image.Gray) *image.Gray { return erodeSequential(img, cfg.element) },
+			func(img *image.Gray, chunkSize int) *image.Gray { return erodeParallel(img, cfg.element, chunkSize) }},
+		{"dilate", func(img *image.Gray) *image.Gray { return dilateSequential(img, cfg.element) },
+			func(img *image.Gray, chunkSize int) *image.Gray { return dilateParallel(img, cfg.element, chunkSize) }},
+		{"open", func(img *image.Gray) *image.Gray { return openSequential(img, cfg.element) },
+			func(img *image.Gray, chunkSize int) *image.Gray { return openParallel(img, cfg.element, chunkSize) }},
+		{"close", func(img *image.Gray) *image.Gray { return closeSequential(img, cfg.element) },
+			func(img *image.Gray, chunkSize int) *image.Gray { return closeParallel(img, cfg.element, chunkSize) }},
+		{"sobel", sobelSequential, sobelParallel},
+		{"canny", func(img *image.Gray) *image.Gray { return cannySequential(img, cfg.cannyLow, cfg.cannyHigh) },
+			func(img *image.Gray, chunkSize int) *image.Gray {
+				return cannyParallel(img, chunkSize, cfg.cannyLow, cfg.cannyHigh)
+			}},
+		{"bilateral", func(img *image.Gray) *image.Gray {
+			return bilateralSequential(img, cfg.bilateralSpatial, cfg.bilateralRange)
+		}, func(img *image.Gray, chunkSize int) *image.Gray {
+			return bilateralParallel(img, chunkSize, cfg.bilateralSpatial, cfg.bilateralRange)
+		}},
+		{"gaussian", func(img *image.Gray) *image.Gray { return gaussianSequential(img, cfg.gaussianSigma) },
+			func(img *image.Gray, chunkSize int) *image.Gray {
+				return gaussianParallel(img, chunkSize, cfg.gaussianSigma)
+			}},
+		{"gaussian2d", func(img *image.Gray) *image.Gray { return gaussian2DSequential(img, cfg.gaussianSigma) },
+			func(img *image.Gray, chunkSize int) *image.Gray {
+				return gaussian2DParallel(img, chunkSize, cfg.gaussianSigma)
+			}},
+		{"rank", func(img *image.Gray) *image.Gray { return rankSequential(img, cfg.rankRadius, cfg.rankPercentile) },
+			func(img *image.Gray, chunkSize int) *image.Gray {
+				return rankParallel(img, chunkSize, cfg.rankRadius, cfg.rankPercentile)
+			}},
+		{"wmedian", func(img *image.Gray) *image.Gray { return weightedMedianSequential(img, cfg.weights) },
+			func(img *image.Gray, chunkSize int) *image.Gray {
+				return weightedMedianParallel(img, chunkSize, cfg.weights)
+			}},
+		{"adaptive", func(img *image.Gray) *image.Gray { return adaptiveMedianSequential(img, cfg.adaptiveMax) },
+			func(img *image.Gray, chunkSize int) *image.Gray {
+				return adaptiveMedianParallel(img, chunkSize, cfg.adaptiveMax)
+			}},
+		{"pyramid", func(img *image.Gray) *image.Gray {
+			return pyramidDenoiseSequential(img, cfg.pyramidLevels, cfg.pyramidThreshold)
+		}, func(img *image.Gray, chunkSize int) *image.Gray {
+			return pyramidDenoiseParallel(img, chunkSize, cfg.pyramidLevels, cfg.pyramidThreshold)
+		}},
+		{"floyd", floydSteinbergSequential, floydSteinbergParallel},
+		{"ordered", orderedDitherSequential, orderedDitherParallel},
+	}
+}
+
+func findOperation(cfg opsConfig, name string) (operation, bool) {
+	for _, op := range operations(cfg) {
+		if op.name == name {
+			return op, true
+		}
+	}
+	return operation{}, false
+}
+
+func operationNames() []string {
+	var names []string
+	for _, op := range operations(opsConfig{}) {
+		names = append(names, op.name)
+	}
+	return names
+}
+
+// restricted returns op running on region only, with margin pixels of
+// context, and copying the rest of the image through. When mask is not nil
+// only its nonzero pixels are replaced.
+func (op operation) restricted(region image.Rectangle, margin int, mask *image.Gray) operation {
+	run := func(img *image.Gray, filter func(*image.Gray) *image.Gray) *image.Gray {
+		output, err := filterRegion(img, region, margin, mask, func(crop *image.Gray) (*image.Gray, error) {
+			return filter(crop), nil
+		})
+		if err != nil {
+			fatal("failed to filter region", "stage", op.name, "err", err)
+		}
+		return output
+	}
+	return operation{
+		name:       op.name,
+		sequential: func(img *image.Gray) *image.Gray { return run(img, op.sequential) },
+		parallel: func(img *image.Gray, chunkSize int) *image.Gray {
+			return run(img, func(crop *image.Gray) *image.Gray { return op.parallel(crop, chunkSize) })
+		},
+	}
+}
+
+// forEachTile calls fn concurrently for every chunkSize x chunkSize tile of
+// bounds, the same tiling the parallel median filter uses, and waits for
+// all of them
+func forEachTile(bounds image.Rectangle, chunkSize int, fn func(tile image.Rectangle)) {
+	var wg sync.WaitGroup
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += chunkSize {
+		for x := bounds.Min.X; x < bounds.Max.X; x += chunkSize {
+			wg.Add(1)
+			go func(tile image.Rectangle) {
+				defer wg.Done()
+				if !filterAbort.Load() {
+					fn(tile)
+				}
+			}(image.Rect(x, y, x+chunkSize, y+chunkSize).Intersect(bounds))
+		}
+	}
+	wg.Wait()
+}
+
+// opTiming is the mean time of one operation over every image. PSNR and
+// SSIM are the mean quality of its output against the clean image, only set
+// when ops adds noise to the inputs.
+type opTiming struct {
+	Name       string
+	Sequential time.Duration
+	Parallel   time.Duration
+	PSNR       float64
+	SSIM       float64
+}
+
+// PrintOperationsTable prints the mean time of every operation and the speedup
+// of its parallel variant, followed by the output quality when quality is set
+func PrintOperationsTable(timings []opTiming, quality bool) {
+	header := "Operation\tSequential Time (s)\tParallel Time (s)\tSpeedup"
+	if quality {
+		header += "\tPSNR (dB)\tSSIM"
+	}
+	fmt.Println(header)
+	fmt.Println("------------------------------------------------------------------")
+	for _, t := range timings {
+		fmt.Printf("%s\t%.6f\t\t%.6f\t\t%.2fx", t.Name, t.Sequential.Seconds(), t.Parallel.Seconds(), t.Sequential.Seconds()/t.Parallel.Seconds())
+		if quality {
+			fmt.Printf("\t%.2f\t\t%.4f", t.PSNR, t.SSIM)
+		}
+		fmt.Println()
+	}
+}
+
+// runOps benchmarks the sequential and parallel variants of every selected
+// operation on the dataset and saves their outputs
+func runOps(args []string) {
+	fs := flag.NewFlagSet("ops", flag.ExitOnError)
+	ops := fs.String("ops", strings.Join(operationNames(), ","), "comma separated operations to run: "+strings.Join(operationNames(), ", "))
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	output := fs.String("output", "dataset-output", "folder, new .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix to write the outputs to")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel variants")
+	runs := fs.Int("runs", 1, "times every variant is run per image, the mean is reported")
+	cannyLow := fs.Float64("canny-low", 50, "gradient magnitude a pixel needs to be a weak Canny edge")
+	cannyHigh := fs.Float64("canny-high", 150, "gradient magnitude a pixel needs to be a strong Canny edge")
+	bilateralSpatial := fs.Float64("bilateral-spatial", 3, "standard deviation in pixels of the bilateral spatial Gaussian")
+	bilateralRange := fs.Float64("bilateral-range", 30, "standard deviation in gray levels of the bilateral range Gaussian")
+	gaussianSigma := fs.Float64("gaussian-sigma", 2, "standard deviation in pixels of the gaussian and gaussian2d blurs")
+	rankRadius := fs.Int("rank-radius", 1, "radius of the rank filter window, 1 gives 3x3")
+	rankPercentile := fs.Float64("percentile", 50, "percentile the rank filter keeps: 0 is min, 50 median, 100 max")
+	weights := fs.String("weights", "1,1,1,1,3,1,1,1,1", "comma separated weights of the wmedian window, row major, an odd square count")
+	adaptiveMax := fs.Int("adaptive-max", 7, "largest window the adaptive median grows to, odd and at least 3")
+	pyramidLevels := fs.Int("levels", 4, "levels of the pyramid operation, including the full resolution image")
+	pyramidThreshold := fs.Float64("pyramid-threshold", 10, "gray levels the pyramid operation shrinks every detail coefficient by")
+	noise := fs.Float64("noise", 0, "fraction of pixels replaced by salt and pepper before running the operations; when above 0 the PSNR and SSIM of every output against the clean image are reported")
+	seed := fs.Int64("seed", 1, "seed of the -noise pixels")
+	roiSpec := fs.String("roi", "", "only filter this region, given as x,y,width,height; the rest of the image is copied through")
+	maskPath := fs.String("mask", "", "grayscale image the size of the inputs; only its nonzero pixels are filtered")
+	roiMargin := fs.Int("roi-margin", 16, "pixels around -roi or -mask the operations can read as context")
+	format := fs.String("format", "", "format of the saved outputs: png, pgm or ppm (default: the input's own format)")
+	element := fs.String("se", "square:3", "structuring element of the morphology operations: square, cross or disk and an odd size, e.g. disk:5")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if *cannyLow > *cannyHigh {
+		fatal("canny-low must not be above canny-high", "low", *cannyLow, "high", *cannyHigh)
+	}
+	if *bilateralSpatial <= 0 || *bilateralRange <= 0 {
+		fatal("bilateral sigmas must be positive", "spatial", *bilateralSpatial, "range", *bilateralRange)
+	}
+	if *gaussianSigma <= 0 {
+		fatal("gaussian sigma must be positive", "sigma", *gaussianSigma)
+	}
+	if *rankRadius < 1 {
+		fatal("rank radius must be positive", "radius", *rankRadius)
+	}
+	if *rankPercentile < 0 || *rankPercentile > 100 {
+		fatal("percentile must be between 0 and 100", "percentile", *rankPercentile)
+	}
+	if *adaptiveMax < 3 || *adaptiveMax%2 == 0 {
+		fatal("adaptive-max must be an odd number of at least 3", "adaptive-max", *adaptiveMax)
+	}
+	if *pyramidLevels < 2 {
+		fatal("a pyramid needs at least 2 levels", "levels", *pyramidLevels)
+	}
+	if *pyramidThreshold < 0 {
+		fatal("pyramid threshold must not be negative", "threshold", *pyramidThreshold)
+	}
+	if *noise < 0 || *noise > 1 {
+		fatal("noise must be between 0 and 1", "noise", *noise)
+	}
+	cfg := opsConfig{
+		cannyLow:         float32(*cannyLow),
+		cannyHigh:        float32(*cannyHigh),
+		bilateralSpatial: *bilateralSpatial,
+		bilateralRange:   *bilateralRange,
+		gaussianSigma:    *gaussianSigma,
+		rankRadius:       *rankRadius,
+		rankPercentile:   *rankPercentile,
+		adaptiveMax:      *adaptiveMax,
+		pyramidLevels:    *pyramidLevels,
+		pyramidThreshold: float32(*pyramidThreshold),
+	}
+	var err error
+	if cfg.element, err = parseStructuringElement(*element); err != nil {
+		fatal("invalid structuring element", "err", err)
+	}
+	if cfg.weights, err = parseWeightMask(*weights); err != nil {
+		fatal("invalid weight mask", "err", err)
+	}
+
+	var selected []operation
+	for _, name := range strings.Split(*ops, ",") {
+		op, ok := findOperation(cfg, strings.TrimSpace(name))
+		if !ok {
+			fatal("unknown operation", "operation", name, "known", operationNames())
+		}
+		selected = append(selected, op)
+	}
+	if *chunkSize < 1 {
+		fatal("chunk size must be positive", "chunk", *chunkSize)
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if !validOutputFormat(*format) {
+		fatal("unknown output format, use png, pgm or ppm", "format", *format)
+	}
+
+	if *roiSpec != "" || *maskPath != "" {
+		if *roiMargin < 0 {
+			fatal("roi margin must not be negative", "margin", *roiMargin)
+		}
+		region := image.Rect(math.MinInt32, math.MinInt32, math.MaxInt32, math.MaxInt32)
+		if *roiSpec != "" {
+			if region, err = parseROI(*roiSpec); err != nil {
+				fatal("invalid region", "err", err)
+			}
+		}
+		var mask *image.Gray
+		if *maskPath != "" {
+			mask = toBlackAndWhite(loadImage(filepath.Dir(*maskPath), filepath.Base(*maskPath)))
+			region = region.Intersect(maskBounds(mask))
+		}
+		for i := range selected {
+			selected[i] = selected[i].restricted(region, *roiMargin, mask)
+		}
+		slog.Info("filtering a region only", "region", region, "mask", *maskPath != "")
+	}
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+	out, err := createImageOutput(*output)
+	if err != nil {
+		fatal("failed to create output", "output", *output, "err", err)
+	}
+	save := func(img *image.Gray, name string, meta imageMetadata) {
+		if _, err := out.Save(withFormat(name, *format), img, meta); err != nil {
+			fatal("failed to save image", "image", name, "output", *output, "err", err)
+		}
+	}
+
+	slog.Info("running operations, please wait", "operations", len(selected), "input", *input)
+	timings := make([]opTiming, len(selected))
+	images := 0
+	err = in.WalkHashed(func(filename, _ string, img image.Image, meta imageMetadata) error {
+		images++
+		clean := toBlackAndWhite(img)
+		bwImage := clean
+		if *noise > 0 {
+			bwImage = addImpulseNoise(clean, *noise, *seed)
+		}
+
+		for i, op := range selected {
+			timings[i].Name = op.name
+			for _, elapsed := range measureRuns(*runs, func() *image.Gray { return op.sequential(bwImage) }) {
+				filterMetrics.Observe(op.name+"-sequential", len(bwImage.Pix), elapsed)
+				timings[i].Sequential += elapsed
+			}
+			for _, elapsed := range measureRuns(*runs, func() *image.Gray { return op.parallel(bwImage, *chunkSize) }) {
+				filterMetrics.Observe(op.name+"-parallel", len(bwImage.Pix), elapsed)
+				timings[i].Parallel += elapsed
+			}
+			result := op.sequential(bwImage)
+			if *noise > 0 {
+				timings[i].PSNR += PSNR(clean, result)
+				timings[i].SSIM += SSIM(clean, result)
+			}
+			save(result, fmt.Sprintf("%s-sequential-%s", op.name, filename), meta)
+			PutGray(result)
+			result = op.parallel(bwImage, *chunkSize)
+			save(result, fmt.Sprintf("%s-parallel-%s", op.name, filename), meta)
+			PutGray(result)
+			slog.Debug("processed image", "image", filename, "stage", op.name)
+		}
+		if *noise > 0 {
+			PutGray(bwImage)
+		}
+		return nil
+	})
+	if err != nil {
+		fatal("failed to read input", "input", *input, "err", err)
+	}
+	if err := out.Close(); err != nil {
+		fatal("failed to finish output", "output", *output, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+
+	n := time.Duration(images * *runs)
+	for i := range timings {
+		timings[i].Sequential /= n
+		timings[i].Parallel /= n
+		timings[i].PSNR /= float64(images)
+		timings[i].SSIM /= float64(images)
+	}
+	PrintOperationsTable(timings, *noise > 0)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+// plotOptions holds the plot flags shared by every subcommand that draws a chart
+type plotOptions struct {
+	path   string
+	format string
+	width  float64
+	height float64
+	logY   bool
+	title  string
+	legend string
+}
+
+func addPlotFlags(fs *flag.FlagSet, path string) *plotOptions {
+	opts := &plotOptions{}
+	fs.StringVar(&opts.path, "plot", path, "where to save the plot")
+	fs.StringVar(&opts.format, "plot-format", "", "plot format: png, svg or pdf (default taken from the -plot extension)")
+	fs.Float64Var(&opts.width, "plot-width", 8, "plot width in inches")
+	fs.Float64Var(&opts.height, "plot-height", 4, "plot height in inches")
+	fs.BoolVar(&opts.logY, "log-y", false, "use a logarithmic Y axis")
+	fs.StringVar(&opts.title, "title", "", "plot title (default depends on the chart)")
+	fs.StringVar(&opts.legend, "legend", "auto", "legend position: auto, top-left, top-right, bottom-left or bottom-right (auto picks a corner free of data)")
+	return opts
+}
+
+// filename is the path the plot is written to, with the extension replaced
+// when an explicit format was requested
+func (o *plotOptions) filename() string {
+	if o.format == "" {
+		return o.path
+	}
+	return strings.TrimSuffix(o.path, filepath.Ext(o.path)) + "." + o.format
+}
+
+// validate reports flag values the plot cannot be drawn with, so a long
+// experiment fails before it starts rather than when it saves
+func (o *plotOptions) validate() error {
+	switch format := strings.TrimPrefix(filepath.Ext(o.filename()), "."); format {
+	case "png", "svg", "pdf":
+	default:
+		return fmt.Errorf("unsupported plot format %q, use png, svg or pdf", format)
+	}
+	if o.width <= 0 || o.height <= 0 {
+		return fmt.Errorf("plot size must be positive, got %gx%g inches", o.width, o.height)
+	}
+	switch o.legend {
+	case "auto", "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return fmt.Errorf("unknown legend position %q", o.legend)
+	}
+	return nil
+}
+
+// apply sets the title, Y scale and legend position of p. series are the
+// points drawn on p and are used to keep the automatic legend off the data.
+func (o *plotOptions) apply(p *plot.Plot, series ...plotter.XYs) {
+	if o.title != "" {
+		p.Title.Text = o.title
+	}
+	if o.logY {
+		p.Y.Scale = plot.LogScale{}
+		p.Y.Tick.Marker = plot.LogTicks{}
+	}
+
+	legend := o.legend
+	if legend == "auto" {
+		legend = o.placeLegend(p, series)
+	}
+	p.Legend.Top = strings.HasPrefix(legend, "top")
+	p.Legend.Left = strings.HasSuffix(legend, "left")
+	p.Legend.XOffs = 0
+	p.Legend.YOffs = 0
+}
+
+// chartFilename is the path of an additional chart drawn next to the main
+// plot, e.g. performance_comparison_box.png for chart "box"
+func (o *plotOptions) chartFilename(chart string) string {
+	filename := o.filename()
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + chart + ext
+}
+
+// save writes p to the configured file
+func (o *plotOptions) save(p *plot.Plot) error {
+	return p.Save(vg.Length(o.width)*vg.Inch, vg.Length(o.height)*vg.Inch, o.filename())
+}
+
+// saveChart writes p to the file of an additional chart
+func (o *plotOptions) saveChart(p *plot.Plot, chart string) error {
+	return p.Save(vg.Length(o.width)*vg.Inch, vg.Length(o.height)*vg.Inch, o.chartFilename(chart))
+}
+
+// legendCorners are tried in this order by the automatic legend placement
+var legendCorners = []string{"top-right", "top-left", "bottom-right", "bottom-left"}
+
+// placeLegend returns the first corner whose legend area holds no data
+// point. When every corner is taken the Y axis is stretched so the data
+// leaves the top of the chart free for the legend.
+func (o *plotOptions) placeLegend(p *plot.Plot, series []plotter.XYs) string {
+	// Rough size of the legend as a fraction of the data area: one text line
+	// per series and enough width for a short label
+	dataHeight := o.height*72 - 60
+	lineHeight := 1.3 * float64(p.Legend.TextStyle.Font.Size.Points())
+	legendHeight := min(0.9, float64(len(series))*lineHeight/dataHeight)
+	legendWidth := min(0.9, 150/(o.width*72-60))
+
+	for _, corner := range legendCorners {
+		top := strings.HasPrefix(corner, "top")
+		left := strings.HasSuffix(corner, "left")
+		free := true
+		for _, xys := range series {
+			for _, xy := range xys {
+				x, y := p.X.Norm(xy.X), p.Y.Norm(xy.Y)
+				inX := (left && x < legendWidth) || (!left && x > 1-legendWidth)
+				inY := (top && y > 1-legendHeight) || (!top && y < legendHeight)
+				if inX && inY {
+					free = false
+				}
+			}
+		}
+		if free {
+			return corner
+		}
+	}
+
+	// Grow the axis so the current range only fills the bottom part
+	if o.logY {
+		p.Y.Max = p.Y.Min * math.Pow(p.Y.Max/p.Y.Min, 1/(1-legendHeight))
+	} else {
+		p.Y.Max = p.Y.Min + (p.Y.Max-p.Y.Min)/(1-legendHeight)
+	}
+	return legendCorners[0]
+}
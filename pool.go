@@ -0,0 +1,96 @@
+package main
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// maxPooledSizes caps how many sizes a sizedPool keeps buffers for. A
+// benchmark run needs a few dozen, while serve sees whatever sizes its
+// clients upload, which must not grow the pool without bound.
+const maxPooledSizes = 64
+
+// sizedPool keeps a sync.Pool of buffers for every size it is asked for, so
+// the images of a dataset, or the frames of a stream, that share a size
+// reuse the buffers of the ones before them. Only the maxPooledSizes most
+// recently used sizes are kept; the buffers of the others are left to the
+// garbage collector. Pooled buffers are not cleared: whoever gets one must
+// overwrite all of it.
+type sizedPool[K comparable, V any] struct {
+	mu    sync.Mutex
+	pools map[K]*list.Element // elements of order, holding *pooledSize[K]
+	order list.List           // most recently used first
+	alloc func(K) V
+}
+
+// pooledSize is the pool of one size
+type pooledSize[K comparable] struct {
+	key  K
+	pool *sync.Pool
+}
+
+func (p *sizedPool[K, V]) pool(key K) *sync.Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.pools[key]; ok {
+		p.order.MoveToFront(e)
+		return e.Value.(*pooledSize[K]).pool
+	}
+	if p.pools == nil {
+		p.pools = map[K]*list.Element{}
+	}
+	if len(p.pools) >= maxPooledSizes {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.pools, oldest.Value.(*pooledSize[K]).key)
+	}
+	entry := &pooledSize[K]{key: key, pool: &sync.Pool{}}
+	p.pools[key] = p.order.PushFront(entry)
+	return entry.pool
+}
+
+func (p *sizedPool[K, V]) get(key K) V {
+	if v := p.pool(key).Get(); v != nil {
+		return v.(V)
+	}
+	return p.alloc(key)
+}
+
+func (p *sizedPool[K, V]) put(key K, v V) {
+	p.pool(key).Put(v)
+}
+
+// grayPool holds output images by bounds, floatPool the float buffers of
+// the separable blur and lutPool the per-region CLAHE lookup tables, both
+// by length
+var (
+	grayPool  = sizedPool[image.Rectangle, *image.Gray]{alloc: image.NewGray}
+	floatPool = sizedPool[int, *[]float32]{alloc: func(n int) *[]float32 {
+		buf := make([]float32, n)
+		return &buf
+	}}
+	lutPool = sizedPool[int, *[][256]uint8]{alloc: func(n int) *[][256]uint8 {
+		luts := make([][256]uint8, n)
+		return &luts
+	}}
+)
+
+// GetGray returns a gray image with the given bounds, reusing one released
+// with PutGray when there is one. Its pixels are not cleared. Every filter
+// takes its output from here, so a caller filtering a stream of same-sized
+// frames that releases each frame and result once it is done with them
+// allocates no new images after the first few frames.
+func GetGray(bounds image.Rectangle) *image.Gray {
+	return grayPool.get(bounds)
+}
+
+// PutGray releases img for a later GetGray of the same bounds. img must not
+// be used afterwards. Sub-images, which share their pixels with a larger
+// image, are not pooled.
+func PutGray(img *image.Gray) {
+	if img == nil || img.Stride != img.Rect.Dx() || len(img.Pix) != img.Rect.Dx()*img.Rect.Dy() {
+		return
+	}
+	grayPool.put(img.Rect, img)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"image"
+	"math"
+	"sync"
+)
+
+// plane is a single channel float image, used for pyramid levels since
+// Laplacian levels hold negative values
+type plane struct {
+	width, height int
+	pix           []float32
+}
+
+func newPlane(width, height int) plane {
+	return plane{width: width, height: height, pix: make([]float32, width*height)}
+}
+
+func (p plane) bounds() image.Rectangle {
+	return image.Rect(0, 0, p.width, p.height)
+}
+
+// at reads a value, replicating the border for offsets outside the plane
+func (p plane) at(x, y int) float32 {
+	x = min(max(x, 0), p.width-1)
+	y = min(max(y, 0), p.height-1)
+	return p.pix[y*p.width+x]
+}
+
+func planeFromGray(img *image.Gray) plane {
+	b := img.Bounds()
+	p := newPlane(b.Dx(), b.Dy())
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			p.pix[y*p.width+x] = float32(img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y)])
+		}
+	}
+	return p
+}
+
+func (p plane) gray() *image.Gray {
+	output := GetGray(p.bounds())
+	for i, v := range p.pix {
+		output.Pix[i] = uint8(min(255, max(0, math.Round(float64(v)))))
+	}
+	return output
+}
+
+// pyramidWeights is the 5-tap binomial kernel used to reduce and expand levels
+var pyramidWeights = [5]float32{1.0 / 16, 4.0 / 16, 6.0 / 16, 4.0 / 16, 1.0 / 16}
+
+// reduceRect blurs src and keeps every second pixel, writing the pixels of
+// rect in dst, which is half the size of src
+func reduceRect(dst, src plane, rect image.Rectangle) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			var sum float32
+			for j, wy := range pyramidWeights {
+				for i, wx := range pyramidWeights {
+					sum += wy * wx * src.at(2*x+i-2, 2*y+j-2)
+				}
+			}
+			dst.pix[y*dst.width+x] = sum
+		}
+	}
+}
+
+// expandRect upsamples src to the size of dst for the pixels of rect,
+// interpolating with the same binomial kernel, and adds sign times the
+// result to base (so 1 reconstructs and -1 builds a Laplacian level)
+func expandRect(dst, base, src plane, rect image.Rectangle, sign float32) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			var sum float32
+			for j, wy := range pyramidWeights {
+				if (y+j-2)%2 != 0 {
+					continue
+				}
+				for i, wx := range pyramidWeights {
+					if (x+i-2)%2 != 0 {
+						continue
+					}
+					sum += 4 * wy * wx * src.at((x+i-2)/2, (y+j-2)/2)
+				}
+			}
+			dst.pix[y*dst.width+x] = base.pix[y*base.width+x] + sign*sum
+		}
+	}
+}
+
+// shrinkRect soft-thresholds the detail coefficients of rect, pulling every
+// value threshold closer to 0, which removes the small oscillations of noise
+// while keeping strong edges
+func shrinkRect(p plane, rect image.Rectangle, threshold float32) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			v := p.pix[y*p.width+x]
+			switch {
+			case v > threshold:
+				v -= threshold
+			case v < -threshold:
+				v += threshold
+			default:
+				v = 0
+			}
+			p.pix[y*p.width+x] = v
+		}
+	}
+}
+
+// pyramidRunner runs a pass over the pixels of a plane, either at once or tiled
+type pyramidRunner func(bounds image.Rectangle, fn func(rect image.Rectangle))
+
+func sequentialRunner(bounds image.Rectangle, fn func(rect image.Rectangle)) {
+	fn(bounds)
+}
+
+func tiledRunner(chunkSize int) pyramidRunner {
+	return func(bounds image.Rectangle, fn func(rect image.Rectangle)) {
+		forEachTile(bounds, chunkSize, fn)
+	}
+}
+
+// gaussianPyramid returns the image followed by levels-1 reductions, each
+// half the size of the previous one. Levels depend on each other, so only
+// the pixels of one level run at the same time.
+func gaussianPyramid(img *image.Gray, levels int, run pyramidRunner) []plane {
+	pyramid := []plane{planeFromGray(img)}
+	for len(pyramid) < levels {
+		prev := pyramid[len(pyramid)-1]
+		if prev.width < 2 || prev.height < 2 {
+			break
+		}
+		next := newPlane((prev.width+1)/2, (prev.height+1)/2)
+		run(next.bounds(), func(rect image.Rectangle) { reduceRect(next, prev, rect) })
+		pyramid = append(pyramid, next)
+	}
+	return pyramid
+}
+
+// laplacianPyramid turns a Gaussian pyramid into detail levels, the
+// difference between every level and the expansion of the next one, ending
+// with the coarsest Gaussian level as the residual
+func laplacianPyramid(gaussian []plane, run pyramidRunner) []plane {
+	laplacian := make([]plane, len(gaussian))
+	last := len(gaussian) - 1
+	laplacian[last] = gaussian[last]
+	for i := 0; i < last; i++ {
+		level := newPlane(gaussian[i].width, gaussian[i].height)
+		run(level.bounds(), func(rect image.Rectangle) { expandRect(level, gaussian[i], gaussian[i+1], rect, -1) })
+		laplacian[i] = level
+	}
+	return laplacian
+}
+
+// reconstructPyramid collapses a Laplacian pyramid back into an image,
+// from the coarsest level up
+func reconstructPyramid(laplacian []plane, run pyramidRunner) *image.Gray {
+	current := laplacian[len(laplacian)-1]
+	for i := len(laplacian) - 2; i >= 0; i-- {
+		next := newPlane(laplacian[i].width, laplacian[i].height)
+		run(next.bounds(), func(rect image.Rectangle) { expandRect(next, laplacian[i], current, rect, 1) })
+		current = next
+	}
+	return current.gray()
+}
+
+// Multi-scale Denoising (Sequential)
+// Builds a Laplacian pyramid, soft-thresholds the detail of every level but
+// the residual and reconstructs
+func pyramidDenoiseSequential(img *image.Gray, levels int, threshold float32) *image.Gray {
+	laplacian := laplacianPyramid(gaussianPyramid(img, levels, sequentialRunner), sequentialRunner)
+	for _, level := range laplacian[:len(laplacian)-1] {
+		shrinkRect(level, level.bounds(), threshold)
+	}
+	return reconstructPyramid(laplacian, sequentialRunner)
+}
+
+// Multi-scale Denoising (Parallel)
+// Building and collapsing the pyramid are tiled level by level; the detail
+// levels are independent, so they are thresholded concurrently, each tiled
+func pyramidDenoiseParallel(img *image.Gray, chunkSize, levels int, threshold float32) *image.Gray {
+	run := tiledRunner(chunkSize)
+	laplacian := laplacianPyramid(gaussianPyramid(img, levels, run), run)
+	var wg sync.WaitGroup
+	for _, level := range laplacian[:len(laplacian)-1] {
+		wg.Add(1)
+		go func(level plane) {
+			defer wg.Done()
+			forEachTile(level.bounds(), chunkSize, func(rect image.Rectangle) { shrinkRect(level, rect, threshold) })
+		}(level)
+	}
+	wg.Wait()
+	return reconstructPyramid(laplacian, run)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"image"
+	"math"
+	"math/rand"
+)
+
+// addImpulseNoise returns a copy of img where a density fraction of the
+// pixels is replaced by black or white salt and pepper. The same seed always
+// hits the same pixels.
+func addImpulseNoise(img *image.Gray, density float64, seed int64) *image.Gray {
+	rng := rand.New(rand.NewSource(seed))
+	noisy := GetGray(img.Bounds())
+	copy(noisy.Pix, img.Pix)
+	for i := range noisy.Pix {
+		if rng.Float64() >= density {
+			continue
+		}
+		if rng.Intn(2) == 0 {
+			noisy.Pix[i] = 0
+		} else {
+			noisy.Pix[i] = 255
+		}
+	}
+	return noisy
+}
+
+// PSNR returns the peak signal-to-noise ratio of img against reference in
+// decibels, +Inf when they are identical. Both must have the same bounds.
+func PSNR(reference, img *image.Gray) float64 {
+	var sum float64
+	for i, v := range reference.Pix {
+		d := float64(v) - float64(img.Pix[i])
+		sum += d * d
+	}
+	if sum == 0 {
+		return math.Inf(1)
+	}
+	mse := sum / float64(len(reference.Pix))
+	return 10 * math.Log10(255*255/mse)
+}
+
+// ssimWindow is the side of the square windows SSIM is averaged over
+const ssimWindow = 8
+
+// SSIM returns the mean structural similarity of img against reference over
+// ssimWindow x ssimWindow windows moved by half a window, 1 for identical
+// images. Both must have the same bounds.
+func SSIM(reference, img *image.Gray) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	bounds := reference.Bounds()
+	step := ssimWindow / 2
+	var total float64
+	windows := 0
+	for y := bounds.Min.Y; y+ssimWindow <= bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x+ssimWindow <= bounds.Max.X; x += step {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for wy := y; wy < y+ssimWindow; wy++ {
+				for wx := x; wx < x+ssimWindow; wx++ {
+					a := float64(reference.Pix[reference.PixOffset(wx, wy)])
+					b := float64(img.Pix[img.PixOffset(wx, wy)])
+					sumA += a
+					sumB += b
+					sumAA += a * a
+					sumBB += b * b
+					sumAB += a * b
+				}
+			}
+			n := float64(ssimWindow * ssimWindow)
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) / ((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	if windows == 0 {
+		return 1
+	}
+	return total / float64(windows)
+}
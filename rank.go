@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// rankBins is both the number of coarse bins of the rank histograms and the
+// number of gray levels in each of them
+const rankBins = 16
+
+// rankColumn is the histogram of one column of the windows of a row, the
+// 2*radius+1 pixels centered on it, at two levels: 16 coarse bins of 16
+// gray levels each, and the 256 gray levels themselves
+type rankColumn struct {
+	coarse [rankBins]int32
+	fine   [256]int32
+	total  int32
+}
+
+func (c *rankColumn) add(level uint8, delta int32) {
+	c.coarse[level/rankBins] += delta
+	c.fine[level] += delta
+	c.total += delta
+}
+
+// rankRect writes the percentile of the (2*radius+1)^2 window of every
+// pixel in rect, keeping the value at index round(p/100*(n-1)) of the n
+// sorted pixels of the window, skipping everything outside the image.
+// It is the constant time median filter of Perreault and Hébert: every
+// column keeps a histogram that moves down one row at a time, adding the
+// incoming pixel and removing the outgoing one, and the histogram of a
+// window is the sum of those of its columns. The cost per pixel does not
+// grow with the radius.
+func rankRect(output, img *image.Gray, rect image.Rectangle, radius int, percentile float64) {
+	bounds := img.Bounds()
+	// columns[i] is column rect.Min.X-radius+i, left empty outside the image
+	left := rect.Min.X - radius
+	columns := make([]rankColumn, rect.Dx()+2*radius)
+	x0, x1 := max(left, bounds.Min.X), min(rect.Max.X+radius, bounds.Max.X)
+	row := func(y int, delta int32) {
+		if y < bounds.Min.Y || y >= bounds.Max.Y {
+			return
+		}
+		for i, level := range img.Pix[img.PixOffset(x0, y):][:x1-x0] {
+			columns[x0-left+i].add(level, delta)
+		}
+	}
+
+	for y := rect.Min.Y - radius; y < rect.Min.Y+radius; y++ {
+		row(y, 1)
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row(y+radius, 1)
+		if y > rect.Min.Y {
+			row(y-radius-1, -1)
+		}
+		rankRow(output.Pix[output.PixOffset(rect.Min.X, y):][:rect.Dx()], columns, 2*radius+1, percentile)
+	}
+}
+
+// rankRow writes the percentile of every window of one row, where the
+// window of dst[i] is columns[i:i+size]. The coarse histogram of the
+// window slides right one column per pixel. The fine bins of a coarse bin
+// are only brought up to date when the percentile falls in it, by sliding
+// them over the columns they missed, or by summing the columns of the
+// window again when that is cheaper.
+func rankRow(dst []uint8, columns []rankColumn, size int, percentile float64) {
+	var coarse [rankBins]int32
+	var fine [rankBins][rankBins]int32
+	var total int32
+	// updated[b] is the pixel fine[b] was last brought up to date for
+	var updated [rankBins]int
+	for b := range updated {
+		updated[b] = -size
+	}
+	for _, c := range columns[:size] {
+		for b := range coarse {
+			coarse[b] += c.coarse[b]
+		}
+		total += c.total
+	}
+
+	for i := range dst {
+		if i > 0 {
+			in, out := &columns[i+size-1], &columns[i-1]
+			for b := range coarse {
+				coarse[b] += in.coarse[b] - out.coarse[b]
+			}
+			total += in.total - out.total
+		}
+		target := int32(math.Round(percentile / 100 * float64(total-1)))
+		b := 0
+		for ; b < rankBins-1 && coarse[b] <= target; b++ {
+			target -= coarse[b]
+		}
+
+		bins, first := &fine[b], b*rankBins
+		if 2*(i-updated[b]) > size {
+			*bins = [rankBins]int32{}
+			for _, c := range columns[i:][:size] {
+				for k := range bins {
+					bins[k] += c.fine[first+k]
+				}
+			}
+		} else {
+			for j := updated[b] + 1; j <= i; j++ {
+				in, out := &columns[j+size-1], &columns[j-1]
+				for k := range bins {
+					bins[k] += in.fine[first+k] - out.fine[first+k]
+				}
+			}
+		}
+		updated[b] = i
+
+		k := 0
+		for ; k < rankBins-1 && bins[k] <= target; k++ {
+			target -= bins[k]
+		}
+		dst[i] = uint8(first + k)
+	}
+}
+
+// Rank Filter (Sequential)
+// percentile 0 is a minimum filter, 100 a maximum filter and 50 the median
+func rankSequential(img *image.Gray, radius int, percentile float64) *image.Gray {
+	output := GetGray(img.Bounds())
+	rankRect(output, img, img.Bounds(), radius, percentile)
+	return output
+}
+
+// Rank Filter (Parallel)
+func rankParallel(img *image.Gray, chunkSize, radius int, percentile float64) *image.Gray {
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		rankRect(output, img, tile, radius, percentile)
+	})
+	return output
+}
+
+// applyRank is applyFilter for a percentile other than the median, which
+// only the sequential and parallel modes have
+func applyRank(mode string, img *image.Gray, chunkSize, kernel int, percentile float64) (*image.Gray, error) {
+	if kernel < 1 || kernel%2 == 0 {
+		return nil, fmt.Errorf("kernel size must be a positive odd number, got %d", kernel)
+	}
+	if chunkSize < 1 {
+		return nil, fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+	}
+	switch mode {
+	case "sequential":
+		return rankSequential(img, kernel/2, percentile), nil
+	case "parallel":
+		return rankParallel(img, chunkSize, kernel/2, percentile), nil
+	}
+	return nil, fmt.Errorf("%s mode only supports the median, percentile 50", mode)
+}
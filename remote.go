@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Remote storage: s3://bucket/prefix and gs://bucket/prefix paths are read
+// and written through the S3 REST API, which Google Cloud Storage also
+// serves with HMAC keys, signed with AWS Signature Version 4. Objects above
+// remotePartSize are transferred in parts, remoteConcurrency at a time.
+const (
+	remoteConcurrency = 8
+	remotePartSize    = 8 << 20
+)
+
+// isRemote reports whether p is an s3:// or gs:// path
+func isRemote(p string) bool {
+	return strings.HasPrefix(p, "s3://") || strings.HasPrefix(p, "gs://")
+}
+
+// remoteStore is a bucket and key prefix on an S3 compatible service
+type remoteStore struct {
+	endpoint     *url.URL
+	virtualHost  bool // bucket in the host name instead of the path
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// newRemoteStore configures the store for an s3:// or gs:// path from the
+// environment:
+//
+//	s3://  AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+//	       AWS_REGION (us-east-1), AWS_ENDPOINT_URL for S3 compatible servers
+//	gs://  GCS_ACCESS_KEY_ID and GCS_SECRET_ACCESS_KEY, an HMAC key pair
+func newRemoteStore(p string) (*remoteStore, error) {
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: missing bucket name", p)
+	}
+	s := &remoteStore{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+
+	endpoint := ""
+	switch u.Scheme {
+	case "s3":
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		s.region = os.Getenv("AWS_REGION")
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+			s.virtualHost = true
+		}
+		if s.accessKey == "" || s.secretKey == "" {
+			return nil, errors.New("set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to use s3:// paths")
+		}
+	case "gs":
+		s.accessKey = os.Getenv("GCS_ACCESS_KEY_ID")
+		s.secretKey = os.Getenv("GCS_SECRET_ACCESS_KEY")
+		s.region = "auto"
+		endpoint = "https://storage.googleapis.com"
+		if s.accessKey == "" || s.secretKey == "" {
+			return nil, errors.New("set GCS_ACCESS_KEY_ID and GCS_SECRET_ACCESS_KEY (an HMAC key) to use gs:// paths")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme %q", u.Scheme)
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	return s, nil
+}
+
+// key returns the object key of name under the store's prefix
+func (s *remoteStore) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+// uriEncode percent-encodes everything but the unreserved characters, and
+// slashes unless encodeSlash is set, as Signature Version 4 requires
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// request sends a signed request for key (the bucket itself when empty) and
+// returns the response when its status is one of the accepted ones
+func (s *remoteStore) request(method, key string, query url.Values, header http.Header, body []byte, accept ...int) (*http.Response, error) {
+	host := s.endpoint.Host
+	objectPath := "/" + s.bucket
+	if s.virtualHost {
+		host = s.bucket + "." + host
+		objectPath = ""
+	}
+	if key != "" {
+		objectPath += "/" + key
+	}
+	if objectPath == "" {
+		objectPath = "/"
+	}
+
+	var pairs []string
+	for k, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	canonicalQuery := strings.Join(pairs, "&")
+	canonicalPath := uriEncode(objectPath, false)
+
+	u := &url.URL{Scheme: s.endpoint.Scheme, Host: host, Path: objectPath, RawPath: canonicalPath, RawQuery: canonicalQuery}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, values := range header {
+		req.Header[k] = values
+	}
+	s.sign(req, host, canonicalPath, canonicalQuery, sha256Hex(body), time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range accept {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("%s %s: %s: %s", method, u.Redacted(), resp.Status, bytes.TrimSpace(msg))
+}
+
+// sign adds the Signature Version 4 headers to req
+func (s *remoteStore) sign(req *http.Request, host, canonicalPath, canonicalQuery, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": host}
+	for k, values := range req.Header {
+		lower := strings.ToLower(k)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, canonicalPath, canonicalQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+// remoteObject is an entry of a bucket listing
+type remoteObject struct {
+	Key  string `xml:"Key"`
+	Size int64  `xml:"Size"`
+}
+
+// list returns every object under the store's prefix
+func (s *remoteStore) list() ([]remoteObject, error) {
+	var objects []remoteObject
+	query := url.Values{"list-type": {"2"}}
+	if s.prefix != "" {
+		query.Set("prefix", s.prefix+"/")
+	}
+	for {
+		resp, err := s.request(http.MethodGet, "", query, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents              []remoteObject `xml:"Contents"`
+			IsTruncated           bool           `xml:"IsTruncated"`
+			NextContinuationToken string         `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading bucket listing: %w", err)
+		}
+		objects = append(objects, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// get downloads an object, in remotePartSize ranges fetched concurrently
+// when it is larger than one part
+func (s *remoteStore) get(obj remoteObject) ([]byte, error) {
+	if obj.Size <= remotePartSize {
+		resp, err := s.request(http.MethodGet, obj.Key, nil, nil, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return io.ReadAll(resp.Body)
+	}
+
+	data := make([]byte, obj.Size)
+	parts := int((obj.Size + remotePartSize - 1) / remotePartSize)
+	errs := make([]error, parts)
+	sem := make(chan struct{}, remoteConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < parts; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			start := int64(i) * remotePartSize
+			end := min(start+remotePartSize, obj.Size) - 1
+			header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end)}}
+			resp, err := s.request(http.MethodGet, obj.Key, nil, header, nil, http.StatusPartialContent)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			_, errs[i] = io.ReadFull(resp.Body, data[start:end+1])
+		}(i)
+	}
+	wg.Wait()
+	return data, errors.Join(errs...)
+}
+
+// put uploads an object, as a multipart upload with remoteConcurrency parts
+// in flight when it is larger than one part
+func (s *remoteStore) put(key string, data []byte) error {
+	if len(data) <= remotePartSize {
+		resp, err := s.request(http.MethodPut, key, nil, nil, data, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	resp, err := s.request(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("starting multipart upload of %s: %w", key, err)
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	parts := make([]part, (len(data)+remotePartSize-1)/remotePartSize)
+	errs := make([]error, len(parts))
+	sem := make(chan struct{}, remoteConcurrency)
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			chunk := data[i*remotePartSize : min((i+1)*remotePartSize, len(data))]
+			query := url.Values{"partNumber": {strconv.Itoa(i + 1)}, "uploadId": {initiated.UploadID}}
+			resp, err := s.request(http.MethodPut, key, query, nil, chunk, http.StatusOK)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			resp.Body.Close()
+			parts[i] = part{PartNumber: i + 1, ETag: resp.Header.Get("ETag")}
+		}(i)
+	}
+	wg.Wait()
+
+	abort := url.Values{"uploadId": {initiated.UploadID}}
+	if err := errors.Join(errs...); err != nil {
+		if resp, abortErr := s.request(http.MethodDelete, key, abort, nil, nil, http.StatusNoContent); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err = s.request(http.MethodPost, key, abort, nil, body, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// remoteInput reads the images under a bucket prefix in key order,
+// downloading up to remoteConcurrency objects ahead of the one being
+// processed
+type remoteInput struct {
+	store *remoteStore
+}
+
+// objects returns the images under the prefix in key order
+func (r *remoteInput) objects() ([]remoteObject, error) {
+	all, err := r.store.list()
+	if err != nil {
+		return nil, err
+	}
+	var objects []remoteObject
+	for _, obj := range all {
+		if isImageName(obj.Key) {
+			objects = append(objects, obj)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (r *remoteInput) Walk(fn func(name string, img image.Image) error) error {
+	return r.WalkHashed(ignoreHash(fn))
+}
+
+func (r *remoteInput) WalkHashed(fn func(name, sum string, img image.Image, meta imageMetadata) error) error {
+	objects, err := r.objects()
+	if err != nil {
+		return err
+	}
+
+	type download struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan download, len(objects))
+	for i := range results {
+		results[i] = make(chan download, 1)
+	}
+	sem := make(chan struct{}, remoteConcurrency)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, obj := range objects {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int, obj remoteObject) {
+				data, err := r.store.get(obj)
+				results[i] <- download{data, err}
+			}(i, obj)
+		}
+	}()
+
+	for i, obj := range objects {
+		d := <-results[i]
+		<-sem
+		if d.err != nil {
+			return d.err
+		}
+		img, meta, sum, err := decodeHashed(obj.Key, bytes.NewReader(d.data))
+		if skipRejected(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(path.Base(obj.Key), sum, img, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *remoteInput) Names() ([]string, error) {
+	objects, err := r.objects()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(objects))
+	for i, obj := range objects {
+		names[i] = path.Base(obj.Key)
+	}
+	return names, nil
+}
+
+func (r *remoteInput) Close() error { return nil }
+
+// remoteOutput uploads every saved image in the background, up to
+// remoteConcurrency at a time. Close waits for them and reports the first
+// failure.
+type remoteOutput struct {
+	store *remoteStore
+	sem   chan struct{}
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	err   error
+	// synchronous makes Save return only once the image is stored, for
+	// callers that record it as done, such as a checkpoint
+	synchronous bool
+}
+
+func (r *remoteOutput) Save(name string, img image.Image, meta imageMetadata) (string, error) {
+	data, sum, err := encodeForName(name, img, meta)
+	if err != nil {
+		return "", err
+	}
+	if r.synchronous {
+		return sum, r.store.put(r.store.key(name), data)
+	}
+	r.sem <- struct{}{}
+	r.wg.Add(1)
+	go func() {
+		defer func() { <-r.sem; r.wg.Done() }()
+		if err := r.store.put(r.store.key(name), data); err != nil {
+			r.mu.Lock()
+			if r.err == nil {
+				r.err = err
+			}
+			r.mu.Unlock()
+		}
+	}()
+	return sum, nil
+}
+
+// saveManifest uploads m under the prefix as manifest.json
+func (r *remoteOutput) saveManifest(m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return r.store.put(r.store.key("manifest.json"), data)
+}
+
+func (r *remoteOutput) Close() error {
+	r.wg.Wait()
+	return r.err
+}
+
+func openRemoteInput(p string) (imageInput, error) {
+	store, err := newRemoteStore(p)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteInput{store: store}, nil
+}
+
+func createRemoteOutput(p string) (imageOutput, error) {
+	store, err := newRemoteStore(p)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteOutput{store: store, sem: make(chan struct{}, remoteConcurrency)}, nil
+}
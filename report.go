@@ -0,0 +1,386 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/color"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// timingVariant is one filter variant drawn in the benchmark charts and
+// listed in its tables
+type timingVariant struct {
+	name  string
+	label string
+	short string // label of the combined columns of the text table
+	color color.Color
+}
+
+// timingVariants are the median filter variants timed by the benchmark, in
+// the order they are drawn
+var timingVariants = []timingVariant{
+	{"sequential", "Sequential", "Seq", color.RGBA{R: 255, G: 0, B: 0, A: 255}}, // Red for sequential
+	{"parallel", "Parallel", "Par", color.RGBA{R: 0, G: 0, B: 255, A: 255}},     // Blue for parallel
+	{"simd", "SIMD", "SIMD", color.RGBA{R: 0, G: 160, B: 0, A: 255}},            // Green for simd
+}
+
+// chartVariants returns the median variants followed by every registered
+// filter the benchmark timed on images, sorted by name and colored from the
+// default palette. The charts, tables and summary all list these.
+func chartVariants(images []ManifestImage) []timingVariant {
+	extra := map[string]bool{}
+	for _, img := range images {
+		for name := range img.Seconds {
+			extra[name] = true
+		}
+	}
+	variants := append([]timingVariant(nil), timingVariants...)
+	for _, variant := range timingVariants {
+		delete(extra, variant.name)
+	}
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		variants = append(variants, timingVariant{name, name, name, plotutil.Color(i + 3)})
+	}
+	return variants
+}
+
+// meanSeconds returns the mean time of variant on img, and false when the
+// variant has no time there, as on an image that timed out. Such images
+// are left out of the charts instead of being drawn as 0 s, which would
+// pass for the fastest time and which a log scale cannot draw.
+func meanSeconds(img ManifestImage, variant string) (float64, bool) {
+	seconds, ok := img.Seconds[variant]
+	return seconds, ok && !img.TimedOut
+}
+
+// samples returns every recorded run of variant, falling back to the mean
+// for manifests written before individual runs were kept
+func samples(img ManifestImage, variant string) plotter.Values {
+	if runs := img.Runs[variant]; len(runs) > 0 {
+		return plotter.Values(runs)
+	}
+	return plotter.Values{img.Seconds[variant]}
+}
+
+// swatch is a legend thumbnail filled with a single color
+type swatch struct {
+	color color.Color
+}
+
+func (s swatch) Thumbnail(c *draw.Canvas) {
+	c.FillPolygon(s.color, c.ClipPolygonXY([]vg.Point{
+		{X: c.Min.X, Y: c.Min.Y},
+		{X: c.Max.X, Y: c.Min.Y},
+		{X: c.Max.X, Y: c.Max.Y},
+		{X: c.Min.X, Y: c.Max.Y},
+	}))
+}
+
+// imageNumbers labels the X axis of the per-image charts 1, 2, 3, ...
+func imageNumbers(images []ManifestImage) []string {
+	names := make([]string, len(images))
+	for i := range images {
+		names[i] = fmt.Sprint(i + 1)
+	}
+	return names
+}
+
+// groupOffset places the k-th of n bars or boxes of a group so the group is
+// centered on its tick
+func groupOffset(k, n int, width vg.Length) vg.Length {
+	return vg.Length(float64(k)-float64(n-1)/2) * width
+}
+
+// plotTimingLines draws the mean time of every variant per image. The
+// line of a variant is broken at the images it has no time for.
+func plotTimingLines(images []ManifestImage, opts *plotOptions) error {
+	p := plot.New()
+	p.Title.Text = "Performance Comparison"
+	p.X.Label.Text = "Image Number"
+	p.Y.Label.Text = "Time (s)"
+
+	var drawn []plotter.XYs
+	for _, variant := range chartVariants(images) {
+		var segments []plotter.XYs
+		var points plotter.XYs
+		for i, img := range images {
+			seconds, ok := meanSeconds(img, variant.name)
+			if ok {
+				points = append(points, plotter.XY{X: float64(i + 1), Y: seconds})
+			}
+			if (!ok || i == len(images)-1) && len(points) > 0 {
+				segments = append(segments, points)
+				points = nil
+			}
+		}
+
+		for k, segment := range segments {
+			line, pts, err := plotter.NewLinePoints(segment)
+			if err != nil {
+				return fmt.Errorf("failed to create line points for %s: %w", variant.name, err)
+			}
+			line.Color = variant.color
+
+			p.Add(line, pts)
+			if k == 0 {
+				p.Legend.Add(variant.label, line, pts)
+			}
+			drawn = append(drawn, segment)
+		}
+	}
+
+	opts.apply(p, drawn...)
+	return opts.save(p)
+}
+
+// plotTimingBoxes draws one box per variant and image showing the spread of
+// the individual runs
+func plotTimingBoxes(images []ManifestImage, opts *plotOptions) error {
+	p := plot.New()
+	p.Title.Text = "Timing Distribution"
+	p.X.Label.Text = "Image Number"
+	p.Y.Label.Text = "Time (s)"
+
+	width := vg.Points(8)
+	variants := chartVariants(images)
+	var drawn []plotter.XYs
+	for k, variant := range variants {
+		var medians plotter.XYs
+		for i, img := range images {
+			if _, ok := meanSeconds(img, variant.name); !ok {
+				continue
+			}
+			box, err := plotter.NewBoxPlot(width, float64(i), samples(img, variant.name))
+			if err != nil {
+				return fmt.Errorf("failed to create box plot for %s: %w", variant.name, err)
+			}
+			box.Offset = groupOffset(k, len(variants), width)
+			box.FillColor = variant.color
+			p.Add(box)
+			medians = append(medians, plotter.XY{X: float64(i), Y: box.Median})
+		}
+		p.Legend.Add(variant.label, swatch{variant.color})
+		drawn = append(drawn, medians)
+	}
+	p.NominalX(imageNumbers(images)...)
+
+	opts.apply(p, drawn...)
+	return opts.saveChart(p, "box")
+}
+
+// plotMeanBars draws the mean time of every variant per image as grouped
+// bars
+func plotMeanBars(images []ManifestImage, opts *plotOptions) error {
+	return plotGroupedBars(images, opts, "bar", "Mean Execution Time", "Time (s)", meanSeconds)
+}
+
+// plotMemoryBars draws the peak heap of every variant per image as grouped
+// bars. Images resumed from manifests without memory usage are drawn as 0.
+func plotMemoryBars(images []ManifestImage, opts *plotOptions) error {
+	return plotGroupedBars(images, opts, "memory", "Peak Heap", "Peak heap (KiB)", func(img ManifestImage, variant string) (float64, bool) {
+		return float64(img.Memory[variant].PeakHeap) / (1 << 10), !img.TimedOut
+	})
+}
+
+// plotGroupedBars draws value of every variant per image as grouped bars,
+// saved as the additional chart named chart. Images value reports false
+// for get no bar. Bars always start at zero, so -log-y is ignored for
+// these charts.
+func plotGroupedBars(images []ManifestImage, opts *plotOptions, chart, title, label string, value func(img ManifestImage, variant string) (float64, bool)) error {
+	p := plot.New()
+	p.Title.Text = title
+	p.X.Label.Text = "Image Number"
+	p.Y.Label.Text = label
+
+	width := vg.Points(6)
+	variants := chartVariants(images)
+	var drawn []plotter.XYs
+	for k, variant := range variants {
+		// One bar chart per run of images with a value, since a bar chart
+		// has no gaps
+		var points plotter.XYs
+		var values plotter.Values
+		first, legend := 0, false
+		for i, img := range images {
+			v, ok := value(img, variant.name)
+			if ok {
+				if len(values) == 0 {
+					first = i
+				}
+				values = append(values, v)
+				points = append(points, plotter.XY{X: float64(i), Y: v})
+			}
+			if (ok && i < len(images)-1) || len(values) == 0 {
+				continue
+			}
+
+			bars, err := plotter.NewBarChart(values, width)
+			if err != nil {
+				return fmt.Errorf("failed to create bar chart for %s: %w", variant.name, err)
+			}
+			bars.XMin = float64(first)
+			bars.Offset = groupOffset(k, len(variants), width)
+			bars.Color = variant.color
+			bars.LineStyle.Width = 0
+
+			p.Add(bars)
+			if !legend {
+				p.Legend.Add(variant.label, bars)
+				legend = true
+			}
+			values = nil
+		}
+		drawn = append(drawn, points)
+	}
+	p.NominalX(imageNumbers(images)...)
+
+	linear := *opts
+	linear.logY = false
+	linear.apply(p, drawn...)
+	return linear.saveChart(p, chart)
+}
+
+// benchmarkCharts are the charts selected with -charts
+type benchmarkCharts struct {
+	line, box, bar, memory bool
+}
+
+// parseCharts parses a comma separated list of charts
+func parseCharts(list string) (benchmarkCharts, error) {
+	var charts benchmarkCharts
+	for _, chart := range strings.Split(list, ",") {
+		switch chart {
+		case "line":
+			charts.line = true
+		case "box":
+			charts.box = true
+		case "bar":
+			charts.bar = true
+		case "memory":
+			charts.memory = true
+		default:
+			return charts, fmt.Errorf("unknown chart %q, use line, box, bar or memory", chart)
+		}
+	}
+	return charts, nil
+}
+
+// validTable reports an error for unknown -table formats
+func validTable(table string) error {
+	switch table {
+	case "text", "markdown", "latex":
+		return nil
+	}
+	return fmt.Errorf("unknown table format %q, use text, markdown or latex", table)
+}
+
+// performanceData turns manifest entries into table rows, numbered in order
+func performanceData(images []ManifestImage) []PerformanceData {
+	rows := make([]PerformanceData, len(images))
+	for i, entry := range images {
+		times := map[string]time.Duration{}
+		for variant := range entry.Seconds {
+			times[variant] = entry.Duration(variant)
+		}
+		rows[i] = PerformanceData{
+			ImageNumber: i + 1,
+			Times:       times,
+			Pixels:      entry.Pixels,
+			Memory:      entry.Memory,
+			Energy:      entry.Energy,
+			TimedOut:    entry.TimedOut,
+		}
+	}
+	return rows
+}
+
+// writeReport draws the selected charts of images and prints their table
+// and summary in the given format. wallClock is 0 when it is not known.
+func writeReport(images []ManifestImage, wallClock time.Duration, table string, charts benchmarkCharts, plotOpts *plotOptions) {
+	if charts.line {
+		if err := plotTimingLines(images, plotOpts); err != nil {
+			fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+		}
+	}
+	if charts.box {
+		if err := plotTimingBoxes(images, plotOpts); err != nil {
+			fatal("failed to save plot", "path", plotOpts.chartFilename("box"), "err", err)
+		}
+	}
+	if charts.bar {
+		if err := plotMeanBars(images, plotOpts); err != nil {
+			fatal("failed to save plot", "path", plotOpts.chartFilename("bar"), "err", err)
+		}
+	}
+	if charts.memory {
+		if err := plotMemoryBars(images, plotOpts); err != nil {
+			fatal("failed to save plot", "path", plotOpts.chartFilename("memory"), "err", err)
+		}
+	}
+
+	rows := performanceData(images)
+	variants := chartVariants(images)
+	summary := summarize(rows, variants, wallClock)
+	switch table {
+	case "markdown":
+		WriteMarkdownTable(os.Stdout, rows, variants)
+		WriteMarkdownSummary(os.Stdout, summary)
+	case "latex":
+		WriteLaTeXTable(os.Stdout, rows, variants)
+		WriteLaTeXSummary(os.Stdout, summary)
+	default:
+		PrintExecutionTimesTable(rows, variants)
+		PrintSummary(summary)
+	}
+}
+
+// runReport draws the charts and prints the tables of a results manifest
+// without filtering anything. The benchmark saves the manifest after every
+// image, so this also works on the manifest of a run that is still going
+// or that crashed.
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	manifestPath := fs.String("manifest", filepath.Join("dataset-output", "manifest.json"), "results manifest to report on")
+	table := fs.String("table", "text", "format of the timing table printed to stdout: text, markdown or latex")
+	charts := fs.String("charts", "line", "comma separated charts to draw: line, box (timing distribution per image), bar (mean time per image) and memory (peak heap per image)")
+	plotOpts := addPlotFlags(fs, "performance_comparison.png")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+	if err := validTable(*table); err != nil {
+		fatal("invalid table format", "err", err)
+	}
+	drawCharts, err := parseCharts(*charts)
+	if err != nil {
+		fatal("invalid charts", "err", err)
+	}
+	manifest, err := loadManifest(*manifestPath)
+	if err != nil {
+		fatal("failed to load manifest", "path", *manifestPath, "err", err)
+	}
+	if len(manifest.Images) == 0 {
+		fatal("manifest has no images yet", "path", *manifestPath)
+	}
+	slog.Info("loaded manifest", "path", *manifestPath, "images", len(manifest.Images), "created_at", manifest.CreatedAt)
+	writeReport(manifest.Images, 0, *table, drawCharts, plotOpts)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+)
+
+// resampleFilter is a reconstruction kernel for resizing, nonzero on
+// (-support, support) source pixels at scale 1
+type resampleFilter struct {
+	support float64
+	weight  func(x float64) float64
+}
+
+// resampleFilters are the kernels selectable with -resize-filter
+var resampleFilters = map[string]resampleFilter{
+	"bilinear": {1, func(x float64) float64 { return max(0, 1-math.Abs(x)) }},
+	"lanczos":  {3, lanczos3},
+}
+
+// lanczos3 is the Lanczos window with three lobes
+func lanczos3(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	if math.Abs(x) >= 3 {
+		return 0
+	}
+	px := math.Pi * x
+	return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+}
+
+// resampleTaps are the source pixels and weights every output pixel of one
+// axis is computed from: output i is the sum of weights[i][k] times source
+// start[i]+k
+type resampleTaps struct {
+	start   []int
+	weights [][]float32
+}
+
+// resampleAxis computes the taps that resample srcLen pixels to dstLen.
+// When shrinking, the kernel is stretched by the inverse of the scale so
+// it also removes the detail the smaller image cannot hold; when enlarging
+// it keeps its size. Taps past the edge are dropped and the rest
+// renormalized, which replicates nothing and keeps flat areas flat.
+func resampleAxis(srcLen, dstLen int, f resampleFilter) resampleTaps {
+	scale := float64(dstLen) / float64(srcLen)
+	stretch := max(1, 1/scale)
+	support := f.support * stretch
+	taps := resampleTaps{start: make([]int, dstLen), weights: make([][]float32, dstLen)}
+	for i := range taps.start {
+		center := (float64(i)+0.5)/scale - 0.5
+		first := max(0, int(math.Ceil(center-support)))
+		last := min(srcLen-1, int(math.Floor(center+support)))
+		weights := make([]float64, 0, last-first+1)
+		var sum float64
+		for j := first; j <= last; j++ {
+			w := f.weight((float64(j) - center) / stretch)
+			weights = append(weights, w)
+			sum += w
+		}
+		taps.start[i] = first
+		taps.weights[i] = make([]float32, len(weights))
+		for k, w := range weights {
+			taps.weights[i][k] = float32(w / sum)
+		}
+	}
+	return taps
+}
+
+// resizeRowsRect resamples the rows of img into the pixels of rect of tmp,
+// a buffer of width values per source row
+func resizeRowsRect(tmp []float32, width int, img *image.Gray, rect image.Rectangle, taps resampleTaps) {
+	bounds := img.Bounds()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:bounds.Dx()]
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			var sum float32
+			for k, w := range taps.weights[x] {
+				sum += w * float32(row[taps.start[x]+k])
+			}
+			tmp[y*width+x] = sum
+		}
+	}
+}
+
+// resizeColumnsRect resamples the columns of tmp into the pixels of rect
+func resizeColumnsRect(output *image.Gray, tmp []float32, rect image.Rectangle, taps resampleTaps) {
+	width := output.Bounds().Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		dst := output.Pix[output.PixOffset(rect.Min.X, y):][:rect.Dx()]
+		for x := range dst {
+			var sum float32
+			for k, w := range taps.weights[y] {
+				sum += w * tmp[(taps.start[y]+k)*width+rect.Min.X+x]
+			}
+			// Lanczos overshoots at edges
+			dst[x] = uint8(min(255, max(0, math.Round(float64(sum)))))
+		}
+	}
+}
+
+// resizeGray resamples img to width x height with the separable filter f:
+// a horizontal pass into a float buffer, then a vertical one. Both passes
+// are split into chunkSize x chunkSize tiles like the parallel median
+// filter; the vertical pass reads rows of neighboring tiles, so it starts
+// once the horizontal pass is done everywhere. The result has its origin at
+// (0, 0).
+func resizeGray(img *image.Gray, width, height int, f resampleFilter, chunkSize int) *image.Gray {
+	bounds := img.Bounds()
+	columns := resampleAxis(bounds.Dx(), width, f)
+	rows := resampleAxis(bounds.Dy(), height, f)
+
+	buf := floatPool.get(width * bounds.Dy())
+	defer floatPool.put(width*bounds.Dy(), buf)
+	tmp := *buf
+	forEachTile(image.Rect(0, 0, width, bounds.Dy()), chunkSize, func(tile image.Rectangle) {
+		resizeRowsRect(tmp, width, img, tile, columns)
+	})
+	output := GetGray(image.Rect(0, 0, width, height))
+	forEachTile(output.Bounds(), chunkSize, func(tile image.Rectangle) {
+		resizeColumnsRect(output, tmp, tile, rows)
+	})
+	return output
+}
+
+// resizeOptions holds the resizing flags of the subcommands that can
+// normalize their inputs before filtering
+type resizeOptions struct {
+	scale  float64
+	maxDim int
+	filter string
+}
+
+func addResizeFlags(fs *flag.FlagSet) *resizeOptions {
+	opts := &resizeOptions{}
+	fs.Float64Var(&opts.scale, "scale", 1, "resize every input by this factor before filtering, e.g. 0.5 to halve it")
+	fs.IntVar(&opts.maxDim, "max-dim", 0, "shrink inputs whose width or height exceeds this many pixels to fit, keeping the aspect ratio (0 for no limit)")
+	fs.StringVar(&opts.filter, "resize-filter", "lanczos", "resampling filter used by -scale and -max-dim: bilinear or lanczos")
+	return opts
+}
+
+func (o *resizeOptions) validate() error {
+	if o.scale <= 0 {
+		return fmt.Errorf("scale must be positive, got %g", o.scale)
+	}
+	if o.maxDim < 0 {
+		return fmt.Errorf("max-dim must not be negative, got %d", o.maxDim)
+	}
+	if _, ok := resampleFilters[o.filter]; !ok {
+		return fmt.Errorf("unknown resize filter %q, use bilinear or lanczos", o.filter)
+	}
+	return nil
+}
+
+// enabled reports whether the options change any image
+func (o *resizeOptions) enabled() bool {
+	return o.scale != 1 || o.maxDim > 0
+}
+
+// size returns the size an image of size src is resized to: scaled first,
+// then shrunk to fit maxDim, never below one pixel
+func (o *resizeOptions) size(src image.Point) image.Point {
+	factor := o.scale
+	if o.maxDim > 0 {
+		if longest := float64(max(src.X, src.Y)) * factor; longest > float64(o.maxDim) {
+			factor *= float64(o.maxDim) / longest
+		}
+	}
+	return image.Pt(max(1, int(math.Round(float64(src.X)*factor))), max(1, int(math.Round(float64(src.Y)*factor))))
+}
+
+// apply returns img resized by the options, or img itself when they leave
+// its size unchanged. A resized img is released to the gray pool.
+func (o *resizeOptions) apply(img *image.Gray, chunkSize int) *image.Gray {
+	src := img.Bounds().Size()
+	dst := o.size(src)
+	if dst == src {
+		return img
+	}
+	output := resizeGray(img, dst.X, dst.Y, resampleFilters[o.filter], chunkSize)
+	PutGray(img)
+	return output
+}
+
+// resolutionTiming is the mean time per image of the median filter at one
+// scale of the dataset
+type resolutionTiming struct {
+	Scale      float64
+	Pixels     int // mean per image
+	Sequential time.Duration
+	Parallel   time.Duration
+}
+
+// PrintResolutionTable prints the time of both filters per scale
+func PrintResolutionTable(timings []resolutionTiming) {
+	fmt.Println("Scale\tMegapixels\tSequential (s)\tParallel (s)\tSpeedup")
+	fmt.Println("------------------------------------------------------------------")
+	for _, t := range timings {
+		fmt.Printf("%.2f\t%.3f\t\t%.6f\t%.6f\t%.2fx\n", t.Scale, float64(t.Pixels)/1e6, t.Sequential.Seconds(), t.Parallel.Seconds(), t.Sequential.Seconds()/t.Parallel.Seconds())
+	}
+}
+
+// plotResolutionTimings saves the time of both filters against the image size
+func plotResolutionTimings(timings []resolutionTiming, opts *plotOptions) error {
+	p := plot.New()
+	p.Title.Text = "Resolution vs Runtime"
+	p.X.Label.Text = "Image size (megapixels)"
+	p.Y.Label.Text = "Time per image (s)"
+
+	sequential := make(plotter.XYs, len(timings))
+	parallel := make(plotter.XYs, len(timings))
+	for i, t := range timings {
+		sequential[i] = plotter.XY{X: float64(t.Pixels) / 1e6, Y: t.Sequential.Seconds()}
+		parallel[i] = plotter.XY{X: float64(t.Pixels) / 1e6, Y: t.Parallel.Seconds()}
+	}
+	for i, series := range []struct {
+		label  string
+		points plotter.XYs
+	}{{"Sequential", sequential}, {"Parallel", parallel}} {
+		line, pts, err := plotter.NewLinePoints(series.points)
+		if err != nil {
+			return err
+		}
+		line.Color = plotutil.Color(i)
+		pts.Color = plotutil.Color(i)
+		p.Add(line, pts)
+		p.Legend.Add(series.label, line, pts)
+	}
+	opts.apply(p, sequential, parallel)
+	return opts.save(p)
+}
+
+// parseScales parses a comma separated list of positive scale factors
+func parseScales(list string) ([]float64, error) {
+	var scales []float64
+	for _, field := range strings.Split(list, ",") {
+		var scale float64
+		if _, err := fmt.Sscan(strings.TrimSpace(field), &scale); err != nil || scale <= 0 {
+			return nil, fmt.Errorf("invalid scale %q", field)
+		}
+		scales = append(scales, scale)
+	}
+	return scales, nil
+}
+
+// runResolution times the sequential and parallel median filters on the
+// dataset resized to several scales, for resolution vs runtime curves
+func runResolution(args []string) {
+	fs := flag.NewFlagSet("resolution", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the input images")
+	scaleList := fs.String("scales", "0.25,0.5,1,2", "comma separated factors the inputs are resized by")
+	resizeFilter := fs.String("resize-filter", "lanczos", "resampling filter: bilinear or lanczos")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	runs := fs.Int("runs", 3, "times every filter is run per image and scale, the mean is reported")
+	plotOpts := addPlotFlags(fs, "resolution_runtime.png")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	scales, err := parseScales(*scaleList)
+	if err != nil {
+		fatal("failed to parse scales", "err", err)
+	}
+	f, ok := resampleFilters[*resizeFilter]
+	if !ok {
+		fatal("unknown resize filter, use bilinear or lanczos", "resize-filter", *resizeFilter)
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+	if _, err := applyFilter("parallel", image.NewGray(image.Rect(0, 0, 1, 1)), *chunkSize, *kernel); err != nil {
+		fatal("invalid filter settings", "err", err)
+	}
+	filterSize := *kernel / 2
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+
+	slog.Info("timing the median filter at every scale, please wait", "input", *input, "scales", scales, "kernel", *kernel)
+	timings := make([]resolutionTiming, len(scales))
+	images := 0
+	err = in.Walk(func(filename string, img image.Image) error {
+		images++
+		bwImage := toBlackAndWhite(img)
+		for i, scale := range scales {
+			timings[i].Scale = scale
+			opts := resizeOptions{scale: scale}
+			size := opts.size(bwImage.Bounds().Size())
+			resized := resizeGray(bwImage, size.X, size.Y, f, *chunkSize)
+			timings[i].Pixels += len(resized.Pix)
+			for _, elapsed := range measureRuns(*runs, func() *image.Gray { return medianFilterSequential(resized, filterSize) }) {
+				timings[i].Sequential += elapsed
+			}
+			for _, elapsed := range measureRuns(*runs, func() *image.Gray { return medianFilterParallel(resized, *chunkSize, filterSize) }) {
+				timings[i].Parallel += elapsed
+			}
+			PutGray(resized)
+		}
+		PutGray(bwImage)
+		slog.Debug("processed image", "image", filename, "stage", "resolution")
+		return nil
+	})
+	if err != nil {
+		fatal("failed to time resolutions", "input", *input, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+
+	n := time.Duration(images * *runs)
+	for i := range timings {
+		timings[i].Pixels /= images
+		timings[i].Sequential /= n
+		timings[i].Parallel /= n
+	}
+	if err := plotResolutionTimings(timings, plotOpts); err != nil {
+		fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+	}
+	PrintResolutionTable(timings)
+}
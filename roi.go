@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// parseROI parses a region of interest given as "x,y,width,height"
+func parseROI(spec string) (image.Rectangle, error) {
+	fields := strings.Split(spec, ",")
+	if len(fields) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q, want x,y,width,height", spec)
+	}
+	var v [4]int
+	for i, field := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("invalid region %q, want x,y,width,height", spec)
+		}
+		v[i] = n
+	}
+	if v[2] < 1 || v[3] < 1 {
+		return image.Rectangle{}, fmt.Errorf("region %q must have a positive width and height", spec)
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// maskBounds returns the smallest rectangle holding every nonzero pixel of mask
+func maskBounds(mask *image.Gray) image.Rectangle {
+	var r image.Rectangle
+	b := mask.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if mask.Pix[mask.PixOffset(x, y)] != 0 {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return r
+}
+
+// filterRegion runs filter on region of img only and returns a copy of img
+// with the filtered pixels pasted in. The filter sees margin extra pixels
+// around the region, so windows reaching up to margin pixels out give the
+// same result as filtering the whole frame. When mask is not nil only the
+// pixels of region that are nonzero in it are replaced.
+func filterRegion(img *image.Gray, region image.Rectangle, margin int, mask *image.Gray, filter func(*image.Gray) (*image.Gray, error)) (*image.Gray, error) {
+	bounds := img.Bounds()
+	region = region.Intersect(bounds)
+	if region.Empty() {
+		return nil, fmt.Errorf("region does not overlap the %dx%d image", bounds.Dx(), bounds.Dy())
+	}
+	if mask != nil && mask.Bounds() != bounds {
+		return nil, fmt.Errorf("mask is %dx%d but the image is %dx%d", mask.Bounds().Dx(), mask.Bounds().Dy(), bounds.Dx(), bounds.Dy())
+	}
+
+	// Filters expect images starting at the origin, so the crop is copied
+	// into one and shifted back when pasting
+	crop := region.Inset(-margin).Intersect(bounds)
+	input := GetGray(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	for y := crop.Min.Y; y < crop.Max.Y; y++ {
+		copy(input.Pix[(y-crop.Min.Y)*input.Stride:], img.Pix[img.PixOffset(crop.Min.X, y):img.PixOffset(crop.Max.X, y)])
+	}
+	filtered, err := filter(input)
+	PutGray(input)
+	if err != nil {
+		return nil, err
+	}
+	defer PutGray(filtered)
+
+	output := GetGray(bounds)
+	copy(output.Pix, img.Pix)
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		for x := region.Min.X; x < region.Max.X; x++ {
+			if mask != nil && mask.Pix[mask.PixOffset(x, y)] == 0 {
+				continue
+			}
+			output.Pix[output.PixOffset(x, y)] = filtered.Pix[filtered.PixOffset(x-crop.Min.X, y-crop.Min.Y)]
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+)
+
+// ScalingPoint is the best time measured for one worker count. Pin and CPUs
+// are the pinning policy and the CPUs used by the cpus sweep.
+type ScalingPoint struct {
+	Workers  int
+	Width    int
+	Height   int
+	Schedule string
+	Pin      string
+	CPUs     []int
+	Time     time.Duration
+}
+
+// defaultWorkerCounts returns 1, 2, 4, ... up to the number of CPUs, always
+// ending with the CPU count itself
+func defaultWorkerCounts() []int {
+	var counts []int
+	for w := 1; w < runtime.NumCPU(); w *= 2 {
+		counts = append(counts, w)
+	}
+	return append(counts, runtime.NumCPU())
+}
+
+// parseWorkerCounts parses a comma separated list of positive worker counts.
+// The list must start with 1, the baseline every speedup is measured against.
+func parseWorkerCounts(list string) ([]int, error) {
+	var counts []int
+	for _, field := range strings.Split(list, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("invalid worker count %q", field)
+		}
+		counts = append(counts, w)
+	}
+	if counts[0] != 1 {
+		return nil, fmt.Errorf("worker counts must start with 1, got %d", counts[0])
+	}
+	return counts, nil
+}
+
+// timeFilter runs the filter runs times and returns the fastest run, which is
+// the least disturbed by the rest of the machine
+func timeFilter(mode, schedule, pattern string, width, height, chunkSize, kernel, runs int) (time.Duration, error) {
+	img, err := generateImage(pattern, width, height, 1)
+	if err != nil {
+		return 0, err
+	}
+	var best time.Duration
+	for i := 0; i < runs; i++ {
+		start := time.Now()
+		if _, err := applyScheduledFilter(mode, schedule, img, chunkSize, kernel); err != nil {
+			return 0, err
+		}
+		elapsed := time.Since(start)
+		filterMetrics.Observe(mode, len(img.Pix), elapsed)
+		if i == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	return best, nil
+}
+
+// weakScaling runs the parallel filter with GOMAXPROCS set to each worker
+// count, growing the image height with the worker count so every worker
+// always has width x height pixels to filter
+func weakScaling(counts []int, pattern string, width, height, chunkSize, kernel, runs int) ([]ScalingPoint, error) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	var points []ScalingPoint
+	for _, workers := range counts {
+		runtime.GOMAXPROCS(workers)
+		filterMetrics.SetWorkers(workers)
+		point := ScalingPoint{Workers: workers, Width: width, Height: height * workers}
+		elapsed, err := timeFilter("parallel", defaultSchedule, pattern, point.Width, point.Height, chunkSize, kernel, runs)
+		if err != nil {
+			return nil, err
+		}
+		point.Time = elapsed
+		slog.Debug("filtered image", "stage", "weak-scaling", "worker", workers, "width", point.Width, "height", point.Height, "duration", elapsed)
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// PrintWeakScalingTable prints the time, weak-scaling efficiency T(1)/T(n)
+// and scaled speedup for every worker count, next to the Gustafson fit
+func PrintWeakScalingTable(points []ScalingPoint) {
+	serial := fitGustafson(points)
+	fmt.Println("Workers\tImage Size\tTime (s)\tEfficiency\tScaled Speedup\tGustafson")
+	fmt.Println("------------------------------------------------------------------")
+	for _, p := range points {
+		efficiency := points[0].Time.Seconds() / p.Time.Seconds()
+		fmt.Printf("%d\t%dx%d\t%.6f\t%.1f%%\t\t%.2fx\t\t%.2fx\n", p.Workers, p.Width, p.Height, p.Time.Seconds(),
+			100*efficiency, float64(p.Workers)*efficiency, gustafsonSpeedup(serial, p.Workers))
+	}
+	fmt.Printf("Parallel fraction: %.1f%% (Gustafson)\n", 100*(1-serial))
+}
+
+// strongScaling runs the parallel filter with the given scheduling policy on
+// the same width x height image with GOMAXPROCS set to each worker count
+func strongScaling(counts []int, schedule, pattern string, width, height, chunkSize, kernel, runs int) ([]ScalingPoint, error) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	var points []ScalingPoint
+	for _, workers := range counts {
+		runtime.GOMAXPROCS(workers)
+		filterMetrics.SetWorkers(workers)
+		elapsed, err := timeFilter("parallel", schedule, pattern, width, height, chunkSize, kernel, runs)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("filtered image", "stage", "strong-scaling", "worker", workers, "width", width, "height", height, "schedule", schedule, "duration", elapsed)
+		points = append(points, ScalingPoint{Workers: workers, Width: width, Height: height, Schedule: schedule, Time: elapsed})
+	}
+	return points, nil
+}
+
+// PrintStrongScalingTable prints the measured speedup of one image size next
+// to the Amdahl's law prediction fitted to it
+func PrintStrongScalingTable(points []ScalingPoint) {
+	serial := fitAmdahl(points)
+	fmt.Printf("Image size %dx%d, %s schedule\n", points[0].Width, points[0].Height, points[0].Schedule)
+	fmt.Println("Workers\tTime (s)\tSpeedup\tAmdahl\tEfficiency")
+	fmt.Println("------------------------------------------------------------------")
+	for _, p := range points {
+		speedup := points[0].Time.Seconds() / p.Time.Seconds()
+		fmt.Printf("%d\t%.6f\t%.2fx\t%.2fx\t%.1f%%\n", p.Workers, p.Time.Seconds(), speedup, amdahlSpeedup(serial, p.Workers), 100*speedup/float64(p.Workers))
+	}
+	fmt.Printf("Parallel fraction: %.1f%% (Amdahl)\n", 100*(1-serial))
+}
+
+// plotStrongScaling saves the measured speedup of every image size with its
+// fitted Amdahl's law curve drawn dashed in the same color
+func plotStrongScaling(series [][]ScalingPoint, opts *plotOptions) error {
+	p := plot.New()
+	p.Title.Text = "Strong Scaling (fixed image size)"
+	p.X.Label.Text = "Workers"
+	p.Y.Label.Text = "Speedup"
+	if !opts.logY {
+		p.Y.Min = 0
+	}
+
+	// Name the schedule in the legend only when several were compared
+	schedules := map[string]bool{}
+	for _, points := range series {
+		schedules[points[0].Schedule] = true
+	}
+
+	var drawn []plotter.XYs
+	for i, points := range series {
+		serial := fitAmdahl(points)
+		measured := make(plotter.XYs, len(points))
+		for j, point := range points {
+			measured[j] = plotter.XY{X: float64(point.Workers), Y: points[0].Time.Seconds() / point.Time.Seconds()}
+		}
+
+		// Sample the model at every worker count so the curve is smooth
+		last := points[len(points)-1].Workers
+		predicted := make(plotter.XYs, last)
+		for n := 1; n <= last; n++ {
+			predicted[n-1] = plotter.XY{X: float64(n), Y: amdahlSpeedup(serial, n)}
+		}
+
+		line, pts, err := plotter.NewLinePoints(measured)
+		if err != nil {
+			return err
+		}
+		line.Color = plotutil.Color(i)
+		pts.Color = plotutil.Color(i)
+
+		model, err := plotter.NewLine(predicted)
+		if err != nil {
+			return err
+		}
+		model.Color = plotutil.Color(i)
+		model.Dashes = []vg.Length{vg.Points(4), vg.Points(4)}
+
+		p.Add(line, pts, model)
+		drawn = append(drawn, measured, predicted)
+		label := fmt.Sprintf("%dx%d", points[0].Width, points[0].Height)
+		if len(schedules) > 1 {
+			label += " " + points[0].Schedule
+		}
+		p.Legend.Add(label, line, pts)
+		p.Legend.Add(fmt.Sprintf("Amdahl, %.1f%% parallel", 100*(1-serial)), model)
+	}
+
+	opts.apply(p, drawn...)
+	return opts.save(p)
+}
+
+// parseSizes parses a comma separated list of WIDTHxHEIGHT image sizes
+func parseSizes(list string) ([]image.Point, error) {
+	var sizes []image.Point
+	for _, field := range strings.Split(list, ",") {
+		var size image.Point
+		if _, err := fmt.Sscanf(strings.TrimSpace(field), "%dx%d", &size.X, &size.Y); err != nil || size.X < 1 || size.Y < 1 {
+			return nil, fmt.Errorf("invalid image size %q, want WIDTHxHEIGHT", field)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// plotWeakScaling saves time against worker count next to the ideal flat line
+func plotWeakScaling(points []ScalingPoint, opts *plotOptions) error {
+	p := plot.New()
+	p.Title.Text = "Weak Scaling (constant work per worker)"
+	p.X.Label.Text = "Workers"
+	p.Y.Label.Text = "Time (s)"
+	if !opts.logY {
+		p.Y.Min = 0
+	}
+
+	// Gustafson's scaled speedup S(n) = n T(1)/T(n) turned back into a time
+	serial := fitGustafson(points)
+	measured := make(plotter.XYs, len(points))
+	ideal := make(plotter.XYs, len(points))
+	predicted := make(plotter.XYs, len(points))
+	for i, point := range points {
+		measured[i] = plotter.XY{X: float64(point.Workers), Y: point.Time.Seconds()}
+		ideal[i] = plotter.XY{X: float64(point.Workers), Y: points[0].Time.Seconds()}
+		predicted[i] = plotter.XY{X: float64(point.Workers), Y: float64(point.Workers) * points[0].Time.Seconds() / gustafsonSpeedup(serial, point.Workers)}
+	}
+
+	line, pts, err := plotter.NewLinePoints(measured)
+	if err != nil {
+		return err
+	}
+	line.Color = color.RGBA{R: 0, G: 0, B: 255, A: 255} // Blue line for parallel
+
+	idealLine, err := plotter.NewLine(ideal)
+	if err != nil {
+		return err
+	}
+	idealLine.Dashes = []vg.Length{vg.Points(4), vg.Points(4)}
+
+	model, err := plotter.NewLine(predicted)
+	if err != nil {
+		return err
+	}
+	model.Color = line.Color
+	model.Dashes = []vg.Length{vg.Points(2), vg.Points(2)}
+
+	p.Add(line, pts, idealLine, model)
+	p.Legend.Add("Parallel", line, pts)
+	p.Legend.Add("Ideal", idealLine)
+	p.Legend.Add(fmt.Sprintf("Gustafson, %.1f%% parallel", 100*(1-serial)), model)
+
+	opts.apply(p, measured, ideal, predicted)
+	return opts.save(p)
+}
+
+// runWeakScaling times the parallel filter on synthetic images whose size
+// grows with the worker count and plots time against workers
+func runWeakScaling(args []string) {
+	fs := flag.NewFlagSet("weak-scaling", flag.ExitOnError)
+	workers := fs.String("workers", "", "comma separated worker counts starting with 1 (default 1, 2, 4, ... up to the number of CPUs)")
+	width := fs.Int("width", 768, "image width, the same for every worker count")
+	height := fs.Int("height", 512, "image height per worker")
+	pattern := fs.String("pattern", "impulse", "synthetic pattern to filter: "+strings.Join(synthPatterns, ", "))
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	runs := fs.Int("runs", 3, "runs per worker count, the fastest one is reported")
+	plotOpts := addPlotFlags(fs, "weak_scaling.png")
+	metricsAddr := fs.String("metrics", "", "address to expose Prometheus /metrics on while the experiment runs (disabled when empty)")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+	serveMetrics(*metricsAddr)
+
+	counts := defaultWorkerCounts()
+	if *workers != "" {
+		var err error
+		if counts, err = parseWorkerCounts(*workers); err != nil {
+			fatal("failed to parse worker counts", "err", err)
+		}
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+
+	slog.Info("running weak scaling experiment, please wait", "workers", counts)
+	points, err := weakScaling(counts, *pattern, *width, *height, *chunkSize, *kernel, *runs)
+	if err != nil {
+		fatal("weak scaling experiment failed", "err", err)
+	}
+	if err := plotWeakScaling(points, plotOpts); err != nil {
+		fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+	}
+	PrintWeakScalingTable(points)
+}
+
+// runStrongScaling times the parallel filter on fixed size synthetic images
+// for every worker count and fits Amdahl's law to each image size
+func runStrongScaling(args []string) {
+	fs := flag.NewFlagSet("strong-scaling", flag.ExitOnError)
+	workers := fs.String("workers", "", "comma separated worker counts starting with 1 (default 1, 2, 4, ... up to the number of CPUs)")
+	sizes := fs.String("sizes", "768x512,1536x1024,3072x2048", "comma separated WIDTHxHEIGHT image sizes")
+	scheduleList := fs.String("schedule", defaultSchedule, "comma separated tile scheduling policies to compare: tiles, static or stealing")
+	pattern := fs.String("pattern", "impulse", "synthetic pattern to filter: "+strings.Join(synthPatterns, ", "))
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	runs := fs.Int("runs", 3, "runs per worker count, the fastest one is reported")
+	plotOpts := addPlotFlags(fs, "strong_scaling.png")
+	metricsAddr := fs.String("metrics", "", "address to expose Prometheus /metrics on while the experiment runs (disabled when empty)")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+	serveMetrics(*metricsAddr)
+
+	counts := defaultWorkerCounts()
+	if *workers != "" {
+		var err error
+		if counts, err = parseWorkerCounts(*workers); err != nil {
+			fatal("failed to parse worker counts", "err", err)
+		}
+	}
+	imageSizes, err := parseSizes(*sizes)
+	if err != nil {
+		fatal("failed to parse image sizes", "err", err)
+	}
+	schedules := strings.Split(*scheduleList, ",")
+	for _, schedule := range schedules {
+		if err := validSchedule(schedule); err != nil {
+			fatal("invalid schedule", "err", err)
+		}
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+
+	slog.Info("running strong scaling experiment, please wait", "workers", counts, "sizes", *sizes, "schedule", *scheduleList)
+	var series [][]ScalingPoint
+	for _, size := range imageSizes {
+		for _, schedule := range schedules {
+			points, err := strongScaling(counts, schedule, *pattern, size.X, size.Y, *chunkSize, *kernel, *runs)
+			if err != nil {
+				fatal("strong scaling experiment failed", "err", err)
+			}
+			series = append(series, points)
+		}
+	}
+	if err := plotStrongScaling(series, plotOpts); err != nil {
+		fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+	}
+	for i, points := range series {
+		if i > 0 {
+			fmt.Println()
+		}
+		PrintStrongScalingTable(points)
+	}
+}
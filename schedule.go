@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+)
+
+// defaultSchedule is the policy of the original parallel filter
+const defaultSchedule = "tiles"
+
+// tileScheduler runs fn once for every tile and waits for all of them. worker
+// identifies the goroutine that ran the tile, or is -1 when the policy has no
+// fixed workers.
+type tileScheduler func(tiles []image.Rectangle, fn func(worker int, tile image.Rectangle))
+
+// tileSchedulers are the policies the parallel median filter can hand its
+// tiles out with:
+//   - tiles starts a goroutine per tile and leaves the rest to the Go runtime
+//   - static gives each of GOMAXPROCS workers an equal contiguous run of tiles
+//   - stealing starts from the static split, but a worker that runs out of
+//     tiles takes half of the remaining tiles of another worker
+var tileSchedulers = map[string]tileScheduler{
+	"tiles":    scheduleTiles,
+	"static":   scheduleStatic,
+	"stealing": scheduleStealing,
+}
+
+// tileRects splits bounds into chunkSize x chunkSize tiles, row by row
+func tileRects(bounds image.Rectangle, chunkSize int) []image.Rectangle {
+	var tiles []image.Rectangle
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += chunkSize {
+		for x := bounds.Min.X; x < bounds.Max.X; x += chunkSize {
+			tiles = append(tiles, image.Rect(x, y, x+chunkSize, y+chunkSize).Intersect(bounds))
+		}
+	}
+	return tiles
+}
+
+func scheduleTiles(tiles []image.Rectangle, fn func(worker int, tile image.Rectangle)) {
+	var wg sync.WaitGroup
+	for _, tile := range tiles {
+		wg.Add(1)
+		go func(tile image.Rectangle) {
+			defer wg.Done()
+			if !filterAbort.Load() {
+				fn(-1, tile)
+			}
+		}(tile)
+	}
+	wg.Wait()
+}
+
+// splitTiles divides tiles into at most GOMAXPROCS contiguous runs whose
+// lengths differ by at most one
+func splitTiles(tiles []image.Rectangle) [][]image.Rectangle {
+	workers := min(runtime.GOMAXPROCS(0), len(tiles))
+	parts := make([][]image.Rectangle, workers)
+	for w := range parts {
+		parts[w] = tiles[len(tiles)*w/workers : len(tiles)*(w+1)/workers]
+	}
+	return parts
+}
+
+func scheduleStatic(tiles []image.Rectangle, fn func(worker int, tile image.Rectangle)) {
+	var wg sync.WaitGroup
+	for w, part := range splitTiles(tiles) {
+		wg.Add(1)
+		go func(worker int, part []image.Rectangle) {
+			defer wg.Done()
+			for _, tile := range part {
+				if filterAbort.Load() {
+					return
+				}
+				fn(worker, tile)
+			}
+		}(w, part)
+	}
+	wg.Wait()
+}
+
+// tileDeque is the queue of tiles still owned by one worker. The owner takes
+// tiles from the front, thieves take them from the back.
+type tileDeque struct {
+	mu    sync.Mutex
+	tiles []image.Rectangle
+}
+
+func (d *tileDeque) pop() (image.Rectangle, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.tiles) == 0 {
+		return image.Rectangle{}, false
+	}
+	tile := d.tiles[0]
+	d.tiles = d.tiles[1:]
+	return tile, true
+}
+
+// stealHalf removes the back half of the queue, rounded up. The tiles are
+// copied, since the owner may append to the array again after stealing.
+func (d *tileDeque) stealHalf() []image.Rectangle {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keep := len(d.tiles) / 2
+	stolen := append([]image.Rectangle(nil), d.tiles[keep:]...)
+	d.tiles = d.tiles[:keep]
+	return stolen
+}
+
+func (d *tileDeque) push(tiles []image.Rectangle) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tiles = append(d.tiles, tiles...)
+}
+
+func scheduleStealing(tiles []image.Rectangle, fn func(worker int, tile image.Rectangle)) {
+	parts := splitTiles(tiles)
+	deques := make([]*tileDeque, len(parts))
+	for w, part := range parts {
+		// Own copy, so appending stolen tiles never overwrites a neighbour's
+		deques[w] = &tileDeque{tiles: append([]image.Rectangle(nil), part...)}
+	}
+
+	// No tiles are added once the workers start, so a worker that finds every
+	// queue empty is done. Tiles a thief is still moving are invisible to the
+	// others, but the thief runs them itself.
+	var wg sync.WaitGroup
+	for w := range deques {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			own := deques[worker]
+			for !filterAbort.Load() {
+				if tile, ok := own.pop(); ok {
+					fn(worker, tile)
+					continue
+				}
+				stolen := false
+				for i := 1; i < len(deques) && !stolen; i++ {
+					if loot := deques[(worker+i)%len(deques)].stealHalf(); len(loot) > 0 {
+						own.push(loot)
+						stolen = true
+					}
+				}
+				if !stolen {
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// medianFilterScheduled is the parallel median filter with its tiles handed
+// out by the named scheduling policy
+func medianFilterScheduled(img *image.Gray, chunkSize, filterSize int, schedule string) *image.Gray {
+	output := GetGray(img.Bounds())
+	tileSchedulers[schedule](tileRects(img.Bounds(), chunkSize), func(_ int, tile image.Rectangle) {
+		medianRect(output, img, tile, filterSize)
+	})
+	return output
+}
+
+// validSchedule reports an error for unknown scheduling policies
+func validSchedule(schedule string) error {
+	if _, ok := tileSchedulers[schedule]; !ok {
+		return fmt.Errorf("unknown schedule %q, use tiles, static or stealing", schedule)
+	}
+	return nil
+}
+
+// applyScheduledFilter is applyFilter with the tiles of the parallel and
+// halo variants handed out by schedule
+func applyScheduledFilter(mode, schedule string, img *image.Gray, chunkSize, kernel int) (*image.Gray, error) {
+	if err := validSchedule(schedule); err != nil {
+		return nil, err
+	}
+	if mode != "parallel" && mode != "halo" || schedule == defaultSchedule {
+		return applyFilter(mode, img, chunkSize, kernel)
+	}
+	// Filtering an empty image only checks the settings
+	if _, err := applyFilter(mode, image.NewGray(image.Rectangle{}), chunkSize, kernel); err != nil {
+		return nil, err
+	}
+	if mode == "halo" {
+		return medianFilterHalo(img, chunkSize, kernel/2, schedule), nil
+	}
+	return medianFilterScheduled(img, chunkSize, kernel/2, schedule), nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+
+	"hpc_final/filter"
+)
+
+// The self-test images are drawn by generateImage, so nothing has to be
+// shipped with the binary. The size is odd and not a multiple of the chunk
+// size, so every parallel variant also filters partial tiles.
+const (
+	selftestWidth  = 61
+	selftestHeight = 47
+	selftestSeed   = 1
+	selftestChunk  = 16
+)
+
+// selftestVariant is one way of filtering the self-test images. Variants
+// that must produce the same pixels, such as all the median filters, share
+// the golden hashes they are checked against.
+type selftestVariant struct {
+	name   string
+	golden string
+	run    func(img *image.Gray) (*image.Gray, error)
+	// optional variants need something the platform may lack, such as the
+	// NUMA topology, so an error skips them instead of failing them
+	optional bool
+}
+
+// selftestResult is the outcome of one variant over every self-test image
+type selftestResult struct {
+	variant string
+	hashes  []string // one per image in synthPatterns order, empty when it was not run
+	failed  []string // images whose output does not match the golden hash
+	skipped string   // why the variant was not run or could not be checked
+}
+
+// selftestVariants lists every filter variant of this build: the median
+// modes and schedules, the tile path of the gRPC server, the filter
+// package's median, and both the sequential and the parallel variant of
+// every other registered filter
+func selftestVariants() []selftestVariant {
+	var variants []selftestVariant
+	for _, kernel := range []int{3, 5} {
+		kernel := kernel
+		golden := fmt.Sprintf("median/k%d", kernel)
+		for _, mode := range []string{"sequential", "parallel", "halo", "numa", "simd"} {
+			mode := mode
+			if mode == "simd" && kernel != 3 {
+				continue
+			}
+			variants = append(variants, selftestVariant{
+				name:   fmt.Sprintf("median %s k%d", mode, kernel),
+				golden: golden,
+				run: func(img *image.Gray) (*image.Gray, error) {
+					return applyFilter(mode, img, selftestChunk, kernel)
+				},
+				optional: mode == "numa",
+			})
+		}
+		schedules := make([]string, 0, len(tileSchedulers))
+		for schedule := range tileSchedulers {
+			schedules = append(schedules, schedule)
+		}
+		sort.Strings(schedules)
+		for _, schedule := range schedules {
+			schedule := schedule
+			variants = append(variants, selftestVariant{
+				name:   fmt.Sprintf("median schedule=%s k%d", schedule, kernel),
+				golden: golden,
+				run: func(img *image.Gray) (*image.Gray, error) {
+					return medianFilterScheduled(img, selftestChunk, kernel/2, schedule), nil
+				},
+			})
+		}
+		variants = append(variants,
+			selftestVariant{
+				name:   fmt.Sprintf("median tiles k%d", kernel),
+				golden: golden,
+				run: func(img *image.Gray) (*image.Gray, error) {
+					return filterTiles(img, selftestChunk, kernel)
+				},
+			},
+			selftestVariant{
+				name:   fmt.Sprintf("filter.Median k%d", kernel),
+				golden: golden,
+				run: func(img *image.Gray) (*image.Gray, error) {
+					return filter.Median(img, filter.Kernel(kernel), filter.ChunkSize(selftestChunk))
+				},
+			},
+			selftestVariant{
+				name:   fmt.Sprintf("filter.Median border=replicate k%d", kernel),
+				golden: fmt.Sprintf("median-replicate/k%d", kernel),
+				run: func(img *image.Gray) (*image.Gray, error) {
+					return filter.Median(img, filter.Kernel(kernel), filter.ChunkSize(selftestChunk), filter.Border(filter.Replicate))
+				},
+			})
+	}
+
+	for _, name := range filter.Names() {
+		name := name
+		switch name {
+		case "median":
+			// Covered by filter.Median above
+			continue
+		case "opencv":
+			// OpenCV replicates the edge, so it must match the replicate
+			// border median
+			variants = append(variants, selftestVariant{
+				name:   "opencv k3",
+				golden: "median-replicate/k3",
+				run: func(img *image.Gray) (*image.Gray, error) {
+					return filter.Run(name, img, filter.Kernel(3), filter.Border(filter.Replicate))
+				},
+			})
+			continue
+		}
+		for _, mode := range []string{"sequential", "parallel"} {
+			// The parallel variant gets several workers even on one CPU
+			workers := 1
+			if mode == "parallel" {
+				workers = max(4, runtime.GOMAXPROCS(0))
+			}
+			variants = append(variants, selftestVariant{
+				name:   fmt.Sprintf("%s %s", name, mode),
+				golden: name,
+				run: func(img *image.Gray) (*image.Gray, error) {
+					return filter.Run(name, img, filter.Kernel(3), filter.ChunkSize(selftestChunk), filter.Workers(workers))
+				},
+			})
+		}
+	}
+	return variants
+}
+
+// filterTiles filters img the way the tile server does, one request at a
+// time, and assembles the replies
+func filterTiles(img *image.Gray, tileSize, kernel int) (*image.Gray, error) {
+	bounds := img.Bounds()
+	output := GetGray(bounds)
+	for _, req := range tileRequests(img, tileSize, kernel) {
+		reply, err := filterTile(req)
+		if err != nil {
+			PutGray(output)
+			return nil, err
+		}
+		tile := reply.Tile.Add(bounds.Min)
+		copyRect(output, &image.Gray{Pix: reply.Pix, Stride: tile.Dx(), Rect: tile}, tile)
+	}
+	return output, nil
+}
+
+// grayHash returns the first 16 hex digits of the SHA-256 of the size and
+// pixels of img, row by row, so the stride does not change it
+func grayHash(img *image.Gray) string {
+	h := sha256.New()
+	bounds := img.Bounds()
+	fmt.Fprintf(h, "%dx%d\n", bounds.Dx(), bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		h.Write(img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// runSelftestVariant filters every self-test image with v and compares the
+// outputs against the golden hashes
+func runSelftestVariant(v selftestVariant, images []*image.Gray) selftestResult {
+	result := selftestResult{variant: v.name}
+	for _, img := range images {
+		output, err := v.run(img)
+		if err != nil && v.optional {
+			result.skipped = err.Error()
+			return result
+		} else if err != nil {
+			result.failed = []string{err.Error()}
+			return result
+		}
+		result.hashes = append(result.hashes, grayHash(output))
+		PutGray(output)
+	}
+
+	golden, ok := selftestGoldens[v.golden]
+	if !ok {
+		result.skipped = fmt.Sprintf("no golden hashes for %s", v.golden)
+		return result
+	}
+	for i, hash := range result.hashes {
+		if hash != golden[i] {
+			result.failed = append(result.failed, synthPatterns[i])
+		}
+	}
+	return result
+}
+
+// PrintSelftestTable prints one line per variant with its outcome
+func PrintSelftestTable(results []selftestResult) {
+	fmt.Printf("Platform %s/%s, %s, %d CPUs, SIMD kernel %s\n", runtime.GOOS, runtime.GOARCH, runtime.Version(), runtime.GOMAXPROCS(0), simdKernel())
+	fmt.Println("Variant\t\t\t\t\tResult")
+	fmt.Println("------------------------------------------------------------------")
+	for _, r := range results {
+		status := "pass"
+		switch {
+		case len(r.failed) > 0:
+			status = "FAIL: " + strings.Join(r.failed, ", ")
+		case r.skipped != "":
+			status = "skip: " + r.skipped
+		}
+		fmt.Printf("%-40s%s\n", r.variant, status)
+	}
+}
+
+// printSelftestGoldens prints the hashes of this build as the source of
+// selftest_golden.go, for when a filter changes on purpose or is added
+func printSelftestGoldens(variants []selftestVariant, results []selftestResult) {
+	goldens := map[string][]string{}
+	var names []string
+	for i, r := range results {
+		if r.hashes == nil {
+			continue
+		}
+		golden := variants[i].golden
+		if _, ok := goldens[golden]; !ok {
+			names = append(names, golden)
+			goldens[golden] = r.hashes
+		} else if !slices.Equal(goldens[golden], r.hashes) {
+			fatal("variants that share golden hashes disagree", "golden", golden, "variant", r.variant)
+		}
+	}
+	sort.Strings(names)
+	fmt.Println("package main")
+	fmt.Println()
+	fmt.Println("// selftestGoldens holds the hashes of the self-test outputs, one per image")
+	fmt.Println("// in synthPatterns order, keyed by the golden name of the variants that")
+	fmt.Printf("// must produce them. They were recorded on %s/%s; regenerate them\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Println("// with selftest -print-goldens after changing a filter on purpose.")
+	fmt.Println("var selftestGoldens = map[string][]string{")
+	for _, name := range names {
+		quoted := make([]string, len(goldens[name]))
+		for i, hash := range goldens[name] {
+			quoted[i] = fmt.Sprintf("%q", hash)
+		}
+		fmt.Printf("\t%q: {%s},\n", name, strings.Join(quoted, ", "))
+	}
+	fmt.Println("}")
+}
+
+// runSelftest checks that every filter variant of this build reproduces the
+// golden outputs on the synthetic test images, exiting with status 1 when
+// one does not
+func runSelftest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	only := fs.String("variants", "", "comma separated substrings, only variants whose name contains one of them are run (default all)")
+	printGoldens := fs.Bool("print-goldens", false, "print the hashes of this build as the Go source of the golden table instead of checking them")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	images := make([]*image.Gray, len(synthPatterns))
+	for i, pattern := range synthPatterns {
+		img, err := generateImage(pattern, selftestWidth, selftestHeight, selftestSeed)
+		if err != nil {
+			fatal("failed to generate image", "pattern", pattern, "err", err)
+		}
+		images[i] = img
+	}
+
+	var variants []selftestVariant
+	for _, v := range selftestVariants() {
+		if *only == "" || containsAny(v.name, strings.Split(*only, ",")) {
+			variants = append(variants, v)
+		}
+	}
+	if len(variants) == 0 {
+		fatal("no variant matches", "variants", *only)
+	}
+
+	results := make([]selftestResult, len(variants))
+	failed := 0
+	for i, v := range variants {
+		results[i] = runSelftestVariant(v, images)
+		if len(results[i].failed) > 0 {
+			failed++
+		}
+		slog.Debug("checked variant", "variant", v.name, "hashes", results[i].hashes, "failed", results[i].failed, "skipped", results[i].skipped)
+	}
+
+	if *printGoldens {
+		printSelftestGoldens(variants, results)
+		return
+	}
+	PrintSelftestTable(results)
+	if failed > 0 {
+		slog.Error("self-test failed", "failed", failed, "variants", len(variants))
+		os.Exit(1)
+	}
+	slog.Info("self-test passed", "variants", len(variants))
+}
+
+func containsAny(s string, substrings []string) bool {
+	for _, sub := range substrings {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
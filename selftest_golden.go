@@ -0,0 +1,29 @@
+package main
+
+// selftestGoldens holds the hashes of the self-test outputs, one per image
+// in synthPatterns order, keyed by the golden name of the variants that
+// must produce them. They were recorded on linux/amd64; regenerate them
+// with selftest -print-goldens after changing a filter on purpose.
+var selftestGoldens = map[string][]string{
+	"adaptive":            {"02c14e20110ee98d", "ebd167747fdeb270", "aed594d1e5d59e35", "a0d623ff5557e864"},
+	"bilateral":           {"b2cea28838bd8bd9", "d70ce02a845626c9", "3708fbafd038e05e", "76f98ab82a23ca84"},
+	"canny":               {"884ae4ff8632de3b", "08b205975844b9b3", "f06c915386ef0fe2", "c277ef08f6b2824b"},
+	"clahe":               {"794d8871a97257d4", "b4af51732313ea57", "5061d1c85cfd9466", "2b1ae06b3023fb26"},
+	"close":               {"2c7b7b78c26f169e", "08b8808548a656d6", "a4cb4e6c530ec85a", "198cf263a6bb0567"},
+	"dilate":              {"d4d5b2a1bc49ff88", "8ea1a235c8069e37", "743ac63247678988", "aa85d6b88a62f990"},
+	"equalize":            {"f966cd61a18d5c64", "d70ce02a845626c9", "b9afba70c81f033e", "437a40911546a38d"},
+	"erode":               {"652c7bb3d3b3a5f3", "884ae4ff8632de3b", "6189960b861e4b7d", "23e69ac33bc61548"},
+	"floyd":               {"617e08400194df1b", "d70ce02a845626c9", "9957df2c9ed7da21", "a0374e8971483380"},
+	"gaussian":            {"41419219490e0f23", "7ff8ca1e892e7e68", "ed8892feec0c104a", "9a46f1a39426f9a8"},
+	"gaussian2d":          {"41419219490e0f23", "7ff8ca1e892e7e68", "ed8892feec0c104a", "9a46f1a39426f9a8"},
+	"median-replicate/k3": {"02c14e20110ee98d", "d70ce02a845626c9", "d6c4f3f0441bf163", "a0d623ff5557e864"},
+	"median-replicate/k5": {"d0540cb31b642093", "f55c11f0bae16a91", "b750788c130a233a", "a0d623ff5557e864"},
+	"median/k3":           {"f9fa0e8c613aef51", "ebd167747fdeb270", "c7f40abc56d3ee73", "a0d623ff5557e864"},
+	"median/k5":           {"82b039bcacfa30af", "7358dd87652363df", "612567ce2960c9a8", "a0d623ff5557e864"},
+	"open":                {"08a5075ad1e05a85", "884ae4ff8632de3b", "b3b19a3ad4e4f101", "084e67db4b46b481"},
+	"ordered":             {"5c2168285a1e5506", "d70ce02a845626c9", "652833d7948bf7fb", "17ba3b01e93491cd"},
+	"pyramid":             {"77e7d8d59d93c3d1", "6f14cb5ea1ce7301", "3222a005f4d9693c", "c9ec47fc26fb16df"},
+	"rank":                {"f9fa0e8c613aef51", "ebd167747fdeb270", "c7f40abc56d3ee73", "a0d623ff5557e864"},
+	"sobel":               {"d92a8962aae341f6", "8ea1a235c8069e37", "4110c1bfba39a468", "6fab247c0b7eff43"},
+	"wmedian":             {"50cb8ceb26785adc", "d70ce02a845626c9", "832731fd2284e9ff", "89c4789e6fc1bc8e"},
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"hpc_final/filter"
+)
+
+// maxUploadSize caps the request body accepted by POST /filter
+const maxUploadSize = 64 << 20
+
+// maxRemoteKernel is the largest kernel a client may ask the server for.
+// Every tile holds a kernel x kernel window, so without a cap one request
+// can exhaust the memory of the server.
+const maxRemoteKernel = 31
+
+// checkRemoteKernel rejects a client supplied kernel above maxRemoteKernel
+// or above the smaller side of a size image, past which the windows cover
+// the whole image anyway. A 3x3 window is always allowed, so tiny images
+// still filter with the default.
+func checkRemoteKernel(kernel int, size image.Point) error {
+	limit := min(maxRemoteKernel, max(3, min(size.X, size.Y)))
+	if kernel > limit {
+		return fmt.Errorf("kernel size %d is too large, at most %d is allowed for a %dx%d image", kernel, limit, size.X, size.Y)
+	}
+	return nil
+}
+
+// maxRemoteTiles is the most tiles a request is cut into. The parallel
+// filter starts a goroutine per tile, so a tiny chunk on a large image
+// would start millions of them.
+const maxRemoteTiles = 4096
+
+// remoteChunkSize grows a client supplied chunk size until a size image
+// has at most maxRemoteTiles tiles. The chunk size does not change the
+// output, so the request is served instead of being rejected.
+func remoteChunkSize(chunkSize int, size image.Point) int {
+	for ((size.X+chunkSize-1)/chunkSize)*((size.Y+chunkSize-1)/chunkSize) > maxRemoteTiles {
+		chunkSize++
+	}
+	return chunkSize
+}
+
+// filterJob is one request waiting for a slot in the worker pool
+type filterJob struct {
+	// ctx is the request's context. A job whose client went away before a
+	// worker got to it is skipped.
+	ctx       context.Context
+	img       *image.Gray
+	mode      string
+	filter    string // registered filter to run, the median filter when empty
+	chunkSize int
+	kernel    int
+	roi       image.Rectangle   // whole image when empty
+	border    filter.BorderMode // anything but crop runs filter.Median
+	// percentile of every window the median filter keeps, 50 for the
+	// median itself
+	percentile float64
+	alpha      *image.Gray // nil for opaque images
+	// filterAlpha runs the filter on the alpha channel too instead of
+	// passing it through
+	filterAlpha bool
+	done        chan filterResult
+}
+
+type filterResult struct {
+	img     *image.Gray
+	alpha   *image.Gray
+	elapsed time.Duration
+	err     error
+}
+
+// filterPool runs filter jobs on a fixed number of goroutines. Jobs that do
+// not fit in the queue are rejected instead of piling up in memory.
+type filterPool struct {
+	jobs chan filterJob
+}
+
+func newFilterPool(workers, queue int) *filterPool {
+	pool := &filterPool{jobs: make(chan filterJob, queue)}
+	for i := 0; i < workers; i++ {
+		go func(id int) {
+			for job := range pool.jobs {
+				job.done <- job.process(id)
+			}
+		}(i)
+	}
+	return pool
+}
+
+// errFilterPanic is returned for a job whose filter panicked, which is a
+// bug in the server rather than in the request
+var errFilterPanic = errors.New("filter failed")
+
+// process runs the job on the worker id. A panic fails only this job
+// instead of taking the server down.
+func (job filterJob) process(id int) (result filterResult) {
+	if err := job.ctx.Err(); err != nil {
+		slog.Debug("skipped request, the client went away", "stage", job.mode, "worker", id, "err", err)
+		return filterResult{err: err}
+	}
+	idle := filterMetrics.WorkerBusy()
+	defer idle()
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("filter panicked", "stage", job.mode, "kernel", job.kernel, "worker", id, "panic", r)
+			result = filterResult{err: fmt.Errorf("%w: %v", errFilterPanic, r)}
+		}
+	}()
+
+	start := time.Now()
+	output, err := job.run(job.img)
+	alpha := job.alpha
+	if err == nil && alpha != nil && job.filterAlpha {
+		alpha, err = job.run(alpha)
+	}
+	elapsed := time.Since(start)
+	if err == nil {
+		filterMetrics.Observe(job.mode, len(job.img.Pix), elapsed)
+	}
+	slog.Debug("filtered request", "stage", job.mode, "kernel", job.kernel, "duration", elapsed, "worker", id, "err", err)
+	return filterResult{img: output, alpha: alpha, elapsed: elapsed, err: err}
+}
+
+// release hands the pooled images of a result of the job back with PutGray
+func (job filterJob) release(result filterResult) {
+	if result.img != nil {
+		PutGray(result.img)
+	}
+	if result.alpha != nil && job.filterAlpha {
+		PutGray(result.alpha)
+	}
+}
+
+// run filters the job's region of interest of img, or all of it when the job has none
+func (job filterJob) run(img *image.Gray) (*image.Gray, error) {
+	name := job.filter
+	if name == "" {
+		name = "median"
+	}
+	run := func(img *image.Gray) (*image.Gray, error) {
+		if name != "median" || job.border != filter.Crop {
+			return registeredFilter(name, job.mode, img, job.chunkSize, job.kernel, job.border, job.percentile)
+		}
+		if job.percentile != 50 {
+			return applyRank(job.mode, img, job.chunkSize, job.kernel, job.percentile)
+		}
+		return applyFilter(job.mode, img, job.chunkSize, job.kernel)
+	}
+	if job.roi.Empty() {
+		return run(img)
+	}
+	return filterRegion(img, job.roi, job.kernel/2, nil, run)
+}
+
+var errPoolFull = errors.New("filter queue is full")
+
+// submit queues a job without blocking
+func (p *filterPool) submit(job filterJob) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	default:
+		return errPoolFull
+	}
+}
+
+// intParam reads an integer query parameter, falling back to def when it is missing
+func intParam(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// filterHandler serves POST /filter?kernel=3&mode=parallel&chunk=45. The body
+// is a PNG or JPEG image and the response is the filtered grayscale PNG,
+// binarized with Otsu's method when binarize=true. kernel=auto picks the
+// kernel size from the noise of the image; the size used is returned in
+// X-Kernel-Size. Kernels above checkRemoteKernel's limit are rejected with
+// 400, and the chunk is grown to remoteChunkSize, returned in X-Chunk-Size.
+// mode=numa is rejected. percentile=p keeps that percentile of every window
+// instead of the median, 0 for a minimum and 100 for a maximum filter. With
+// roi=x,y,width,height only that region is filtered and the rest is
+// returned unchanged. Images with transparency keep their alpha channel,
+// which is filtered as well when alpha=filter.
+func filterHandler(pool *filterPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		kernel := 3
+		var err error
+		if value := r.URL.Query().Get("kernel"); value != "" {
+			if kernel, err = parseKernel(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		chunkSize, err := intParam(r, "chunk", 45)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if chunkSize < 1 {
+			http.Error(w, fmt.Sprintf("chunk size must be positive, got %d", chunkSize), http.StatusBadRequest)
+			return
+		}
+		mode := r.URL.Query().Get("mode")
+		switch mode {
+		case "":
+			mode = "parallel"
+		case "numa":
+			// Every numa run locks an OS thread per CPU, too much to hand
+			// to any client
+			http.Error(w, "mode numa is not served, use sequential, parallel, halo or simd", http.StatusBadRequest)
+			return
+		}
+		percentile := 50.0
+		if value := r.URL.Query().Get("percentile"); value != "" {
+			if percentile, err = strconv.ParseFloat(value, 64); err != nil || percentile < 0 || percentile > 100 {
+				http.Error(w, fmt.Sprintf("invalid percentile %q, use 0 to 100", value), http.StatusBadRequest)
+				return
+			}
+		}
+		binarize := false
+		if value := r.URL.Query().Get("binarize"); value != "" {
+			if binarize, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid binarize %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var roi image.Rectangle
+		if value := r.URL.Query().Get("roi"); value != "" {
+			if roi, err = parseROI(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		filterAlpha := false
+		switch value := r.URL.Query().Get("alpha"); value {
+		case "", "keep":
+		case "filter":
+			filterAlpha = true
+		default:
+			http.Error(w, fmt.Sprintf("invalid alpha %q, use keep or filter", value), http.StatusBadRequest)
+			return
+		}
+
+		keepMetadata := true
+		switch value := r.URL.Query().Get("metadata"); value {
+		case "", "keep":
+		case "strip":
+			keepMetadata = false
+		default:
+			http.Error(w, fmt.Sprintf("invalid metadata %q, use keep or strip", value), http.StatusBadRequest)
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read image: %v", err), http.StatusBadRequest)
+			return
+		}
+		img, _, err := decodeBytes("upload", data)
+		if err != nil {
+			status := http.StatusBadRequest
+			var rejected *DecodeError
+			if errors.As(err, &rejected) && rejected.TooLarge() {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, fmt.Sprintf("failed to decode image: %v", err), status)
+			return
+		}
+		meta := readMetadata(data)
+		if !keepMetadata {
+			// The orientation is still applied, the rest is dropped
+			meta = imageMetadata{Orientation: meta.Orientation}
+		}
+
+		gray, alpha := splitAlpha(img)
+		gray = orient(gray, meta.Orientation)
+		if alpha != nil {
+			alpha = orient(alpha, meta.Orientation)
+		}
+		kernel = autoKernel(gray, kernel, "request")
+		if err := checkRemoteKernel(kernel, gray.Bounds().Size()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Kernel-Size", strconv.Itoa(kernel))
+		chunkSize = remoteChunkSize(chunkSize, gray.Bounds().Size())
+		w.Header().Set("X-Chunk-Size", strconv.Itoa(chunkSize))
+		job := filterJob{
+			ctx:         r.Context(),
+			img:         gray,
+			mode:        mode,
+			chunkSize:   chunkSize,
+			kernel:      kernel,
+			roi:         roi,
+			percentile:  percentile,
+			alpha:       alpha,
+			filterAlpha: filterAlpha,
+			done:        make(chan filterResult, 1),
+		}
+		if err := pool.submit(job); err != nil {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		var result filterResult
+		select {
+		case result = <-job.done:
+		case <-r.Context().Done():
+			// The job is still queued or running. It is skipped if no
+			// worker started it yet; otherwise its output goes back to
+			// the pool once it is done.
+			go func() { job.release(<-job.done) }()
+			return
+		}
+		if errors.Is(result.err, errFilterPanic) {
+			http.Error(w, result.err.Error(), http.StatusInternalServerError)
+			return
+		} else if result.err != nil {
+			http.Error(w, result.err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		defer job.release(result)
+		output := result.img
+		if binarize {
+			var threshold uint8
+			output, threshold = BinarizeOtsu(output)
+			w.Header().Set("X-Otsu-Threshold", strconv.Itoa(int(threshold)))
+		}
+
+		var encoded image.Image = output
+		if result.alpha != nil {
+			encoded = mergeAlpha(output, result.alpha)
+		}
+
+		var buf bytes.Buffer
+		if err := encodeWithMetadata(&buf, encoded, "png", meta); err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode image: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Filter-Duration", result.elapsed.String())
+		w.Write(buf.Bytes())
+	}
+}
+
+// runServe exposes the median filter over HTTP
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	workers := fs.Int("workers", runtime.NumCPU(), "number of images filtered concurrently")
+	queue := fs.Int("queue", 64, "number of requests allowed to wait for a worker")
+	addDecodeFlags(fs, false)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if *workers < 1 {
+		fatal("workers must be positive", "workers", *workers)
+	}
+
+	filterMetrics.SetWorkers(*workers)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/filter", filterHandler(newFilterPool(*workers, *queue)))
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	slog.Info("serving median filter", "addr", *addr, "workers", *workers)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		fatal("server stopped", "err", err)
+	}
+}
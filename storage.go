@@ -0,0 +1,406 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageInput is a set of images read by the batch drivers: a folder, an
+// archive or a bucket prefix
+type imageInput interface {
+	// Walk decodes every image in order and calls fn with its base name
+	Walk(fn func(name string, img image.Image) error) error
+	// WalkHashed is Walk that also passes the SHA-256 of the encoded image,
+	// which the benchmark records to tell when an input changed, and its
+	// metadata, for the outputs to carry over
+	WalkHashed(fn func(name, sum string, img image.Image, meta imageMetadata) error) error
+	// Names lists the base names of the images Walk visits, without
+	// decoding them
+	Names() ([]string, error)
+	Close() error
+}
+
+// imageOutput is where the batch drivers save their results. Save may be
+// called from several goroutines and returns the SHA-256 of the encoded file.
+// The metadata of the input is written to PNG outputs, see
+// encodeWithMetadata.
+type imageOutput interface {
+	Save(name string, img image.Image, meta imageMetadata) (string, error)
+	Close() error
+}
+
+// isImageName reports whether name has one of the imageExtensions
+func isImageName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range imageExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func isZip(p string) bool {
+	return strings.HasSuffix(strings.ToLower(p), ".zip")
+}
+
+func isTar(p string) bool {
+	p = strings.ToLower(p)
+	return strings.HasSuffix(p, ".tar") || strings.HasSuffix(p, ".tar.gz") || strings.HasSuffix(p, ".tgz")
+}
+
+func isGzip(p string) bool {
+	p = strings.ToLower(p)
+	return strings.HasSuffix(p, ".gz") || strings.HasSuffix(p, ".tgz")
+}
+
+// openImageInput opens a folder, a .zip or a .tar, .tar.gz or .tgz archive,
+// or an s3:// or gs:// prefix
+func openImageInput(p string) (imageInput, error) {
+	switch {
+	case isRemote(p):
+		return openRemoteInput(p)
+	case isZip(p):
+		r, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, err
+		}
+		return &zipInput{r}, nil
+	case isTar(p):
+		return &tarInput{path: p}, nil
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is neither a folder nor a .zip or .tar(.gz) archive", p)
+	}
+	return dirInput(p), nil
+}
+
+// createImageOutput creates a folder, a new .zip or .tar(.gz) archive or an
+// s3:// or gs:// prefix. The output is complete once Close returns.
+func createImageOutput(p string) (imageOutput, error) {
+	if isRemote(p) {
+		return createRemoteOutput(p)
+	}
+	if !isZip(p) && !isTar(p) {
+		if err := os.MkdirAll(p, os.ModePerm); err != nil {
+			return nil, err
+		}
+		return dirOutput(p), nil
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	if isZip(p) {
+		return &zipOutput{file: f, w: zip.NewWriter(f)}, nil
+	}
+	out := &tarOutput{file: f}
+	if isGzip(p) {
+		out.gz = gzip.NewWriter(f)
+		out.w = tar.NewWriter(out.gz)
+	} else {
+		out.w = tar.NewWriter(f)
+	}
+	return out, nil
+}
+
+// encodeForName encodes img with meta in the format given by the extension
+// of name
+func encodeForName(name string, img image.Image, meta imageMetadata) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if err := encodeWithMetadata(&buf, img, strings.TrimPrefix(strings.ToLower(path.Ext(name)), "."), meta); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return buf.Bytes(), hex.EncodeToString(sum[:]), nil
+}
+
+// decodeHashed is decodeImage that also returns the metadata of the image
+// and the SHA-256 of the encoded image, the same hashFile gives for it on
+// disk. The image is turned upright according to its EXIF orientation.
+func decodeHashed(name string, r io.Reader) (image.Image, imageMetadata, string, error) {
+	data, err := readInput(name, r)
+	if err != nil {
+		return nil, imageMetadata{}, "", err
+	}
+	img, _, err := decodeBytes(name, data)
+	if err != nil {
+		return nil, imageMetadata{}, "", err
+	}
+	meta := readMetadata(data)
+	sum := sha256.Sum256(data)
+	return orientImage(img, meta.Orientation), meta, hex.EncodeToString(sum[:]), nil
+}
+
+// ignoreHash adapts a Walk callback to WalkHashed
+func ignoreHash(fn func(name string, img image.Image) error) func(name, sum string, img image.Image, meta imageMetadata) error {
+	return func(name, _ string, img image.Image, _ imageMetadata) error { return fn(name, img) }
+}
+
+// dirInput reads the images of a folder in name order
+type dirInput string
+
+func (d dirInput) Walk(fn func(name string, img image.Image) error) error {
+	return d.WalkHashed(ignoreHash(fn))
+}
+
+func (d dirInput) WalkHashed(fn func(name, sum string, img image.Image, meta imageMetadata) error) error {
+	files, err := listImages(string(d))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		img, meta, sum, err := decodeHashed(file, f)
+		f.Close()
+		if skipRejected(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(filepath.Base(file), sum, img, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d dirInput) Names() ([]string, error) {
+	files, err := listImages(string(d))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = filepath.Base(file)
+	}
+	return names, nil
+}
+
+func (dirInput) Close() error { return nil }
+
+// zipInput reads the images of a zip archive in name order, one entry at a
+// time, without extracting it
+type zipInput struct {
+	r *zip.ReadCloser
+}
+
+// files returns the image entries of the archive in name order
+func (z *zipInput) files() []*zip.File {
+	var files []*zip.File
+	for _, f := range z.r.File {
+		if !f.FileInfo().IsDir() && isImageName(f.Name) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+func (z *zipInput) Walk(fn func(name string, img image.Image) error) error {
+	return z.WalkHashed(ignoreHash(fn))
+}
+
+func (z *zipInput) WalkHashed(fn func(name, sum string, img image.Image, meta imageMetadata) error) error {
+	for _, f := range z.files() {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		img, meta, sum, err := decodeHashed(f.Name, rc)
+		rc.Close()
+		if skipRejected(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(path.Base(f.Name), sum, img, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *zipInput) Names() ([]string, error) {
+	var names []string
+	for _, f := range z.files() {
+		names = append(names, path.Base(f.Name))
+	}
+	return names, nil
+}
+
+func (z *zipInput) Close() error { return z.r.Close() }
+
+// tarInput streams the images of a tar archive, gzip compressed or not, in
+// archive order. Tar has no index, so the archive is read front to back
+// and only the current entry is held in memory.
+type tarInput struct {
+	path string
+}
+
+// entries calls fn with every image entry of the archive, positioned at its
+// contents
+func (t *tarInput) entries(fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if isGzip(t.path) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !isImageName(hdr.Name) {
+			continue
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *tarInput) Walk(fn func(name string, img image.Image) error) error {
+	return t.WalkHashed(ignoreHash(fn))
+}
+
+func (t *tarInput) WalkHashed(fn func(name, sum string, img image.Image, meta imageMetadata) error) error {
+	return t.entries(func(hdr *tar.Header, r io.Reader) error {
+		img, meta, sum, err := decodeHashed(hdr.Name, r)
+		if skipRejected(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(path.Base(hdr.Name), sum, img, meta)
+	})
+}
+
+// Names reads the whole archive, skipping over the contents of the entries
+func (t *tarInput) Names() ([]string, error) {
+	var names []string
+	err := t.entries(func(hdr *tar.Header, _ io.Reader) error {
+		names = append(names, path.Base(hdr.Name))
+		return nil
+	})
+	return names, err
+}
+
+func (t *tarInput) Close() error { return nil }
+
+// dirOutput writes every image as its own file in a folder
+type dirOutput string
+
+func (d dirOutput) Save(name string, img image.Image, meta imageMetadata) (string, error) {
+	data, sum, err := encodeForName(name, img, meta)
+	if err != nil {
+		return "", err
+	}
+	return sum, os.WriteFile(filepath.Join(string(d), name), data, 0o644)
+}
+
+func (dirOutput) Close() error { return nil }
+
+// zipOutput adds every image as an entry of a new zip archive. PNG is
+// already compressed, so entries are stored rather than deflated.
+type zipOutput struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *zip.Writer
+}
+
+func (z *zipOutput) Save(name string, img image.Image, meta imageMetadata) (string, error) {
+	data, sum, err := encodeForName(name, img, meta)
+	if err != nil {
+		return "", err
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	w, err := z.w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write(data)
+	return sum, err
+}
+
+func (z *zipOutput) Close() error {
+	if err := z.w.Close(); err != nil {
+		z.file.Close()
+		return err
+	}
+	return z.file.Close()
+}
+
+// tarOutput adds every image as an entry of a new tar archive, gzip
+// compressed when its name ends in .gz or .tgz
+type tarOutput struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	w    *tar.Writer
+}
+
+func (t *tarOutput) Save(name string, img image.Image, meta imageMetadata) (string, error) {
+	data, sum, err := encodeForName(name, img, meta)
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.w.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg, ModTime: time.Now()}); err != nil {
+		return "", err
+	}
+	_, err = t.w.Write(data)
+	return sum, err
+}
+
+func (t *tarOutput) Close() error {
+	err := t.w.Close()
+	if t.gz != nil {
+		if gzErr := t.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// storeSchema creates the results tables. Every benchmark run is one row in
+// runs with one row per image and filter variant in timings.
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at    TEXT NOT NULL,
+	git_commit    TEXT NOT NULL,
+	git_tags      TEXT NOT NULL,
+	go_version    TEXT NOT NULL,
+	goos          TEXT NOT NULL,
+	goarch        TEXT NOT NULL,
+	num_cpu       INTEGER NOT NULL,
+	cpu_model     TEXT NOT NULL,
+	filter_size   INTEGER NOT NULL,
+	chunk_size    INTEGER NOT NULL,
+	schedule      TEXT NOT NULL DEFAULT 'tiles',
+	binarize      INTEGER NOT NULL DEFAULT 0,
+	filters       TEXT NOT NULL DEFAULT '',
+	scale         REAL NOT NULL DEFAULT 0,
+	max_dim       INTEGER NOT NULL DEFAULT 0,
+	resize_filter TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS timings (
+	run_id  INTEGER NOT NULL REFERENCES runs(id),
+	image   TEXT NOT NULL,
+	variant TEXT NOT NULL,
+	seconds REAL NOT NULL,
+	PRIMARY KEY (run_id, image, variant)
+);
+`
+
+// openStore opens the SQLite results database at path, creating it when needed
+func openStore(path string) (*sql.DB, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(storeSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema in %s: %w", path, err)
+	}
+	if err := migrateStore(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to update schema in %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// addedColumns are the columns of runs introduced after the first schema,
+// in the order they were added. Runs stored before a column existed get its
+// default, the setting of a plain run: the tiles schedule, no binarization,
+// no extra filters and no resizing.
+var addedColumns = []struct{ name, definition string }{
+	{"schedule", "TEXT NOT NULL DEFAULT 'tiles'"},
+	{"binarize", "INTEGER NOT NULL DEFAULT 0"},
+	{"filters", "TEXT NOT NULL DEFAULT ''"},
+	{"scale", "REAL NOT NULL DEFAULT 0"},
+	{"max_dim", "INTEGER NOT NULL DEFAULT 0"},
+	{"resize_filter", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrateStore adds the addedColumns a database created before them lacks
+func migrateStore(db *sql.DB) error {
+	for _, column := range addedColumns {
+		var found int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('runs') WHERE name = ?`, column.name).Scan(&found); err != nil {
+			return err
+		}
+		if found > 0 {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE runs ADD COLUMN %s %s`, column.name, column.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitOutput runs git with args and returns its trimmed output, or "" when
+// git is not installed or the folder is not a repository
+func gitOutput(args ...string) string {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// storeRun saves the parameters and timings of m as a new run and returns its id
+func storeRun(db *sql.DB, m *Manifest) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	tags := strings.Fields(gitOutput("tag", "--points-at", "HEAD"))
+	schedule := m.Parameters.Schedule
+	if schedule == "" {
+		schedule = defaultSchedule
+	}
+	p := m.Parameters
+	res, err := tx.Exec(`INSERT INTO runs (created_at, git_commit, git_tags, go_version, goos, goarch, num_cpu, cpu_model, filter_size, chunk_size, schedule, binarize, filters, scale, max_dim, resize_filter)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.CreatedAt.Format(time.RFC3339), gitOutput("rev-parse", "HEAD"), strings.Join(tags, ","),
+		m.GoVersion, m.GOOS, m.GOARCH, m.NumCPU, m.CPUModel, p.FilterSize, p.ChunkSize, schedule,
+		p.Binarize, p.Filters, p.Scale, p.MaxDim, p.ResizeFilter)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, img := range m.Images {
+		if err := insertTimings(tx, id, img); err != nil {
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+// insertTimings adds the timings of one image to run id
+func insertTimings(tx *sql.Tx, id int64, img ManifestImage) error {
+	for variant, seconds := range img.Seconds {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO timings (run_id, image, variant, seconds) VALUES (?, ?, ?, ?)`, id, img.Name, variant, seconds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendTimings adds the timings of one more image to an existing run, as
+// watch mode does for every image that arrives
+func appendTimings(db *sql.DB, id int64, img ManifestImage) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertTimings(tx, id, img); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// storedRun is the summary of one run used by compare
+type storedRun struct {
+	ID        int64
+	CreatedAt string
+	Commit    string
+	Tags      string
+	Schedule  string
+	Settings  runSettings
+}
+
+// runSettings are the parameters of a run that change what its timings
+// measure, so runs whose settings differ are not comparable
+type runSettings struct {
+	FilterSize   int
+	ChunkSize    int
+	Binarize     bool
+	Filters      string
+	Scale        float64
+	MaxDim       int
+	ResizeFilter string
+}
+
+// diff describes every setting that differs between s and other, or
+// returns nil when they match
+func (s runSettings) diff(other runSettings) []string {
+	var diffs []string
+	add := func(name string, a, b any) {
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("%s %v vs %v", name, a, b))
+		}
+	}
+	add("filter_size", s.FilterSize, other.FilterSize)
+	add("chunk_size", s.ChunkSize, other.ChunkSize)
+	add("binarize", s.Binarize, other.Binarize)
+	add("filters", fmt.Sprintf("%q", s.Filters), fmt.Sprintf("%q", other.Filters))
+	add("scale", s.Scale, other.Scale)
+	add("max_dim", s.MaxDim, other.MaxDim)
+	add("resize_filter", fmt.Sprintf("%q", s.ResizeFilter), fmt.Sprintf("%q", other.ResizeFilter))
+	return diffs
+}
+
+func (r storedRun) String() string {
+	s := fmt.Sprintf("run %d (%s", r.ID, r.CreatedAt)
+	if r.Commit != "" {
+		s += fmt.Sprintf(", %.12s", r.Commit)
+	}
+	if r.Tags != "" {
+		s += ", " + r.Tags
+	}
+	if r.Schedule != defaultSchedule {
+		s += ", " + r.Schedule + " schedule"
+	}
+	return s + ")"
+}
+
+var errNoRun = errors.New("no matching run in the database")
+
+// findRun resolves ref to a run. ref may be empty for the latest run, "prev"
+// for the run before current, a run id, or a git ref whose commit was
+// benchmarked (the latest run of that commit is used).
+func findRun(db *sql.DB, ref string, current int64) (storedRun, error) {
+	query := `SELECT id, created_at, git_commit, git_tags, schedule, filter_size, chunk_size, binarize, filters, scale, max_dim, resize_filter FROM runs`
+	var args []any
+	switch id, err := strconv.ParseInt(ref, 10, 64); {
+	case ref == "":
+		query += ` ORDER BY id DESC LIMIT 1`
+	case ref == "prev":
+		query += ` WHERE id < ? ORDER BY id DESC LIMIT 1`
+		args = append(args, current)
+	case err == nil:
+		query += ` WHERE id = ?`
+		args = append(args, id)
+	default:
+		commit := gitOutput("rev-parse", "--verify", "--quiet", ref+"^{commit}")
+		if commit == "" {
+			return storedRun{}, fmt.Errorf("%q is neither a run id nor a git ref", ref)
+		}
+		query += ` WHERE git_commit = ? ORDER BY id DESC LIMIT 1`
+		args = append(args, commit)
+	}
+
+	var run storedRun
+	settings := &run.Settings
+	err := db.QueryRow(query, args...).Scan(&run.ID, &run.CreatedAt, &run.Commit, &run.Tags, &run.Schedule,
+		&settings.FilterSize, &settings.ChunkSize, &settings.Binarize, &settings.Filters, &settings.Scale, &settings.MaxDim, &settings.ResizeFilter)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storedRun{}, fmt.Errorf("%w for %q", errNoRun, ref)
+	}
+	return run, err
+}
+
+// loadTimings returns the seconds of a run keyed by "image/variant"
+func loadTimings(db *sql.DB, id int64) (map[string]float64, error) {
+	rows, err := db.Query(`SELECT image, variant, seconds FROM timings WHERE run_id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timings := map[string]float64{}
+	for rows.Next() {
+		var image, variant string
+		var seconds float64
+		if err := rows.Scan(&image, &variant, &seconds); err != nil {
+			return nil, err
+		}
+		timings[image+"/"+variant] = seconds
+	}
+	return timings, rows.Err()
+}
+
+// PrintComparison prints the change of every timing between two runs and
+// returns how many got slower by more than threshold (0.1 is 10%)
+func PrintComparison(base, current map[string]float64, threshold float64) int {
+	var keys []string
+	for key := range current {
+		if _, ok := base[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Println("Image/Variant\t\t\tBase (s)\tCurrent (s)\tChange")
+	fmt.Println("------------------------------------------------------------------")
+	regressions := 0
+	var baseTotal, currentTotal float64
+	for _, key := range keys {
+		change := current[key]/base[key] - 1
+		flag := ""
+		if change > threshold {
+			flag = "\tREGRESSION"
+			regressions++
+		}
+		fmt.Printf("%-24s\t%.6f\t%.6f\t%+.1f%%%s\n", key, base[key], current[key], 100*change, flag)
+		baseTotal += base[key]
+		currentTotal += current[key]
+	}
+	if baseTotal > 0 {
+		fmt.Println()
+		fmt.Printf("Total:             %.6f s -> %.6f s (%+.1f%%)\n", baseTotal, currentTotal, 100*(currentTotal/baseTotal-1))
+	}
+	fmt.Printf("Regressions:       %d of %d timings slower by more than %.0f%%\n", regressions, len(keys), 100*threshold)
+	return regressions
+}
+
+// runCompare diffs the timings of two stored runs and exits with status 1
+// when any got slower than the threshold. Runs whose settings differ are
+// refused unless -force is given, since their timings measure different
+// work; the schedule may differ, comparing schedules is what it is for.
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	dbPath := fs.String("db", filepath.Join("dataset-output", "results.db"), "SQLite database written by benchmark runs")
+	runRef := fs.String("run", "", "run to check: a run id or git ref (default the latest run)")
+	baseRef := fs.String("base", "prev", "run to compare against: a run id, a git ref, or prev for the run before -run")
+	threshold := fs.Float64("threshold", 0.1, "slowdown ratio reported as a regression, 0.1 is 10%")
+	force := fs.Bool("force", false, "compare runs even when their kernel, chunk, binarize, filters or resize settings differ")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		fatal("failed to open results database", "path", *dbPath, "err", err)
+	}
+	db, err := openStore(*dbPath)
+	if err != nil {
+		fatal("failed to open results database", "path", *dbPath, "err", err)
+	}
+	defer db.Close()
+
+	current, err := findRun(db, *runRef, 0)
+	if err != nil {
+		fatal("failed to find run", "run", *runRef, "err", err)
+	}
+	base, err := findRun(db, *baseRef, current.ID)
+	if err != nil {
+		fatal("failed to find base run", "base", *baseRef, "err", err)
+	}
+
+	if diffs := base.Settings.diff(current.Settings); len(diffs) > 0 {
+		if !*force {
+			fatal("runs were made with different settings, use -force to compare them anyway", "base", base.ID, "run", current.ID, "differences", strings.Join(diffs, ", "))
+		}
+		slog.Warn("comparing runs made with different settings", "base", base.ID, "run", current.ID, "differences", strings.Join(diffs, ", "))
+	}
+
+	currentTimings, err := loadTimings(db, current.ID)
+	if err != nil {
+		fatal("failed to load timings", "run", current.ID, "err", err)
+	}
+	baseTimings, err := loadTimings(db, base.ID)
+	if err != nil {
+		fatal("failed to load timings", "run", base.ID, "err", err)
+	}
+
+	fmt.Printf("Base:    %s\n", base)
+	fmt.Printf("Current: %s\n\n", current)
+	if PrintComparison(baseTimings, currentTimings, *threshold) > 0 {
+		os.Exit(1)
+	}
+}
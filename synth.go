@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"math/rand"
+	"strings"
+)
+
+// synthPatterns lists the images the generator knows how to draw, in the
+// order they are written by the generate subcommand
+var synthPatterns = []string{"gradient", "checkerboard", "noise", "impulse"}
+
+// generateImage draws pattern at width x height. The output only depends on
+// the arguments, so the same call always produces the same pixels.
+func generateImage(pattern string, width, height int, seed int64) (*image.Gray, error) {
+	if width < 1 || height < 1 {
+		return nil, fmt.Errorf("image size must be positive, got %dx%d", width, height)
+	}
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(seed))
+
+	switch pattern {
+	case "gradient":
+		// Diagonal ramp from black in the top left to white in the bottom right
+		span := width + height - 2
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				value := 0
+				if span > 0 {
+					value = (x + y) * 255 / span
+				}
+				img.Pix[y*img.Stride+x] = uint8(value)
+			}
+		}
+	case "checkerboard":
+		cell := max(1, min(width, height)/16)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				if (x/cell+y/cell)%2 == 1 {
+					img.Pix[y*img.Stride+x] = 255
+				}
+			}
+		}
+	case "noise":
+		// Uniform noise, the worst case for the sorting network input
+		rng.Read(img.Pix)
+	case "impulse":
+		// Mid-gray field with 10% salt and pepper, the noise the filter removes
+		for i := range img.Pix {
+			switch r := rng.Intn(20); {
+			case r == 0:
+				img.Pix[i] = 0
+			case r == 1:
+				img.Pix[i] = 255
+			default:
+				img.Pix[i] = 128
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown pattern %q, use one of %s", pattern, strings.Join(synthPatterns, ", "))
+	}
+	return img, nil
+}
+
+// runGenerate writes synthetic test images into a folder
+func runGenerate(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	dir := fs.String("dir", "dataset-synthetic", "folder to write the images into")
+	width := fs.Int("width", 768, "image width in pixels")
+	height := fs.Int("height", 512, "image height in pixels")
+	patterns := fs.String("patterns", strings.Join(synthPatterns, ","), "comma separated patterns to generate")
+	seed := fs.Int64("seed", 1, "seed for the noise and impulse patterns")
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	for _, pattern := range strings.Split(*patterns, ",") {
+		img, err := generateImage(pattern, *width, *height, *seed)
+		if err != nil {
+			fatal("failed to generate image", "pattern", pattern, "err", err)
+		}
+		filename := fmt.Sprintf("%s-%dx%d.png", pattern, *width, *height)
+		sum := saveImage(img, *dir, filename)
+		slog.Info("generated image", "image", filename, "sha256", sum)
+	}
+}
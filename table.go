@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// speedup returns how many times faster than the sequential filter a
+// variant taking seconds was
+func (data PerformanceData) speedup(seconds float64) float64 {
+	if seconds == 0 {
+		return 0
+	}
+	return data.Times["sequential"].Seconds() / seconds
+}
+
+// throughput formats the megapixels per second of one variant, or "-" when
+// the image size is unknown (entries resumed from older manifests)
+func (data PerformanceData) throughput(seconds float64) string {
+	if data.Pixels == 0 || seconds == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", float64(data.Pixels)/1e6/seconds)
+}
+
+// tableHeader returns the columns shared by the Markdown and LaTeX tables:
+// the time of every variant, then the speedup and throughput of every one
+// but the sequential filter, then the peak heap and energy of every variant
+func tableHeader(variants []timingVariant) []string {
+	header := []string{"Image"}
+	for _, v := range variants {
+		header = append(header, v.label+" (s)")
+	}
+	for _, v := range variants[1:] {
+		header = append(header, v.label+" Speedup")
+	}
+	for _, v := range variants[1:] {
+		header = append(header, v.label+" MP/s")
+	}
+	for _, v := range variants {
+		header = append(header, v.label+" Heap (KiB)")
+	}
+	for _, v := range variants {
+		header = append(header, v.label+" Energy (J)")
+	}
+	return header
+}
+
+// tableRow formats one image in the column order of tableHeader
+func (data PerformanceData) tableRow(variants []timingVariant) []string {
+	row := []string{fmt.Sprint(data.ImageNumber)}
+	if data.TimedOut {
+		row = append(row, "timeout")
+		for len(row) < len(tableHeader(variants)) {
+			row = append(row, "-")
+		}
+		return row
+	}
+	for _, v := range variants {
+		row = append(row, data.seconds(v.name))
+	}
+	for _, v := range variants[1:] {
+		speedup := "-"
+		if elapsed, ok := data.Times[v.name]; ok {
+			speedup = fmt.Sprintf("%.2fx", data.speedup(elapsed.Seconds()))
+		}
+		row = append(row, speedup)
+	}
+	for _, v := range variants[1:] {
+		row = append(row, data.throughput(data.Times[v.name].Seconds()))
+	}
+	for _, v := range variants {
+		row = append(row, data.peakHeap(v.name))
+	}
+	for _, v := range variants {
+		row = append(row, data.energy(v.name))
+	}
+	return row
+}
+
+// tableMean averages every image that did not time out into a single row.
+// The time of a variant is averaged over the images it was timed on, and
+// its peak heap and energy over the images where they were measured.
+func tableMean(performanceData []PerformanceData) PerformanceData {
+	mean := PerformanceData{Times: map[string]time.Duration{}}
+	timed := map[string]time.Duration{}
+	measured := map[string]uint64{}
+	metered := map[string]float64{}
+	n := 0
+	for _, data := range performanceData {
+		if data.TimedOut {
+			continue
+		}
+		n++
+		for variant, elapsed := range data.Times {
+			mean.Times[variant] += elapsed
+			timed[variant]++
+		}
+		mean.Pixels += data.Pixels
+		for variant, usage := range data.Memory {
+			if mean.Memory == nil {
+				mean.Memory = map[string]MemoryUsage{}
+			}
+			total := mean.Memory[variant]
+			total.PeakHeap += usage.PeakHeap
+			mean.Memory[variant] = total
+			measured[variant]++
+		}
+		for variant, usage := range data.Energy {
+			if mean.Energy == nil {
+				mean.Energy = map[string]EnergyUsage{}
+			}
+			total := mean.Energy[variant]
+			total.Joules += usage.Joules
+			total.Watts += usage.Watts
+			mean.Energy[variant] = total
+			metered[variant]++
+		}
+	}
+	for variant, count := range timed {
+		mean.Times[variant] /= count
+	}
+	if n > 0 {
+		mean.Pixels /= n
+	}
+	for variant, usage := range mean.Memory {
+		usage.PeakHeap /= measured[variant]
+		mean.Memory[variant] = usage
+	}
+	for variant, usage := range mean.Energy {
+		usage.Joules /= metered[variant]
+		usage.Watts /= metered[variant]
+		mean.Energy[variant] = usage
+	}
+	return mean
+}
+
+// WriteMarkdownTable writes the performance table as a GitHub-flavored Markdown table
+func WriteMarkdownTable(w io.Writer, performanceData []PerformanceData, variants []timingVariant) {
+	header := tableHeader(variants)
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "|%s\n", strings.Repeat(" ---: |", len(header)))
+	for _, data := range performanceData {
+		fmt.Fprintf(w, "| %s |\n", strings.Join(data.tableRow(variants), " | "))
+	}
+	row := tableMean(performanceData).tableRow(variants)
+	row[0] = "**Mean**"
+	fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | "))
+}
+
+// WriteLaTeXTable writes the performance table as a LaTeX tabular. It only
+// needs the booktabs package.
+func WriteLaTeXTable(w io.Writer, performanceData []PerformanceData, variants []timingVariant) {
+	header := tableHeader(variants)
+	for i, column := range header {
+		header[i] = latexEscape(column)
+	}
+
+	fmt.Fprintf(w, "\\begin{tabular}{%s}\n", strings.Repeat("r", len(header)))
+	fmt.Fprintln(w, "\\toprule")
+	fmt.Fprintf(w, "%s \\\\\n", strings.Join(header, " & "))
+	fmt.Fprintln(w, "\\midrule")
+	for _, data := range performanceData {
+		fmt.Fprintf(w, "%s \\\\\n", strings.Join(latexRow(data.tableRow(variants)), " & "))
+	}
+	fmt.Fprintln(w, "\\midrule")
+	row := latexRow(tableMean(performanceData).tableRow(variants))
+	row[0] = "Mean"
+	fmt.Fprintf(w, "%s \\\\\n", strings.Join(row, " & "))
+	fmt.Fprintln(w, "\\bottomrule")
+	fmt.Fprintln(w, "\\end{tabular}")
+}
+
+// latexRow escapes every cell and typesets speedups with a proper times sign
+func latexRow(row []string) []string {
+	cells := make([]string, len(row))
+	for i, cell := range row {
+		if value, ok := strings.CutSuffix(cell, "x"); ok {
+			cells[i] = value + "$\\times$"
+			continue
+		}
+		cells[i] = latexEscape(cell)
+	}
+	return cells
+}
+
+var latexReplacer = strings.NewReplacer(
+	`\`, `\textbackslash{}`, `&`, `\&`, `%`, `\%`, `$`, `\$`, `#`, `\#`, `_`, `\_`, `{`, `\{`, `}`, `\}`,
+)
+
+func latexEscape(s string) string {
+	return latexReplacer.Replace(s)
+}
+
+// batchSummary aggregates a whole batch: the total time of every variant,
+// the geometric mean of the per-image speedups over the sequential filter,
+// the throughput over all images and, where RAPL could be read, the energy
+// and average power
+type batchSummary struct {
+	Images    int
+	TimedOut  int
+	WallClock time.Duration // of the whole run, loading and saving included; 0 when unknown
+	Variants  []variantSummary
+}
+
+type variantSummary struct {
+	Name       string
+	Total      time.Duration
+	Speedup    float64 // geometric mean over the images, 0 when unknown
+	Throughput float64 // megapixels per second, 0 when unknown
+	Joules     float64 // one run per image, 0 when not measured
+	Watts      float64 // over the images whose energy was measured
+}
+
+// summarize aggregates performanceData over every one of variants.
+// performanceData took wallClock to produce.
+func summarize(performanceData []PerformanceData, variants []timingVariant, wallClock time.Duration) batchSummary {
+	summary := batchSummary{Images: len(performanceData), WallClock: wallClock}
+	for _, data := range performanceData {
+		if data.TimedOut {
+			summary.TimedOut++
+		}
+	}
+	for _, variant := range variants {
+		v := variantSummary{Name: variant.label}
+		var logSpeedup, timed float64
+		var pixels int
+		var pixelTime, meteredTime time.Duration
+		for _, data := range performanceData {
+			elapsed, ok := data.Times[variant.name]
+			if data.TimedOut || !ok {
+				continue
+			}
+			v.Total += elapsed
+			if elapsed > 0 && data.Times["sequential"] > 0 {
+				logSpeedup += math.Log(data.speedup(elapsed.Seconds()))
+				timed++
+			}
+			// Entries resumed from older manifests have no size
+			if data.Pixels > 0 {
+				pixels += data.Pixels
+				pixelTime += elapsed
+			}
+			if usage, ok := data.Energy[variant.name]; ok {
+				v.Joules += usage.Joules
+				meteredTime += elapsed
+			}
+		}
+		if meteredTime > 0 {
+			v.Watts = v.Joules / meteredTime.Seconds()
+		}
+		if timed > 0 {
+			v.Speedup = math.Exp(logSpeedup / timed)
+		}
+		if pixelTime > 0 {
+			v.Throughput = float64(pixels) / 1e6 / pixelTime.Seconds()
+		}
+		summary.Variants = append(summary.Variants, v)
+	}
+	return summary
+}
+
+// summaryHeader are the columns of the summary table
+var summaryHeader = []string{"Variant", "Total (s)", "Geo-mean Speedup", "MP/s", "Energy (J)", "Power (W)"}
+
+// rows formats every variant in the column order of summaryHeader
+func (s batchSummary) rows() [][]string {
+	rows := make([][]string, len(s.Variants))
+	for i, v := range s.Variants {
+		throughput, energy, power := "-", "-", "-"
+		if v.Throughput > 0 {
+			throughput = fmt.Sprintf("%.2f", v.Throughput)
+		}
+		if v.Watts > 0 {
+			energy = fmt.Sprintf("%.3f", v.Joules)
+			power = fmt.Sprintf("%.1f", v.Watts)
+		}
+		rows[i] = []string{v.Name, fmt.Sprintf("%.6f", v.Total.Seconds()), fmt.Sprintf("%.2fx", v.Speedup), throughput, energy, power}
+	}
+	return rows
+}
+
+func (s batchSummary) title() string {
+	title := fmt.Sprintf("Summary of %d images", s.Images)
+	if s.WallClock > 0 {
+		title += fmt.Sprintf(", wall clock %.3f s", s.WallClock.Seconds())
+	}
+	if s.TimedOut > 0 {
+		title += fmt.Sprintf(", %d timed out and left out", s.TimedOut)
+	}
+	return title
+}
+
+// PrintSummary prints the batch summary as a plain text table
+func PrintSummary(s batchSummary) {
+	fmt.Println()
+	fmt.Println(s.title())
+	fmt.Println(strings.Join(summaryHeader, "\t"))
+	fmt.Println("------------------------------------------------------------------")
+	for _, row := range s.rows() {
+		fmt.Printf("%-10s\t%s\t%s\t\t%s\t%s\t\t%s\n", row[0], row[1], row[2], row[3], row[4], row[5])
+	}
+}
+
+// WriteMarkdownSummary writes the batch summary as a Markdown table
+func WriteMarkdownSummary(w io.Writer, s batchSummary) {
+	fmt.Fprintf(w, "\n%s\n\n", s.title())
+	fmt.Fprintf(w, "| %s |\n", strings.Join(summaryHeader, " | "))
+	fmt.Fprintf(w, "| --- |%s\n", strings.Repeat(" ---: |", len(summaryHeader)-1))
+	for _, row := range s.rows() {
+		fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | "))
+	}
+}
+
+// WriteLaTeXSummary writes the batch summary as a second LaTeX tabular
+func WriteLaTeXSummary(w io.Writer, s batchSummary) {
+	header := make([]string, len(summaryHeader))
+	for i, column := range summaryHeader {
+		header[i] = latexEscape(column)
+	}
+	fmt.Fprintf(w, "\n%% %s\n", s.title())
+	fmt.Fprintf(w, "\\begin{tabular}{l%s}\n", strings.Repeat("r", len(summaryHeader)-1))
+	fmt.Fprintln(w, "\\toprule")
+	fmt.Fprintf(w, "%s \\\\\n", strings.Join(header, " & "))
+	fmt.Fprintln(w, "\\midrule")
+	for _, row := range s.rows() {
+		fmt.Fprintf(w, "%s \\\\\n", strings.Join(latexRow(row), " & "))
+	}
+	fmt.Fprintln(w, "\\bottomrule")
+	fmt.Fprintln(w, "\\end{tabular}")
+}
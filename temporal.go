@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+)
+
+// temporalMedianRect writes the median of every pixel of rect across frames
+// to output. With an even number of frames the upper of the two middle
+// values is kept, like the spatial filter does for clipped windows.
+func temporalMedianRect(output *image.Gray, frames []*image.Gray, rect image.Rectangle) {
+	values := make([]uint8, len(frames))
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		dst := output.Pix[output.PixOffset(rect.Min.X, y):][:rect.Dx()]
+		for x := range dst {
+			for i, frame := range frames {
+				values[i] = frame.Pix[frame.PixOffset(rect.Min.X+x, y)]
+			}
+			slices.Sort(values)
+			dst[x] = values[len(values)/2]
+		}
+	}
+}
+
+// temporalMedianSequential returns the per-pixel median of frames, which
+// must all have the same bounds
+func temporalMedianSequential(frames []*image.Gray) *image.Gray {
+	output := GetGray(frames[0].Bounds())
+	temporalMedianRect(output, frames, output.Bounds())
+	return output
+}
+
+// temporalMedianParallel is temporalMedianSequential with the pixels split
+// into chunkSize x chunkSize tiles filtered concurrently
+func temporalMedianParallel(frames []*image.Gray, chunkSize int) *image.Gray {
+	output := GetGray(frames[0].Bounds())
+	forEachTile(output.Bounds(), chunkSize, func(tile image.Rectangle) {
+		temporalMedianRect(output, frames, tile)
+	})
+	return output
+}
+
+// runTemporal computes the per-pixel median of a burst of aligned frames,
+// which removes objects that only cross part of the frames and averages
+// out sensor noise
+func runTemporal(args []string) {
+	fs := flag.NewFlagSet("temporal", flag.ExitOnError)
+	input := fs.String("input", "", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the aligned frames, all the same size")
+	mode := fs.String("mode", "parallel", "filter variant: sequential or parallel")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	runs := fs.Int("runs", 1, "times the median is computed, the mean time is reported")
+	format := fs.String("format", "", "output format: png, pgm or ppm (default: from the output extension)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hpc_final temporal -input <frames> [flags] <output|->")
+		fs.PrintDefaults()
+	}
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if fs.NArg() != 1 || *input == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	outputPath := fs.Arg(0)
+	var median func(frames []*image.Gray) *image.Gray
+	switch *mode {
+	case "sequential":
+		median = temporalMedianSequential
+	case "parallel":
+		median = func(frames []*image.Gray) *image.Gray { return temporalMedianParallel(frames, *chunkSize) }
+	default:
+		fatal("unknown mode, use sequential or parallel", "mode", *mode)
+	}
+	if *chunkSize < 1 {
+		fatal("chunk size must be positive", "chunk", *chunkSize)
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if !validOutputFormat(*format) {
+		fatal("unknown output format, use png, pgm or ppm", "format", *format)
+	}
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	var frames []*image.Gray
+	err = in.Walk(func(name string, img image.Image) error {
+		frame := toBlackAndWhite(img)
+		if len(frames) > 0 && frame.Bounds() != frames[0].Bounds() {
+			return fmt.Errorf("%s is %v, the first frame is %v", name, frame.Bounds().Size(), frames[0].Bounds().Size())
+		}
+		frames = append(frames, frame)
+		return nil
+	})
+	in.Close()
+	if err != nil {
+		fatal("failed to read frames", "input", *input, "err", err)
+	}
+	if len(frames) == 0 {
+		fatal("no frames found", "input", *input)
+	}
+
+	var total time.Duration
+	for _, elapsed := range measureRuns(*runs, func() *image.Gray { return median(frames) }) {
+		total += elapsed
+	}
+	slog.Info("computed temporal median", "frames", len(frames), "mode", *mode, "duration", total/time.Duration(*runs))
+
+	output := median(frames)
+	out, err := createOutput(outputPath)
+	if err != nil {
+		fatal("failed to create output", "path", outputPath, "err", err)
+	}
+	w := bufio.NewWriter(out)
+	if err := encodeImage(w, output, outputFormat(*format, outputPath, "png")); err != nil {
+		fatal("failed to encode output", "path", outputPath, "err", err)
+	}
+	if err := w.Flush(); err != nil {
+		fatal("failed to write output", "path", outputPath, "err", err)
+	}
+	if err := out.Close(); err != nil {
+		fatal("failed to write output", "path", outputPath, "err", err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// terminalSize assumes an 80x24 terminal, since the size cannot be queried
+// portably
+func terminalSize(f *os.File) (width, height int, ok bool) {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return 0, 0, false
+	}
+	return 80, 24, true
+}
+
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
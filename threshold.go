@@ -0,0 +1,70 @@
+package main
+
+import (
+	"image"
+)
+
+// OtsuThreshold returns the gray level that best splits img into a dark and
+// a bright class, the one maximizing the between-class variance (Otsu, 1979).
+// Pixels above the threshold belong to the bright class.
+func OtsuThreshold(img *image.Gray) uint8 {
+	var histogram [256]int
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):img.PixOffset(bounds.Max.X, y)]
+		for _, v := range row {
+			histogram[v]++
+		}
+	}
+
+	total := bounds.Dx() * bounds.Dy()
+	var sum float64
+	for level, count := range histogram {
+		sum += float64(level * count)
+	}
+
+	var best uint8
+	var bestVariance, darkSum float64
+	dark := 0
+	for level, count := range histogram {
+		dark += count
+		if dark == 0 {
+			continue
+		}
+		bright := total - dark
+		if bright == 0 {
+			break
+		}
+		darkSum += float64(level * count)
+		darkMean := darkSum / float64(dark)
+		brightMean := (sum - darkSum) / float64(bright)
+		variance := float64(dark) * float64(bright) * (darkMean - brightMean) * (darkMean - brightMean)
+		if variance > bestVariance {
+			bestVariance = variance
+			best = uint8(level)
+		}
+	}
+	return best
+}
+
+// Binarize sets every pixel above threshold to white and the rest to black
+func Binarize(img *image.Gray, threshold uint8) *image.Gray {
+	bounds := img.Bounds()
+	output := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		in := img.Pix[img.PixOffset(bounds.Min.X, y):img.PixOffset(bounds.Max.X, y)]
+		out := output.Pix[output.PixOffset(bounds.Min.X, y):output.PixOffset(bounds.Max.X, y)]
+		for i, v := range in {
+			if v > threshold {
+				out[i] = 255
+			}
+		}
+	}
+	return output
+}
+
+// BinarizeOtsu binarizes img at its Otsu threshold and returns the threshold used
+func BinarizeOtsu(img *image.Gray) (*image.Gray, uint8) {
+	threshold := OtsuThreshold(img)
+	return Binarize(img, threshold), threshold
+}
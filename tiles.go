@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+	"time"
+)
+
+// TileRequest is one tile a client streams to the tile server: the pixels
+// of Halo, which must contain Tile grown by Kernel/2 on every side and
+// clipped to an image of size Image. Only the Tile pixels are filtered;
+// the rest is there so the windows near the tile edge see the same pixels
+// they would in the whole image. The wire format is the TileRequest
+// message of tiles.proto.
+type TileRequest struct {
+	ID     uint64
+	Kernel int
+	Image  image.Point
+	Tile   image.Rectangle
+	Halo   image.Rectangle
+	// Pix holds the Halo pixels row by row, Halo.Dx() bytes per row
+	Pix []byte
+}
+
+// TileReply is the filtered Tile of the request with the same ID. Replies
+// come back in the order the server finishes them, which need not be the
+// order the tiles were sent in.
+type TileReply struct {
+	ID      uint64
+	Tile    image.Rectangle
+	Pix     []byte
+	Elapsed time.Duration
+}
+
+// filterTile runs the median filter on the tile of req. The halo is
+// clipped to the image like the windows are, so the result is the same as
+// filtering the whole image. The kernel comes from the client, so it is
+// capped like the kernel of serve requests.
+func filterTile(req *TileRequest) (*TileReply, error) {
+	if req.Kernel < 1 || req.Kernel%2 == 0 {
+		return nil, fmt.Errorf("tile %d: kernel size must be a positive odd number, got %d", req.ID, req.Kernel)
+	}
+	if err := checkRemoteKernel(req.Kernel, req.Image); err != nil {
+		return nil, fmt.Errorf("tile %d: %w", req.ID, err)
+	}
+	bounds := image.Rectangle{Max: req.Image}
+	switch {
+	case req.Tile.Empty() || !req.Tile.In(bounds):
+		return nil, fmt.Errorf("tile %d: tile %v is not inside the %dx%d image", req.ID, req.Tile, req.Image.X, req.Image.Y)
+	case !req.Halo.In(bounds):
+		return nil, fmt.Errorf("tile %d: halo %v is not inside the %dx%d image", req.ID, req.Halo, req.Image.X, req.Image.Y)
+	case !req.Tile.Inset(-req.Kernel / 2).Intersect(bounds).In(req.Halo):
+		return nil, fmt.Errorf("tile %d: halo %v does not cover the windows of tile %v", req.ID, req.Halo, req.Tile)
+	case len(req.Pix) != req.Halo.Dx()*req.Halo.Dy():
+		return nil, fmt.Errorf("tile %d: got %d pixels for a %dx%d halo", req.ID, len(req.Pix), req.Halo.Dx(), req.Halo.Dy())
+	}
+
+	local := &image.Gray{Pix: req.Pix, Stride: req.Halo.Dx(), Rect: req.Halo}
+	result := &image.Gray{Pix: make([]uint8, req.Tile.Dx()*req.Tile.Dy()), Stride: req.Tile.Dx(), Rect: req.Tile}
+	start := time.Now()
+	medianRect(result, local, req.Tile, req.Kernel/2)
+	return &TileReply{ID: req.ID, Tile: req.Tile, Pix: result.Pix, Elapsed: time.Since(start)}, nil
+}
+
+// tileRequests cuts img into tileSize x tileSize tiles with the halo a
+// kernel x kernel window needs
+func tileRequests(img *image.Gray, tileSize, kernel int) []*TileRequest {
+	bounds := img.Bounds()
+	var requests []*TileRequest
+	for i, tile := range tileRects(bounds, tileSize) {
+		halo := tile.Inset(-kernel / 2).Intersect(bounds)
+		local := &image.Gray{Pix: make([]uint8, halo.Dx()*halo.Dy()), Stride: halo.Dx(), Rect: halo}
+		copyRect(local, img, halo)
+		requests = append(requests, &TileRequest{
+			ID:     uint64(i),
+			Kernel: kernel,
+			Image:  bounds.Size(),
+			Tile:   tile.Sub(bounds.Min),
+			Halo:   halo.Sub(bounds.Min),
+			Pix:    local.Pix,
+		})
+	}
+	return requests
+}
+
+// tileMessage is implemented by the messages of tiles.proto, which are
+// encoded by hand rather than with generated code
+type tileMessage interface {
+	marshal() []byte
+	unmarshal(data []byte) error
+}
+
+func (m *TileRequest) marshal() []byte {
+	b := appendVarintField(nil, 1, m.ID)
+	b = appendVarintField(b, 2, uint64(m.Kernel))
+	b = appendVarintField(b, 3, uint64(m.Image.X))
+	b = appendVarintField(b, 4, uint64(m.Image.Y))
+	b = appendRectFields(b, 5, m.Tile)
+	b = appendRectFields(b, 9, m.Halo)
+	return appendBytesField(b, 13, m.Pix)
+}
+
+func (m *TileRequest) unmarshal(data []byte) error {
+	*m = TileRequest{}
+	var tile, halo [4]int
+	return readFields(data, func(field int, v uint64, raw []byte) {
+		switch {
+		case field == 1:
+			m.ID = v
+		case field == 2:
+			m.Kernel = int(int32(v))
+		case field == 3:
+			m.Image.X = int(int32(v))
+		case field == 4:
+			m.Image.Y = int(int32(v))
+		case field >= 5 && field <= 8:
+			tile[field-5] = int(int32(v))
+			m.Tile = rectFromFields(tile)
+		case field >= 9 && field <= 12:
+			halo[field-9] = int(int32(v))
+			m.Halo = rectFromFields(halo)
+		case field == 13:
+			// Copied since the transport may reuse its receive buffer
+			m.Pix = slices.Clone(raw)
+		}
+	})
+}
+
+func (m *TileReply) marshal() []byte {
+	b := appendVarintField(nil, 1, m.ID)
+	b = appendRectFields(b, 2, m.Tile)
+	b = appendBytesField(b, 6, m.Pix)
+	return appendVarintField(b, 7, uint64(m.Elapsed))
+}
+
+func (m *TileReply) unmarshal(data []byte) error {
+	*m = TileReply{}
+	var tile [4]int
+	return readFields(data, func(field int, v uint64, raw []byte) {
+		switch {
+		case field == 1:
+			m.ID = v
+		case field >= 2 && field <= 5:
+			tile[field-2] = int(int32(v))
+			m.Tile = rectFromFields(tile)
+		case field == 6:
+			// Copied since the transport may reuse its receive buffer
+			m.Pix = slices.Clone(raw)
+		case field == 7:
+			m.Elapsed = time.Duration(v)
+		}
+	})
+}
+
+// Protobuf wire types used by the tile messages
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// appendVarintField appends a varint field. Zero is the default value and
+// is left out, as protobuf encoders do.
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	if len(data) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendRectFields appends a rectangle as its x, y, width and height in
+// four consecutive fields starting at first
+func appendRectFields(b []byte, first int, r image.Rectangle) []byte {
+	for i, v := range []int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()} {
+		b = appendVarintField(b, first+i, uint64(v))
+	}
+	return b
+}
+
+func rectFromFields(f [4]int) image.Rectangle {
+	return image.Rect(f[0], f[1], f[0]+f[2], f[1]+f[3])
+}
+
+var errTruncatedMessage = errors.New("truncated tile message")
+
+// readFields calls fn with every field of a protobuf message, with its
+// value for varint fields and its contents for length delimited ones.
+// Fixed width fields, which the tile messages do not use, are skipped so
+// newer clients can add them.
+func readFields(data []byte, fn func(field int, v uint64, raw []byte)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncatedMessage
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncatedMessage
+			}
+			data = data[n:]
+			fn(field, v, nil)
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errTruncatedMessage
+			}
+			fn(field, 0, data[n:n+int(size)])
+			data = data[n+int(size):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if key&7 == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errTruncatedMessage
+			}
+			data = data[size:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in tile message", key&7)
+		}
+	}
+	return nil
+}
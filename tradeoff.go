@@ -0,0 +1,426 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+
+	"hpc_final/filter"
+)
+
+// qualityTiming is the mean time per image and the mean quality of the
+// outputs of a filter with one kernel size at one noise density
+type qualityTiming struct {
+	Filter  string
+	Kernel  int
+	Density float64
+	Time    time.Duration
+	PSNR    float64 // dB, against the clean image
+	SSIM    float64
+}
+
+// PrintKernelTable prints the time and output quality per kernel size
+func PrintKernelTable(timings []qualityTiming, mode string) {
+	fmt.Printf("%s filter, %.0f%% salt and pepper\n", mode, 100*timings[0].Density)
+	fmt.Println("Kernel\tTime (s)\tPSNR (dB)\tSSIM")
+	fmt.Println("------------------------------------------------------------------")
+	for _, t := range timings {
+		fmt.Printf("%dx%d\t%.6f\t%.2f\t\t%.4f\n", t.Kernel, t.Kernel, t.Time.Seconds(), t.PSNR, t.SSIM)
+	}
+}
+
+// plotKernelQuality saves the PSNR against the kernel size as the main
+// plot, the SSIM against the kernel size as the "ssim" chart and the PSNR
+// against the runtime, with every point labeled by its kernel size, as the
+// "tradeoff" chart
+func plotKernelQuality(timings []qualityTiming, opts *plotOptions) error {
+	psnr := make(plotter.XYs, len(timings))
+	ssim := make(plotter.XYs, len(timings))
+	tradeoff := make(plotter.XYs, len(timings))
+	labels := make([]string, len(timings))
+	for i, t := range timings {
+		psnr[i] = plotter.XY{X: float64(t.Kernel), Y: t.PSNR}
+		ssim[i] = plotter.XY{X: float64(t.Kernel), Y: t.SSIM}
+		tradeoff[i] = plotter.XY{X: t.Time.Seconds(), Y: t.PSNR}
+		labels[i] = fmt.Sprintf("%dx%d", t.Kernel, t.Kernel)
+	}
+	title := fmt.Sprintf("%.0f%% Salt and Pepper", 100*timings[0].Density)
+
+	p, err := qualityPlot("Kernel Size vs PSNR, "+title, "Kernel size (pixels)", "PSNR (dB)", nil, psnr)
+	if err != nil {
+		return err
+	}
+	opts.apply(p, psnr)
+	if err := opts.save(p); err != nil {
+		return err
+	}
+
+	p, err = qualityPlot("Kernel Size vs SSIM, "+title, "Kernel size (pixels)", "SSIM", nil, ssim)
+	if err != nil {
+		return err
+	}
+	opts.apply(p, ssim)
+	if err := opts.saveChart(p, "ssim"); err != nil {
+		return err
+	}
+
+	p, err = qualityPlot("Quality vs Cost, "+title, "Time per image (s)", "PSNR (dB)", nil, tradeoff)
+	if err != nil {
+		return err
+	}
+	names, err := plotter.NewLabels(plotter.XYLabels{XYs: tradeoff, Labels: labels})
+	if err != nil {
+		return err
+	}
+	p.Add(names)
+	opts.apply(p, tradeoff)
+	return opts.saveChart(p, "tradeoff")
+}
+
+// qualityPlot returns a plot of every series as points joined by a line,
+// named in the legend by names when there is more than one. The points
+// need not be ordered along X, which the runtime of a sweep is not always.
+func qualityPlot(title, x, y string, names []string, series ...plotter.XYs) (*plot.Plot, error) {
+	p := plot.New()
+	p.Title.Text = title
+	p.X.Label.Text = x
+	p.Y.Label.Text = y
+	for i, points := range series {
+		line, pts, err := plotter.NewLinePoints(points)
+		if err != nil {
+			return nil, err
+		}
+		line.Color = plotutil.Color(i)
+		pts.Color = plotutil.Color(i)
+		pts.Shape = plotutil.Shape(i)
+		p.Add(line, pts)
+		if len(series) > 1 {
+			p.Legend.Add(names[i], line, pts)
+		}
+	}
+	return p, nil
+}
+
+// measureQuality times run on a noisy copy of clean and adds the time and
+// the quality of its output to t
+func measureQuality(t *qualityTiming, clean, noisy *image.Gray, runs int, run func(img *image.Gray) (*image.Gray, error)) error {
+	var err error
+	for _, elapsed := range measureRuns(runs, func() *image.Gray {
+		output, runErr := run(noisy)
+		if runErr != nil {
+			err = runErr
+			return nil
+		}
+		return output
+	}) {
+		t.Time += elapsed
+	}
+	if err != nil {
+		return err
+	}
+	output, err := run(noisy)
+	if err != nil {
+		return err
+	}
+	// An output identical to the clean image, which only a kernel of 1 on
+	// an image without noise gives, has an infinite PSNR
+	t.PSNR += math.Min(PSNR(clean, output), maxPSNR)
+	t.SSIM += SSIM(clean, output)
+	PutGray(output)
+	return nil
+}
+
+// maxPSNR caps the PSNR of single images to keep the means and the plots
+// finite
+const maxPSNR = 100
+
+// meanQuality divides the sums measureQuality added up over images images
+// by their count
+func meanQuality(timings []qualityTiming, images, runs int) {
+	for i := range timings {
+		timings[i].Time /= time.Duration(images * runs)
+		timings[i].PSNR /= float64(images)
+		timings[i].SSIM /= float64(images)
+	}
+}
+
+// runKernels sweeps the median kernel size on noisy copies of the dataset
+// and reports the quality of the outputs against the time they took
+func runKernels(args []string) {
+	fs := flag.NewFlagSet("kernels", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the clean input images")
+	kernelList := fs.String("kernels", "1,3,5,7,9,11", "comma separated kernel sizes to sweep")
+	density := fs.Float64("noise", 0.1, "fraction of pixels replaced by salt and pepper before filtering")
+	seed := fs.Int64("seed", 1, "seed of the -noise pixels")
+	mode := fs.String("mode", "parallel", "filter variant: sequential, parallel, halo or numa")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filters")
+	runs := fs.Int("runs", 3, "times every kernel size is run per image, the mean is reported")
+	plotOpts := addPlotFlags(fs, "kernel_quality.png")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	kernels, err := parseKernelSizes(*kernelList)
+	if err != nil {
+		fatal("failed to parse kernel sizes", "err", err)
+	}
+	if *density < 0 || *density > 1 {
+		fatal("noise density must be between 0 and 1", "noise", *density)
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+	timings := make([]qualityTiming, len(kernels))
+	for i, kernel := range kernels {
+		if _, err := applyFilter(*mode, image.NewGray(image.Rect(0, 0, 1, 1)), *chunkSize, kernel); err != nil {
+			fatal("invalid filter settings", "kernel", kernel, "err", err)
+		}
+		timings[i] = qualityTiming{Kernel: kernel, Density: *density}
+	}
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+
+	slog.Info("sweeping the kernel size, please wait", "input", *input, "kernels", kernels, "noise", *density)
+	images := 0
+	err = in.Walk(func(filename string, img image.Image) error {
+		images++
+		clean := toBlackAndWhite(img)
+		noisy := addImpulseNoise(clean, *density, *seed)
+		var err error
+		for i := range timings {
+			kernel := timings[i].Kernel
+			err = measureQuality(&timings[i], clean, noisy, *runs, func(img *image.Gray) (*image.Gray, error) {
+				return applyFilter(*mode, img, *chunkSize, kernel)
+			})
+			if err != nil {
+				break
+			}
+		}
+		PutGray(noisy)
+		PutGray(clean)
+		slog.Debug("processed image", "image", filename, "stage", "kernels")
+		return err
+	})
+	if err != nil {
+		fatal("failed to sweep kernel sizes", "input", *input, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+
+	meanQuality(timings, images, *runs)
+	if err := plotKernelQuality(timings, plotOpts); err != nil {
+		fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+	}
+	PrintKernelTable(timings, *mode)
+}
+
+// qualityVariant is a registered filter and the kernel size it runs with
+type qualityVariant struct {
+	Name   string
+	Kernel int
+}
+
+func (v qualityVariant) String() string {
+	return fmt.Sprintf("%s %dx%d", v.Name, v.Kernel, v.Kernel)
+}
+
+// parseQualityVariants parses a comma separated list of registered filters,
+// each with its kernel size after a colon, e.g. median:5
+func parseQualityVariants(list string) ([]qualityVariant, error) {
+	var variants []qualityVariant
+	for _, field := range strings.Split(list, ",") {
+		name, size, ok := strings.Cut(strings.TrimSpace(field), ":")
+		kernel, err := strconv.Atoi(size)
+		if !ok || err != nil || kernel < 1 || kernel%2 == 0 {
+			return nil, fmt.Errorf("invalid filter %q, use name:kernel with an odd kernel size", field)
+		}
+		if !filter.Registered(name) {
+			return nil, fmt.Errorf("unknown filter %q, use one of %s", name, strings.Join(filter.Names(), ", "))
+		}
+		variants = append(variants, qualityVariant{name, kernel})
+	}
+	return variants, nil
+}
+
+// parseDensities parses a comma separated list of noise densities between
+// 0 and 1
+func parseDensities(list string) ([]float64, error) {
+	var densities []float64
+	for _, field := range strings.Split(list, ",") {
+		density, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || density < 0 || density > 1 {
+			return nil, fmt.Errorf("invalid noise density %q, must be between 0 and 1", field)
+		}
+		densities = append(densities, density)
+	}
+	return densities, nil
+}
+
+// PrintDensityTable prints the time and output quality of every filter at
+// every noise density, then the filter with the best PSNR per density
+func PrintDensityTable(timings [][]qualityTiming) {
+	for _, variant := range timings {
+		fmt.Printf("%s %dx%d\n", variant[0].Filter, variant[0].Kernel, variant[0].Kernel)
+		fmt.Println("Noise\tTime (s)\tPSNR (dB)\tSSIM")
+		fmt.Println("------------------------------------------------------------------")
+		for _, t := range variant {
+			fmt.Printf("%.0f%%\t%.6f\t%.2f\t\t%.4f\n", 100*t.Density, t.Time.Seconds(), t.PSNR, t.SSIM)
+		}
+		fmt.Println()
+	}
+	fmt.Println("Noise\tBest PSNR (dB)\tFilter")
+	fmt.Println("------------------------------------------------------------------")
+	for d := range timings[0] {
+		best := timings[0][d]
+		for _, variant := range timings[1:] {
+			if variant[d].PSNR > best.PSNR {
+				best = variant[d]
+			}
+		}
+		fmt.Printf("%.0f%%\t%.2f\t\t%s %dx%d\n", 100*best.Density, best.PSNR, best.Filter, best.Kernel, best.Kernel)
+	}
+}
+
+// plotDensitySweep saves the PSNR of every filter against the noise density
+// as the main plot, their SSIM as the "ssim" chart and their runtime as the
+// "runtime" chart
+func plotDensitySweep(timings [][]qualityTiming, opts *plotOptions) error {
+	names := make([]string, len(timings))
+	psnr := make([]plotter.XYs, len(timings))
+	ssim := make([]plotter.XYs, len(timings))
+	runtime := make([]plotter.XYs, len(timings))
+	for v, variant := range timings {
+		names[v] = fmt.Sprintf("%s %dx%d", variant[0].Filter, variant[0].Kernel, variant[0].Kernel)
+		for _, t := range variant {
+			psnr[v] = append(psnr[v], plotter.XY{X: 100 * t.Density, Y: t.PSNR})
+			ssim[v] = append(ssim[v], plotter.XY{X: 100 * t.Density, Y: t.SSIM})
+			runtime[v] = append(runtime[v], plotter.XY{X: 100 * t.Density, Y: t.Time.Seconds()})
+		}
+	}
+
+	for _, chart := range []struct {
+		name, title, y string
+		series         []plotter.XYs
+	}{
+		{"", "Noise Density vs PSNR", "PSNR (dB)", psnr},
+		{"ssim", "Noise Density vs SSIM", "SSIM", ssim},
+		{"runtime", "Noise Density vs Runtime", "Time per image (s)", runtime},
+	} {
+		p, err := qualityPlot(chart.title, "Salt and pepper (% of pixels)", chart.y, names, chart.series...)
+		if err != nil {
+			return err
+		}
+		opts.apply(p, chart.series...)
+		if chart.name == "" {
+			err = opts.save(p)
+		} else {
+			err = opts.saveChart(p, chart.name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDensity adds salt and pepper of increasing density to the dataset and
+// reports how the output quality and the runtime of every filter change
+func runDensity(args []string) {
+	fs := flag.NewFlagSet("density", flag.ExitOnError)
+	input := fs.String("input", "dataset", "folder, .zip, .tar or .tar.gz archive, or s3:// or gs:// prefix with the clean input images")
+	densityList := fs.String("densities", "0.01,0.05,0.1,0.2,0.3,0.4,0.5", "comma separated fractions of pixels replaced by salt and pepper")
+	filterList := fs.String("filters", "median:3,median:5,median:7,adaptive:7", "comma separated registered filters to compare, each as name:kernel")
+	seed := fs.Int64("seed", 1, "seed of the noise pixels")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the filters")
+	runs := fs.Int("runs", 3, "times every filter is run per image and density, the mean is reported")
+	plotOpts := addPlotFlags(fs, "noise_density.png")
+	addDecodeFlags(fs, true)
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	densities, err := parseDensities(*densityList)
+	if err != nil {
+		fatal("failed to parse densities", "err", err)
+	}
+	variants, err := parseQualityVariants(*filterList)
+	if err != nil {
+		fatal("failed to parse filters", "err", err)
+	}
+	if *runs < 1 {
+		fatal("runs must be positive", "runs", *runs)
+	}
+	if err := plotOpts.validate(); err != nil {
+		fatal("invalid plot options", "err", err)
+	}
+	timings := make([][]qualityTiming, len(variants))
+	for v, variant := range variants {
+		if _, err := filter.Run(variant.Name, image.NewGray(image.Rect(0, 0, 1, 1)), filter.Kernel(variant.Kernel), filter.ChunkSize(*chunkSize)); err != nil {
+			fatal("invalid filter settings", "filter", variant, "err", err)
+		}
+		for _, density := range densities {
+			timings[v] = append(timings[v], qualityTiming{Filter: variant.Name, Kernel: variant.Kernel, Density: density})
+		}
+	}
+
+	in, err := openImageInput(*input)
+	if err != nil {
+		fatal("failed to open input", "input", *input, "err", err)
+	}
+	defer in.Close()
+
+	slog.Info("sweeping the noise density, please wait", "input", *input, "densities", densities, "filters", variants)
+	images := 0
+	err = in.Walk(func(filename string, img image.Image) error {
+		images++
+		clean := toBlackAndWhite(img)
+		defer PutGray(clean)
+		for d, density := range densities {
+			noisy := addImpulseNoise(clean, density, *seed)
+			for v, variant := range variants {
+				err := measureQuality(&timings[v][d], clean, noisy, *runs, func(img *image.Gray) (*image.Gray, error) {
+					return filter.Run(variant.Name, img, filter.Kernel(variant.Kernel), filter.ChunkSize(*chunkSize))
+				})
+				if err != nil {
+					PutGray(noisy)
+					return fmt.Errorf("%s: %s: %w", filename, variant, err)
+				}
+			}
+			PutGray(noisy)
+		}
+		slog.Debug("processed image", "image", filename, "stage", "density")
+		return nil
+	})
+	if err != nil {
+		fatal("failed to sweep noise densities", "input", *input, "err", err)
+	}
+	if images == 0 {
+		fatal("no images found", "input", *input)
+	}
+
+	for v := range timings {
+		meanQuality(timings[v], images, *runs)
+	}
+	if err := plotDensitySweep(timings, plotOpts); err != nil {
+		fatal("failed to save plot", "path", plotOpts.filename(), "err", err)
+	}
+	PrintDensityTable(timings)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"hpc_final/filter"
+)
+
+// verifyOpenCV checks the Go median filters against OpenCV's on one image
+// and returns one line per variant that differs. The median of the same
+// window is unique, so the results must match exactly: every pixel of the
+// replicate border filter, and for the sequential, parallel and SIMD
+// filters, which crop their windows at the edge, every pixel at least
+// kernel/2 from it. OpenCV is only available in builds with -tags opencv.
+func verifyOpenCV(name string, img *image.Gray, chunkSize, kernel int) ([]string, error) {
+	reference, err := filter.Run("opencv", img, filter.Kernel(kernel), filter.Border(filter.Replicate))
+	if err != nil {
+		return nil, err
+	}
+	defer PutGray(reference)
+
+	replicate, err := filter.Median(img, filter.Kernel(kernel), filter.ChunkSize(chunkSize), filter.Border(filter.Replicate))
+	if err != nil {
+		return nil, err
+	}
+	variants := map[string]*image.Gray{"replicate": replicate}
+	variants["sequential"] = medianFilterSequential(img, kernel/2)
+	variants["parallel"] = medianFilterParallel(img, chunkSize, kernel/2)
+	if kernel == 3 {
+		variants["simd"] = medianFilterSIMD(img)
+	}
+
+	var problems []string
+	interior := img.Bounds().Inset(kernel / 2)
+	for _, variant := range []string{"replicate", "sequential", "parallel", "simd"} {
+		output, ok := variants[variant]
+		if !ok {
+			continue
+		}
+		rect := interior
+		if variant == "replicate" {
+			rect = img.Bounds()
+		}
+		if differ, worst := compareRect(output, reference, rect); differ > 0 {
+			problems = append(problems, fmt.Sprintf("%s: %s differs from OpenCV in %d of %d pixels, by up to %d levels", name, variant, differ, rect.Dx()*rect.Dy(), worst))
+		}
+		PutGray(output)
+	}
+	return problems, nil
+}
+
+// compareRect counts the pixels of rect that differ between a and b and
+// returns the largest difference
+func compareRect(a, b *image.Gray, rect image.Rectangle) (differ, worst int) {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		rowA := a.Pix[a.PixOffset(rect.Min.X, y):][:rect.Dx()]
+		rowB := b.Pix[b.PixOffset(rect.Min.X, y):][:rect.Dx()]
+		for x, v := range rowA {
+			if d := int(v) - int(rowB[x]); d != 0 {
+				differ++
+				worst = max(worst, d, -d)
+			}
+		}
+	}
+	return differ, worst
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeVideo returns the size and frame rate of the first video stream of path
+func probeVideo(path string) (width, height int, fps string, err error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,r_frame_rate", "-of", "csv=p=0", path).Output()
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("ffprobe %s: %w", path, err)
+	}
+	fields := strings.Split(strings.TrimSpace(string(out)), ",")
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("ffprobe %s: unexpected output %q", path, out)
+	}
+	if width, err = strconv.Atoi(fields[0]); err != nil {
+		return 0, 0, "", fmt.Errorf("ffprobe %s: invalid width %q", path, fields[0])
+	}
+	if height, err = strconv.Atoi(fields[1]); err != nil {
+		return 0, 0, "", fmt.Errorf("ffprobe %s: invalid height %q", path, fields[1])
+	}
+	return width, height, fields[2], nil
+}
+
+// videoFrame is one raw 8-bit grayscale frame moving through the pipeline
+type videoFrame struct {
+	img     *image.Gray
+	elapsed time.Duration // time spent filtering
+}
+
+// readFrames reads width x height gray frames from r until EOF. A partial
+// frame at the end is an error. Frames come from the gray pool and go back
+// to it once they have been filtered and written.
+func readFrames(r io.Reader, width, height int, frames chan<- videoFrame) error {
+	defer close(frames)
+	br := bufio.NewReaderSize(r, width*height)
+	for {
+		img := GetGray(image.Rect(0, 0, width, height))
+		if _, err := io.ReadFull(br, img.Pix); err != nil {
+			PutGray(img)
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("reading frame: %w", err)
+		}
+		frames <- videoFrame{img: img}
+	}
+}
+
+// runVideo filters a video frame by frame. Frames are decoded by ffmpeg, or
+// read raw from stdin when the input is "-", filtered with the selected
+// median variant and encoded by a second ffmpeg, or written raw to stdout
+// when the output is "-". Reading, filtering and writing overlap, so the
+// reported throughput is that of the sustained pipeline.
+func runVideo(args []string) {
+	fs := flag.NewFlagSet("video", flag.ExitOnError)
+	kernel := fs.Int("kernel", 3, "median window size, must be odd")
+	mode := fs.String("mode", "parallel", "filter variant: sequential, parallel, halo (parallel with private tile copies) or simd")
+	chunkSize := fs.Int("chunk", 45, "chunk size used by the parallel filter")
+	width := fs.Int("width", 0, "frame width, required when reading raw frames from stdin")
+	height := fs.Int("height", 0, "frame height, required when reading raw frames from stdin")
+	fps := fs.String("fps", "", "frame rate of the output video (default: the input's, or 25 for raw input)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hpc_final video [flags] <input|-> <output|->")
+		fs.PrintDefaults()
+	}
+	logOpts := addLogFlags(fs)
+	fs.Parse(args)
+	logOpts.setup()
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	inputPath, outputPath := fs.Arg(0), fs.Arg(1)
+	if _, err := applyFilter(*mode, image.NewGray(image.Rect(0, 0, 1, 1)), *chunkSize, *kernel); err != nil {
+		fatal("invalid filter settings", "err", err)
+	}
+
+	var input io.Reader = os.Stdin
+	var decoder *exec.Cmd
+	if inputPath == "-" {
+		if *width < 1 || *height < 1 {
+			fatal("-width and -height are required for raw input on stdin")
+		}
+		if *fps == "" {
+			*fps = "25"
+		}
+	} else {
+		w, h, rate, err := probeVideo(inputPath)
+		if err != nil {
+			fatal("failed to read video", "path", inputPath, "err", err)
+		}
+		*width, *height = w, h
+		if *fps == "" {
+			*fps = rate
+		}
+		decoder = exec.Command("ffmpeg", "-v", "error", "-i", inputPath, "-f", "rawvideo", "-pix_fmt", "gray", "-")
+		decoder.Stderr = os.Stderr
+		if input, err = decoder.StdoutPipe(); err != nil {
+			fatal("failed to start ffmpeg", "err", err)
+		}
+		if err := decoder.Start(); err != nil {
+			fatal("failed to start ffmpeg", "err", err)
+		}
+	}
+
+	var output io.WriteCloser = nopWriteCloser{os.Stdout}
+	var encoder *exec.Cmd
+	if outputPath != "-" {
+		encoder = exec.Command("ffmpeg", "-v", "error", "-y", "-f", "rawvideo", "-pix_fmt", "gray",
+			"-s", fmt.Sprintf("%dx%d", *width, *height), "-r", *fps, "-i", "-", "-pix_fmt", "yuv420p", outputPath)
+		encoder.Stderr = os.Stderr
+		var err error
+		if output, err = encoder.StdinPipe(); err != nil {
+			fatal("failed to start ffmpeg", "err", err)
+		}
+		if err := encoder.Start(); err != nil {
+			fatal("failed to start ffmpeg", "err", err)
+		}
+	}
+
+	slog.Info("filtering video", "input", inputPath, "output", outputPath, "width", *width, "height", *height, "fps", *fps, "stage", *mode)
+	start := time.Now()
+	decoded := make(chan videoFrame, 2)
+	filtered := make(chan videoFrame, 2)
+	readErr := make(chan error, 1)
+	go func() { readErr <- readFrames(input, *width, *height, decoded) }()
+	go func() {
+		defer close(filtered)
+		for frame := range decoded {
+			began := time.Now()
+			img, _ := applyFilter(*mode, frame.img, *chunkSize, *kernel)
+			elapsed := time.Since(began)
+			PutGray(frame.img)
+			filterMetrics.Observe(*mode, len(img.Pix), elapsed)
+			filtered <- videoFrame{img: img, elapsed: elapsed}
+		}
+	}()
+
+	w := bufio.NewWriterSize(output, *width**height)
+	frames := 0
+	var filtering time.Duration
+	var writeErr error
+	for frame := range filtered {
+		if writeErr == nil {
+			_, writeErr = w.Write(frame.img.Pix)
+		}
+		PutGray(frame.img)
+		frames++
+		filtering += frame.elapsed
+		slog.Debug("filtered frame", "frame", frames, "duration", frame.elapsed)
+	}
+	if writeErr == nil {
+		writeErr = w.Flush()
+	}
+	wall := time.Since(start)
+
+	if err := output.Close(); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	if err := <-readErr; err != nil {
+		fatal("failed to read frames", "err", err)
+	}
+	if decoder != nil {
+		if err := decoder.Wait(); err != nil {
+			fatal("ffmpeg failed to decode", "path", inputPath, "err", err)
+		}
+	}
+	if encoder != nil {
+		if err := encoder.Wait(); err != nil {
+			fatal("ffmpeg failed to encode", "path", outputPath, "err", err)
+		}
+	}
+	if writeErr != nil {
+		fatal("failed to write frames", "err", writeErr)
+	}
+
+	if frames == 0 {
+		fatal("no frames read", "input", inputPath)
+	}
+	PrintVideoReport(frames, wall, filtering)
+}
+
+// PrintVideoReport prints the sustained throughput of the pipeline and of the filter alone
+func PrintVideoReport(frames int, wall, filtering time.Duration) {
+	fmt.Fprintf(os.Stderr, "Frames:            %d\n", frames)
+	fmt.Fprintf(os.Stderr, "Wall clock time:   %.6f s\n", wall.Seconds())
+	fmt.Fprintf(os.Stderr, "Achieved FPS:      %.2f\n", float64(frames)/wall.Seconds())
+	fmt.Fprintf(os.Stderr, "Filter time/frame: %.6f s\n", filtering.Seconds()/float64(frames))
+	fmt.Fprintf(os.Stderr, "Filter-only FPS:   %.2f\n", float64(frames)/filtering.Seconds())
+}
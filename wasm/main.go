@@ -0,0 +1,91 @@
+//go:build js && wasm
+
+// Command wasm exposes the filter package to the browser demo in this
+// folder. It registers one JavaScript function,
+//
+//	hpcFilter(bytes, {filter, kernel, workers, chunk, border}) -> {image, width, height, millis}
+//
+// which decodes a PNG or JPEG given as a Uint8Array, filters its grayscale
+// version and returns it encoded as PNG, with the time the filter alone took.
+// Images over filter.DefaultLimits are rejected before they are decoded, so
+// a decompression bomb cannot take the tab down. Errors are returned as
+// {error}. It never touches a file system.
+package main
+
+import (
+	"bytes"
+	"errors"
+	_ "image/jpeg"
+	"image/png"
+	"syscall/js"
+	"time"
+
+	"hpc_final/filter"
+)
+
+func main() {
+	js.Global().Set("hpcFilter", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if len(args) != 2 {
+			return errorResult(errors.New("hpcFilter needs the image bytes and an options object"))
+		}
+		data := make([]byte, args[0].Get("length").Int())
+		js.CopyBytesToGo(data, args[0])
+		result, err := filterBytes(data, args[1])
+		if err != nil {
+			return errorResult(err)
+		}
+		return result
+	}))
+	js.Global().Set("hpcFilters", js.ValueOf(toAny(filter.Names())))
+	select {}
+}
+
+// filterBytes runs the filter picked by settings on an encoded image
+func filterBytes(data []byte, settings js.Value) (map[string]any, error) {
+	img, _, err := filter.DefaultLimits.Decode("image", data)
+	if err != nil {
+		return nil, err
+	}
+	border, err := filter.ParseBorder(settings.Get("border").String())
+	if err != nil {
+		return nil, err
+	}
+
+	gray := filter.Gray(img)
+	start := time.Now()
+	output, err := filter.Run(settings.Get("filter").String(), gray,
+		filter.Kernel(settings.Get("kernel").Int()),
+		filter.Workers(settings.Get("workers").Int()),
+		filter.ChunkSize(settings.Get("chunk").Int()),
+		filter.Border(border))
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, output); err != nil {
+		return nil, err
+	}
+	encoded := js.Global().Get("Uint8Array").New(buf.Len())
+	js.CopyBytesToJS(encoded, buf.Bytes())
+	return map[string]any{
+		"image":  encoded,
+		"width":  output.Bounds().Dx(),
+		"height": output.Bounds().Dy(),
+		"millis": float64(elapsed.Microseconds()) / 1000,
+	}, nil
+}
+
+func errorResult(err error) map[string]any {
+	return map[string]any{"error": err.Error()}
+}
+
+// toAny converts a string slice to the []any js.ValueOf accepts
+func toAny(values []string) []any {
+	out := make([]any, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
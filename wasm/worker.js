@@ -0,0 +1,15 @@
+// Runs the Go filter in a Web Worker so the page stays responsive while it
+// filters. Messages in are {bytes, options}, messages out are the result of
+// hpcFilter, plus one {ready, filters} once the module has started.
+importScripts("wasm_exec.js");
+
+const go = new Go();
+WebAssembly.instantiateStreaming(fetch("filter.wasm"), go.importObject).then((result) => {
+	go.run(result.instance);
+	postMessage({ ready: true, filters: self.hpcFilters });
+}, (err) => postMessage({ error: `failed to load filter.wasm: ${err}` }));
+
+onmessage = (event) => {
+	const result = self.hpcFilter(event.data.bytes, event.data.options);
+	postMessage(result, result.image ? [result.image.buffer] : []);
+};
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle is how long a file must go without write events before it is
+// considered complete; cameras and copies write images in several chunks
+const watchSettle = 500 * time.Millisecond
+
+// watchOptions are the settings the benchmark passes on to watch mode
+type watchOptions struct {
+	folder       string
+	out          imageOutput
+	noisy        imageOutput // nil when the black and white inputs are not saved
+	filterSize   int
+	chunkSize    int
+	runs         int
+	binarize     bool
+	schedule     string
+	filters      []string
+	resize       *resizeOptions
+	timeout      time.Duration // per image, 0 for none
+	manifestPath string
+	db           *sql.DB // nil when the results store is disabled
+}
+
+// watchImages filters every image that appears in opts.folder, saving the
+// outputs and adding its timings to the manifest and to one run in the
+// results store, until interrupted. Images already in the folder are left
+// alone.
+func watchImages(manifest *Manifest, opts watchOptions) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fatal("failed to start watching", "err", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(opts.folder); err != nil {
+		fatal("failed to watch folder", "folder", opts.folder, "err", err)
+	}
+
+	var runID int64
+	if opts.db != nil {
+		if runID, err = storeRun(opts.db, manifest); err != nil {
+			fatal("failed to store run", "err", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Every event restarts the file's timer, so an image is only queued once
+	// its writer has been quiet for watchSettle
+	ready := make(chan string)
+	var mu sync.Mutex
+	pending := map[string]*time.Timer{}
+	settle := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if t, ok := pending[name]; ok {
+			t.Reset(watchSettle)
+			return
+		}
+		pending[name] = time.AfterFunc(watchSettle, func() {
+			mu.Lock()
+			delete(pending, name)
+			mu.Unlock()
+			select {
+			case ready <- name:
+			case <-ctx.Done():
+			}
+		})
+	}
+
+	slog.Info("watching for new images, press Ctrl+C to stop", "folder", opts.folder, "run", runID)
+	processed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("stopped watching", "images", processed)
+			return
+		case err := <-watcher.Errors:
+			slog.Error("watch error", "err", err)
+		case event := <-watcher.Events:
+			if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+				continue
+			}
+			if name := filepath.Base(event.Name); isImageName(name) {
+				settle(name)
+			}
+		case name := <-ready:
+			entry, err := watchedImage(name, opts)
+			if err != nil {
+				slog.Error("failed to process image", "image", name, "err", err)
+				continue
+			}
+			manifest.Images = append(manifest.Images, entry)
+			if err := manifest.Save(opts.manifestPath); err != nil {
+				fatal("failed to save manifest", "path", opts.manifestPath, "err", err)
+			}
+			if opts.db != nil {
+				if err := appendTimings(opts.db, runID, entry); err != nil {
+					fatal("failed to store timings", "image", name, "run", runID, "err", err)
+				}
+			}
+			processed++
+			slog.Info("filtered new image", "image", name, "sequential", entry.Duration("sequential"),
+				"parallel", entry.Duration("parallel"), "simd", entry.Duration("simd"))
+		}
+	}
+}
+
+// watchedImage benchmarks one image that arrived in the watched folder.
+// Decoding errors are returned rather than fatal, since a truncated or
+// foreign file must not stop the service.
+func watchedImage(name string, opts watchOptions) (ManifestImage, error) {
+	f, err := os.Open(filepath.Join(opts.folder, name))
+	if err != nil {
+		return ManifestImage{}, err
+	}
+	img, meta, inputHash, err := decodeHashed(name, f)
+	f.Close()
+	if err != nil {
+		return ManifestImage{}, fmt.Errorf("not a readable image: %w", err)
+	}
+
+	entry := benchmarkImage(name, img, meta, opts.out, opts.noisy, opts.filterSize, opts.chunkSize, opts.runs, opts.binarize, opts.schedule, opts.filters, opts.resize, opts.timeout)
+	entry.InputSHA256 = inputHash
+	return entry, nil
+}
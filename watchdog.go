@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// filterAbort tells the running median filters to give up. medianRect and
+// the SIMD filter poll it between rows and the tile schedulers before every
+// tile, so their workers return quickly and leave the rest of the output
+// unfiltered.
+var filterAbort atomic.Bool
+
+// errImageTimeout is returned for an image that ran past its -timeout
+var errImageTimeout = errors.New("image timed out")
+
+// withTimeout runs fn and raises filterAbort if it is still running after
+// timeout, so the workers of the image stop at their next row or tile. It
+// always waits for fn to return before clearing the flag, which leaves no
+// workers behind to slow down the next image, and returns errImageTimeout
+// when the timeout expired. A timeout of 0 runs fn without a watchdog.
+//
+// filterAbort is shared by the whole process, which is fine for the
+// benchmark since it filters one image at a time.
+func withTimeout(timeout time.Duration, fn func() error) error {
+	if timeout <= 0 {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	filterAbort.Store(true)
+	<-done
+	filterAbort.Store(false)
+	return errImageTimeout
+}
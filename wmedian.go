@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// weightMask is a square window of integer weights, row major. A weight of
+// n counts its pixel n times in the weighted median.
+type weightMask struct {
+	radius  int
+	weights []int
+}
+
+// parseWeightMask parses comma separated weights of an odd square window,
+// e.g. "1,2,1,2,3,2,1,2,1" for 3x3
+func parseWeightMask(spec string) (weightMask, error) {
+	fields := strings.Split(spec, ",")
+	size := int(math.Sqrt(float64(len(fields))))
+	if size*size != len(fields) || size%2 == 0 {
+		return weightMask{}, fmt.Errorf("weight mask needs an odd square number of weights, got %d", len(fields))
+	}
+	mask := weightMask{radius: size / 2}
+	for _, field := range fields {
+		w, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || w < 0 {
+			return weightMask{}, fmt.Errorf("invalid weight %q", field)
+		}
+		mask.weights = append(mask.weights, w)
+	}
+	if mask.weights[len(mask.weights)/2] == 0 {
+		return weightMask{}, fmt.Errorf("the center weight must not be 0")
+	}
+	return mask, nil
+}
+
+// weightedMedianRect writes the weighted median of every pixel in rect,
+// repeating every neighbor by its weight before taking the middle value.
+// Weights outside the image are skipped, like getNeighborhood does.
+func weightedMedianRect(output, img *image.Gray, rect image.Rectangle, mask weightMask) {
+	bounds := img.Bounds()
+	size := 2*mask.radius + 1
+	var values []uint8
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			values = values[:0]
+			for dy := -mask.radius; dy <= mask.radius; dy++ {
+				for dx := -mask.radius; dx <= mask.radius; dx++ {
+					p := image.Point{X: x + dx, Y: y + dy}
+					if !p.In(bounds) {
+						continue
+					}
+					v := img.Pix[img.PixOffset(p.X, p.Y)]
+					for n := mask.weights[(dy+mask.radius)*size+dx+mask.radius]; n > 0; n-- {
+						values = append(values, v)
+					}
+				}
+			}
+			slices.Sort(values)
+			output.Pix[output.PixOffset(x, y)] = values[len(values)/2]
+		}
+	}
+}
+
+// Weighted Median Filter (Sequential)
+func weightedMedianSequential(img *image.Gray, mask weightMask) *image.Gray {
+	output := GetGray(img.Bounds())
+	weightedMedianRect(output, img, img.Bounds(), mask)
+	return output
+}
+
+// Weighted Median Filter (Parallel)
+func weightedMedianParallel(img *image.Gray, chunkSize int, mask weightMask) *image.Gray {
+	output := GetGray(img.Bounds())
+	forEachTile(img.Bounds(), chunkSize, func(tile image.Rectangle) {
+		weightedMedianRect(output, img, tile, mask)
+	})
+	return output
+}